@@ -90,12 +90,17 @@ func handleCommand(args []string) {
 	}
 	fmt.Print(status)
 
+	// WATCH keeps sending one response per change until interrupted
+	watching := strings.ToUpper(args[0]) == "WATCH" && strings.HasPrefix(status, "200")
 	for {
 		line, err := reader.ReadString('\n')
 		if err != nil {
 			break
 		}
 		if strings.TrimSpace(line) == "---END---" {
+			if watching {
+				continue
+			}
 			break
 		}
 		fmt.Print(line)
@@ -125,7 +130,17 @@ func printUsage() {
 	fmt.Println("  PING                     - Check server status")
 	fmt.Println("  LIST                     - List all keys")
 	fmt.Println("  FETCH <key>              - Get content from chain")
+	fmt.Println("  FETCH <key>@<n|time>     - Get version n or the value at an RFC3339 time")
+	fmt.Println("  HISTORY <key>            - List every block that changed a key")
+	fmt.Println("  DELETE <key>             - Remove a key (tombstone block, history is kept)")
+	fmt.Println("  PROOF <key>              - Merkle proof for a key against the latest checkpoint")
+	fmt.Println("  CHECKPOINT               - Commit a checkpoint of the current state")
 	fmt.Println("  PUBLISH <key> <content>  - Mine a new block with content")
+	fmt.Println("    [SIG=<pubkey>:<sig>]   - Optional Ed25519 client signature over \"key\\ncontent\" (hex)")
+	fmt.Println("  WATCH <key|prefix*> [h]  - Stream changes to a key or prefix, optionally resuming from height h")
+	fmt.Println("  BATCH <json>             - Atomic multi-key write, e.g. {\"ops\":[{\"key\":\"a\",\"value\":\"1\"}],\"if\":[{\"key\":\"a\",\"absent\":true}]}")
 	fmt.Println("  LEDGER                   - Show blockchain info")
+	fmt.Println("  SYNC [host:port token]   - Show chain height, or pull from a configured peer (admin token from AUTH)")
+	fmt.Println("  BLOCKS <start> [limit]   - Dump raw blocks (used for replication)")
 	fmt.Println("  AUTH <user> <pass>       - Login to session")
 }
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/MultiX0/nexa/pkg/ledger"
+)
+
+// runLedgerCommand handles the offline "nexa ledger ..." maintenance
+// subcommands. The core node must not be running on the same ledger.
+func runLedgerCommand(args []string) int {
+	if len(args) == 0 {
+		printLedgerUsage()
+		return 2
+	}
+
+	fs := flag.NewFlagSet("ledger "+args[0], flag.ContinueOnError)
+	file := fs.String("ledger", "ledger.json", "ledger file the core node uses")
+	format := fs.String("format", "", "state format: json or csv (default from file extension, else json)")
+	out := fs.String("o", "", "export to this file instead of stdout")
+	height := fs.Int("height", 0, "snapshot height (default: current head)")
+	prune := fs.Bool("prune", false, "delete blocks older than the snapshot")
+	if err := fs.Parse(args[1:]); err != nil {
+		return 2
+	}
+
+	bc, err := ledger.NewBlockchain(*file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to open ledger: %v\n", err)
+		return 1
+	}
+	defer bc.Close()
+
+	switch args[0] {
+	case "export":
+		w := io.Writer(os.Stdout)
+		if *out != "" {
+			f, err := os.Create(*out)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to create %s: %v\n", *out, err)
+				return 1
+			}
+			defer f.Close()
+			w = f
+		}
+		if err := bc.ExportState(w, stateFormat(*format, *out)); err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %v\n", err)
+			return 1
+		}
+
+	case "import":
+		if fs.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Usage: nexa ledger import [-ledger file] [-format json|csv] <state file>")
+			return 2
+		}
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to open %s: %v\n", fs.Arg(0), err)
+			return 1
+		}
+		defer f.Close()
+		n, err := bc.ImportState(f, stateFormat(*format, fs.Arg(0)), bc.Identity().NodeID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Imported %d keys into %s\n", n, *file)
+
+	case "snapshot":
+		snap, err := bc.CreateSnapshot(*height)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Snapshot failed: %v\n", err)
+			return 1
+		}
+		fmt.Printf("Snapshot at height %d, state root %s (%d keys)\n", snap.Height, snap.StateRoot, len(snap.State))
+		if *prune {
+			n, err := bc.Prune()
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Prune failed: %v\n", err)
+				return 1
+			}
+			fmt.Printf("Pruned %d blocks\n", n)
+		}
+
+	default:
+		printLedgerUsage()
+		return 2
+	}
+	return 0
+}
+
+// stateFormat picks the export/import format from the flag or the file extension
+func stateFormat(format, filename string) string {
+	if format != "" {
+		return format
+	}
+	if strings.HasSuffix(strings.ToLower(filename), ".csv") {
+		return "csv"
+	}
+	return "json"
+}
+
+func printLedgerUsage() {
+	fmt.Println("Usage: nexa ledger <command> [flags]")
+	fmt.Println("  export   [-format json|csv] [-o file]   - Write the current key/value state")
+	fmt.Println("  import   [-format json|csv] <file>      - Load a state export into a fresh ledger")
+	fmt.Println("  snapshot [-height n] [-prune]           - Write a signed state snapshot, optionally pruning older blocks")
+	fmt.Println("All commands accept -ledger <file> (default ledger.json). Stop the node first.")
+}
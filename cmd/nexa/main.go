@@ -9,6 +9,7 @@ import (
 	"time"
 
 	"github.com/MultiX0/nexa/pkg/analytics"
+	"github.com/MultiX0/nexa/pkg/audit"
 	"github.com/MultiX0/nexa/pkg/config"
 	"github.com/MultiX0/nexa/pkg/governance"
 	"github.com/MultiX0/nexa/pkg/network"
@@ -31,12 +32,19 @@ type Service struct {
 }
 
 func main() {
+	// Offline maintenance subcommands
+	if len(os.Args) > 1 && os.Args[1] == "ledger" {
+		os.Exit(runLedgerCommand(os.Args[2:]))
+	}
+
 	// Initialize Configuration
 	cfg, err := config.Load()
 	if err != nil {
 		utils.LogWarning("Config", fmt.Sprintf("Loader issue: %v", err))
 		// We continue because Load() sets defaults even on error
 	}
+	// One audit log for every service in the process
+	audit.Init(cfg.System.AuditLog)
 
 	// MATRIX PRO: Auto-deploy Wireless Matrix (Hotspot)
 	utils.LogInfo("Nucleus", "Deploying Wireless Matrix Pulse...")
@@ -0,0 +1,256 @@
+// Package acl grants users read, write and share permissions on folders,
+// kept in a JSON file. The rule closest to a path decides, so a grant on a
+// folder covers everything below it until a deeper rule says otherwise.
+package acl
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// Everyone is the subject of rules for every authenticated user. A rule
+// for the user themselves wins over one for Everyone on the same folder.
+const Everyone = "*"
+
+var (
+	ErrInvalidPerm    = errors.New("invalid permission")
+	ErrInvalidSubject = errors.New("invalid user")
+)
+
+// Perm is a set of permissions
+type Perm uint8
+
+const (
+	Read  Perm = 1 << iota
+	Write      // upload, create folders, delete and restore
+	Share      // create share links
+)
+
+// None revokes a rule
+const None Perm = 0
+
+// String spells p as "rws", with "-" for missing permissions
+func (p Perm) String() string {
+	b := []byte("---")
+	for i, c := range "rws" {
+		if p&(1<<i) != 0 {
+			b[i] = byte(c)
+		}
+	}
+	return string(b)
+}
+
+// ParsePerm reads a set of permissions from letters such as "rw" or "r-s"
+func ParsePerm(s string) (Perm, error) {
+	var p Perm
+	for _, c := range s {
+		switch c {
+		case 'r':
+			p |= Read
+		case 'w':
+			p |= Write
+		case 's':
+			p |= Share
+		case '-':
+		default:
+			return None, fmt.Errorf("%w: %q", ErrInvalidPerm, s)
+		}
+	}
+	return p, nil
+}
+
+func (p Perm) MarshalText() ([]byte, error) { return []byte(p.String()), nil }
+
+func (p *Perm) UnmarshalText(text []byte) error {
+	v, err := ParsePerm(string(text))
+	*p = v
+	return err
+}
+
+// Rule grants a user, or Everyone, permissions on a folder
+type Rule struct {
+	Path      string    `json:"path"`
+	Subject   string    `json:"user"`
+	Perms     Perm      `json:"perms"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// List is a set of rules. It is safe for concurrent use.
+type List struct {
+	mu       sync.RWMutex
+	rules    map[string]map[string]Rule // by path, then subject
+	filename string
+}
+
+// Clean turns p into a rule path: slash-separated, without leading or
+// trailing slashes. The root is "".
+func Clean(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+strings.ReplaceAll(p, "\\", "/")), "/")
+}
+
+// Load reads the rules kept in filename. A missing file starts the list
+// with defaults, which are saved right away.
+func Load(filename string, defaults []Rule) (*List, error) {
+	l := &List{rules: make(map[string]map[string]Rule), filename: filename}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		for _, r := range defaults {
+			l.put(r)
+		}
+		return l, l.save()
+	}
+	if err != nil {
+		return l, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return l, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+	for _, r := range rules {
+		l.put(r)
+	}
+	return l, nil
+}
+
+// put stores r, or removes the rule it replaces when r grants nothing.
+// Caller holds l.mu.
+func (l *List) put(r Rule) {
+	r.Path = Clean(r.Path)
+	if r.Perms == None {
+		delete(l.rules[r.Path], r.Subject)
+		if len(l.rules[r.Path]) == 0 {
+			delete(l.rules, r.Path)
+		}
+		return
+	}
+	if l.rules[r.Path] == nil {
+		l.rules[r.Path] = make(map[string]Rule)
+	}
+	l.rules[r.Path][r.Subject] = r
+}
+
+// Set grants subject perms on folder p, replacing any rule it had there.
+// None removes the rule.
+func (l *List) Set(p, subject string, perms Perm, by string) (Rule, error) {
+	subject = strings.TrimSpace(subject)
+	if subject == "" || strings.ContainsAny(subject, "/\\") {
+		return Rule{}, fmt.Errorf("%w: %q", ErrInvalidSubject, subject)
+	}
+	if perms&^(Read|Write|Share) != 0 {
+		return Rule{}, fmt.Errorf("%w: %d", ErrInvalidPerm, perms)
+	}
+	r := Rule{Path: Clean(p), Subject: subject, Perms: perms, UpdatedBy: by, UpdatedAt: time.Now()}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, had := l.rules[r.Path][subject]
+	l.put(r)
+	if err := l.save(); err != nil {
+		if had {
+			l.put(old)
+		} else {
+			l.put(Rule{Path: r.Path, Subject: subject})
+		}
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+// Rules returns every rule, by path and then user
+func (l *List) Rules() []Rule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.all()
+}
+
+func (l *List) all() []Rule {
+	out := []Rule{}
+	for _, byUser := range l.rules {
+		for _, r := range byUser {
+			out = append(out, r)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Path != out[j].Path {
+			return out[i].Path < out[j].Path
+		}
+		return out[i].Subject < out[j].Subject
+	})
+	return out
+}
+
+// Perms returns what user may do at p, going by the closest rule for the
+// user or Everyone
+func (l *List) Perms(user, p string) Perm {
+	p = Clean(p)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for {
+		if byUser, ok := l.rules[p]; ok {
+			if r, ok := byUser[user]; ok {
+				return r.Perms
+			}
+			if r, ok := byUser[Everyone]; ok {
+				return r.Perms
+			}
+		}
+		if p == "" {
+			return None
+		}
+		p = parent(p)
+	}
+}
+
+// Allowed reports whether user has every permission in want at p
+func (l *List) Allowed(user, p string, want Perm) bool {
+	return l.Perms(user, p)&want == want
+}
+
+// Reachable reports whether user can read p or something below it, which
+// is what it takes to see p while browsing down to a grant
+func (l *List) Reachable(user, p string) bool {
+	if l.Allowed(user, p, Read) {
+		return true
+	}
+	p = Clean(p)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for rp, byUser := range l.rules {
+		if rp == p || !(p == "" || strings.HasPrefix(rp, p+"/")) {
+			continue
+		}
+		r, ok := byUser[user]
+		if !ok {
+			r, ok = byUser[Everyone]
+		}
+		if ok && r.Perms&Read != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func parent(p string) string {
+	if i := strings.LastIndexByte(p, '/'); i >= 0 {
+		return p[:i]
+	}
+	return ""
+}
+
+// save writes the rules. Caller holds l.mu.
+func (l *List) save() error {
+	data, err := json.MarshalIndent(l.all(), "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(l.filename, data, 0644)
+}
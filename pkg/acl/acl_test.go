@@ -0,0 +1,68 @@
+package acl_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/acl"
+)
+
+func TestPerms(t *testing.T) {
+	l, err := acl.Load(filepath.Join(t.TempDir(), "acl.json"), []acl.Rule{
+		{Path: "public", Subject: acl.Everyone, Perms: acl.Read},
+		{Path: "/incoming/", Subject: acl.Everyone, Perms: acl.Read | acl.Write},
+	})
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	l.Set("public/team", "alice", acl.Read|acl.Write|acl.Share, "admin")
+	l.Set("incoming/private", acl.Everyone, acl.None, "admin") // nothing to remove
+	l.Set("incoming/quiet", "bob", acl.Read, "admin")
+
+	cases := []struct {
+		user, path string
+		want       acl.Perm
+	}{
+		{"bob", "public", acl.Read},
+		{"bob", "public/team/doc.txt", acl.Read},
+		{"alice", "public/team/doc.txt", acl.Read | acl.Write | acl.Share},
+		{"alice", "public/other", acl.Read},
+		{"bob", "incoming/quiet/x", acl.Read}, // the user's own rule beats Everyone
+		{"alice", "incoming/quiet/x", acl.Read | acl.Write},
+		{"bob", "vault", acl.None},
+		{"bob", "", acl.None},
+	}
+	for _, c := range cases {
+		if got := l.Perms(c.user, c.path); got != c.want {
+			t.Errorf("Perms(%q, %q) = %s, want %s", c.user, c.path, got, c.want)
+		}
+	}
+	if !l.Reachable("alice", "") || l.Reachable("alice", "vault") {
+		t.Error("Reachable does not follow the grants below a folder")
+	}
+
+	if _, err := l.Set("x", "a/b", acl.Read, "admin"); !errors.Is(err, acl.ErrInvalidSubject) {
+		t.Errorf("Set with a bad user = %v", err)
+	}
+	if _, err := acl.ParsePerm("rwx"); !errors.Is(err, acl.ErrInvalidPerm) {
+		t.Errorf("ParsePerm(rwx) = %v", err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	l, _ := acl.Load(file, []acl.Rule{{Path: "public", Subject: acl.Everyone, Perms: acl.Read}})
+	l.Set("shared", "carol", acl.Read|acl.Share, "admin")
+	l.Set("public", acl.Everyone, acl.None, "admin")
+
+	// Defaults only apply to a missing file
+	l, err := acl.Load(file, []acl.Rule{{Path: "vault", Subject: acl.Everyone, Perms: acl.Read}})
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	rules := l.Rules()
+	if len(rules) != 1 || rules[0].Path != "shared" || rules[0].Perms.String() != "r-s" || rules[0].UpdatedBy != "admin" {
+		t.Fatalf("Rules after reload = %+v", rules)
+	}
+}
@@ -49,7 +49,7 @@ type Action struct {
 type FileActivity struct {
 	FileName  string    `json:"file_name"`
 	FileSize  int64     `json:"file_size"`
-	Action    string    `json:"action"` // upload, download, delete, view
+	Action    string    `json:"action"` // upload, download, delete, restore, view
 	Path      string    `json:"path"`
 	Timestamp time.Time `json:"timestamp"`
 	Status    string    `json:"status"` // success, failed
@@ -79,6 +79,7 @@ type Stats struct {
 	TotalActions           int            `json:"total_actions"`
 	TotalFilesUploaded     int            `json:"total_files_uploaded"`
 	TotalFilesDownloaded   int            `json:"total_files_downloaded"`
+	TotalFilesRestored     int            `json:"total_files_restored"`
 	AverageSessionDuration float64        `json:"average_session_duration"`
 	TopPages               []PageStat     `json:"top_pages"`
 	RecentSessions         []*Session     `json:"recent_sessions"`
@@ -313,7 +314,7 @@ func (am *AnalyticsManager) GetStats() Stats {
 
 	pageViews := make(map[string]int)
 	var totalDuration float64
-	var filesUploaded, filesDownloaded int
+	var filesUploaded, filesDownloaded, filesRestored int
 
 	for _, session := range am.sessions {
 		if session.IsActive && time.Since(session.LastActivity) < 5*time.Minute {
@@ -340,6 +341,8 @@ func (am *AnalyticsManager) GetStats() Stats {
 				filesUploaded++
 			case "download":
 				filesDownloaded++
+			case "restore":
+				filesRestored++
 			}
 		}
 
@@ -351,6 +354,7 @@ func (am *AnalyticsManager) GetStats() Stats {
 
 	stats.TotalFilesUploaded = filesUploaded
 	stats.TotalFilesDownloaded = filesDownloaded
+	stats.TotalFilesRestored = filesRestored
 
 	if len(am.sessions) > 0 {
 		stats.AverageSessionDuration = totalDuration / float64(len(am.sessions))
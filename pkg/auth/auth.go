@@ -4,6 +4,7 @@ import (
 	"encoding/json"
 	"os"
 	"sync"
+	"time"
 
 	"golang.org/x/crypto/bcrypt"
 )
@@ -17,6 +18,9 @@ type AuthManager struct {
 	mu       sync.RWMutex
 	Users    map[string]*User `json:"users"`
 	filename string
+	modTime  time.Time // of the users file as last read, see reload
+	size     int64
+	secret   []byte // signs issued tokens
 }
 
 func NewAuthManager(filename string) (*AuthManager, error) {
@@ -25,28 +29,69 @@ func NewAuthManager(filename string) (*AuthManager, error) {
 		filename: filename,
 	}
 
-	if _, err := os.Stat(filename); err == nil {
-		content, err := os.ReadFile(filename)
+	if info, err := os.Stat(filename); err == nil {
+		users, err := readUsers(filename)
 		if err != nil {
 			return nil, err
 		}
-		if err := json.Unmarshal(content, &am.Users); err != nil {
-			return nil, err
-		}
+		am.Users, am.modTime, am.size = users, info.ModTime(), info.Size()
 	} else {
 		// Create default admin if file doesn't exist
 		pass, _ := bcrypt.GenerateFromPassword([]byte("admin123"), bcrypt.DefaultCost)
 		am.Users["admin"] = &User{
 			Password: string(pass),
-			Role:     "admin",
+			Role:     RoleAdmin,
 		}
 		am.save()
 	}
 
+	secret, err := loadSecret(secretFile(filename))
+	if err != nil {
+		return nil, err
+	}
+	am.secret = secret
+
 	return am, nil
 }
 
+func readUsers(filename string) (map[string]*User, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	users := make(map[string]*User)
+	if err := json.Unmarshal(content, &users); err != nil {
+		return nil, err
+	}
+	return users, nil
+}
+
+// reload re-reads the users file if it changed since it was last read, so
+// users the admin service adds, removes or demotes take effect in every
+// service at once. A file that cannot be read, e.g. one being rewritten,
+// keeps the current users until the next call.
+func (am *AuthManager) reload() {
+	info, err := os.Stat(am.filename)
+	if err != nil {
+		return
+	}
+	am.mu.RLock()
+	same := info.ModTime().Equal(am.modTime) && info.Size() == am.size
+	am.mu.RUnlock()
+	if same {
+		return
+	}
+	users, err := readUsers(am.filename)
+	if err != nil {
+		return
+	}
+	am.mu.Lock()
+	am.Users, am.modTime, am.size = users, info.ModTime(), info.Size()
+	am.mu.Unlock()
+}
+
 func (am *AuthManager) Verify(username, password string) (bool, string) {
+	am.reload()
 	am.mu.RLock()
 	defer am.mu.RUnlock()
 
@@ -63,10 +108,28 @@ func (am *AuthManager) Verify(username, password string) (bool, string) {
 	return true, user.Role
 }
 
+// Role returns username's role and whether the user exists
+func (am *AuthManager) Role(username string) (string, bool) {
+	am.reload()
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	user, exists := am.Users[username]
+	if !exists {
+		return "", false
+	}
+	return user.Role, true
+}
+
 func (am *AuthManager) save() error {
 	data, err := json.MarshalIndent(am.Users, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(am.filename, data, 0644)
+	if err := os.WriteFile(am.filename, data, 0644); err != nil {
+		return err
+	}
+	if info, err := os.Stat(am.filename); err == nil {
+		am.modTime, am.size = info.ModTime(), info.Size()
+	}
+	return nil
 }
@@ -0,0 +1,101 @@
+package auth_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/auth"
+)
+
+func TestTokens(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	am, err := auth.NewAuthManager(usersFile)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+
+	token, err := am.IssueToken("admin")
+	if err != nil {
+		t.Fatalf("IssueToken failed: %v", err)
+	}
+	user, role, err := am.ValidateToken(token)
+	if err != nil || user != "admin" || role != auth.RoleAdmin {
+		t.Fatalf("ValidateToken = %q %q %v", user, role, err)
+	}
+
+	// A second manager on the same users file shares the signing key
+	other, err := auth.NewAuthManager(usersFile)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	if _, _, err := other.ValidateToken(token); err != nil {
+		t.Fatalf("token rejected by second manager: %v", err)
+	}
+
+	// Any change to the payload breaks the signature
+	payload, sig, _ := strings.Cut(token, ".")
+	forged := "X" + payload[1:] + "." + sig
+	for _, bad := range []string{"", "garbage", payload, forged} {
+		if _, _, err := am.ValidateToken(bad); !errors.Is(err, auth.ErrInvalidToken) {
+			t.Fatalf("ValidateToken(%q) = %v", bad, err)
+		}
+	}
+
+	// Managers with their own users file have their own key
+	stranger, _ := auth.NewAuthManager(filepath.Join(t.TempDir(), "users.json"))
+	if _, _, err := stranger.ValidateToken(token); !errors.Is(err, auth.ErrInvalidToken) {
+		t.Fatalf("foreign token accepted: %v", err)
+	}
+
+	if _, err := am.IssueToken("nobody"); !errors.Is(err, auth.ErrUnknownUser) {
+		t.Fatalf("token issued for unknown user: %v", err)
+	}
+}
+
+func TestShortSecret(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "users.secret"), []byte("short"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	// A truncated key must stop startup instead of signing tokens with it
+	if _, err := auth.NewAuthManager(filepath.Join(dir, "users.json")); err == nil {
+		t.Fatal("NewAuthManager accepted a 5 byte secret")
+	}
+}
+
+func TestUsersReload(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), "users.json")
+	am, err := auth.NewAuthManager(usersFile)
+	if err != nil {
+		t.Fatalf("NewAuthManager failed: %v", err)
+	}
+	token, _ := am.IssueToken("admin")
+
+	// Another service demotes admin and adds bob
+	write := func(content string) {
+		if err := os.WriteFile(usersFile, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write(`{"admin": {"password": "x", "role": "user"}, "bob": {"password": "x", "role": "user"}}`)
+	if _, role, err := am.ValidateToken(token); err != nil || role != "user" {
+		t.Fatalf("ValidateToken after demotion = %q %v", role, err)
+	}
+	if _, ok := am.Role("bob"); !ok {
+		t.Fatal("added user not visible")
+	}
+
+	write(`{"bob": {"password": "x", "role": "user"}}`)
+	if _, _, err := am.ValidateToken(token); !errors.Is(err, auth.ErrUnknownUser) {
+		t.Fatalf("token of a deleted user = %v", err)
+	}
+
+	// A half-written file keeps the users already loaded
+	write(`{"bob": {"password"`)
+	if _, ok := am.Role("bob"); !ok {
+		t.Fatal("unreadable users file dropped the loaded users")
+	}
+}
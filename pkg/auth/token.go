@@ -0,0 +1,156 @@
+package auth
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// RoleAdmin may manage resources owned by other users
+const RoleAdmin = "admin"
+
+// TokenTTL is how long an issued token stays valid
+const TokenTTL = 24 * time.Hour
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+	ErrUnknownUser  = errors.New("unknown user")
+)
+
+// tokenClaims is the signed part of a token
+type tokenClaims struct {
+	User    string `json:"u"`
+	Expires int64  `json:"exp"`
+}
+
+// secretFile is kept next to the users file so every service loading the
+// same users accepts the same tokens
+func secretFile(usersFile string) string {
+	return strings.TrimSuffix(usersFile, filepath.Ext(usersFile)) + ".secret"
+}
+
+// secretSize is the length of a generated signing key
+const secretSize = 32
+
+// loadSecret reads the signing key, creating it on first use. A new key is
+// written to a temporary file and linked into place, which fails if the file
+// exists, so services starting together agree on one complete key.
+func loadSecret(filename string) ([]byte, error) {
+	data, err := os.ReadFile(filename)
+	if err == nil {
+		return checkSecret(filename, data)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret := make([]byte, secretSize)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(secret); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Link(tmp.Name(), filename); err != nil {
+		if !os.IsExist(err) {
+			return nil, err
+		}
+		// Another service won the race
+		data, err := os.ReadFile(filename)
+		if err != nil {
+			return nil, err
+		}
+		return checkSecret(filename, data)
+	}
+	return secret, nil
+}
+
+// checkSecret refuses keys too short to sign with, e.g. a file truncated by a
+// crash, rather than silently issuing weak tokens
+func checkSecret(filename string, data []byte) ([]byte, error) {
+	if len(data) < secretSize {
+		return nil, fmt.Errorf("token secret %s is only %d bytes; remove it to generate a new one", filename, len(data))
+	}
+	return data, nil
+}
+
+// IssueToken returns a signed token for username, valid for TokenTTL
+func (am *AuthManager) IssueToken(username string) (string, error) {
+	am.reload()
+	am.mu.RLock()
+	_, exists := am.Users[username]
+	am.mu.RUnlock()
+	if !exists {
+		return "", ErrUnknownUser
+	}
+
+	payload, err := json.Marshal(tokenClaims{User: username, Expires: time.Now().Add(TokenTTL).Unix()})
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	return enc.EncodeToString(payload) + "." + enc.EncodeToString(am.sign(payload)), nil
+}
+
+// ValidateToken checks a token's signature and expiry and returns the user
+// it was issued to along with their current role
+func (am *AuthManager) ValidateToken(token string) (string, string, error) {
+	enc := base64.RawURLEncoding
+	payloadPart, sigPart, ok := strings.Cut(token, ".")
+	if !ok {
+		return "", "", ErrInvalidToken
+	}
+	payload, err := enc.DecodeString(payloadPart)
+	if err != nil {
+		return "", "", ErrInvalidToken
+	}
+	sig, err := enc.DecodeString(sigPart)
+	if err != nil || !hmac.Equal(sig, am.sign(payload)) {
+		return "", "", ErrInvalidToken
+	}
+
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return "", "", ErrInvalidToken
+	}
+	if time.Now().Unix() >= claims.Expires {
+		return "", "", ErrTokenExpired
+	}
+
+	am.reload()
+	am.mu.RLock()
+	defer am.mu.RUnlock()
+	user, exists := am.Users[claims.User]
+	if !exists {
+		return "", "", ErrUnknownUser
+	}
+	return claims.User, user.Role, nil
+}
+
+func (am *AuthManager) sign(payload []byte) []byte {
+	mac := hmac.New(sha256.New, am.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
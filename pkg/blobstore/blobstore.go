@@ -0,0 +1,655 @@
+// Package blobstore keeps files as content-addressed blobs named by their
+// SHA-256, with an index mapping slash-separated paths to blobs. Paths
+// with the same content share one blob, which is deleted once nothing
+// references it.
+//
+// Blobs live under <dir>/blobs/<first two hex digits>/<hash> and the index
+// in <dir>/index.json. A blob is written before the index points at it and
+// removed only after the index stops doing so, so a crash can leave an
+// unreferenced blob behind but never a path without its data; Open sweeps
+// the leftovers.
+//
+// Overwritten content is kept as versions of the path, within the limits
+// set by SetRetention, and Trash sets files aside until they are restored
+// or purged. Both hold references to their blobs like paths do.
+package blobstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+var (
+	ErrNotFound = errors.New("no such file or directory")
+	ErrIsDir    = errors.New("is a directory")
+	ErrNotDir   = errors.New("not a directory")
+	ErrRoot     = errors.New("the root cannot be changed")
+	ErrBadName  = errors.New("invalid file name")
+)
+
+// Blob is stored content. Write hands one out holding a reference that
+// Link takes over or Release drops.
+type Blob struct {
+	Hash string `json:"hash"`
+	Size int64  `json:"size"`
+}
+
+// Entry is a file: a path and the blob holding its content
+type Entry struct {
+	Path    string    `json:"path"`
+	Blob    string    `json:"blob"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	Owner   string    `json:"owner,omitempty"` // for the caller, counted by Owners
+}
+
+// Info describes one child of a directory
+type Info struct {
+	Name    string
+	Size    int64
+	ModTime time.Time
+	IsDir   bool
+}
+
+// Usage compares the size of every path with what is actually stored
+type Usage struct {
+	Files        int   `json:"files"`
+	Bytes        int64 `json:"bytes"` // sum of file sizes
+	Versions     int   `json:"versions"`
+	VersionBytes int64 `json:"version_bytes"`
+	Trashed      int   `json:"trashed"` // files in the trash
+	TrashBytes   int64 `json:"trash_bytes"`
+	Blobs        int   `json:"blobs"`        // distinct contents
+	StoredBytes  int64 `json:"stored_bytes"` // sum of blob sizes
+}
+
+type index struct {
+	Files    map[string]*Entry     `json:"files"`
+	Dirs     map[string]time.Time  `json:"dirs"`
+	Versions map[string][]*Version `json:"versions,omitempty"`
+	Trash    []*trashed            `json:"trash,omitempty"`
+	Seq      int64                 `json:"seq,omitempty"` // last version or trash ID
+}
+
+// Store is safe for concurrent use
+type Store struct {
+	mu        sync.RWMutex
+	dir       string
+	files     map[string]*Entry
+	dirs      map[string]time.Time
+	versions  map[string][]*Version // per path, oldest first
+	trash     []*trashed            // oldest first
+	seq       int64
+	retention Retention
+	refs      map[string]int // paths, versions, trash and unreleased Writes per blob
+}
+
+// Open loads the store kept in dir, creating it if needed, and removes
+// blobs no path references
+func Open(dir string) (*Store, error) {
+	for _, d := range []string{"blobs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, fmt.Errorf("failed to create blob store: %v", err)
+		}
+	}
+	s := &Store{
+		dir:      dir,
+		files:    make(map[string]*Entry),
+		dirs:     make(map[string]time.Time),
+		versions: make(map[string][]*Version),
+		refs:     make(map[string]int),
+	}
+	if data, err := os.ReadFile(s.indexFile()); err == nil {
+		var idx index
+		if err := json.Unmarshal(data, &idx); err != nil {
+			return nil, fmt.Errorf("failed to parse blob index: %v", err)
+		}
+		if idx.Files != nil {
+			s.files = idx.Files
+		}
+		if idx.Dirs != nil {
+			s.dirs = idx.Dirs
+		}
+		if idx.Versions != nil {
+			s.versions = idx.Versions
+		}
+		s.trash, s.seq = idx.Trash, idx.Seq
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	live := subtree{Entries: s.files, Versions: s.versions}
+	for _, h := range live.blobs() {
+		s.refs[h]++
+	}
+	for _, t := range s.trash {
+		for _, h := range t.blobs() {
+			s.refs[h]++
+		}
+	}
+
+	// Writes cut short and blobs orphaned by a crash
+	tmp, _ := os.ReadDir(filepath.Join(dir, "tmp"))
+	for _, f := range tmp {
+		os.Remove(filepath.Join(dir, "tmp", f.Name()))
+	}
+	filepath.WalkDir(filepath.Join(dir, "blobs"), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() && s.refs[d.Name()] == 0 {
+			os.Remove(p)
+		}
+		return nil
+	})
+	return s, nil
+}
+
+func (s *Store) indexFile() string { return filepath.Join(s.dir, "index.json") }
+
+func (s *Store) blobPath(hash string) string {
+	return filepath.Join(s.dir, "blobs", hash[:2], hash)
+}
+
+// save writes the index. Caller holds s.mu.
+func (s *Store) save() error {
+	data, err := json.MarshalIndent(index{
+		Files:    s.files,
+		Dirs:     s.dirs,
+		Versions: s.versions,
+		Trash:    s.trash,
+		Seq:      s.seq,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.indexFile(), data, 0644)
+}
+
+// Clean turns p into a store path: slash-separated, without leading or
+// trailing slashes, with "." and ".." resolved inside the root. The root
+// is "". Backslashes are not separators; files and directories are never
+// created under a path holding one, see checkName.
+func Clean(p string) string {
+	return strings.TrimPrefix(path.Clean("/"+p), "/")
+}
+
+// ValidName reports whether name can be one element of a store path, such
+// as an uploaded file's name: not empty, without "..", slashes,
+// backslashes or control characters
+func ValidName(name string) error {
+	if name == "" || name == "." || strings.Contains(name, "..") || strings.ContainsAny(name, "/\\") ||
+		strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%q: %w", name, ErrBadName)
+	}
+	return nil
+}
+
+// checkName rejects a cleaned path with characters no element may hold
+func checkName(p string) error {
+	if strings.ContainsAny(p, "\\\x00") {
+		return fmt.Errorf("%q: %w", p, ErrBadName)
+	}
+	return nil
+}
+
+// Write stores the content of r and returns its blob, holding a reference
+// until it is passed to Link or Release
+func (s *Store) Write(r io.Reader) (Blob, error) {
+	tmp, err := os.CreateTemp(filepath.Join(s.dir, "tmp"), "blob-*")
+	if err != nil {
+		return Blob{}, err
+	}
+	defer os.Remove(tmp.Name())
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return Blob{}, err
+	}
+	return s.adopt(tmp.Name(), hex.EncodeToString(h.Sum(nil)), n)
+}
+
+// WriteFile moves the file at src into the store, like Write without
+// copying the data
+func (s *Store) WriteFile(src string) (Blob, error) {
+	f, err := os.Open(src)
+	if err != nil {
+		return Blob{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		return Blob{}, err
+	}
+	b, err := s.adopt(src, hex.EncodeToString(h.Sum(nil)), n)
+	os.Remove(src) // still there if the content was already stored
+	return b, err
+}
+
+// adopt makes the file at src the blob for hash unless it already exists
+func (s *Store) adopt(src, hash string, size int64) (Blob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dst := s.blobPath(hash)
+	if _, err := os.Stat(dst); err != nil {
+		if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+			return Blob{}, err
+		}
+		if err := os.Rename(src, dst); err != nil {
+			return Blob{}, err
+		}
+	}
+	s.refs[hash]++
+	return Blob{Hash: hash, Size: size}, nil
+}
+
+// Release drops the reference Write handed out with b
+func (s *Store) Release(b Blob) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.removeBlobs(s.unref(b.Hash))
+}
+
+// unref drops one reference to each hash and reports blobs left without
+// any. Caller holds s.mu.
+func (s *Store) unref(hashes ...string) []string {
+	var dead []string
+	for _, h := range hashes {
+		s.refs[h]--
+		if s.refs[h] <= 0 {
+			delete(s.refs, h)
+			dead = append(dead, h)
+		}
+	}
+	return dead
+}
+
+// removeBlobs deletes the files of unreferenced blobs. It runs only once
+// the index no longer names them. Caller holds s.mu.
+func (s *Store) removeBlobs(hashes []string) {
+	for _, h := range hashes {
+		os.Remove(s.blobPath(h))
+	}
+}
+
+// Put stores r at p, replacing any file there
+func (s *Store) Put(p string, r io.Reader) (Entry, error) {
+	b, err := s.Write(r)
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := s.Link(p, b)
+	if err != nil {
+		s.Release(b)
+	}
+	return e, err
+}
+
+// Link points p at b, taking over the reference Write handed out. A file
+// already at p is replaced, its content kept as a version, and missing
+// parent directories are created.
+func (s *Store) Link(p string, b Blob) (Entry, error) {
+	return s.LinkAs(p, b, "")
+}
+
+// LinkAs is Link recording owner as the file's owner. An empty owner
+// keeps the owner of the file it replaces.
+func (s *Store) LinkAs(p string, b Blob, owner string) (Entry, error) {
+	p = Clean(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.checkFilePath(p); err != nil {
+		return Entry{}, err
+	}
+	return s.link(p, b.Hash, b.Size, owner)
+}
+
+// link stores the entry for p, which checkFilePath accepted, taking over
+// a reference to hash. Replaced content becomes a version when retention
+// allows, taking the old entry's reference with it. If the index cannot
+// be saved nothing changes and the reference stays with the caller.
+// Caller holds s.mu.
+func (s *Store) link(p, hash string, size int64, owner string) (Entry, error) {
+	old, replaced := s.files[p]
+	history := s.versions[p]
+	if owner == "" && replaced {
+		owner = old.Owner
+	}
+	e := &Entry{Path: p, Blob: hash, Size: size, ModTime: time.Now(), Owner: owner}
+	s.files[p] = e
+	s.mkdirAll(path.Dir(p))
+
+	versioned := replaced && old.Blob != hash && s.retention.Keep > 0
+	var dropped []*Version
+	if versioned {
+		s.seq++
+		s.versions[p] = append(append([]*Version(nil), history...), &Version{
+			ID:       s.seq,
+			Blob:     old.Blob,
+			Size:     old.Size,
+			ModTime:  old.ModTime,
+			Replaced: e.ModTime,
+			Owner:    old.Owner,
+		})
+		dropped = s.prune(p, e.ModTime)
+	}
+	if err := s.save(); err != nil {
+		if replaced {
+			s.files[p] = old
+		} else {
+			delete(s.files, p)
+		}
+		s.setVersions(p, history)
+		return Entry{}, err
+	}
+	var dead []string
+	if replaced && !versioned {
+		dead = s.unref(old.Blob)
+	}
+	for _, v := range dropped {
+		dead = append(dead, s.unref(v.Blob)...)
+	}
+	s.removeBlobs(dead)
+	return *e, nil
+}
+
+// checkFilePath reports whether a file may be stored at p. Caller holds s.mu.
+func (s *Store) checkFilePath(p string) error {
+	if p == "" {
+		return ErrRoot
+	}
+	if err := checkName(p); err != nil {
+		return err
+	}
+	if _, ok := s.dirs[p]; ok {
+		return fmt.Errorf("%s: %w", p, ErrIsDir)
+	}
+	for dir := path.Dir(p); dir != "."; dir = path.Dir(dir) {
+		if _, ok := s.files[dir]; ok {
+			return fmt.Errorf("%s: %w", dir, ErrNotDir)
+		}
+	}
+	return nil
+}
+
+// Copy makes dst a file with the content of src, sharing its blob
+func (s *Store) Copy(src, dst string) (Entry, error) {
+	src, dst = Clean(src), Clean(dst)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.files[src]
+	if !ok {
+		return Entry{}, fmt.Errorf("%s: %w", src, ErrNotFound)
+	}
+	if cur, ok := s.files[dst]; ok && cur.Blob == e.Blob {
+		return *cur, nil
+	}
+	if err := s.checkFilePath(dst); err != nil {
+		return Entry{}, err
+	}
+	s.refs[e.Blob]++
+	c, err := s.link(dst, e.Blob, e.Size, e.Owner)
+	if err != nil {
+		s.refs[e.Blob]--
+	}
+	return c, err
+}
+
+// Mkdir creates directory p and its parents
+func (s *Store) Mkdir(p string) error {
+	p = Clean(p)
+	if err := checkName(p); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for dir := p; dir != "" && dir != "."; dir = path.Dir(dir) {
+		if _, ok := s.files[dir]; ok {
+			return fmt.Errorf("%s: %w", dir, ErrNotDir)
+		}
+	}
+	if s.mkdirAll(p) == 0 {
+		return nil
+	}
+	return s.save()
+}
+
+// mkdirAll records p and its parents and returns how many were new.
+// Caller holds s.mu.
+func (s *Store) mkdirAll(p string) int {
+	n := 0
+	now := time.Now()
+	for dir := p; dir != "" && dir != "."; dir = path.Dir(dir) {
+		if _, ok := s.dirs[dir]; ok {
+			break
+		}
+		s.dirs[dir] = now
+		n++
+	}
+	return n
+}
+
+// Stat returns the file at p
+func (s *Store) Stat(p string) (Entry, error) {
+	p = Clean(p)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if e, ok := s.files[p]; ok {
+		return *e, nil
+	}
+	if _, ok := s.dirs[p]; ok || p == "" {
+		return Entry{}, fmt.Errorf("%s: %w", p, ErrIsDir)
+	}
+	return Entry{}, fmt.Errorf("%s: %w", p, ErrNotFound)
+}
+
+// IsDir reports whether p is a directory
+func (s *Store) IsDir(p string) bool {
+	p = Clean(p)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.dirs[p]
+	return ok || p == ""
+}
+
+// Open opens the content of the file at p for reading
+func (s *Store) Open(p string) (*os.File, Entry, error) {
+	e, err := s.Stat(p)
+	if err != nil {
+		return nil, Entry{}, err
+	}
+	f, err := os.Open(s.blobPath(e.Blob))
+	return f, e, err
+}
+
+// List returns the children of directory p, directories first
+func (s *Store) List(p string) ([]Info, error) {
+	p = Clean(p)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.dirs[p]; !ok && p != "" {
+		if _, ok := s.files[p]; ok {
+			return nil, fmt.Errorf("%s: %w", p, ErrNotDir)
+		}
+		return nil, fmt.Errorf("%s: %w", p, ErrNotFound)
+	}
+	prefix := ""
+	if p != "" {
+		prefix = p + "/"
+	}
+	out := []Info{}
+	for dir, t := range s.dirs {
+		if rest, ok := strings.CutPrefix(dir, prefix); ok && rest != "" && !strings.Contains(rest, "/") {
+			out = append(out, Info{Name: rest, ModTime: t, IsDir: true})
+		}
+	}
+	for fp, e := range s.files {
+		if rest, ok := strings.CutPrefix(fp, prefix); ok && !strings.Contains(rest, "/") {
+			out = append(out, Info{Name: rest, Size: e.Size, ModTime: e.ModTime})
+		}
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].IsDir != out[j].IsDir {
+			return out[i].IsDir
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out, nil
+}
+
+// Files returns the files at or below p
+func (s *Store) Files(p string) []Entry {
+	p = Clean(p)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var out []Entry
+	for fp, e := range s.files {
+		if within(fp, p) {
+			out = append(out, *e)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Path < out[j].Path })
+	return out
+}
+
+// Remove deletes the file or directory tree at p, with its versions, and
+// returns how many files went with it
+func (s *Store) Remove(p string) (int, error) {
+	p = Clean(p)
+	if p == "" {
+		return 0, ErrRoot
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exists(p) {
+		return 0, fmt.Errorf("%s: %w", p, ErrNotFound)
+	}
+	t := s.detach(p)
+	if err := s.save(); err != nil {
+		s.attach(t)
+		return 0, err
+	}
+	s.removeBlobs(s.unref(t.blobs()...))
+	return len(t.Entries), nil
+}
+
+// Owners totals what each owner keeps: their files, the versions of their
+// files and what they deleted into the trash. Content without an owner is
+// left out, and Blobs and StoredBytes are not set.
+func (s *Store) Owners() map[string]Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]Usage)
+	for _, e := range s.files {
+		u := out[e.Owner]
+		u.Files++
+		u.Bytes += e.Size
+		out[e.Owner] = u
+	}
+	for p, list := range s.versions {
+		for _, v := range list {
+			owner := versionOwner(v, s.files[p])
+			u := out[owner]
+			u.Versions++
+			u.VersionBytes += v.Size
+			out[owner] = u
+		}
+	}
+	for _, t := range s.trash {
+		for _, e := range t.Entries {
+			u := out[e.Owner]
+			u.Trashed++
+			u.TrashBytes += e.Size
+			out[e.Owner] = u
+		}
+		for p, list := range t.Versions {
+			for _, v := range list {
+				owner := versionOwner(v, t.Entries[p])
+				u := out[owner]
+				u.TrashBytes += v.Size
+				out[owner] = u
+			}
+		}
+	}
+	delete(out, "")
+	return out
+}
+
+// versionOwner is who v counts against. Versions kept before they recorded
+// an owner belong to the owner of their file.
+func versionOwner(v *Version, file *Entry) string {
+	if v.Owner == "" && file != nil {
+		return file.Owner
+	}
+	return v.Owner
+}
+
+// exists reports whether p is a file or directory. Caller holds s.mu.
+func (s *Store) exists(p string) bool {
+	_, isFile := s.files[p]
+	_, isDir := s.dirs[p]
+	return isFile || isDir
+}
+
+// Usage totals the files, versions and trash and the blobs behind them
+func (s *Store) Usage() Usage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	u := Usage{Files: len(s.files)}
+	seen := make(map[string]bool, len(s.refs))
+	count := func(hash string, size int64) {
+		if !seen[hash] {
+			seen[hash] = true
+			u.Blobs++
+			u.StoredBytes += size
+		}
+	}
+	for _, e := range s.files {
+		u.Bytes += e.Size
+		count(e.Blob, e.Size)
+	}
+	for _, list := range s.versions {
+		for _, v := range list {
+			u.Versions++
+			u.VersionBytes += v.Size
+			count(v.Blob, v.Size)
+		}
+	}
+	for _, t := range s.trash {
+		for _, e := range t.Entries {
+			u.Trashed++
+			u.TrashBytes += e.Size
+			count(e.Blob, e.Size)
+		}
+		for _, list := range t.Versions {
+			for _, v := range list {
+				u.TrashBytes += v.Size
+				count(v.Blob, v.Size)
+			}
+		}
+	}
+	return u
+}
+
+// within reports whether p is dir or below it
+func within(p, dir string) bool {
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
@@ -0,0 +1,312 @@
+package blobstore_test
+
+import (
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/blobstore"
+)
+
+func blobCount(t *testing.T, dir string) int {
+	t.Helper()
+	n := 0
+	filepath.WalkDir(filepath.Join(dir, "blobs"), func(p string, d os.DirEntry, err error) error {
+		if err == nil && !d.IsDir() {
+			n++
+		}
+		return nil
+	})
+	return n
+}
+
+func read(t *testing.T, s *blobstore.Store, p string) string {
+	t.Helper()
+	f, _, err := s.Open(p)
+	if err != nil {
+		t.Fatalf("Open(%q) failed: %v", p, err)
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(f)
+	return string(data)
+}
+
+func TestDedup(t *testing.T) {
+	dir := t.TempDir()
+	s, err := blobstore.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	a, _ := s.Put("incoming/a.txt", strings.NewReader("same content"))
+	b, _ := s.Put("/shared/../incoming/b.txt", strings.NewReader("same content"))
+	if b.Path != "incoming/b.txt" || a.Blob != b.Blob {
+		t.Fatalf("entries %+v and %+v should share a blob", a, b)
+	}
+	if _, err := s.Copy("incoming/a.txt", "backup/a.txt"); err != nil {
+		t.Fatalf("Copy failed: %v", err)
+	}
+	s.Put("incoming/c.txt", strings.NewReader("other"))
+
+	u := s.Usage()
+	if u.Files != 4 || u.Blobs != 2 || u.Bytes != 3*12+5 || u.StoredBytes != 12+5 {
+		t.Fatalf("Usage = %+v", u)
+	}
+	if n := blobCount(t, dir); n != 2 {
+		t.Fatalf("%d blob files, want 2", n)
+	}
+
+	// The blob goes with its last reference
+	s.Remove("incoming/a.txt")
+	s.Remove("incoming/b.txt")
+	if read(t, s, "backup/a.txt") != "same content" {
+		t.Fatal("backup lost its content")
+	}
+	if n, err := s.Remove("backup"); n != 1 || err != nil {
+		t.Fatalf("Remove(backup) = %d, %v", n, err)
+	}
+	if n := blobCount(t, dir); n != 1 {
+		t.Fatalf("%d blob files after removal, want 1", n)
+	}
+
+	// Overwriting releases the old content
+	s.Put("incoming/c.txt", strings.NewReader("new"))
+	if read(t, s, "incoming/c.txt") != "new" || blobCount(t, dir) != 1 {
+		t.Fatal("overwrite kept the old blob")
+	}
+
+	// An unlinked Write is dropped by Release
+	blob, _ := s.Write(strings.NewReader("pending"))
+	s.Release(blob)
+	if blobCount(t, dir) != 1 {
+		t.Fatal("Release left the blob behind")
+	}
+}
+
+func TestList(t *testing.T) {
+	s, _ := blobstore.Open(t.TempDir())
+	s.Mkdir("vault/empty")
+	s.Put("docs/z.txt", strings.NewReader("z"))
+	s.Put("docs/sub/a.txt", strings.NewReader("a"))
+	s.Put("top.txt", strings.NewReader("t"))
+
+	names := func(p string) string {
+		list, err := s.List(p)
+		if err != nil {
+			t.Fatalf("List(%q) failed: %v", p, err)
+		}
+		var out []string
+		for _, i := range list {
+			if i.IsDir {
+				out = append(out, i.Name+"/")
+			} else {
+				out = append(out, i.Name)
+			}
+		}
+		return strings.Join(out, " ")
+	}
+	if got := names(""); got != "docs/ vault/ top.txt" {
+		t.Errorf("List(root) = %q", got)
+	}
+	if got := names("docs"); got != "sub/ z.txt" {
+		t.Errorf("List(docs) = %q", got)
+	}
+	if got := names("vault/empty"); got != "" {
+		t.Errorf("List(vault/empty) = %q", got)
+	}
+	if _, err := s.List("missing"); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("List(missing) = %v", err)
+	}
+	if _, err := s.Put("top.txt/x", strings.NewReader("x")); !errors.Is(err, blobstore.ErrNotDir) {
+		t.Errorf("Put under a file = %v", err)
+	}
+	if _, err := s.Put("docs", strings.NewReader("x")); !errors.Is(err, blobstore.ErrIsDir) {
+		t.Errorf("Put over a directory = %v", err)
+	}
+	if _, err := s.Remove(""); !errors.Is(err, blobstore.ErrRoot) {
+		t.Errorf("Remove(root) = %v", err)
+	}
+}
+
+func TestReopen(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := blobstore.Open(dir)
+	s.Put("a/file.bin", strings.NewReader("kept"))
+	s.Mkdir("a/empty")
+	s.Write(strings.NewReader("never linked, as if the process died"))
+
+	src := filepath.Join(t.TempDir(), "upload.part")
+	os.WriteFile(src, []byte("moved in"), 0644)
+	blob, err := s.WriteFile(src)
+	if err != nil {
+		t.Fatalf("WriteFile failed: %v", err)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Fatal("WriteFile left the source file")
+	}
+	s.Link("a/moved.bin", blob)
+
+	s, err = blobstore.Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if read(t, s, "a/file.bin") != "kept" || read(t, s, "a/moved.bin") != "moved in" {
+		t.Fatal("content lost across reopen")
+	}
+	if !s.IsDir("a/empty") {
+		t.Fatal("empty directory lost across reopen")
+	}
+	if n := blobCount(t, dir); n != 2 {
+		t.Fatalf("%d blob files after reopen, want the orphan swept", n)
+	}
+}
+
+func TestVersions(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := blobstore.Open(dir)
+	s.SetRetention(blobstore.Retention{Keep: 2})
+	for _, c := range []string{"one", "two", "three", "four"} {
+		s.Put("doc.txt", strings.NewReader(c))
+	}
+	s.Put("doc.txt", strings.NewReader("four")) // unchanged content is no version
+
+	versions, err := s.Versions("doc.txt")
+	if err != nil {
+		t.Fatalf("Versions failed: %v", err)
+	}
+	if len(versions) != 2 || versions[0].Size != 5 || versions[1].Size != 3 {
+		t.Fatalf("Versions = %+v, want three then two", versions)
+	}
+	if n := blobCount(t, dir); n != 3 {
+		t.Fatalf("%d blob files, want the pruned version dropped", n)
+	}
+
+	if _, err := s.RestoreVersion("doc.txt", versions[1].ID); err != nil {
+		t.Fatalf("RestoreVersion failed: %v", err)
+	}
+	if read(t, s, "doc.txt") != "two" {
+		t.Fatal("restore did not bring back the content")
+	}
+	versions, _ = s.Versions("doc.txt")
+	if len(versions) != 2 || versions[0].Size != 4 || versions[1].Size != 5 {
+		t.Fatalf("after restore Versions = %+v, want four then three", versions)
+	}
+	if _, err := s.RestoreVersion("doc.txt", 999); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Errorf("RestoreVersion(unknown) = %v", err)
+	}
+
+	s, _ = blobstore.Open(dir)
+	if versions, _ := s.Versions("doc.txt"); len(versions) != 2 {
+		t.Fatalf("%d versions after reopen, want 2", len(versions))
+	}
+	s.SetRetention(blobstore.Retention{Keep: 1})
+	if n, err := s.PruneVersions(); n != 1 || err != nil {
+		t.Fatalf("PruneVersions = %d, %v", n, err)
+	}
+	if u := s.Usage(); u.Versions != 1 || u.Blobs != 2 {
+		t.Fatalf("Usage = %+v", u)
+	}
+}
+
+func TestTrash(t *testing.T) {
+	dir := t.TempDir()
+	s, _ := blobstore.Open(dir)
+	s.SetRetention(blobstore.Retention{Keep: 5})
+	s.Put("docs/a.txt", strings.NewReader("old"))
+	s.Put("docs/a.txt", strings.NewReader("new"))
+	s.Put("docs/sub/b.txt", strings.NewReader("b"))
+
+	item, err := s.Trash("docs")
+	if err != nil {
+		t.Fatalf("Trash failed: %v", err)
+	}
+	if !item.IsDir || item.Files != 2 || s.IsDir("docs") {
+		t.Fatalf("Trash = %+v", item)
+	}
+	if u := s.Usage(); u.Files != 0 || u.Trashed != 2 || u.Blobs != 3 {
+		t.Fatalf("Usage with docs trashed = %+v", u)
+	}
+
+	// A path taken since the delete gets a new name
+	s.Mkdir("docs")
+	s, _ = blobstore.Open(dir)
+	restored, err := s.RestoreTrash(item.ID)
+	if err != nil || restored != "docs_restored" {
+		t.Fatalf("RestoreTrash = %q, %v", restored, err)
+	}
+	if read(t, s, "docs_restored/sub/b.txt") != "b" {
+		t.Fatal("restored tree lost its content")
+	}
+	if versions, _ := s.Versions("docs_restored/a.txt"); len(versions) != 1 {
+		t.Fatal("restored file lost its versions")
+	}
+	if len(s.TrashList()) != 0 {
+		t.Fatal("restored item is still in the trash")
+	}
+
+	item, _ = s.Trash("docs_restored/a.txt")
+	if err := s.PurgeTrash(item.ID); err != nil {
+		t.Fatalf("PurgeTrash failed: %v", err)
+	}
+	if n := blobCount(t, dir); n != 1 {
+		t.Fatalf("%d blob files after purge, want 1", n)
+	}
+	s.Trash("docs_restored")
+	if purged, _ := s.PurgeTrashOlder(time.Hour); len(purged) != 0 {
+		t.Fatal("PurgeTrashOlder purged a fresh item")
+	}
+	if purged, _ := s.PurgeTrashOlder(0); len(purged) != 1 || blobCount(t, dir) != 0 {
+		t.Fatalf("PurgeTrashOlder(0) = %+v", purged)
+	}
+}
+
+func TestOwners(t *testing.T) {
+	s, _ := blobstore.Open(t.TempDir())
+	b, _ := s.Write(strings.NewReader("alice's"))
+	s.LinkAs("home/alice/a.txt", b, "alice")
+	b, _ = s.Write(strings.NewReader("changed"))
+	s.Link("home/alice/a.txt", b) // keeps the owner
+	s.Copy("home/alice/a.txt", "backup/a.txt")
+	s.Put("public/unowned.txt", strings.NewReader("x"))
+
+	owners := s.Owners()
+	if len(owners) != 1 || owners["alice"].Files != 2 || owners["alice"].Bytes != 14 {
+		t.Fatalf("Owners = %+v", owners)
+	}
+
+	// Kept versions and the trash still count against the owner
+	s.SetRetention(blobstore.Retention{Keep: 1})
+	b, _ = s.Write(strings.NewReader("newer"))
+	s.Link("home/alice/a.txt", b)
+	s.Trash("backup/a.txt")
+	u := s.Owners()["alice"]
+	if u.Files != 1 || u.Bytes != 5 || u.Versions != 1 || u.VersionBytes != 7 || u.Trashed != 1 || u.TrashBytes != 7 {
+		t.Fatalf("Owners()[alice] = %+v", u)
+	}
+}
+
+func TestNames(t *testing.T) {
+	s, _ := blobstore.Open(t.TempDir())
+	for _, name := range []string{"", ".", "..", "a..b", "a/b", `..\..\home\admin\x.html`, "a\x00b", "line\nbreak"} {
+		if err := blobstore.ValidName(name); !errors.Is(err, blobstore.ErrBadName) {
+			t.Errorf("ValidName(%q) = %v", name, err)
+		}
+	}
+	if err := blobstore.ValidName("report v2.pdf"); err != nil {
+		t.Errorf("ValidName rejected a plain name: %v", err)
+	}
+
+	// Backslashes are not separators, so they cannot climb out of a folder
+	if _, err := s.Put(`shared/box/..\..\home\admin\x.html`, strings.NewReader("x")); !errors.Is(err, blobstore.ErrBadName) {
+		t.Fatalf("Put with backslashes = %v", err)
+	}
+	if err := s.Mkdir(`shared\evil`); !errors.Is(err, blobstore.ErrBadName) {
+		t.Fatalf("Mkdir with a backslash = %v", err)
+	}
+	if _, err := s.Stat("home/admin/x.html"); !errors.Is(err, blobstore.ErrNotFound) {
+		t.Fatal("a backslash path was written elsewhere")
+	}
+}
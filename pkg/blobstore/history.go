@@ -0,0 +1,373 @@
+package blobstore
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Version is earlier content of a file, kept when it was overwritten
+type Version struct {
+	ID       int64     `json:"id"`
+	Blob     string    `json:"blob"`
+	Size     int64     `json:"size"`
+	ModTime  time.Time `json:"mod_time"`        // when the content was written
+	Replaced time.Time `json:"replaced"`        // when it stopped being current
+	Owner    string    `json:"owner,omitempty"` // the file's owner at the time, counted by Owners
+}
+
+// Retention limits the versions kept per file
+type Retention struct {
+	Keep   int           // versions per file; 0 keeps none
+	MaxAge time.Duration // versions replaced longer ago are dropped; 0 keeps them
+}
+
+// TrashItem describes a deleted file or directory tree
+type TrashItem struct {
+	ID        int64     `json:"id"`
+	Path      string    `json:"path"`
+	IsDir     bool      `json:"is_dir"`
+	Files     int       `json:"files"`
+	Size      int64     `json:"size"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// subtree is part of the index taken out by detach
+type subtree struct {
+	Entries  map[string]*Entry     `json:"entries"`
+	Versions map[string][]*Version `json:"versions,omitempty"`
+	Dirs     map[string]time.Time  `json:"dirs,omitempty"`
+}
+
+// blobs lists one hash per reference the subtree holds
+func (t subtree) blobs() []string {
+	var out []string
+	for _, e := range t.Entries {
+		out = append(out, e.Blob)
+	}
+	for _, list := range t.Versions {
+		for _, v := range list {
+			out = append(out, v.Blob)
+		}
+	}
+	return out
+}
+
+// rebase moves the subtree from root from to root to
+func (t subtree) rebase(from, to string) subtree {
+	move := func(p string) string { return to + strings.TrimPrefix(p, from) }
+	out := subtree{
+		Entries:  make(map[string]*Entry, len(t.Entries)),
+		Versions: make(map[string][]*Version, len(t.Versions)),
+		Dirs:     make(map[string]time.Time, len(t.Dirs)),
+	}
+	for p, e := range t.Entries {
+		c := *e
+		c.Path = move(p)
+		out.Entries[c.Path] = &c
+	}
+	for p, list := range t.Versions {
+		out.Versions[move(p)] = list
+	}
+	for p, mt := range t.Dirs {
+		out.Dirs[move(p)] = mt
+	}
+	return out
+}
+
+type trashed struct {
+	TrashItem
+	subtree
+}
+
+// SetRetention sets the limits applied to versions from now on.
+// PruneVersions applies them to the versions already kept.
+func (s *Store) SetRetention(r Retention) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.retention = r
+}
+
+// setVersions replaces the versions of p. Caller holds s.mu.
+func (s *Store) setVersions(p string, list []*Version) {
+	if len(list) == 0 {
+		delete(s.versions, p)
+		return
+	}
+	s.versions[p] = list
+}
+
+// prune drops the versions of p outside the retention limits and returns
+// them, still referenced. Caller holds s.mu.
+func (s *Store) prune(p string, now time.Time) []*Version {
+	list := s.versions[p]
+	n := 0
+	for n < len(list) && (len(list)-n > s.retention.Keep ||
+		s.retention.MaxAge > 0 && now.Sub(list[n].Replaced) > s.retention.MaxAge) {
+		n++
+	}
+	s.setVersions(p, list[n:])
+	return list[:n]
+}
+
+// Versions returns the earlier contents of the file at p, newest first
+func (s *Store) Versions(p string) ([]Version, error) {
+	p = Clean(p)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.files[p]; !ok {
+		if _, ok := s.dirs[p]; ok || p == "" {
+			return nil, fmt.Errorf("%s: %w", p, ErrIsDir)
+		}
+		return nil, fmt.Errorf("%s: %w", p, ErrNotFound)
+	}
+	list := s.versions[p]
+	out := make([]Version, 0, len(list))
+	for i := len(list) - 1; i >= 0; i-- {
+		out = append(out, *list[i])
+	}
+	return out, nil
+}
+
+// RestoreVersion makes version id the content of p again. It leaves the
+// list of versions, and the content it replaces joins it.
+func (s *Store) RestoreVersion(p string, id int64) (Entry, error) {
+	p = Clean(p)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := s.versions[p]
+	i := sort.Search(len(list), func(i int) bool { return list[i].ID >= id })
+	if _, ok := s.files[p]; !ok || i == len(list) || list[i].ID != id {
+		return Entry{}, fmt.Errorf("version %d of %s: %w", id, p, ErrNotFound)
+	}
+	v := list[i]
+	rest := append(append([]*Version(nil), list[:i]...), list[i+1:]...)
+	s.setVersions(p, rest)
+	// The version's reference passes to the entry
+	e, err := s.link(p, v.Blob, v.Size, "")
+	if err != nil {
+		s.setVersions(p, list)
+	}
+	return e, err
+}
+
+// PruneVersions applies the retention limits to every file and returns
+// how many versions were dropped
+func (s *Store) PruneVersions() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	before := make(map[string][]*Version)
+	var dropped []string
+	for p, list := range s.versions {
+		for _, v := range s.prune(p, now) {
+			dropped = append(dropped, v.Blob)
+		}
+		if len(s.versions[p]) != len(list) {
+			before[p] = list
+		}
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+	if err := s.save(); err != nil {
+		for p, list := range before {
+			s.versions[p] = list
+		}
+		return 0, err
+	}
+	s.removeBlobs(s.unref(dropped...))
+	return len(dropped), nil
+}
+
+// detach takes the files, versions and directories at or below p out of
+// the index. Caller holds s.mu.
+func (s *Store) detach(p string) subtree {
+	t := subtree{
+		Entries:  make(map[string]*Entry),
+		Versions: make(map[string][]*Version),
+		Dirs:     make(map[string]time.Time),
+	}
+	for fp, e := range s.files {
+		if within(fp, p) {
+			t.Entries[fp] = e
+			delete(s.files, fp)
+		}
+	}
+	for fp, list := range s.versions {
+		if within(fp, p) {
+			t.Versions[fp] = list
+			delete(s.versions, fp)
+		}
+	}
+	for dir, mt := range s.dirs {
+		if within(dir, p) {
+			t.Dirs[dir] = mt
+			delete(s.dirs, dir)
+		}
+	}
+	return t
+}
+
+// attach puts a detached subtree back. Caller holds s.mu.
+func (s *Store) attach(t subtree) {
+	for fp, e := range t.Entries {
+		s.files[fp] = e
+	}
+	for fp, list := range t.Versions {
+		s.versions[fp] = list
+	}
+	for dir, mt := range t.Dirs {
+		s.dirs[dir] = mt
+	}
+}
+
+// Trash moves the file or directory tree at p, with its versions, to the
+// trash
+func (s *Store) Trash(p string) (TrashItem, error) {
+	p = Clean(p)
+	if p == "" {
+		return TrashItem{}, ErrRoot
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.exists(p) {
+		return TrashItem{}, fmt.Errorf("%s: %w", p, ErrNotFound)
+	}
+	_, isDir := s.dirs[p]
+	t := s.detach(p)
+	s.seq++
+	item := &trashed{
+		TrashItem: TrashItem{ID: s.seq, Path: p, IsDir: isDir, Files: len(t.Entries), DeletedAt: time.Now()},
+		subtree:   t,
+	}
+	for _, e := range t.Entries {
+		item.Size += e.Size
+	}
+	s.trash = append(s.trash, item)
+	if err := s.save(); err != nil {
+		s.trash = s.trash[:len(s.trash)-1]
+		s.attach(t)
+		return TrashItem{}, err
+	}
+	return item.TrashItem, nil
+}
+
+// TrashList returns what is in the trash, most recently deleted first
+func (s *Store) TrashList() []TrashItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make([]TrashItem, 0, len(s.trash))
+	for i := len(s.trash) - 1; i >= 0; i-- {
+		out = append(out, s.trash[i].TrashItem)
+	}
+	return out
+}
+
+// trashIndex finds item id in s.trash. Caller holds s.mu.
+func (s *Store) trashIndex(id int64) (int, error) {
+	for i, t := range s.trash {
+		if t.ID == id {
+			return i, nil
+		}
+	}
+	return -1, fmt.Errorf("trash item %d: %w", id, ErrNotFound)
+}
+
+// takeTrash removes the items drop selects from s.trash and returns them
+// with a function putting them back. Caller holds s.mu.
+func (s *Store) takeTrash(drop func(*trashed) bool) ([]*trashed, func()) {
+	old := s.trash
+	var kept, taken []*trashed
+	for _, t := range old {
+		if drop(t) {
+			taken = append(taken, t)
+		} else {
+			kept = append(kept, t)
+		}
+	}
+	s.trash = kept
+	return taken, func() { s.trash = old }
+}
+
+// RestoreTrash puts item id back where it was deleted from, or beside it
+// with a "_restored" suffix when that path has been taken since, and
+// returns the path it was restored to
+func (s *Store) RestoreTrash(id int64) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i, err := s.trashIndex(id)
+	if err != nil {
+		return "", err
+	}
+	item := s.trash[i]
+	dest := item.Path
+	for n := 1; s.exists(dest); n++ {
+		dest = restoredName(item.Path, n)
+	}
+	if err := s.checkFilePath(dest); err != nil {
+		return "", err
+	}
+	t := item.rebase(item.Path, dest)
+	_, undo := s.takeTrash(func(c *trashed) bool { return c == item })
+	s.attach(t)
+	s.mkdirAll(path.Dir(dest))
+	if err := s.save(); err != nil {
+		s.detach(dest)
+		undo()
+		return "", err
+	}
+	return dest, nil
+}
+
+// restoredName is the nth alternative to p for a restored item
+func restoredName(p string, n int) string {
+	ext := path.Ext(p)
+	base := strings.TrimSuffix(p, ext)
+	if n == 1 {
+		return base + "_restored" + ext
+	}
+	return fmt.Sprintf("%s_restored%d%s", base, n, ext)
+}
+
+// PurgeTrash deletes item id for good
+func (s *Store) PurgeTrash(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.trashIndex(id); err != nil {
+		return err
+	}
+	_, err := s.purge(func(t *trashed) bool { return t.ID == id })
+	return err
+}
+
+// PurgeTrashOlder deletes the items that have been in the trash longer
+// than maxAge and returns them
+func (s *Store) PurgeTrashOlder(maxAge time.Duration) ([]TrashItem, error) {
+	cutoff := time.Now().Add(-maxAge)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.purge(func(t *trashed) bool { return t.DeletedAt.Before(cutoff) })
+}
+
+// purge deletes the trash items drop selects. Caller holds s.mu.
+func (s *Store) purge(drop func(*trashed) bool) ([]TrashItem, error) {
+	taken, undo := s.takeTrash(drop)
+	if len(taken) == 0 {
+		return nil, nil
+	}
+	if err := s.save(); err != nil {
+		undo()
+		return nil, err
+	}
+	var hashes []string
+	out := make([]TrashItem, 0, len(taken))
+	for _, t := range taken {
+		hashes = append(hashes, t.blobs()...)
+		out = append(out, t.TrashItem)
+	}
+	s.removeBlobs(s.unref(hashes...))
+	return out, nil
+}
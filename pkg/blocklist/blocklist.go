@@ -0,0 +1,285 @@
+// Package blocklist matches domain names against exact and wildcard rules,
+// kept in a JSON file and fillable from hosts-format block lists.
+package blocklist
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// SourceManual marks rules added one by one rather than imported
+const SourceManual = "manual"
+
+var ErrInvalidPattern = errors.New("invalid domain pattern")
+
+// Rule blocks one domain, or with a leading "*." every name below it
+type Rule struct {
+	Pattern string    `json:"pattern"`
+	Source  string    `json:"source"` // SourceManual or the name of an imported list
+	AddedBy string    `json:"added_by,omitempty"`
+	AddedAt time.Time `json:"added_at"`
+}
+
+// List is a set of rules. It is safe for concurrent use.
+type List struct {
+	mu       sync.RWMutex
+	rules    map[string]Rule // by pattern
+	filename string
+}
+
+// Load reads the rules kept in filename. A missing file is an empty list.
+func Load(filename string) (*List, error) {
+	l := &List{rules: make(map[string]Rule), filename: filename}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return l, nil
+	}
+	if err != nil {
+		return l, err
+	}
+	var rules []Rule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return l, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+	for _, r := range rules {
+		if p, err := Normalize(r.Pattern); err == nil {
+			r.Pattern = p
+			l.rules[p] = r
+		}
+	}
+	return l, nil
+}
+
+// Normalize lowercases a pattern and checks that it is a domain name,
+// optionally prefixed with "*."
+func Normalize(pattern string) (string, error) {
+	p := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(pattern), "."))
+	name := strings.TrimPrefix(p, "*.")
+	if name == "" || len(name) > 253 || net.ParseIP(name) != nil {
+		return "", fmt.Errorf("%w: %q", ErrInvalidPattern, pattern)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return "", fmt.Errorf("%w: %q", ErrInvalidPattern, pattern)
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return "", fmt.Errorf("%w: %q", ErrInvalidPattern, pattern)
+			}
+		}
+	}
+	return p, nil
+}
+
+// Match returns the rule blocking name, if any. An exact rule wins over a
+// wildcard, and a closer wildcard over one further up.
+func (l *List) Match(name string) (Rule, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	if r, ok := l.rules[name]; ok {
+		return r, true
+	}
+	for i := strings.IndexByte(name, '.'); i >= 0; i = strings.IndexByte(name, '.') {
+		name = name[i+1:]
+		if r, ok := l.rules["*."+name]; ok {
+			return r, true
+		}
+	}
+	return Rule{}, false
+}
+
+// Add stores a manual rule
+func (l *List) Add(pattern, user string) (Rule, error) {
+	p, err := Normalize(pattern)
+	if err != nil {
+		return Rule{}, err
+	}
+	r := Rule{Pattern: p, Source: SourceManual, AddedBy: user, AddedAt: time.Now()}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, had := l.rules[p]
+	l.rules[p] = r
+	if err := l.save(); err != nil {
+		if had {
+			l.rules[p] = old
+		} else {
+			delete(l.rules, p)
+		}
+		return Rule{}, err
+	}
+	return r, nil
+}
+
+// Remove deletes the rule for pattern and reports whether there was one
+func (l *List) Remove(pattern string) (bool, error) {
+	p, err := Normalize(pattern)
+	if err != nil {
+		return false, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	old, ok := l.rules[p]
+	if !ok {
+		return false, nil
+	}
+	delete(l.rules, p)
+	if err := l.save(); err != nil {
+		l.rules[p] = old
+		return false, err
+	}
+	return true, nil
+}
+
+// Import replaces the rules of source with the domains of a hosts-format
+// list and returns how many it holds. Manual rules are kept.
+func (l *List) Import(r io.Reader, source, user string) (int, error) {
+	source = strings.TrimSpace(source)
+	if source == "" || source == SourceManual {
+		return 0, fmt.Errorf("import needs a list name other than %q", SourceManual)
+	}
+	domains, err := ParseHosts(r)
+	if err != nil {
+		return 0, err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	prev := make(map[string]Rule, len(l.rules))
+	for p, rule := range l.rules {
+		prev[p] = rule
+		if rule.Source == source {
+			delete(l.rules, p)
+		}
+	}
+	now := time.Now()
+	added := 0
+	for _, d := range domains {
+		if existing, ok := l.rules[d]; ok && existing.Source == SourceManual {
+			continue
+		}
+		l.rules[d] = Rule{Pattern: d, Source: source, AddedBy: user, AddedAt: now}
+		added++
+	}
+	if err := l.save(); err != nil {
+		l.rules = prev
+		return 0, err
+	}
+	return added, nil
+}
+
+// RemoveSource drops every rule imported from source
+func (l *List) RemoveSource(source string) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var dropped []Rule
+	for p, rule := range l.rules {
+		if rule.Source == source {
+			dropped = append(dropped, rule)
+			delete(l.rules, p)
+		}
+	}
+	if len(dropped) == 0 {
+		return 0, nil
+	}
+	if err := l.save(); err != nil {
+		for _, rule := range dropped {
+			l.rules[rule.Pattern] = rule
+		}
+		return 0, err
+	}
+	return len(dropped), nil
+}
+
+// Rules returns the rules sorted by pattern
+func (l *List) Rules() []Rule {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]Rule, 0, len(l.rules))
+	for _, r := range l.rules {
+		out = append(out, r)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Pattern < out[j].Pattern })
+	return out
+}
+
+// Len returns the number of rules
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.rules)
+}
+
+// save writes the rules through a temporary file, so a crash mid-save
+// leaves the previous file intact. Caller holds l.mu.
+func (l *List) save() error {
+	if l.filename == "" {
+		return nil
+	}
+	rules := make([]Rule, 0, len(l.rules))
+	for _, r := range l.rules {
+		rules = append(rules, r)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].Pattern < rules[j].Pattern })
+	data, err := json.MarshalIndent(rules, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(l.filename, data, 0644)
+}
+
+// ParseHosts reads the domains of a hosts-format block list. Lines map an
+// address to one or more names ("0.0.0.0 ads.example.com"); bare domains,
+// "*." wildcards and comments are accepted too. Names of the machine
+// itself, such as localhost, are skipped.
+func ParseHosts(r io.Reader) ([]string, error) {
+	seen := make(map[string]bool)
+	var out []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, f := range fields {
+			d, err := Normalize(f)
+			if err != nil || isHostName(d) || seen[d] {
+				continue
+			}
+			seen[d] = true
+			out = append(out, d)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func isHostName(d string) bool {
+	switch d {
+	case "localhost", "localhost.localdomain", "local", "broadcasthost", "ip6-localhost", "ip6-loopback",
+		"ip6-localnet", "ip6-mcastprefix", "ip6-allnodes", "ip6-allrouters", "ip6-allhosts":
+		return true
+	}
+	return false
+}
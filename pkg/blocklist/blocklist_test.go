@@ -0,0 +1,135 @@
+package blocklist_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/blocklist"
+)
+
+func TestMatch(t *testing.T) {
+	l, err := blocklist.Load(filepath.Join(t.TempDir(), "blocklist.json"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	for _, p := range []string{"Ads.Example.com.", "*.tracker.net", "*.sub.tracker.net"} {
+		if _, err := l.Add(p, "admin"); err != nil {
+			t.Fatalf("Add(%q) failed: %v", p, err)
+		}
+	}
+	for _, p := range []string{"", "*.", "bad domain", "10.0.0.1", "a..b"} {
+		if _, err := l.Add(p, "admin"); !errors.Is(err, blocklist.ErrInvalidPattern) {
+			t.Fatalf("Add(%q) = %v", p, err)
+		}
+	}
+
+	cases := map[string]string{
+		"ads.example.com":     "ads.example.com",
+		"ADS.EXAMPLE.COM.":    "ads.example.com",
+		"www.ads.example.com": "", // exact rules do not cover subdomains
+		"example.com":         "",
+		"tracker.net":         "", // nor do wildcards cover their own domain
+		"a.tracker.net":       "*.tracker.net",
+		"x.sub.tracker.net":   "*.sub.tracker.net",
+	}
+	for name, want := range cases {
+		r, ok := l.Match(name)
+		if ok != (want != "") || r.Pattern != want {
+			t.Errorf("Match(%q) = %q, %v; want %q", name, r.Pattern, ok, want)
+		}
+	}
+
+	if ok, _ := l.Remove("*.sub.tracker.net"); !ok {
+		t.Fatal("Remove found nothing")
+	}
+	if r, _ := l.Match("x.sub.tracker.net"); r.Pattern != "*.tracker.net" {
+		t.Fatalf("after Remove matched %q", r.Pattern)
+	}
+}
+
+func TestImport(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "blocklist.json")
+	l, _ := blocklist.Load(file)
+	l.Add("keep.example", "admin")
+
+	hosts := `# ad servers
+127.0.0.1 localhost
+::1 localhost ip6-localhost
+0.0.0.0 ads.example doubleclick.example   # inline comment
+0.0.0.0 keep.example
+*.metrics.example
+plain.example
+`
+	n, err := l.Import(strings.NewReader(hosts), "ads", "admin")
+	if err != nil || n != 4 {
+		t.Fatalf("Import = %d, %v", n, err)
+	}
+	if r, ok := l.Match("keep.example"); !ok || r.Source != blocklist.SourceManual {
+		t.Fatalf("manual rule replaced by import: %+v", r)
+	}
+	if _, ok := l.Match("localhost"); ok {
+		t.Fatal("localhost imported")
+	}
+	if r, ok := l.Match("a.metrics.example"); !ok || r.Source != "ads" {
+		t.Fatalf("wildcard from hosts file: %+v", r)
+	}
+
+	// Re-importing a list replaces its rules
+	if n, _ := l.Import(strings.NewReader("0.0.0.0 new.example\n"), "ads", "admin"); n != 1 {
+		t.Fatalf("re-import = %d", n)
+	}
+	if _, ok := l.Match("ads.example"); ok {
+		t.Fatal("old import survived")
+	}
+
+	// Rules survive a reload
+	reloaded, err := blocklist.Load(file)
+	if err != nil || reloaded.Len() != 2 {
+		t.Fatalf("reloaded %d rules, %v", reloaded.Len(), err)
+	}
+	if n, _ := reloaded.RemoveSource("ads"); n != 1 || reloaded.Len() != 1 {
+		t.Fatalf("RemoveSource = %d, left %d", n, reloaded.Len())
+	}
+	if _, err := l.Import(strings.NewReader(""), blocklist.SourceManual, "admin"); err == nil {
+		t.Fatal("imported into the manual source")
+	}
+}
+
+func TestSaveFailure(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "dns")
+	os.Mkdir(dir, 0755)
+	l, _ := blocklist.Load(filepath.Join(dir, "blocklist.json"))
+	l.Add("keep.example", "admin")
+	l.Import(strings.NewReader("0.0.0.0 ads.example\n"), "ads", "admin")
+
+	// Nothing changes in memory that could not be written
+	os.RemoveAll(dir)
+	if _, err := l.Add("new.example", "admin"); err == nil {
+		t.Error("Add succeeded without saving")
+	}
+	if _, err := l.Remove("keep.example"); err == nil {
+		t.Error("Remove succeeded without saving")
+	}
+	if _, err := l.Import(strings.NewReader("0.0.0.0 other.example\n"), "ads", "admin"); err == nil {
+		t.Error("Import succeeded without saving")
+	}
+	if _, err := l.RemoveSource("ads"); err == nil {
+		t.Error("RemoveSource succeeded without saving")
+	}
+	for _, name := range []string{"keep.example", "ads.example"} {
+		if _, ok := l.Match(name); !ok {
+			t.Errorf("%s lost after failed saves", name)
+		}
+	}
+	for _, name := range []string{"new.example", "other.example"} {
+		if _, ok := l.Match(name); ok {
+			t.Errorf("%s added by a failed save", name)
+		}
+	}
+	if l.Len() != 2 {
+		t.Errorf("Len = %d after failed saves", l.Len())
+	}
+}
@@ -3,6 +3,8 @@ package config
 import (
 	"fmt"
 	"os" // Added missing import
+	"strconv"
+	"strings"
 	"sync"
 
 	"gopkg.in/yaml.v3"
@@ -14,6 +16,7 @@ type Config struct {
 		Name        string `yaml:"name"`
 		Version     string `yaml:"version"`
 		Environment string `yaml:"environment"`
+		AuditLog    string `yaml:"audit_log"` // Security events from every service
 	} `yaml:"system"`
 
 	Network struct {
@@ -22,16 +25,26 @@ type Config struct {
 	} `yaml:"network"`
 
 	Server struct {
-		Host string `yaml:"host"`
-		Port int    `yaml:"port"`
+		Host  string   `yaml:"host"`
+		Port  int      `yaml:"port"`
+		Peers []string `yaml:"peers"` // Other core nodes (host:port) to replicate the ledger with
+
+		// Quorum consensus: the leader orders blocks, peers act as validators
+		Consensus struct {
+			Enabled   bool   `yaml:"enabled"`
+			Leader    bool   `yaml:"leader"`
+			LeaderKey string `yaml:"leader_key"` // Leader public key (hex), followers only
+			// Validators (host:port) the leader needs a majority of; peers if empty
+			Validators []string `yaml:"validators"`
+		} `yaml:"consensus"`
 	} `yaml:"server"`
 
 	Services struct {
 		Gateway   ServiceConfig `yaml:"gateway"`
-		DNS       ServiceConfig `yaml:"dns"`
+		DNS       DNSConfig     `yaml:"dns"`
 		Dashboard ServiceConfig `yaml:"dashboard"`
 		Admin     ServiceConfig `yaml:"admin"`
-		Storage   ServiceConfig `yaml:"storage"`
+		Storage   StorageConfig `yaml:"storage"`
 		Chat      ServiceConfig `yaml:"chat"`
 		Web       ServiceConfig `yaml:"web"`
 	} `yaml:"services"`
@@ -47,6 +60,46 @@ type ServiceConfig struct {
 	Host string `yaml:"host,omitempty"`
 }
 
+// DNSConfig adds resolver behaviour to the DNS service settings
+type DNSConfig struct {
+	ServiceConfig `yaml:",inline"`
+	Strict        bool `yaml:"strict"` // Unknown .n/.nexa names get NXDOMAIN instead of the gateway
+
+	// Forwarding of non-local names
+	Upstreams    []string `yaml:"upstreams"`     // 8.8.8.8, tcp://..., tls://host#name, https://.../dns-query
+	TimeoutMs    int      `yaml:"timeout_ms"`    // per upstream attempt
+	CacheSize    int      `yaml:"cache_size"`    // reply cache entries, -1 disables it
+	Offline      bool     `yaml:"offline"`       // never forward, answer with OfflineRCode
+	OfflineRCode string   `yaml:"offline_rcode"` // SERVFAIL or NXDOMAIN
+
+	// Split-horizon: clients matching a view see its records before the shared ones
+	Views []DNSView `yaml:"views"`
+
+	// Query log and blocklists
+	QueryLog      string `yaml:"query_log"`        // JSON lines, one per query
+	QueryLogMaxMB int    `yaml:"query_log_max_mb"` // size at which the log is rotated
+	QueryLogFiles int    `yaml:"query_log_files"`  // rotated logs kept
+	BlockMode     string `yaml:"block_mode"`       // nxdomain or sinkhole
+	SinkholeIP    string `yaml:"sinkhole_ip"`      // answer for blocked names in sinkhole mode
+}
+
+// StorageConfig adds file retention to the storage service settings
+type StorageConfig struct {
+	ServiceConfig  `yaml:",inline"`
+	VersionsKept   int `yaml:"versions_kept"`    // earlier versions kept per file, -1 disables versioning
+	VersionMaxDays int `yaml:"version_max_days"` // versions older than this are dropped, 0 keeps them
+	TrashDays      int `yaml:"trash_days"`       // deleted files are purged from the trash after this, -1 never
+	DefaultQuotaMB int `yaml:"default_quota_mb"` // per user unless set by an admin, 0 is unlimited
+	ShareDays      int `yaml:"share_days"`       // expiry of share links that do not set one
+}
+
+// DNSView is a named set of client subnets with records of their own
+type DNSView struct {
+	Name       string   `yaml:"name"`
+	Subnets    []string `yaml:"subnets"`    // client networks in CIDR form
+	Interfaces []string `yaml:"interfaces"` // or every subnet of these interfaces, e.g. the hotspot
+}
+
 var (
 	GlobalConfig *Config
 	once         sync.Once
@@ -113,6 +166,14 @@ func overrideWithEnv() {
 	if port := os.Getenv("NEXA_GATEWAY_PORT"); port != "" {
 		// parsing int omitted for brevity in this manual mapping
 	}
+
+	// Lets several core nodes run side by side on one machine
+	if port, err := strconv.Atoi(os.Getenv("NEXA_SERVER_PORT")); err == nil && port > 0 {
+		GlobalConfig.Server.Port = port
+	}
+	if peers := os.Getenv("NEXA_SERVER_PEERS"); peers != "" {
+		GlobalConfig.Server.Peers = strings.Split(peers, ",")
+	}
 }
 
 func setDefaults() {
@@ -129,12 +190,36 @@ func setDefaults() {
 	if GlobalConfig.Services.Storage.Port == 0 {
 		GlobalConfig.Services.Storage.Port = 8081
 	}
+	if GlobalConfig.Services.Storage.VersionsKept == 0 {
+		GlobalConfig.Services.Storage.VersionsKept = 10
+	}
+	if GlobalConfig.Services.Storage.TrashDays == 0 {
+		GlobalConfig.Services.Storage.TrashDays = 30
+	}
+	if GlobalConfig.Services.Storage.ShareDays == 0 {
+		GlobalConfig.Services.Storage.ShareDays = 7
+	}
 	if GlobalConfig.Services.Chat.Port == 0 {
 		GlobalConfig.Services.Chat.Port = 8082
 	}
 	if GlobalConfig.Services.DNS.Port == 0 {
 		GlobalConfig.Services.DNS.Port = 53
 	}
+	if len(GlobalConfig.Services.DNS.Upstreams) == 0 {
+		GlobalConfig.Services.DNS.Upstreams = []string{"8.8.8.8", "1.1.1.1"}
+	}
+	if GlobalConfig.Services.DNS.OfflineRCode == "" {
+		GlobalConfig.Services.DNS.OfflineRCode = "SERVFAIL"
+	}
+	if GlobalConfig.Services.DNS.QueryLog == "" {
+		GlobalConfig.Services.DNS.QueryLog = "dns_queries.log"
+	}
+	if GlobalConfig.Services.DNS.BlockMode == "" {
+		GlobalConfig.Services.DNS.BlockMode = "nxdomain"
+	}
+	if GlobalConfig.Services.DNS.SinkholeIP == "" {
+		GlobalConfig.Services.DNS.SinkholeIP = "0.0.0.0"
+	}
 	if GlobalConfig.Services.Web.Port == 0 {
 		GlobalConfig.Services.Web.Port = 3000
 	}
@@ -150,6 +235,9 @@ func setDefaults() {
 	if GlobalConfig.System.Environment == "" {
 		GlobalConfig.System.Environment = "production"
 	}
+	if GlobalConfig.System.AuditLog == "" {
+		GlobalConfig.System.AuditLog = "audit.log"
+	}
 	if GlobalConfig.Server.Host == "" {
 		GlobalConfig.Server.Host = "0.0.0.0"
 	}
@@ -0,0 +1,244 @@
+package dnsmsg_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+)
+
+func sampleMessage() *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header: dnsmsg.Header{ID: 0xBEEF, Response: true, Authoritative: true, RecursionDesired: true},
+		Questions: []dnsmsg.Question{
+			{Name: "share.n", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET},
+			{Name: "_http._tcp.nexa.local", Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET},
+		},
+		Answers: []dnsmsg.RR{
+			{Name: "share.n", Class: dnsmsg.ClassINET, TTL: 60, Data: dnsmsg.A{IP: net.ParseIP("10.0.0.5")}},
+			{Name: "share.n", Class: dnsmsg.ClassINET, TTL: 60, Data: dnsmsg.AAAA{IP: net.ParseIP("fd00::5")}},
+			{Name: "_http._tcp.nexa.local", Class: dnsmsg.ClassINET, TTL: 120, Data: dnsmsg.PTR{Target: "Storage._http._tcp.nexa.local"}},
+			{Name: "Storage._http._tcp.nexa.local", Class: dnsmsg.ClassINET, TTL: 120, Data: dnsmsg.SRV{Priority: 0, Weight: 0, Port: 8081, Target: "share.n"}},
+			{Name: "Storage._http._tcp.nexa.local", Class: dnsmsg.ClassINET, TTL: 120, Data: dnsmsg.TXT{Strings: []string{"path=/", "v=1"}}},
+			{Name: "www.n", Class: dnsmsg.ClassINET, TTL: 60, Data: dnsmsg.CNAME{Target: "share.n"}},
+		},
+		Authority: []dnsmsg.RR{
+			{Name: "n", Class: dnsmsg.ClassINET, TTL: 3600, Data: dnsmsg.SOA{NS: "ns.n", MBox: "admin.n", Serial: 7, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: 60}},
+		},
+		Additional: []dnsmsg.RR{
+			{Name: "n", Class: dnsmsg.ClassINET, TTL: 3600, Data: dnsmsg.MX{Preference: 10, Host: "mail.n"}},
+			{Name: "x.n", Class: dnsmsg.ClassINET, TTL: 5, Data: dnsmsg.Unknown{RRType: 65280, Data: []byte{1, 2, 3}}},
+		},
+		EDNS: &dnsmsg.EDNS{UDPSize: 1232, DNSSECOK: true, Options: []dnsmsg.EDNSOption{{Code: 10, Data: []byte("cookie!!")}}},
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	m := sampleMessage()
+	m.RCode = dnsmsg.RCodeBadVersion // needs the EDNS extended bits
+
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	got, err := dnsmsg.Parse(wire)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+
+	if got.Header != m.Header {
+		t.Fatalf("header mismatch: %+v != %+v", got.Header, m.Header)
+	}
+	if !reflect.DeepEqual(got.Questions, m.Questions) {
+		t.Fatalf("questions mismatch: %+v", got.Questions)
+	}
+	if len(got.Answers) != len(m.Answers) || len(got.Authority) != 1 || len(got.Additional) != 2 {
+		t.Fatalf("section sizes: %d/%d/%d", len(got.Answers), len(got.Authority), len(got.Additional))
+	}
+	if ip := got.Answers[0].Data.(dnsmsg.A).IP; !ip.Equal(net.ParseIP("10.0.0.5")) {
+		t.Fatalf("A record: %v", ip)
+	}
+	if ip := got.Answers[1].Data.(dnsmsg.AAAA).IP; !ip.Equal(net.ParseIP("fd00::5")) {
+		t.Fatalf("AAAA record: %v", ip)
+	}
+	for i := 2; i < len(m.Answers); i++ {
+		if !reflect.DeepEqual(got.Answers[i], m.Answers[i]) {
+			t.Fatalf("answer %d: %+v != %+v", i, got.Answers[i], m.Answers[i])
+		}
+	}
+	if !reflect.DeepEqual(got.Authority, m.Authority) || !reflect.DeepEqual(got.Additional, m.Additional) {
+		t.Fatalf("authority/additional mismatch: %+v %+v", got.Authority, got.Additional)
+	}
+	if got.EDNS == nil || got.EDNS.UDPSize != 1232 || !got.EDNS.DNSSECOK || len(got.EDNS.Options) != 1 {
+		t.Fatalf("EDNS mismatch: %+v", got.EDNS)
+	}
+	if got.MaxUDPSize() != 1232 {
+		t.Fatalf("MaxUDPSize = %d", got.MaxUDPSize())
+	}
+
+	// Compression keeps repeated names to a pointer, except for the SRV
+	// target which RFC 2782 keeps uncompressed
+	full := []byte("\x05share\x01n\x00")
+	if n := bytes.Count(wire, full); n != 2 {
+		t.Fatalf("share.n written %d times in full", n)
+	}
+	if !bytes.Contains(wire, append([]byte{0x1f, 0x91}, full...)) {
+		t.Fatal("SRV target was compressed")
+	}
+}
+
+func TestNames(t *testing.T) {
+	m := &dnsmsg.Message{Questions: []dnsmsg.Question{
+		{Name: `odd\.label\032x.N.`, Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET},
+		{Name: ".", Type: dnsmsg.TypeNS, Class: dnsmsg.ClassINET},
+	}}
+	wire, err := m.Pack()
+	if err != nil {
+		t.Fatalf("Pack failed: %v", err)
+	}
+	got, err := dnsmsg.Parse(wire)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if got.Questions[0].Name != `odd\.label\032x.N` || got.Questions[1].Name != "." {
+		t.Fatalf("names: %q %q", got.Questions[0].Name, got.Questions[1].Name)
+	}
+	if c := dnsmsg.CanonicalName("Share.N."); c != "share.n" {
+		t.Fatalf("CanonicalName = %q", c)
+	}
+	if l := dnsmsg.EscapeLabel("Nexa Storage v1.2"); l != `Nexa\032Storage\032v1\.2` {
+		t.Fatalf("EscapeLabel = %q", l)
+	}
+
+	bad := []string{"a..b", string(make([]byte, 64)) + ".n", `trailing\`}
+	for _, name := range bad {
+		m := &dnsmsg.Message{Questions: []dnsmsg.Question{{Name: name, Type: dnsmsg.TypeA}}}
+		if _, err := m.Pack(); err == nil {
+			t.Fatalf("Pack accepted %q", name)
+		}
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	header := []byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0} // one question
+
+	cases := map[string]struct {
+		body []byte
+		want error
+	}{
+		"truncated label":  {[]byte{5, 's', 'h'}, dnsmsg.ErrShortBuffer},
+		"missing type":     {[]byte{1, 'n', 0, 0}, dnsmsg.ErrShortBuffer},
+		"self pointer":     {[]byte{0xC0, 12, 0, 1, 0, 1}, dnsmsg.ErrBadPointer},
+		"forward pointer":  {[]byte{0xC0, 40, 0, 1, 0, 1}, dnsmsg.ErrBadPointer},
+		"reserved label":   {[]byte{0x40, 0, 1, 0, 1}, dnsmsg.ErrBadLabel},
+		"dangling pointer": {[]byte{0xC0}, dnsmsg.ErrShortBuffer},
+	}
+	for name, tc := range cases {
+		_, err := dnsmsg.Parse(append(append([]byte(nil), header...), tc.body...))
+		if !errors.Is(err, tc.want) {
+			t.Fatalf("%s: got %v, want %v", name, err, tc.want)
+		}
+	}
+
+	// Two pointers bouncing between each other must not loop
+	loop := append(append([]byte(nil), header...), 1, 'a', 0xC0, 12, 0, 1, 0, 1)
+	loop[5] = 1
+	if _, err := dnsmsg.Parse(loop); !errors.Is(err, dnsmsg.ErrBadPointer) {
+		t.Fatalf("pointer loop: %v", err)
+	}
+
+	if _, err := dnsmsg.Parse(header[:5]); !errors.Is(err, dnsmsg.ErrShortBuffer) {
+		t.Fatalf("short header: %v", err)
+	}
+	if _, err := dnsmsg.ParseHeader(header); err != nil {
+		t.Fatalf("ParseHeader: %v", err)
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	m := &dnsmsg.Message{Header: dnsmsg.Header{ID: 1, Response: true}}
+	for i := 0; i < 100; i++ {
+		m.Answers = append(m.Answers, dnsmsg.RR{
+			Name: "many.n", Class: dnsmsg.ClassINET, TTL: 60,
+			Data: dnsmsg.TXT{Strings: []string{"some fairly long text to fill up the packet"}},
+		})
+	}
+	wire, err := m.Truncate(dnsmsg.MinUDPSize)
+	if err != nil {
+		t.Fatalf("Truncate failed: %v", err)
+	}
+	if len(wire) > dnsmsg.MinUDPSize {
+		t.Fatalf("reply is %d bytes", len(wire))
+	}
+	got, err := dnsmsg.Parse(wire)
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	if !got.Truncated || len(got.Answers) == 0 || len(got.Answers) == 100 {
+		t.Fatalf("TC=%v with %d answers", got.Truncated, len(got.Answers))
+	}
+}
+
+func TestReply(t *testing.T) {
+	q := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 42, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: "dash.n", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+		EDNS:      &dnsmsg.EDNS{UDPSize: 4096},
+	}
+	r := q.Reply()
+	if r.ID != 42 || !r.Response || !r.RecursionDesired || len(r.Questions) != 1 {
+		t.Fatalf("reply header: %+v", r.Header)
+	}
+	if r.EDNS == nil || r.EDNS.UDPSize != dnsmsg.DefaultEDNSSize {
+		t.Fatalf("reply EDNS: %+v", r.EDNS)
+	}
+	r.RCode = dnsmsg.RCodeBadVersion
+	r.EDNS = nil
+	if _, err := r.Pack(); err == nil {
+		t.Fatal("extended rcode packed without EDNS")
+	}
+	if s := dnsmsg.RCodeString(dnsmsg.RCodeNameError); s != "NXDOMAIN" {
+		t.Fatalf("RCodeString = %q", s)
+	}
+	if s := dnsmsg.RCodeString(23); s != "RCODE23" {
+		t.Fatalf("RCodeString = %q", s)
+	}
+}
+
+// FuzzParse feeds arbitrary bytes to the parser. Whatever parses must pack
+// again, and packing is stable from then on.
+func FuzzParse(f *testing.F) {
+	wire, err := sampleMessage().Pack()
+	if err != nil {
+		f.Fatal(err)
+	}
+	f.Add(wire)
+	f.Add([]byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0, 4, 'd', 'a', 's', 'h', 1, 'n', 0, 0, 1, 0, 1})
+	f.Add([]byte{0, 1, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0xC0, 12, 0, 1, 0, 1})
+	f.Add([]byte{0, 0, 0x84, 0, 0, 0, 0, 1, 0, 0, 0, 0, 4, 'n', 'e', 'x', 'a', 5, 'l', 'o', 'c', 'a', 'l', 0, 0, 1, 0x80, 1, 0, 0, 0, 120, 0, 4, 10, 0, 0, 1})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		m, err := dnsmsg.Parse(data)
+		if err != nil {
+			return
+		}
+		first, err := m.Pack()
+		if err != nil {
+			t.Fatalf("parsed message does not pack: %v", err)
+		}
+		again, err := dnsmsg.Parse(first)
+		if err != nil {
+			t.Fatalf("packed message does not parse: %v", err)
+		}
+		second, err := again.Pack()
+		if err != nil {
+			t.Fatalf("second pack failed: %v", err)
+		}
+		if !bytes.Equal(first, second) {
+			t.Fatalf("pack is not stable:\n%x\n%x", first, second)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// EDNS is the EDNS(0) pseudo-record (RFC 6891) carried as OPT in the
+// additional section
+type EDNS struct {
+	UDPSize  uint16 // largest UDP payload the sender accepts
+	Version  uint8
+	DNSSECOK bool
+	Options  []EDNSOption
+
+	extRCode uint8 // upper rcode bits, merged into Header.RCode by Parse
+}
+
+// EDNSOption is one option of the OPT record, e.g. a client subnet or cookie
+type EDNSOption struct {
+	Code uint16
+	Data []byte
+}
+
+func readEDNS(data []byte, class uint16, ttl uint32) (*EDNS, error) {
+	e := &EDNS{
+		UDPSize:  class,
+		extRCode: uint8(ttl >> 24),
+		Version:  uint8(ttl >> 16),
+		DNSSECOK: ttl&(1<<15) != 0,
+	}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, ErrShortBuffer
+		}
+		code := binary.BigEndian.Uint16(data)
+		n := int(binary.BigEndian.Uint16(data[2:]))
+		if 4+n > len(data) {
+			return nil, ErrShortBuffer
+		}
+		e.Options = append(e.Options, EDNSOption{Code: code, Data: append([]byte(nil), data[4:4+n]...)})
+		data = data[4+n:]
+	}
+	return e, nil
+}
+
+func (e *EDNS) pack(b []byte, extRCode uint8) ([]byte, error) {
+	ttl := uint32(extRCode)<<24 | uint32(e.Version)<<16
+	if e.DNSSECOK {
+		ttl |= 1 << 15
+	}
+	b = append(b, 0) // root owner name
+	b = binary.BigEndian.AppendUint16(b, uint16(TypeOPT))
+	b = binary.BigEndian.AppendUint16(b, e.UDPSize)
+	b = binary.BigEndian.AppendUint32(b, ttl)
+	at := len(b)
+	b = append(b, 0, 0)
+	for _, o := range e.Options {
+		if len(o.Data) > 0xFFFF {
+			return nil, fmt.Errorf("dnsmsg: EDNS option %d too long", o.Code)
+		}
+		b = binary.BigEndian.AppendUint16(b, o.Code)
+		b = binary.BigEndian.AppendUint16(b, uint16(len(o.Data)))
+		b = append(b, o.Data...)
+	}
+	n := len(b) - at - 2
+	if n > 0xFFFF {
+		return nil, fmt.Errorf("dnsmsg: OPT record too long")
+	}
+	binary.BigEndian.PutUint16(b[at:], uint16(n))
+	return b, nil
+}
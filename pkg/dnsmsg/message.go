@@ -0,0 +1,293 @@
+// Package dnsmsg encodes and decodes DNS messages in the RFC 1035 wire format,
+// including name compression, typed resource records and EDNS(0) (RFC 6891).
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+)
+
+const (
+	headerLen = 12
+
+	// MinUDPSize is the payload every DNS client must accept over UDP
+	MinUDPSize = 512
+	// DefaultEDNSSize is the UDP payload size advertised in replies
+	DefaultEDNSSize = 1232
+)
+
+var (
+	// ErrShortBuffer is returned when a message ends in the middle of a field
+	ErrShortBuffer = errors.New("dnsmsg: message too short")
+	// ErrTrailingData is returned when a record's data is longer than its type allows
+	ErrTrailingData = errors.New("dnsmsg: trailing data")
+)
+
+// Opcodes
+const (
+	OpcodeQuery  uint8 = 0
+	OpcodeStatus uint8 = 2
+	OpcodeNotify uint8 = 4
+	OpcodeUpdate uint8 = 5
+)
+
+// Response codes. Codes above 15 need EDNS to be sent.
+const (
+	RCodeSuccess        uint16 = 0
+	RCodeFormatError    uint16 = 1
+	RCodeServerFailure  uint16 = 2
+	RCodeNameError      uint16 = 3 // NXDOMAIN
+	RCodeNotImplemented uint16 = 4
+	RCodeRefused        uint16 = 5
+	RCodeBadVersion     uint16 = 16
+)
+
+var rcodeNames = map[uint16]string{
+	RCodeSuccess: "NOERROR", RCodeFormatError: "FORMERR", RCodeServerFailure: "SERVFAIL",
+	RCodeNameError: "NXDOMAIN", RCodeNotImplemented: "NOTIMP", RCodeRefused: "REFUSED", RCodeBadVersion: "BADVERS",
+}
+
+// RCodeString returns the mnemonic of a response code, e.g. NXDOMAIN
+func RCodeString(rcode uint16) string {
+	if s, ok := rcodeNames[rcode]; ok {
+		return s
+	}
+	return "RCODE" + strconv.Itoa(int(rcode))
+}
+
+// Header holds the message ID and flags. RCode is the full 12-bit response
+// code; its upper 8 bits travel in the EDNS record.
+type Header struct {
+	ID                 uint16
+	Response           bool
+	Opcode             uint8
+	Authoritative      bool
+	Truncated          bool
+	RecursionDesired   bool
+	RecursionAvailable bool
+	AuthenticData      bool
+	CheckingDisabled   bool
+	RCode              uint16
+}
+
+func (h Header) flags() uint16 {
+	f := uint16(h.Opcode&0xF)<<11 | h.RCode&0xF
+	if h.Response {
+		f |= 1 << 15
+	}
+	if h.Authoritative {
+		f |= 1 << 10
+	}
+	if h.Truncated {
+		f |= 1 << 9
+	}
+	if h.RecursionDesired {
+		f |= 1 << 8
+	}
+	if h.RecursionAvailable {
+		f |= 1 << 7
+	}
+	if h.AuthenticData {
+		f |= 1 << 5
+	}
+	if h.CheckingDisabled {
+		f |= 1 << 4
+	}
+	return f
+}
+
+func (h *Header) setFlags(f uint16) {
+	h.Response = f&(1<<15) != 0
+	h.Opcode = uint8(f>>11) & 0xF
+	h.Authoritative = f&(1<<10) != 0
+	h.Truncated = f&(1<<9) != 0
+	h.RecursionDesired = f&(1<<8) != 0
+	h.RecursionAvailable = f&(1<<7) != 0
+	h.AuthenticData = f&(1<<5) != 0
+	h.CheckingDisabled = f&(1<<4) != 0
+	h.RCode = f & 0xF
+}
+
+// Question is one entry of the question section
+type Question struct {
+	Name  string
+	Type  Type
+	Class Class
+}
+
+// Message is a complete DNS message. The EDNS OPT record is lifted out of
+// the additional section into EDNS.
+type Message struct {
+	Header
+	Questions  []Question
+	Answers    []RR
+	Authority  []RR
+	Additional []RR
+	EDNS       *EDNS
+}
+
+// ParseHeader decodes only the fixed header, e.g. to answer FORMERR for a
+// message whose body does not parse
+func ParseHeader(msg []byte) (Header, error) {
+	var h Header
+	if len(msg) < headerLen {
+		return h, ErrShortBuffer
+	}
+	h.ID = binary.BigEndian.Uint16(msg)
+	h.setFlags(binary.BigEndian.Uint16(msg[2:]))
+	return h, nil
+}
+
+// Parse decodes a wire-format message. It never reads outside msg.
+func Parse(msg []byte) (*Message, error) {
+	h, err := ParseHeader(msg)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{Header: h}
+	counts := [4]int{}
+	for i := range counts {
+		counts[i] = int(binary.BigEndian.Uint16(msg[4+2*i:]))
+	}
+
+	off := headerLen
+	for i := 0; i < counts[0]; i++ {
+		var q Question
+		q.Name, off, err = readName(msg, off)
+		if err != nil {
+			return nil, fmt.Errorf("question %d: %w", i, err)
+		}
+		if off+4 > len(msg) {
+			return nil, ErrShortBuffer
+		}
+		q.Type = Type(binary.BigEndian.Uint16(msg[off:]))
+		q.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+		off += 4
+		m.Questions = append(m.Questions, q)
+	}
+
+	sections := []*[]RR{&m.Answers, &m.Authority, &m.Additional}
+	for s, sec := range sections {
+		for i := 0; i < counts[s+1]; i++ {
+			var rr RR
+			var opt *EDNS
+			rr, opt, off, err = readRR(msg, off, s == 2)
+			if err != nil {
+				return nil, fmt.Errorf("record %d: %w", i, err)
+			}
+			if opt != nil {
+				if m.EDNS != nil {
+					return nil, fmt.Errorf("dnsmsg: more than one OPT record")
+				}
+				m.EDNS = opt
+				m.RCode |= uint16(opt.extRCode) << 4
+				continue
+			}
+			*sec = append(*sec, rr)
+		}
+	}
+	return m, nil
+}
+
+// Pack encodes m, compressing names where RFC 1035 allows it
+func (m *Message) Pack() ([]byte, error) {
+	if m.RCode > 0xF && m.EDNS == nil {
+		return nil, fmt.Errorf("dnsmsg: rcode %d needs EDNS", m.RCode)
+	}
+	additional := len(m.Additional)
+	if m.EDNS != nil {
+		additional++
+	}
+	counts := []int{len(m.Questions), len(m.Answers), len(m.Authority), additional}
+
+	b := make([]byte, headerLen, MinUDPSize)
+	binary.BigEndian.PutUint16(b, m.ID)
+	binary.BigEndian.PutUint16(b[2:], m.flags())
+	for i, n := range counts {
+		if n > 0xFFFF {
+			return nil, fmt.Errorf("dnsmsg: too many records in section %d", i)
+		}
+		binary.BigEndian.PutUint16(b[4+2*i:], uint16(n))
+	}
+
+	comp := make(compression)
+	var err error
+	for _, q := range m.Questions {
+		if b, err = packName(b, q.Name, comp); err != nil {
+			return nil, err
+		}
+		b = binary.BigEndian.AppendUint16(b, uint16(q.Type))
+		b = binary.BigEndian.AppendUint16(b, uint16(q.Class))
+	}
+	for _, sec := range [][]RR{m.Answers, m.Authority, m.Additional} {
+		for _, rr := range sec {
+			if b, err = rr.pack(b, comp); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if m.EDNS != nil {
+		if b, err = m.EDNS.pack(b, uint8(m.RCode>>4)); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Truncate packs m into at most limit bytes. Additional records are dropped
+// first; if answers or authority records have to go as well, TC is set so
+// the client retries over TCP.
+func (m *Message) Truncate(limit int) ([]byte, error) {
+	b, err := m.Pack()
+	if err != nil || len(b) <= limit {
+		return b, err
+	}
+	t := *m
+	for len(b) > limit {
+		switch {
+		case len(t.Additional) > 0:
+			t.Additional = t.Additional[:len(t.Additional)-1]
+		case len(t.Authority) > 0:
+			t.Authority = t.Authority[:len(t.Authority)-1]
+			t.Truncated = true
+		case len(t.Answers) > 0:
+			t.Answers = t.Answers[:len(t.Answers)-1]
+			t.Truncated = true
+		default:
+			return nil, fmt.Errorf("dnsmsg: message does not fit in %d bytes", limit)
+		}
+		if b, err = t.Pack(); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// Reply starts a response to m: same ID, opcode, RD flag and questions, with
+// EDNS echoed if the query used it
+func (m *Message) Reply() *Message {
+	r := &Message{
+		Header: Header{
+			ID:               m.ID,
+			Response:         true,
+			Opcode:           m.Opcode,
+			RecursionDesired: m.RecursionDesired,
+			CheckingDisabled: m.CheckingDisabled,
+		},
+		Questions: append([]Question(nil), m.Questions...),
+	}
+	if m.EDNS != nil {
+		r.EDNS = &EDNS{UDPSize: DefaultEDNSSize, DNSSECOK: m.EDNS.DNSSECOK}
+	}
+	return r
+}
+
+// MaxUDPSize is the largest UDP reply the sender of m accepts
+func (m *Message) MaxUDPSize() int {
+	if m.EDNS == nil || m.EDNS.UDPSize < MinUDPSize {
+		return MinUDPSize
+	}
+	return int(m.EDNS.UDPSize)
+}
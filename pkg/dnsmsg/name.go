@@ -0,0 +1,218 @@
+package dnsmsg
+
+import (
+	"errors"
+	"strings"
+)
+
+const (
+	maxLabelLen = 63
+	maxNameLen  = 255 // wire length including length octets and the root label
+	maxPointer  = 0x3FFF
+)
+
+var (
+	// ErrLabelTooLong is returned for labels over 63 octets
+	ErrLabelTooLong = errors.New("dnsmsg: label too long")
+	// ErrNameTooLong is returned for names over 255 octets on the wire
+	ErrNameTooLong = errors.New("dnsmsg: name too long")
+	// ErrBadPointer is returned for compression pointers that do not point
+	// strictly backwards, which also rules out pointer loops
+	ErrBadPointer = errors.New("dnsmsg: bad compression pointer")
+	// ErrBadLabel is returned for the reserved 0x40 and 0x80 label types
+	ErrBadLabel = errors.New("dnsmsg: bad label type")
+	// ErrBadName is returned for names that cannot be encoded, e.g. with empty labels
+	ErrBadName = errors.New("dnsmsg: bad name")
+)
+
+// compression maps lower-cased name suffixes (in wire form) to their offset
+type compression map[string]int
+
+// readName decodes the name at off and returns it in presentation form
+// without the trailing dot ("." for the root), plus the offset after it.
+// Dots, backslashes and unprintable bytes inside labels are escaped.
+func readName(msg []byte, off int) (string, int, error) {
+	var sb strings.Builder
+	next := -1   // offset after the name once a pointer was followed
+	limit := off // every pointer must land before the previous one
+	wireLen := 1 // the root label
+	for {
+		if off >= len(msg) {
+			return "", 0, ErrShortBuffer
+		}
+		c := int(msg[off])
+		switch c & 0xC0 {
+		case 0x00:
+			if c == 0 {
+				if next < 0 {
+					next = off + 1
+				}
+				if sb.Len() == 0 {
+					return ".", next, nil
+				}
+				return sb.String(), next, nil
+			}
+			if off+1+c > len(msg) {
+				return "", 0, ErrShortBuffer
+			}
+			wireLen += 1 + c
+			if wireLen > maxNameLen {
+				return "", 0, ErrNameTooLong
+			}
+			if sb.Len() > 0 {
+				sb.WriteByte('.')
+			}
+			escapeLabel(&sb, msg[off+1:off+1+c])
+			off += 1 + c
+		case 0xC0:
+			if off+1 >= len(msg) {
+				return "", 0, ErrShortBuffer
+			}
+			ptr := (c&0x3F)<<8 | int(msg[off+1])
+			if ptr >= limit {
+				return "", 0, ErrBadPointer
+			}
+			if next < 0 {
+				next = off + 2
+			}
+			limit, off = ptr, ptr
+		default:
+			return "", 0, ErrBadLabel
+		}
+	}
+}
+
+func escapeLabel(sb *strings.Builder, label []byte) {
+	for _, b := range label {
+		switch {
+		case b == '.' || b == '\\':
+			sb.WriteByte('\\')
+			sb.WriteByte(b)
+		case b < 0x21 || b > 0x7E:
+			sb.WriteByte('\\')
+			sb.WriteByte('0' + b/100)
+			sb.WriteByte('0' + b/10%10)
+			sb.WriteByte('0' + b%10)
+		default:
+			sb.WriteByte(b)
+		}
+	}
+}
+
+// splitName turns a presentation-form name into raw labels. "" and "." are the root.
+func splitName(name string) ([][]byte, error) {
+	if name == "" || name == "." {
+		return nil, nil
+	}
+	var labels [][]byte
+	var cur []byte
+	wireLen := 1
+	end := func() error {
+		if len(cur) == 0 {
+			return ErrBadName
+		}
+		if len(cur) > maxLabelLen {
+			return ErrLabelTooLong
+		}
+		wireLen += 1 + len(cur)
+		if wireLen > maxNameLen {
+			return ErrNameTooLong
+		}
+		labels = append(labels, cur)
+		cur = nil
+		return nil
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c == '\\':
+			if i+1 >= len(name) {
+				return nil, ErrBadName
+			}
+			if isDigit(name[i+1]) {
+				if i+3 >= len(name) || !isDigit(name[i+2]) || !isDigit(name[i+3]) {
+					return nil, ErrBadName
+				}
+				v := int(name[i+1]-'0')*100 + int(name[i+2]-'0')*10 + int(name[i+3]-'0')
+				if v > 0xFF {
+					return nil, ErrBadName
+				}
+				cur = append(cur, byte(v))
+				i += 3
+			} else {
+				cur = append(cur, name[i+1])
+				i++
+			}
+		case c == '.':
+			if err := end(); err != nil {
+				return nil, err
+			}
+			if i == len(name)-1 {
+				return labels, nil // fully qualified
+			}
+		default:
+			cur = append(cur, c)
+		}
+	}
+	if err := end(); err != nil {
+		return nil, err
+	}
+	return labels, nil
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// packName appends name to b, which must hold the message from its first
+// byte. With comp set, known suffixes are replaced by pointers and new ones
+// are recorded.
+func packName(b []byte, name string, comp compression) ([]byte, error) {
+	labels, err := splitName(name)
+	if err != nil {
+		return nil, err
+	}
+	for i := range labels {
+		var key string
+		if comp != nil {
+			key = suffixKey(labels[i:])
+			if ptr, ok := comp[key]; ok {
+				return append(b, byte(0xC0|ptr>>8), byte(ptr)), nil
+			}
+			if len(b) <= maxPointer {
+				comp[key] = len(b)
+			}
+		}
+		b = append(b, byte(len(labels[i])))
+		b = append(b, labels[i]...)
+	}
+	return append(b, 0), nil
+}
+
+func suffixKey(labels [][]byte) string {
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteByte(byte(len(l)))
+		for _, c := range l {
+			if c >= 'A' && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String()
+}
+
+// EscapeLabel turns free text such as a DNS-SD instance name ("Nexa
+// Storage") into a single label in presentation form
+func EscapeLabel(label string) string {
+	var sb strings.Builder
+	escapeLabel(&sb, []byte(label))
+	return sb.String()
+}
+
+// CanonicalName lower-cases name and strips the trailing dot, the form used
+// for lookups
+func CanonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
@@ -0,0 +1,359 @@
+package dnsmsg
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// Type is a resource record type
+type Type uint16
+
+// Record types
+const (
+	TypeA     Type = 1
+	TypeNS    Type = 2
+	TypeCNAME Type = 5
+	TypeSOA   Type = 6
+	TypePTR   Type = 12
+	TypeMX    Type = 15
+	TypeTXT   Type = 16
+	TypeAAAA  Type = 28
+	TypeSRV   Type = 33
+	TypeOPT   Type = 41
+	TypeANY   Type = 255
+)
+
+var typeNames = map[Type]string{
+	TypeA: "A", TypeNS: "NS", TypeCNAME: "CNAME", TypeSOA: "SOA", TypePTR: "PTR",
+	TypeMX: "MX", TypeTXT: "TXT", TypeAAAA: "AAAA", TypeSRV: "SRV", TypeOPT: "OPT", TypeANY: "ANY",
+}
+
+func (t Type) String() string {
+	if s, ok := typeNames[t]; ok {
+		return s
+	}
+	return "TYPE" + strconv.Itoa(int(t))
+}
+
+// Class is a resource record class. mDNS reuses its top bit as the
+// unicast-response flag in questions and the cache-flush flag in records.
+type Class uint16
+
+// Classes
+const (
+	ClassINET Class = 1
+	ClassANY  Class = 255
+)
+
+// RR is a resource record. Its type comes from Data.
+type RR struct {
+	Name  string
+	Class Class
+	TTL   uint32
+	Data  RData
+}
+
+// Type returns the record type
+func (rr RR) Type() Type {
+	return rr.Data.Type()
+}
+
+// RData is the typed data of a resource record
+type RData interface {
+	Type() Type
+	pack(b []byte, comp compression) ([]byte, error)
+}
+
+// A is an IPv4 address record
+type A struct {
+	IP net.IP
+}
+
+// AAAA is an IPv6 address record
+type AAAA struct {
+	IP net.IP
+}
+
+// NS names an authoritative name server
+type NS struct {
+	Host string
+}
+
+// CNAME aliases the owner name to Target
+type CNAME struct {
+	Target string
+}
+
+// PTR points to another name, e.g. for reverse lookups and DNS-SD
+type PTR struct {
+	Target string
+}
+
+// MX names a mail exchanger
+type MX struct {
+	Preference uint16
+	Host       string
+}
+
+// TXT holds one or more character strings of up to 255 bytes each
+type TXT struct {
+	Strings []string
+}
+
+// SRV locates a service (RFC 2782)
+type SRV struct {
+	Priority uint16
+	Weight   uint16
+	Port     uint16
+	Target   string
+}
+
+// SOA marks the start of a zone of authority
+type SOA struct {
+	NS      string
+	MBox    string
+	Serial  uint32
+	Refresh uint32
+	Retry   uint32
+	Expire  uint32
+	MinTTL  uint32
+}
+
+// Unknown carries the raw data of a type this package does not decode (RFC 3597)
+type Unknown struct {
+	RRType Type
+	Data   []byte
+}
+
+func (A) Type() Type         { return TypeA }
+func (AAAA) Type() Type      { return TypeAAAA }
+func (NS) Type() Type        { return TypeNS }
+func (CNAME) Type() Type     { return TypeCNAME }
+func (PTR) Type() Type       { return TypePTR }
+func (MX) Type() Type        { return TypeMX }
+func (TXT) Type() Type       { return TypeTXT }
+func (SRV) Type() Type       { return TypeSRV }
+func (SOA) Type() Type       { return TypeSOA }
+func (u Unknown) Type() Type { return u.RRType }
+
+func (r A) pack(b []byte, _ compression) ([]byte, error) {
+	ip := r.IP.To4()
+	if ip == nil {
+		return nil, fmt.Errorf("dnsmsg: %v is not an IPv4 address", r.IP)
+	}
+	return append(b, ip...), nil
+}
+
+func (r AAAA) pack(b []byte, _ compression) ([]byte, error) {
+	ip := r.IP.To16()
+	if ip == nil {
+		return nil, fmt.Errorf("dnsmsg: %v is not an IPv6 address", r.IP)
+	}
+	return append(b, ip...), nil
+}
+
+func (r NS) pack(b []byte, comp compression) ([]byte, error) {
+	return packName(b, r.Host, comp)
+}
+
+func (r CNAME) pack(b []byte, comp compression) ([]byte, error) {
+	return packName(b, r.Target, comp)
+}
+
+func (r PTR) pack(b []byte, comp compression) ([]byte, error) {
+	return packName(b, r.Target, comp)
+}
+
+func (r MX) pack(b []byte, comp compression) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Preference)
+	return packName(b, r.Host, comp)
+}
+
+func (r TXT) pack(b []byte, _ compression) ([]byte, error) {
+	if len(r.Strings) == 0 {
+		return append(b, 0), nil // a TXT record holds at least one string
+	}
+	for _, s := range r.Strings {
+		if len(s) > 0xFF {
+			return nil, fmt.Errorf("dnsmsg: TXT string longer than 255 bytes")
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	return b, nil
+}
+
+func (r SRV) pack(b []byte, _ compression) ([]byte, error) {
+	b = binary.BigEndian.AppendUint16(b, r.Priority)
+	b = binary.BigEndian.AppendUint16(b, r.Weight)
+	b = binary.BigEndian.AppendUint16(b, r.Port)
+	return packName(b, r.Target, nil) // RFC 2782 forbids compressing the target
+}
+
+func (r SOA) pack(b []byte, comp compression) ([]byte, error) {
+	b, err := packName(b, r.NS, comp)
+	if err != nil {
+		return nil, err
+	}
+	if b, err = packName(b, r.MBox, comp); err != nil {
+		return nil, err
+	}
+	for _, v := range []uint32{r.Serial, r.Refresh, r.Retry, r.Expire, r.MinTTL} {
+		b = binary.BigEndian.AppendUint32(b, v)
+	}
+	return b, nil
+}
+
+func (r Unknown) pack(b []byte, _ compression) ([]byte, error) {
+	return append(b, r.Data...), nil
+}
+
+func (rr RR) pack(b []byte, comp compression) ([]byte, error) {
+	if rr.Data == nil {
+		return nil, fmt.Errorf("dnsmsg: record %s has no data", rr.Name)
+	}
+	b, err := packName(b, rr.Name, comp)
+	if err != nil {
+		return nil, err
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(rr.Type()))
+	b = binary.BigEndian.AppendUint16(b, uint16(rr.Class))
+	b = binary.BigEndian.AppendUint32(b, rr.TTL)
+	return packRData(b, rr.Data, comp)
+}
+
+// packRData appends the length-prefixed record data
+func packRData(b []byte, d RData, comp compression) ([]byte, error) {
+	at := len(b)
+	b = append(b, 0, 0)
+	b, err := d.pack(b, comp)
+	if err != nil {
+		return nil, err
+	}
+	n := len(b) - at - 2
+	if n > 0xFFFF {
+		return nil, fmt.Errorf("dnsmsg: record data too long")
+	}
+	binary.BigEndian.PutUint16(b[at:], uint16(n))
+	return b, nil
+}
+
+// readRR decodes the record at off. In the additional section an OPT
+// record is returned as EDNS instead.
+func readRR(msg []byte, off int, additional bool) (RR, *EDNS, int, error) {
+	var rr RR
+	name, off, err := readName(msg, off)
+	if err != nil {
+		return rr, nil, 0, err
+	}
+	if off+10 > len(msg) {
+		return rr, nil, 0, ErrShortBuffer
+	}
+	typ := Type(binary.BigEndian.Uint16(msg[off:]))
+	rr.Name = name
+	rr.Class = Class(binary.BigEndian.Uint16(msg[off+2:]))
+	rr.TTL = binary.BigEndian.Uint32(msg[off+4:])
+	n := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	end := off + n
+	if end > len(msg) {
+		return rr, nil, 0, ErrShortBuffer
+	}
+
+	if typ == TypeOPT && additional {
+		if name != "." {
+			return rr, nil, 0, fmt.Errorf("dnsmsg: OPT record owner must be the root")
+		}
+		e, err := readEDNS(msg[off:end], uint16(rr.Class), rr.TTL)
+		return rr, e, end, err
+	}
+	rr.Data, err = readRData(msg, off, end, typ)
+	return rr, nil, end, err
+}
+
+func readRData(msg []byte, off, end int, typ Type) (RData, error) {
+	data := msg[off:end]
+	var d RData
+	var err error
+	switch typ {
+	case TypeA:
+		if len(data) != net.IPv4len {
+			return nil, fmt.Errorf("dnsmsg: A record of %d bytes", len(data))
+		}
+		return A{IP: net.IP(append([]byte(nil), data...))}, nil
+	case TypeAAAA:
+		if len(data) != net.IPv6len {
+			return nil, fmt.Errorf("dnsmsg: AAAA record of %d bytes", len(data))
+		}
+		return AAAA{IP: net.IP(append([]byte(nil), data...))}, nil
+	case TypeNS, TypeCNAME, TypePTR:
+		var name string
+		name, off, err = readName(msg[:end], off)
+		switch typ {
+		case TypeNS:
+			d = NS{Host: name}
+		case TypeCNAME:
+			d = CNAME{Target: name}
+		default:
+			d = PTR{Target: name}
+		}
+	case TypeMX:
+		if len(data) < 2 {
+			return nil, ErrShortBuffer
+		}
+		mx := MX{Preference: binary.BigEndian.Uint16(data)}
+		mx.Host, off, err = readName(msg[:end], off+2)
+		d = mx
+	case TypeSRV:
+		if len(data) < 6 {
+			return nil, ErrShortBuffer
+		}
+		srv := SRV{
+			Priority: binary.BigEndian.Uint16(data),
+			Weight:   binary.BigEndian.Uint16(data[2:]),
+			Port:     binary.BigEndian.Uint16(data[4:]),
+		}
+		srv.Target, off, err = readName(msg[:end], off+6)
+		d = srv
+	case TypeSOA:
+		var soa SOA
+		if soa.NS, off, err = readName(msg[:end], off); err != nil {
+			return nil, err
+		}
+		if soa.MBox, off, err = readName(msg[:end], off); err != nil {
+			return nil, err
+		}
+		if off+20 > end {
+			return nil, ErrShortBuffer
+		}
+		v := make([]uint32, 5)
+		for i := range v {
+			v[i] = binary.BigEndian.Uint32(msg[off+4*i:])
+		}
+		soa.Serial, soa.Refresh, soa.Retry, soa.Expire, soa.MinTTL = v[0], v[1], v[2], v[3], v[4]
+		off += 20
+		d = soa
+	case TypeTXT:
+		var txt TXT
+		for len(data) > 0 {
+			l := int(data[0])
+			if 1+l > len(data) {
+				return nil, ErrShortBuffer
+			}
+			txt.Strings = append(txt.Strings, string(data[1:1+l]))
+			data = data[1+l:]
+		}
+		return txt, nil
+	default:
+		return Unknown{RRType: typ, Data: append([]byte(nil), data...)}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if off != end {
+		return nil, ErrTrailingData
+	}
+	return d, nil
+}
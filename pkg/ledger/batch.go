@@ -0,0 +1,102 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+)
+
+// OpBatch marks a block whose Ops are applied together
+const OpBatch = "batch"
+
+// ErrPreconditionFailed is returned when a batch compare-and-set check fails
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// BlockOp is one key change inside a batch block
+type BlockOp struct {
+	Op    string `json:"op,omitempty"` // "" for a write, OpDelete to remove the key
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+}
+
+// Precondition is a compare-and-set check on the current value of a key
+type Precondition struct {
+	Key    string `json:"key"`
+	Value  string `json:"value,omitempty"`
+	Absent bool   `json:"absent,omitempty"` // key must not exist
+}
+
+// IsBatch reports whether the block carries several operations
+func (b Block) IsBatch() bool {
+	return b.Op == OpBatch
+}
+
+// Writes returns the key changes a block makes. A single-key block yields
+// one op; checkpoints yield none.
+func (b Block) Writes() []BlockOp {
+	switch {
+	case b.IsCheckpoint():
+		return nil
+	case b.IsBatch():
+		return b.Ops
+	}
+	return []BlockOp{{Op: b.Op, Key: b.Key, Value: b.Value}}
+}
+
+// write returns what the block did to key
+func (b Block) write(key string) BlockOp {
+	for _, w := range b.Writes() {
+		if w.Key == key {
+			return w
+		}
+	}
+	return BlockOp{Key: key}
+}
+
+// CommitBatch checks every precondition against the current state and, if
+// they all hold, appends one block applying all ops. Nothing is written when
+// a check or op is invalid.
+func (bc *Blockchain) CommitBatch(ops []BlockOp, conds []Precondition, validator string) (Block, error) {
+	if len(ops) == 0 {
+		return Block{}, fmt.Errorf("empty batch")
+	}
+
+	bc.lockWrite()
+	defer bc.unlockWrite()
+
+	for _, c := range conds {
+		val, exists := bc.Data[c.Key]
+		if c.Absent && exists {
+			return Block{}, fmt.Errorf("%w: %s exists", ErrPreconditionFailed, c.Key)
+		}
+		if !c.Absent && (!exists || val != c.Value) {
+			return Block{}, fmt.Errorf("%w: %s is not %q", ErrPreconditionFailed, c.Key, c.Value)
+		}
+	}
+
+	seen := make(map[string]bool, len(ops))
+	for _, op := range ops {
+		if op.Key == "" || op.Key == CheckpointKey {
+			return Block{}, fmt.Errorf("invalid key %q", op.Key)
+		}
+		if seen[op.Key] {
+			return Block{}, fmt.Errorf("key %s appears twice in the batch", op.Key)
+		}
+		seen[op.Key] = true
+		switch op.Op {
+		case "":
+		case OpDelete:
+			if _, exists := bc.Data[op.Key]; !exists {
+				return Block{}, fmt.Errorf("key %s not found", op.Key)
+			}
+		default:
+			return Block{}, fmt.Errorf("unknown op %q", op.Op)
+		}
+	}
+
+	b, err := bc.commit(Block{Op: OpBatch, Validator: validator, Ops: ops})
+	if err != nil {
+		return Block{}, err
+	}
+	bc.maybeCheckpoint(validator)
+	return b, nil
+}
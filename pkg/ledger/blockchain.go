@@ -7,19 +7,37 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"time"
 )
 
 // Block represents a single data record in the chain
 type Block struct {
-	Index        int    `json:"index"`
-	Timestamp    string `json:"timestamp"`
-	Key          string `json:"key"`
-	Value        string `json:"value"`
-	PreviousHash string `json:"previous_hash"`
-	Hash         string `json:"hash"`
-	Validator    string `json:"validator"` // Node that validated this
+	Index        int       `json:"index"`
+	Timestamp    string    `json:"timestamp"`
+	Key          string    `json:"key"`
+	Value        string    `json:"value"`
+	PreviousHash string    `json:"previous_hash"`
+	Hash         string    `json:"hash"`
+	Validator    string    `json:"validator"`     // Node that validated this
+	Op           string    `json:"op,omitempty"`  // "" for a write, OpDelete, OpCheckpoint or OpBatch
+	Ops          []BlockOp `json:"ops,omitempty"` // key changes of an OpBatch block
+
+	// Signature fields (empty on legacy unsigned blocks)
+	PublicKey       string `json:"public_key,omitempty"`
+	Signature       string `json:"signature,omitempty"`
+	ClientKey       string `json:"client_key,omitempty"`
+	ClientSignature string `json:"client_signature,omitempty"`
+}
+
+// OpDelete marks a tombstone block that removes its key from the live state
+const OpDelete = "delete"
+
+// IsTombstone reports whether the block deletes its key
+func (b Block) IsTombstone() bool {
+	return b.Op == OpDelete
 }
 
 // Blockchain manages the chain of blocks
@@ -28,76 +46,336 @@ type Blockchain struct {
 	Chain    []Block           `json:"chain"`
 	Data     map[string]string `json:"data"` // Quick lookup
 	Filename string            `json:"-"`
-	saveCh   chan bool         `json:"-"` // Channel for periodic saves
+	store    *SegmentStore
+	identity *NodeIdentity
+	keyIndex map[string][]int // key -> chain positions of every block touching it
+
+	checkpointEvery int // blocks between automatic checkpoints, 0 disables
+	lastCheckpoint  int // chain position of the newest checkpoint, -1 if none
+
+	storeBase int       // block index at position 0 of the block log
+	baseSnap  *Snapshot // snapshot the in-memory chain starts after, nil from genesis
+	snapshot  *Snapshot // latest snapshot taken or loaded
+
+	treeMu       sync.Mutex
+	proofTree    *merkleTree // state tree of the checkpoint with hash proofTreeFor
+	proofTreeFor string      // keyed by hash, as positions move on prune and resync
+
+	commitMu  sync.Mutex    // serializes writers, see lockWrite
+	consensus Consensus     // nil commits blocks locally right away
+	changed   chan struct{} // closed and replaced whenever a block is applied
 }
 
-// NewBlockchain initializes the ledger
+// NewBlockchain initializes the ledger. Blocks are kept in a segmented log in a
+// directory next to filename; a legacy JSON ledger at filename is imported once.
 func NewBlockchain(filename string) (*Blockchain, error) {
 	bc := &Blockchain{
 		Chain:    []Block{},
 		Data:     make(map[string]string),
 		Filename: filename,
-		saveCh:   make(chan bool, 1),
-	}
-
-	// Load from disk
-	if _, err := os.Stat(filename); err == nil {
-		content, err := os.ReadFile(filename)
-		if err == nil {
-			if err := json.Unmarshal(content, bc); err == nil {
-				// Rebuild Data map
-				for _, b := range bc.Chain {
-					bc.Data[b.Key] = b.Value
-				}
-				// Start periodic saving
-				go bc.startPeriodicSave()
-				return bc, nil
-			}
+		keyIndex: make(map[string][]int),
+
+		checkpointEvery: DefaultCheckpointInterval,
+		lastCheckpoint:  -1,
+	}
+
+	store, err := OpenSegmentStore(SegmentDir(filename), DefaultSegmentSize)
+	if err != nil {
+		return nil, err
+	}
+	bc.store = store
+
+	bc.identity, err = LoadOrCreateIdentity(filepath.Join(SegmentDir(filename), "node_key.json"))
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if err := bc.importLegacy(); err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	if store.Len() > 0 {
+		first, err := store.Get(0)
+		if err != nil {
+			store.Close()
+			return nil, err
 		}
+		bc.storeBase = first.Index
 	}
 
-	// Genesis Block
-	bc.AddBlock("genesis", "Nexa Protocol Genesis Block", "SYSTEM")
+	// Start from the snapshot only once the log was pruned to it, or the node
+	// was seeded from the snapshot alone. An unpruned log is replayed in full
+	// so history and versions keep the blocks before the snapshot.
+	snap, err := loadSnapshot(bc.snapshotPath())
+	if err == nil && snap != nil {
+		err = bc.useSnapshot(snap, bc.storeBase > 0 || store.Len() == 0)
+	}
+	if err != nil {
+		if bc.storeBase > 0 {
+			store.Close()
+			return nil, fmt.Errorf("pruned ledger needs a valid snapshot: %v", err)
+		}
+		log.Printf("WARNING: Ignoring ledger snapshot, replaying from genesis: %v", err)
+	}
 
-	// Start periodic saving
-	go bc.startPeriodicSave()
+	// Replay the log to rebuild the in-memory chain and indexes
+	err = store.ForEachFrom(bc.base()-bc.storeBase, func(b Block) error {
+		bc.applyBlock(b)
+		return nil
+	})
+	if err != nil {
+		store.Close()
+		return nil, fmt.Errorf("failed to replay ledger: %v", err)
+	}
+
+	// Genesis Block
+	if bc.height() == 0 {
+		bc.AddBlock("genesis", "Nexa Protocol Genesis Block", "SYSTEM")
+	}
 
 	return bc, nil
 }
 
+// SegmentDir returns the block log directory used for a ledger file name
+func SegmentDir(filename string) string {
+	ext := filepath.Ext(filename)
+	if ext == "" {
+		return filename + ".d"
+	}
+	return strings.TrimSuffix(filename, ext)
+}
+
+// importLegacy copies the blocks of an old whole-file ledger.json into the log
+// and renames the file so it is not imported twice. The file is only renamed
+// once every block is in the log, so an import cut short by a crash resumes
+// after the blocks already written on the next start.
+func (bc *Blockchain) importLegacy() error {
+	content, err := os.ReadFile(bc.Filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read legacy ledger: %v", err)
+	}
+
+	var legacy struct {
+		Chain []Block `json:"chain"`
+	}
+	if err := json.Unmarshal(content, &legacy); err != nil {
+		log.Printf("WARNING: Skipping unreadable legacy ledger %s: %v", bc.Filename, err)
+		return nil
+	}
+
+	done := bc.store.Len()
+	if done > len(legacy.Chain) {
+		done = len(legacy.Chain)
+	}
+	for i := 0; i < done; i++ {
+		b, err := bc.store.Get(i)
+		if err != nil || b.Hash != legacy.Chain[i].Hash {
+			log.Printf("WARNING: Skipping legacy ledger %s, the block log holds other blocks", bc.Filename)
+			return nil
+		}
+	}
+
+	for _, b := range legacy.Chain[done:] {
+		if err := bc.store.Append(b); err != nil {
+			return fmt.Errorf("failed to import block %d: %v", b.Index, err)
+		}
+	}
+	if done > 0 {
+		log.Printf("Resumed import of legacy ledger %s after %d of %d blocks", bc.Filename, done, len(legacy.Chain))
+	} else {
+		log.Printf("Imported %d blocks from legacy ledger %s", len(legacy.Chain), bc.Filename)
+	}
+
+	if err := os.Rename(bc.Filename, bc.Filename+".imported"); err != nil {
+		log.Printf("WARNING: Failed to rename legacy ledger %s: %v", bc.Filename, err)
+	}
+	return nil
+}
+
 // CalculateHash generates a SHA256 hash for a block
 func CalculateHash(b Block) string {
 	record := fmt.Sprintf("%d%s%s%s%s%s", b.Index, b.Timestamp, b.Key, b.Value, b.PreviousHash, b.Validator)
+	// Signed blocks also commit to the signer and client key; for legacy
+	// blocks these are empty and the hash is unchanged.
+	record += b.Op + b.PublicKey + b.ClientKey + b.ClientSignature
+	if len(b.Ops) > 0 {
+		ops, _ := json.Marshal(b.Ops)
+		record += string(ops)
+	}
 	h := sha256.New()
 	h.Write([]byte(record))
 	return hex.EncodeToString(h.Sum(nil))
 }
 
-// AddBlock adds a new data block to the chain
+// Identity returns the keypair this node signs blocks with
+func (bc *Blockchain) Identity() *NodeIdentity {
+	return bc.identity
+}
+
+// AddBlock adds a new data block to the chain, signed by the node identity.
+// If consensus rejects the block or it cannot be persisted the error is
+// logged and a zero Block is returned; AddClientBlock reports it instead.
 func (bc *Blockchain) AddBlock(key, value, validator string) Block {
-	bc.mu.Lock()
-	defer bc.mu.Unlock()
+	bc.lockWrite()
+	defer bc.unlockWrite()
+	b, err := bc.appendBlock(key, value, validator, nil)
+	if err != nil {
+		log.Printf("ERROR: Block for %s not committed: %v", key, err)
+		return Block{}
+	}
+	bc.maybeCheckpoint(validator)
+	return b
+}
 
-	var prevHash string
-	if len(bc.Chain) > 0 {
-		prevHash = bc.Chain[len(bc.Chain)-1].Hash
+// AddClientBlock adds a block carrying a client signature over key=value.
+// The signature is verified before anything is written.
+func (bc *Blockchain) AddClientBlock(key, value, validator string, client *ClientSignature) (Block, error) {
+	if client != nil && !client.Verify(key, value) {
+		return Block{}, ErrBadSignature
+	}
+	bc.lockWrite()
+	defer bc.unlockWrite()
+	b, err := bc.appendBlock(key, value, validator, client)
+	if err != nil {
+		return Block{}, err
 	}
+	bc.maybeCheckpoint(validator)
+	return b, nil
+}
+
+// Delete appends a tombstone for key. The key disappears from Get and Keys
+// but its earlier blocks stay in the chain for History.
+func (bc *Blockchain) Delete(key, validator string) (Block, error) {
+	bc.lockWrite()
+	defer bc.unlockWrite()
 
+	if _, exists := bc.Data[key]; !exists {
+		return Block{}, fmt.Errorf("key %s not found", key)
+	}
+	b, err := bc.appendOp(key, "", OpDelete, validator, nil)
+	if err != nil {
+		return Block{}, err
+	}
+	bc.maybeCheckpoint(validator)
+	return b, nil
+}
+
+func (bc *Blockchain) appendBlock(key, value, validator string, client *ClientSignature) (Block, error) {
+	return bc.appendOp(key, value, "", validator, client)
+}
+
+func (bc *Blockchain) appendOp(key, value, op, validator string, client *ClientSignature) (Block, error) {
 	newBlock := Block{
-		Index:        len(bc.Chain),
-		Timestamp:    time.Now().Format(time.RFC3339),
-		Key:          key,
-		Value:        value,
-		PreviousHash: prevHash,
-		Validator:    validator,
+		Key:       key,
+		Value:     value,
+		Validator: validator,
+		Op:        op,
+	}
+	if client != nil {
+		newBlock.ClientKey = client.PublicKey
+		newBlock.ClientSignature = client.Signature
 	}
-	newBlock.Hash = CalculateHash(newBlock)
+	return bc.commit(newBlock)
+}
 
-	bc.Chain = append(bc.Chain, newBlock)
-	bc.Data[key] = value // Update quick lookup
-	bc.save()
+// lockWrite takes the locks for appending blocks. commitMu keeps other
+// writers out while commit releases bc.mu to wait for consensus, so the
+// index a new block takes stays reserved and readers are not held up by
+// the network.
+func (bc *Blockchain) lockWrite() {
+	bc.commitMu.Lock()
+	bc.mu.Lock()
+}
+
+func (bc *Blockchain) unlockWrite() {
+	bc.mu.Unlock()
+	bc.commitMu.Unlock()
+}
+
+// commit links a new block to the head, signs it, gets it through consensus
+// if one is set, then persists and applies it. Caller holds the locks from
+// lockWrite; bc.mu is released while consensus replicates the block.
+func (bc *Blockchain) commit(newBlock Block) (Block, error) {
+	newBlock.Index = bc.height()
+	newBlock.Timestamp = time.Now().Format(time.RFC3339)
+	newBlock.PreviousHash = bc.headHash()
+	if bc.identity != nil {
+		bc.identity.SignBlock(&newBlock)
+	} else {
+		newBlock.Hash = CalculateHash(newBlock)
+	}
+
+	if c := bc.consensus; c != nil {
+		prior := bc.priorBlocks(newBlock.Index)
+		bc.mu.Unlock()
+		err := c.Commit(newBlock, prior)
+		bc.mu.Lock()
+		if err != nil {
+			return Block{}, err
+		}
+		// Only a sync can move the head meanwhile; the block no longer fits
+		if bc.height() != newBlock.Index || bc.headHash() != newBlock.PreviousHash {
+			return Block{}, fmt.Errorf("chain changed while block %d was replicated", newBlock.Index)
+		}
+	}
 
-	return newBlock
+	// A block that is not on disk is neither applied nor acknowledged, so the
+	// in-memory chain never runs ahead of the log
+	if err := bc.store.Append(newBlock); err != nil {
+		return Block{}, fmt.Errorf("failed to persist block %d: %v", newBlock.Index, err)
+	}
+	bc.applyBlock(newBlock)
+
+	return newBlock, nil
+}
+
+// applyBlock appends b to the in-memory chain and updates the lookup
+// indexes. Caller holds bc.mu (or has exclusive access during load).
+func (bc *Blockchain) applyBlock(b Block) {
+	pos := len(bc.Chain)
+	bc.Chain = append(bc.Chain, b)
+	bc.notifyLocked()
+	if b.IsCheckpoint() {
+		bc.lastCheckpoint = pos
+		return
+	}
+	for _, w := range b.Writes() {
+		bc.keyIndex[w.Key] = append(bc.keyIndex[w.Key], pos)
+		if w.Op == OpDelete {
+			delete(bc.Data, w.Key)
+			continue
+		}
+		bc.Data[w.Key] = w.Value // Update quick lookup
+	}
+}
+
+// base returns the index of the first in-memory block. Caller holds bc.mu.
+func (bc *Blockchain) base() int {
+	if bc.baseSnap == nil {
+		return 0
+	}
+	return bc.baseSnap.Height
+}
+
+// height returns the chain length, snapshotted blocks included. Caller holds bc.mu.
+func (bc *Blockchain) height() int {
+	return bc.base() + len(bc.Chain)
+}
+
+// headHash returns the hash of the newest block. Caller holds bc.mu.
+func (bc *Blockchain) headHash() string {
+	if len(bc.Chain) > 0 {
+		return bc.Chain[len(bc.Chain)-1].Hash
+	}
+	if bc.baseSnap != nil {
+		return bc.baseSnap.Head.Hash
+	}
+	return ""
 }
 
 // Get retrieves a value (latest state)
@@ -108,46 +386,35 @@ func (bc *Blockchain) Get(key string) (string, bool) {
 	return val, ok
 }
 
-// IsChainValid checks integrity
-func (bc *Blockchain) IsChainValid() bool {
+// Keys returns the live (non-deleted) keys
+func (bc *Blockchain) Keys() []string {
 	bc.mu.RLock()
 	defer bc.mu.RUnlock()
-
-	for i := 1; i < len(bc.Chain); i++ {
-		current := bc.Chain[i]
-		prev := bc.Chain[i-1]
-
-		if current.Hash != CalculateHash(current) {
-			return false
-		}
-		if current.PreviousHash != prev.Hash {
-			return false
-		}
+	keys := make([]string, 0, len(bc.Data))
+	for k := range bc.Data {
+		keys = append(keys, k)
 	}
-	return true
+	return keys
 }
 
-func (bc *Blockchain) save() error {
-	data, err := json.MarshalIndent(bc, "", "  ")
-	if err != nil {
-		log.Printf("ERROR: Failed to marshal blockchain: %v", err)
-		return err
+// IsChainValid checks hash links and block signatures. A chain started from a
+// snapshot is checked from the snapshot head onwards.
+func (bc *Blockchain) IsChainValid() bool {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	// The local log may start with unsigned blocks from a legacy import
+	if bc.baseSnap == nil {
+		return validateSegment(nil, bc.Chain, verifyStoredBlock) == nil
 	}
-	if err := os.WriteFile(bc.Filename, data, 0644); err != nil {
-		log.Printf("ERROR: Failed to save blockchain to %s: %v", bc.Filename, err)
-		return err
+	if bc.baseSnap.Verify() != nil {
+		return false
 	}
-	return nil
+	return validateSegment(&bc.baseSnap.Head, bc.Chain, verifyStoredBlock) == nil
 }
 
-// startPeriodicSave saves blockchain periodically (every 30 seconds)
-func (bc *Blockchain) startPeriodicSave() {
-	ticker := time.NewTicker(30 * time.Second)
-	defer ticker.Stop()
-
-	for range ticker.C {
-		if err := bc.save(); err != nil {
-			log.Printf("WARNING: Periodic save failed: %v", err)
-		}
-	}
+// Close releases the underlying block log
+func (bc *Blockchain) Close() error {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	return bc.store.Close()
 }
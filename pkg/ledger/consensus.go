@@ -0,0 +1,280 @@
+package ledger
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNotLeader is returned for local writes on a follower node
+	ErrNotLeader = errors.New("not the leader")
+	// ErrNoQuorum is returned when too few validators acknowledged a block
+	ErrNoQuorum = errors.New("no quorum")
+	// ErrOutOfSync is returned by a follower that needs earlier blocks first
+	ErrOutOfSync = errors.New("follower out of sync")
+)
+
+// maxCatchUpRounds bounds how often a leader resends earlier blocks to a lagging follower
+const maxCatchUpRounds = 8
+
+// Consensus decides when a new block is final. Without one, blocks are
+// final as soon as they are written locally.
+type Consensus interface {
+	// Commit is called before b is stored, without the chain lock so reads
+	// go on while it waits for the network; other writers are held back
+	// until it returns. The block is only persisted and applied if it
+	// returns nil. prior returns the blocks from index start up to b for
+	// validators that lag behind.
+	Commit(b Block, prior func(start int) []Block) error
+	// Accept reports whether a block replicated from another node may be
+	// appended to the local chain
+	Accept(b Block) error
+}
+
+// ValidatorPeer is how a leader reaches another validator node
+type ValidatorPeer interface {
+	ID() string
+	// AppendBlocks hands blocks to the validator. On ErrOutOfSync the
+	// returned index is where the validator wants the leader to resend from.
+	AppendBlocks(blocks []Block) (int, error)
+}
+
+// QuorumConsensus is a leader-based scheme in the style of Raft: one leader
+// orders and signs every block, replicates it to the validator nodes and
+// treats it as final once a majority (leader included) has stored it.
+// Followers only take blocks signed by the leader and repair conflicting
+// uncommitted blocks by truncating them. The leader is fixed by configuration.
+type QuorumConsensus struct {
+	mu         sync.RWMutex
+	leader     bool
+	leaderKey  string
+	validators func() []ValidatorPeer
+
+	// Timeout bounds how long Commit waits for acknowledgements
+	Timeout time.Duration
+}
+
+// NewLeaderConsensus makes this node the leader. validators returns the
+// other validator nodes at the time of each commit.
+func NewLeaderConsensus(validators func() []ValidatorPeer) *QuorumConsensus {
+	return &QuorumConsensus{leader: true, validators: validators, Timeout: 10 * time.Second}
+}
+
+// NewFollowerConsensus makes this node a follower of the leader with the given public key (hex)
+func NewFollowerConsensus(leaderKey string) *QuorumConsensus {
+	return &QuorumConsensus{leaderKey: leaderKey, Timeout: 10 * time.Second}
+}
+
+// IsLeader reports whether this node orders blocks
+func (q *QuorumConsensus) IsLeader() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	return q.leader
+}
+
+// Commit replicates b and waits for a majority of validators
+func (q *QuorumConsensus) Commit(b Block, prior func(start int) []Block) error {
+	q.mu.RLock()
+	leader, validators, timeout := q.leader, q.validators, q.Timeout
+	q.mu.RUnlock()
+	if !leader {
+		return ErrNotLeader
+	}
+
+	var peers []ValidatorPeer
+	if validators != nil {
+		peers = validators()
+	}
+	quorum := (len(peers)+1)/2 + 1
+	acks := 1 // the leader itself
+	if acks >= quorum {
+		return nil
+	}
+
+	results := make(chan error, len(peers))
+	for _, p := range peers {
+		go func(p ValidatorPeer) {
+			err := replicate(p, b, prior)
+			if err != nil {
+				log.Printf("WARNING: Validator %s did not store block %d: %v", p.ID(), b.Index, err)
+			}
+			results <- err
+		}(p)
+	}
+
+	// A failed block waits for every reply, so no stale copy of it is still
+	// on its way to a follower when the next block is proposed
+	deadline := time.After(timeout)
+	for pending := len(peers); pending > 0 && acks < quorum; pending-- {
+		select {
+		case err := <-results:
+			if err == nil {
+				acks++
+			}
+		case <-deadline:
+			return fmt.Errorf("%w: timed out with %d of %d acknowledgements", ErrNoQuorum, acks, quorum)
+		}
+	}
+	if acks < quorum {
+		return fmt.Errorf("%w: %d of %d validators acknowledged block %d", ErrNoQuorum, acks, len(peers)+1, b.Index)
+	}
+	return nil
+}
+
+// replicate sends b to one validator, backfilling earlier blocks if it lags
+func replicate(p ValidatorPeer, b Block, prior func(start int) []Block) error {
+	batch := []Block{b}
+	for round := 0; round < maxCatchUpRounds; round++ {
+		need, err := p.AppendBlocks(batch)
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrOutOfSync) {
+			return err
+		}
+		if need < 0 || need > b.Index {
+			return fmt.Errorf("validator asked for block %d", need)
+		}
+		batch = append(prior(need), b)
+	}
+	return fmt.Errorf("validator still out of sync after %d rounds", maxCatchUpRounds)
+}
+
+// Accept only lets followers take blocks signed by the leader
+func (q *QuorumConsensus) Accept(b Block) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	if q.leader {
+		return fmt.Errorf("leader does not accept replicated blocks")
+	}
+	if b.PublicKey != q.leaderKey {
+		return fmt.Errorf("block %d is not signed by the leader", b.Index)
+	}
+	return nil
+}
+
+// SetConsensus installs the consensus used for new blocks; nil restores
+// immediate local commits
+func (bc *Blockchain) SetConsensus(c Consensus) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.consensus = c
+}
+
+// priorBlocks returns a reader over the current chain that stays valid after
+// the lock is released: the captured slice is never modified in place.
+// Caller holds bc.mu.
+func (bc *Blockchain) priorBlocks(end int) func(start int) []Block {
+	chain, base, storeBase, store := bc.Chain, bc.base(), bc.storeBase, bc.store
+	return func(start int) []Block {
+		var out []Block
+		for i := start; i < end; i++ {
+			if i >= base {
+				out = append(out, chain[i-base])
+				continue
+			}
+			b, err := store.Get(i - storeBase)
+			if err != nil {
+				return out
+			}
+			out = append(out, b)
+		}
+		return out
+	}
+}
+
+// blockAt returns the block with index i if it is still available. Caller holds bc.mu.
+func (bc *Blockchain) blockAt(i int) (Block, bool) {
+	base := bc.base()
+	switch {
+	case i >= bc.height() || i < 0:
+		return Block{}, false
+	case i >= base:
+		return bc.Chain[i-base], true
+	case i == base-1:
+		return bc.baseSnap.Head, true
+	}
+	b, err := bc.store.Get(i - bc.storeBase)
+	return b, err == nil
+}
+
+// AcceptBlocks appends blocks replicated by the leader. Blocks already held
+// are skipped and conflicting uncommitted ones are replaced. It returns the
+// new height, or on ErrOutOfSync the index to resend from.
+func (bc *Blockchain) AcceptBlocks(blocks []Block) (int, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if bc.consensus == nil {
+		return bc.height(), fmt.Errorf("consensus is not enabled on this node")
+	}
+	for len(blocks) > 0 {
+		local, ok := bc.blockAt(blocks[0].Index)
+		if !ok || local.Hash != blocks[0].Hash {
+			break
+		}
+		blocks = blocks[1:]
+	}
+	if len(blocks) == 0 {
+		return bc.height(), nil
+	}
+
+	first := blocks[0]
+	if first.Index > bc.height() {
+		return bc.height(), ErrOutOfSync
+	}
+	var prev *Block
+	if first.Index > 0 {
+		b, ok := bc.blockAt(first.Index - 1)
+		if !ok || b.Hash != first.PreviousHash {
+			need := first.Index - MaxBlocksPerRequest
+			if need < 0 {
+				need = 0
+			}
+			return need, ErrOutOfSync
+		}
+		prev = &b
+	}
+
+	if bc.snapshot != nil && first.Index < bc.snapshot.Height {
+		return bc.height(), fmt.Errorf("block %d conflicts with the snapshot at %d", first.Index, bc.snapshot.Height)
+	}
+	for _, b := range blocks {
+		if err := bc.consensus.Accept(b); err != nil {
+			return bc.height(), err
+		}
+	}
+	if err := validateSegment(prev, blocks, VerifyBlock); err != nil {
+		return bc.height(), err
+	}
+
+	if first.Index < bc.base() {
+		return bc.height(), fmt.Errorf("block %d is below the in-memory chain at %d", first.Index, bc.base())
+	}
+	if err := bc.replaceTail(first.Index, blocks); err != nil {
+		return bc.height(), err
+	}
+	return bc.height(), nil
+}
+
+// localValidator adapts an in-process Blockchain to ValidatorPeer
+type localValidator struct {
+	id string
+	bc *Blockchain
+}
+
+// AsValidator exposes a local chain as a ValidatorPeer, e.g. for in-process clusters
+func (bc *Blockchain) AsValidator() ValidatorPeer {
+	return localValidator{id: bc.identity.NodeID, bc: bc}
+}
+
+func (lv localValidator) ID() string {
+	return lv.id
+}
+
+func (lv localValidator) AppendBlocks(blocks []Block) (int, error) {
+	return lv.bc.AcceptBlocks(blocks)
+}
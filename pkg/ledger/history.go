@@ -0,0 +1,79 @@
+package ledger
+
+import (
+	"time"
+)
+
+// KeyVersion is one entry in the history of a key
+type KeyVersion struct {
+	Version   int    `json:"version"` // 1-based write count for the key
+	Index     int    `json:"index"`   // block index
+	Timestamp string `json:"timestamp"`
+	Value     string `json:"value"`
+	Validator string `json:"validator"`
+	Hash      string `json:"hash"`
+	Deleted   bool   `json:"deleted,omitempty"` // tombstone
+}
+
+// History returns every block that touched key, oldest first
+func (bc *Blockchain) History(key string) []KeyVersion {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	positions := bc.keyIndex[key]
+	history := make([]KeyVersion, 0, len(positions))
+	for i, pos := range positions {
+		b := bc.Chain[pos]
+		w := b.write(key)
+		history = append(history, KeyVersion{
+			Version:   i + 1,
+			Index:     b.Index,
+			Timestamp: b.Timestamp,
+			Value:     w.Value,
+			Validator: b.Validator,
+			Hash:      b.Hash,
+			Deleted:   w.Op == OpDelete,
+		})
+	}
+	return history
+}
+
+// GetVersion returns the value of key as of its n-th write (1-based)
+func (bc *Blockchain) GetVersion(key string, version int) (string, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	positions := bc.keyIndex[key]
+	if version < 1 || version > len(positions) {
+		return "", false
+	}
+	w := bc.Chain[positions[version-1]].write(key)
+	if w.Op == OpDelete {
+		return "", false
+	}
+	return w.Value, true
+}
+
+// GetAt returns the value key had at time t
+func (bc *Blockchain) GetAt(key string, t time.Time) (string, bool) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	positions := bc.keyIndex[key]
+	// Walk backwards: the newest write not after t wins
+	for i := len(positions) - 1; i >= 0; i-- {
+		b := bc.Chain[positions[i]]
+		ts, err := time.Parse(time.RFC3339, b.Timestamp)
+		if err != nil {
+			continue
+		}
+		if !ts.After(t) {
+			w := b.write(key)
+			if w.Op == OpDelete {
+				return "", false
+			}
+			return w.Value, true
+		}
+	}
+	return "", false
+}
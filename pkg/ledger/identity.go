@@ -0,0 +1,154 @@
+package ledger
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// ErrBadSignature is returned when a client signature does not match the key and value
+var ErrBadSignature = errors.New("invalid client signature")
+
+// NodeIdentity is the Ed25519 keypair a node signs its blocks with
+type NodeIdentity struct {
+	NodeID     string             `json:"node_id"`
+	PublicKey  ed25519.PublicKey  `json:"-"`
+	privateKey ed25519.PrivateKey `json:"-"`
+}
+
+// ClientSignature is an optional signature a client attaches to a PUBLISH
+type ClientSignature struct {
+	PublicKey string `json:"public_key"` // hex
+	Signature string `json:"signature"`  // hex
+}
+
+type identityFile struct {
+	NodeID     string `json:"node_id"`
+	PublicKey  string `json:"public_key"`
+	PrivateKey string `json:"private_key"`
+}
+
+// LoadOrCreateIdentity reads the node keypair from filename, generating and
+// persisting a new one on first start
+func LoadOrCreateIdentity(filename string) (*NodeIdentity, error) {
+	if content, err := os.ReadFile(filename); err == nil {
+		var f identityFile
+		if err := json.Unmarshal(content, &f); err != nil {
+			return nil, fmt.Errorf("failed to parse node identity: %v", err)
+		}
+		priv, err := hex.DecodeString(f.PrivateKey)
+		if err != nil || len(priv) != ed25519.PrivateKeySize {
+			return nil, fmt.Errorf("invalid node private key in %s", filename)
+		}
+		return newIdentity(ed25519.PrivateKey(priv)), nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate node key: %v", err)
+	}
+	id := newIdentity(priv)
+
+	data, _ := json.MarshalIndent(identityFile{
+		NodeID:     id.NodeID,
+		PublicKey:  hex.EncodeToString(id.PublicKey),
+		PrivateKey: hex.EncodeToString(priv),
+	}, "", "  ")
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filename, data, 0600); err != nil {
+		return nil, fmt.Errorf("failed to save node identity: %v", err)
+	}
+	return id, nil
+}
+
+func newIdentity(priv ed25519.PrivateKey) *NodeIdentity {
+	pub := priv.Public().(ed25519.PublicKey)
+	return &NodeIdentity{
+		NodeID:     NodeIDFromKey(pub),
+		PublicKey:  pub,
+		privateKey: priv,
+	}
+}
+
+// NodeIDFromKey derives the short node name from a public key
+func NodeIDFromKey(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return "node-" + hex.EncodeToString(sum[:])[:12]
+}
+
+// PublicKeyHex returns the hex encoded public key
+func (id *NodeIdentity) PublicKeyHex() string {
+	return hex.EncodeToString(id.PublicKey)
+}
+
+// Sign signs msg with the node key and returns the hex signature
+func (id *NodeIdentity) Sign(msg []byte) string {
+	return hex.EncodeToString(ed25519.Sign(id.privateKey, msg))
+}
+
+// SignBlock fills in the signer fields of b, recomputes its hash and signs it
+func (id *NodeIdentity) SignBlock(b *Block) {
+	b.PublicKey = id.PublicKeyHex()
+	b.Hash = CalculateHash(*b)
+	b.Signature = id.Sign([]byte(b.Hash))
+}
+
+// VerifySignature checks a hex signature over msg against a hex public key
+func VerifySignature(pubHex, sigHex string, msg []byte) bool {
+	pub, err := hex.DecodeString(pubHex)
+	if err != nil || len(pub) != ed25519.PublicKeySize {
+		return false
+	}
+	sig, err := hex.DecodeString(sigHex)
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	return ed25519.Verify(ed25519.PublicKey(pub), msg, sig)
+}
+
+// ClientMessage is the byte string a client signs when publishing key=value
+func ClientMessage(key, value string) []byte {
+	return []byte(key + "\n" + value)
+}
+
+// Verify checks a client signature over key=value
+func (cs *ClientSignature) Verify(key, value string) bool {
+	return VerifySignature(cs.PublicKey, cs.Signature, ClientMessage(key, value))
+}
+
+// VerifyBlock checks the node signature (and client signature, if any) of a
+// block. Unsigned blocks are rejected; see verifyStoredBlock for the local log.
+func VerifyBlock(b Block) error {
+	if b.Signature == "" && b.PublicKey == "" {
+		return fmt.Errorf("block %d: unsigned", b.Index)
+	}
+	if !VerifySignature(b.PublicKey, b.Signature, []byte(b.Hash)) {
+		return fmt.Errorf("block %d: invalid node signature", b.Index)
+	}
+	if b.ClientKey != "" || b.ClientSignature != "" {
+		cs := ClientSignature{PublicKey: b.ClientKey, Signature: b.ClientSignature}
+		if !cs.Verify(b.Key, b.Value) {
+			return fmt.Errorf("block %d: %w", b.Index, ErrBadSignature)
+		}
+	}
+	return nil
+}
+
+// verifyStoredBlock is VerifyBlock for blocks already in the local log, which
+// may hold unsigned blocks imported from a legacy ledger
+func verifyStoredBlock(b Block) error {
+	if b.Signature == "" && b.PublicKey == "" {
+		return nil
+	}
+	return VerifyBlock(b)
+}
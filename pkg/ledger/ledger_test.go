@@ -0,0 +1,911 @@
+package ledger_test
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/ledger"
+)
+
+// TestSegmentStore tests appends, rotation and crash recovery of the block log
+func TestSegmentStore(t *testing.T) {
+	dir := t.TempDir()
+
+	// Small segment size forces several rotations
+	store, err := ledger.OpenSegmentStore(dir, 256)
+	if err != nil {
+		t.Fatalf("Failed to open store: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := store.Append(ledger.Block{Index: i, Key: "k", Value: "v"}); err != nil {
+			t.Fatalf("Append %d failed: %v", i, err)
+		}
+	}
+	store.Close()
+
+	segs, _ := filepath.Glob(filepath.Join(dir, "*.seg"))
+	if len(segs) < 2 {
+		t.Fatalf("Expected segment rotation, got %d segments", len(segs))
+	}
+
+	t.Run("Reopen", func(t *testing.T) {
+		store, err := ledger.OpenSegmentStore(dir, 256)
+		if err != nil {
+			t.Fatalf("Failed to reopen store: %v", err)
+		}
+		defer store.Close()
+		if store.Len() != 20 {
+			t.Fatalf("Expected 20 blocks, got %d", store.Len())
+		}
+		b, err := store.Get(13)
+		if err != nil {
+			t.Fatalf("Get failed: %v", err)
+		}
+		if b.Index != 13 {
+			t.Fatalf("Expected block 13, got %d", b.Index)
+		}
+	})
+
+	t.Run("TornRecord", func(t *testing.T) {
+		last := segs[len(segs)-1]
+		f, err := os.OpenFile(last, os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte{0x00, 0x00, 0x01, 0x00, 0xde, 0xad}) // header with no payload
+		f.Close()
+
+		store, err := ledger.OpenSegmentStore(dir, 256)
+		if err != nil {
+			t.Fatalf("Recovery failed: %v", err)
+		}
+		defer store.Close()
+		if store.Len() != 20 {
+			t.Fatalf("Expected 20 blocks after recovery, got %d", store.Len())
+		}
+		if err := store.Append(ledger.Block{Index: 20}); err != nil {
+			t.Fatalf("Append after recovery failed: %v", err)
+		}
+		if b, err := store.Get(20); err != nil || b.Index != 20 {
+			t.Fatalf("Expected block 20 after recovery, got %v (%v)", b.Index, err)
+		}
+	})
+
+	t.Run("LostIndex", func(t *testing.T) {
+		os.Remove(filepath.Join(dir, "blocks.idx"))
+		store, err := ledger.OpenSegmentStore(dir, 256)
+		if err != nil {
+			t.Fatalf("Failed to rebuild index: %v", err)
+		}
+		defer store.Close()
+		if store.Len() != 21 {
+			t.Fatalf("Expected 21 blocks after reindex, got %d", store.Len())
+		}
+	})
+
+	t.Run("Prune", func(t *testing.T) {
+		store, err := ledger.OpenSegmentStore(dir, 256)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dropped, err := store.PruneBefore(15)
+		if err != nil {
+			t.Fatalf("PruneBefore failed: %v", err)
+		}
+		if dropped == 0 || dropped > 15 {
+			t.Fatalf("Expected whole segments before block 15 to go, dropped %d", dropped)
+		}
+		store.Close()
+
+		store, err = ledger.OpenSegmentStore(dir, 256)
+		if err != nil {
+			t.Fatalf("Failed to reopen pruned store: %v", err)
+		}
+		defer store.Close()
+		if store.Len() != 21-dropped {
+			t.Fatalf("Expected %d blocks after prune, got %d", 21-dropped, store.Len())
+		}
+		if b, err := store.Get(15 - dropped); err != nil || b.Index != 15 {
+			t.Fatalf("Expected block 15 to survive the prune, got %v (%v)", b.Index, err)
+		}
+	})
+}
+
+// TestBlockchainPersistence tests reload and legacy ledger.json import
+func TestBlockchainPersistence(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ledger.json")
+
+	// Write a legacy whole-file ledger
+	legacy, _ := ledger.NewBlockchain(filepath.Join(dir, "seed.json"))
+	legacy.AddBlock("site", "hello", "Node-Local")
+	data, _ := json.Marshal(legacy)
+	legacy.Close()
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// An import cut short leaves part of the chain in the log; it is resumed
+	store, err := ledger.OpenSegmentStore(ledger.SegmentDir(filename), ledger.DefaultSegmentSize)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Append(legacy.Chain[0]); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	bc, err := ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatalf("Failed to open ledger: %v", err)
+	}
+	if len(bc.Chain) != 2 {
+		t.Fatalf("Expected 2 imported blocks, got %d", len(bc.Chain))
+	}
+	if v, ok := bc.Get("site"); !ok || v != "hello" {
+		t.Fatalf("Expected imported value, got %q", v)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatal("Legacy ledger should be renamed after import")
+	}
+
+	bc.AddBlock("site", "world", "Node-Local")
+	bc.Close()
+
+	bc, err = ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatalf("Failed to reopen ledger: %v", err)
+	}
+	defer bc.Close()
+	if v, _ := bc.Get("site"); v != "world" {
+		t.Fatalf("Expected latest value after reload, got %q", v)
+	}
+	if !bc.IsChainValid() {
+		t.Fatal("Reloaded chain should be valid")
+	}
+
+	// A block that cannot be written is not applied or acknowledged
+	height := len(bc.Chain)
+	bc.Close()
+	if _, err := bc.AddClientBlock("lost", "v", "Node-Local", nil); err == nil || errors.Is(err, ledger.ErrBadSignature) {
+		t.Fatalf("Expected a write error, got %v", err)
+	}
+	if _, ok := bc.Get("lost"); ok || len(bc.Chain) != height {
+		t.Fatal("Unpersisted block should not be applied")
+	}
+}
+
+// TestSignedBlocks tests node and client block signatures
+func TestSignedBlocks(t *testing.T) {
+	bc, err := ledger.NewBlockchain(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	pub, priv, _ := ed25519.GenerateKey(rand.Reader)
+	client := &ledger.ClientSignature{
+		PublicKey: hex.EncodeToString(pub),
+		Signature: hex.EncodeToString(ed25519.Sign(priv, ledger.ClientMessage("cfg", "on"))),
+	}
+
+	b, err := bc.AddClientBlock("cfg", "on", bc.Identity().NodeID, client)
+	if err != nil {
+		t.Fatalf("Valid client signature rejected: %v", err)
+	}
+	if b.PublicKey != bc.Identity().PublicKeyHex() || b.Signature == "" {
+		t.Fatal("Block should carry the node key and signature")
+	}
+	if !bc.IsChainValid() {
+		t.Fatal("Signed chain should be valid")
+	}
+
+	if _, err := bc.AddClientBlock("cfg", "off", bc.Identity().NodeID, client); !errors.Is(err, ledger.ErrBadSignature) {
+		t.Fatal("Signature over a different value should be rejected")
+	}
+
+	// Re-signing a block with another key must break the chain
+	forged := bc.Chain[1]
+	_, other, _ := ed25519.GenerateKey(rand.Reader)
+	forged.PublicKey = hex.EncodeToString(other.Public().(ed25519.PublicKey))
+	forged.Signature = hex.EncodeToString(ed25519.Sign(other, []byte(forged.Hash)))
+	if err := ledger.VerifyBlock(forged); err != nil {
+		t.Fatalf("Forged signature should verify in isolation: %v", err)
+	}
+	if forged.Hash == ledger.CalculateHash(forged) {
+		t.Fatal("Hash should commit to the signer key")
+	}
+
+	// Unsigned blocks are only trusted from a legacy import of the local log
+	unsigned := ledger.Block{Index: 0, Key: "genesis", Value: "old", Validator: "SYSTEM"}
+	unsigned.Hash = ledger.CalculateHash(unsigned)
+	if err := ledger.ValidateChain([]ledger.Block{unsigned}); err == nil {
+		t.Fatal("Unsigned block from a peer should be rejected")
+	}
+	dir := t.TempDir()
+	data, _ := json.Marshal(map[string][]ledger.Block{"chain": {unsigned}})
+	os.WriteFile(filepath.Join(dir, "legacy.json"), data, 0644)
+	legacy, err := ledger.NewBlockchain(filepath.Join(dir, "legacy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacy.Close()
+	legacy.AddBlock("site", "new", "Node-Local")
+	if !legacy.IsChainValid() {
+		t.Fatal("Imported legacy blocks should stay valid locally")
+	}
+}
+
+// TestSyncForkResolution tests pulling blocks and converging on one fork
+func TestSyncForkResolution(t *testing.T) {
+	a, _ := ledger.NewBlockchain(filepath.Join(t.TempDir(), "a.json"))
+	b, _ := ledger.NewBlockchain(filepath.Join(t.TempDir(), "b.json"))
+	defer a.Close()
+	defer b.Close()
+
+	// Fresh nodes have different genesis blocks; the tie-breaker picks one
+	if _, err := a.SyncWith(b.AsPeer()); err != nil {
+		t.Fatalf("Initial sync failed: %v", err)
+	}
+	if _, err := b.SyncWith(a.AsPeer()); err != nil {
+		t.Fatalf("Initial sync failed: %v", err)
+	}
+	ha, heada := a.Status()
+	hb, headb := b.Status()
+	if ha != hb || heada != headb {
+		t.Fatalf("Nodes did not converge on genesis: %d/%s vs %d/%s", ha, heada, hb, headb)
+	}
+
+	t.Run("PullMissing", func(t *testing.T) {
+		a.AddBlock("x", "1", a.Identity().NodeID)
+		a.AddBlock("y", "2", a.Identity().NodeID)
+		res, err := b.SyncWith(a.AsPeer())
+		if err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		if res.Pulled != 2 || res.Orphaned != 0 {
+			t.Fatalf("Expected 2 pulled blocks, got %+v", res)
+		}
+		if v, _ := b.Get("y"); v != "2" {
+			t.Fatalf("Expected synced value, got %q", v)
+		}
+	})
+
+	t.Run("LongestChainWins", func(t *testing.T) {
+		a.AddBlock("x", "a-fork", a.Identity().NodeID)
+		b.AddBlock("x", "b-fork", b.Identity().NodeID)
+		b.AddBlock("z", "b-only", b.Identity().NodeID)
+
+		res, err := a.SyncWith(b.AsPeer())
+		if err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		if !res.Adopted || res.Orphaned != 1 {
+			t.Fatalf("Expected longer fork to replace one block, got %+v", res)
+		}
+		if v, _ := a.Get("x"); v != "b-fork" {
+			t.Fatalf("Expected value from winning fork, got %q", v)
+		}
+		if !a.IsChainValid() {
+			t.Fatal("Chain should be valid after fork resolution")
+		}
+		if res, _ := b.SyncWith(a.AsPeer()); res.Adopted {
+			t.Fatal("Winning node should not adopt anything back")
+		}
+	})
+
+	t.Run("ForkedCheckpoint", func(t *testing.T) {
+		a.AddBlock("x", "a-cp", a.Identity().NodeID)
+		a.Checkpoint(a.Identity().NodeID)
+		if _, err := a.Prove("x"); err != nil {
+			t.Fatalf("Prove failed: %v", err)
+		}
+		b.AddBlock("x", "b-cp", b.Identity().NodeID)
+		cp, _ := b.Checkpoint(b.Identity().NodeID)
+		b.AddBlock("z", "after", b.Identity().NodeID)
+		if _, err := a.SyncWith(b.AsPeer()); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+
+		// The adopted checkpoint sits where the orphaned one was
+		proof, err := a.Prove("x")
+		if err != nil {
+			t.Fatalf("Prove failed: %v", err)
+		}
+		if proof.Value != "b-cp" || ledger.VerifyProof(proof, cp.Hash) != nil {
+			t.Fatalf("Proof is not against the adopted checkpoint: %+v", proof)
+		}
+	})
+
+	t.Run("UnwritableLog", func(t *testing.T) {
+		b.AddBlock("w", "1", b.Identity().NodeID)
+		height, head := a.Status()
+		a.Close()
+		if _, err := a.SyncWith(b.AsPeer()); err == nil {
+			t.Fatal("Expected an error when the block log cannot be written")
+		}
+		if h, hh := a.Status(); h != height || hh != head {
+			t.Fatalf("Chain moved to %d/%s without its log", h, hh)
+		}
+	})
+}
+
+// TestKeyHistory tests versioned and point-in-time reads
+func TestKeyHistory(t *testing.T) {
+	bc, err := ledger.NewBlockchain(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	bc.AddBlock("cfg", "v1", "test")
+	bc.AddBlock("other", "x", "test")
+	bc.AddBlock("cfg", "v2", "test")
+
+	history := bc.History("cfg")
+	if len(history) != 2 || history[0].Version != 1 || history[1].Value != "v2" {
+		t.Fatalf("Unexpected history: %+v", history)
+	}
+	if history[1].Index != 3 {
+		t.Fatalf("Expected version 2 at block 3, got %d", history[1].Index)
+	}
+	if v, ok := bc.GetVersion("cfg", 1); !ok || v != "v1" {
+		t.Fatalf("Expected v1, got %q", v)
+	}
+	if _, ok := bc.GetVersion("cfg", 3); ok {
+		t.Fatal("Version 3 should not exist")
+	}
+	if v, ok := bc.GetAt("cfg", time.Now().Add(time.Hour)); !ok || v != "v2" {
+		t.Fatalf("Expected latest value in the future, got %q", v)
+	}
+	if _, ok := bc.GetAt("cfg", time.Now().Add(-time.Hour)); ok {
+		t.Fatal("Key should not exist an hour ago")
+	}
+}
+
+// TestTombstones tests deletion and that it survives a reload
+func TestTombstones(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ledger.json")
+	bc, err := ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("tmp", "1", "test")
+	if _, err := bc.Delete("tmp", "test"); err != nil {
+		t.Fatalf("Delete failed: %v", err)
+	}
+	if _, err := bc.Delete("tmp", "test"); err == nil {
+		t.Fatal("Deleting a missing key should fail")
+	}
+	bc.Close()
+
+	bc, err = ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	if _, ok := bc.Get("tmp"); ok {
+		t.Fatal("Deleted key should not be found after reload")
+	}
+	for _, k := range bc.Keys() {
+		if k == "tmp" {
+			t.Fatal("Deleted key should be hidden from Keys")
+		}
+	}
+	history := bc.History("tmp")
+	if len(history) != 2 || !history[1].Deleted {
+		t.Fatalf("Expected write + tombstone in history, got %+v", history)
+	}
+	if !bc.IsChainValid() {
+		t.Fatal("Chain with tombstones should be valid")
+	}
+
+	bc.AddBlock("tmp", "2", "test")
+	if v, _ := bc.Get("tmp"); v != "2" {
+		t.Fatalf("Key should be writable again after delete, got %q", v)
+	}
+}
+
+func TestMerkleProofs(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ledger.json")
+	bc, err := ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bc.Prove("genesis"); err == nil {
+		t.Fatal("Prove should fail before the first checkpoint")
+	}
+
+	bc.SetCheckpointInterval(4)
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		bc.AddBlock(k, "v-"+k, "test")
+	}
+	bc.Delete("e", "test")
+	cp, _ := bc.Checkpoint("test")
+	bc.AddBlock("a", "changed", "test")
+	bc.Close()
+
+	bc, err = ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	for _, k := range []string{"genesis", "a", "b", "c", "d"} {
+		proof, err := bc.Prove(k)
+		if err != nil {
+			t.Fatalf("Prove %s: %v", k, err)
+		}
+		// Round-trip through JSON as a light client would receive it
+		data, _ := json.Marshal(proof)
+		var received ledger.Proof
+		json.Unmarshal(data, &received)
+		if err := ledger.VerifyProof(&received, cp.Hash); err != nil {
+			t.Fatalf("VerifyProof %s: %v", k, err)
+		}
+	}
+
+	proof, _ := bc.Prove("a")
+	if proof.Value != "v-a" {
+		t.Fatalf("Proof should carry the checkpointed value, got %q", proof.Value)
+	}
+	proof.Value = "changed"
+	if ledger.VerifyProof(proof, cp.Hash) == nil {
+		t.Fatal("Tampered value should not verify")
+	}
+	if _, err := bc.Prove("e"); err == nil {
+		t.Fatal("Deleted key should not be provable")
+	}
+	if _, err := bc.Prove(ledger.CheckpointKey); err == nil {
+		t.Fatal("Checkpoint blocks should not be part of the state")
+	}
+	if !bc.IsChainValid() {
+		t.Fatal("Chain with checkpoints should be valid")
+	}
+}
+
+func TestSnapshots(t *testing.T) {
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "ledger.json")
+	bc, err := ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("a", "1", "test")
+	bc.AddBlock("b", "1", "test")
+	bc.AddBlock("c", "1", "test")
+	bc.Delete("c", "test")
+
+	snap, err := bc.CreateSnapshot(0)
+	if err != nil {
+		t.Fatalf("CreateSnapshot failed: %v", err)
+	}
+	if err := snap.Verify(); err != nil {
+		t.Fatalf("Fresh snapshot should verify: %v", err)
+	}
+	if _, ok := snap.State["c"]; ok || snap.State["a"] != "1" {
+		t.Fatalf("Unexpected snapshot state %v", snap.State)
+	}
+	bc.AddBlock("a", "2", "test")
+	bc.Close()
+
+	// Restart: nothing was pruned, so the whole log is replayed and the
+	// snapshot is only remembered
+	bc, err = ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v, _ := bc.Get("a"); v != "2" {
+		t.Fatalf("Expected tail write on top of snapshot, got %q", v)
+	}
+	if v, _ := bc.Get("b"); v != "1" {
+		t.Fatalf("Expected snapshotted key b, got %q", v)
+	}
+	if h, _ := bc.Status(); h != snap.Height+1 {
+		t.Fatalf("Expected height %d, got %d", snap.Height+1, h)
+	}
+	if len(bc.History("a")) != 2 {
+		t.Fatalf("History should keep versions from before an unpruned snapshot")
+	}
+	if bc.Snapshot() == nil || bc.Snapshot().Height != snap.Height {
+		t.Fatal("Snapshot should be loaded on restart")
+	}
+	if blocks := bc.Blocks(0, 2); len(blocks) != 2 || blocks[0].Key != "genesis" {
+		t.Fatalf("Unpruned blocks before the snapshot should still be served, got %+v", blocks)
+	}
+	if !bc.IsChainValid() {
+		t.Fatal("Chain started from a snapshot should be valid")
+	}
+	if _, err := bc.Prune(); err != nil {
+		t.Fatalf("Prune failed: %v", err)
+	}
+
+	// Export the state and load it into a fresh ledger
+	var csvOut, jsonOut bytes.Buffer
+	if err := bc.ExportState(&csvOut, "csv"); err != nil {
+		t.Fatal(err)
+	}
+	if err := bc.ExportState(&jsonOut, "json"); err != nil {
+		t.Fatal(err)
+	}
+	bc.Close()
+
+	for format, data := range map[string]*bytes.Buffer{"csv": &csvOut, "json": &jsonOut} {
+		fresh, err := ledger.NewBlockchain(filepath.Join(t.TempDir(), "ledger.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := fresh.ImportState(bytes.NewReader(data.Bytes()), format, "test")
+		if err != nil {
+			t.Fatalf("ImportState %s failed: %v", format, err)
+		}
+		if v, _ := fresh.Get("a"); n != 3 || v != "2" {
+			t.Fatalf("ImportState %s: got %d keys, a=%q", format, n, v)
+		}
+		if _, err := fresh.ImportState(bytes.NewReader(data.Bytes()), format, "test"); err == nil {
+			t.Fatalf("Second import into a non-empty ledger should fail")
+		}
+		fresh.Close()
+	}
+
+	// A new node can start from just the snapshot file
+	migrated := filepath.Join(t.TempDir(), "ledger.json")
+	os.MkdirAll(ledger.SegmentDir(migrated), 0755)
+	content, _ := os.ReadFile(filepath.Join(ledger.SegmentDir(filename), "snapshot.json"))
+	os.WriteFile(filepath.Join(ledger.SegmentDir(migrated), "snapshot.json"), content, 0644)
+	nc, err := ledger.NewBlockchain(migrated)
+	if err != nil {
+		t.Fatalf("Failed to start from snapshot: %v", err)
+	}
+	if h, head := nc.Status(); h != snap.Height || head != snap.Head.Hash {
+		t.Fatalf("Expected to resume at snapshot head, got %d %s", h, head)
+	}
+	b := nc.AddBlock("d", "1", "test")
+	if b.Index != snap.Height || b.PreviousHash != snap.Head.Hash {
+		t.Fatalf("New block should link to the snapshot head, got %+v", b)
+	}
+	nc.Close()
+
+	nc, err = ledger.NewBlockchain(migrated)
+	if err != nil {
+		t.Fatalf("Failed to reopen migrated ledger: %v", err)
+	}
+	defer nc.Close()
+	if v, _ := nc.Get("d"); v != "1" || !nc.IsChainValid() {
+		t.Fatal("Migrated ledger should reload with its tail")
+	}
+}
+
+func TestBatches(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "ledger.json")
+	bc, err := ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bc.AddBlock("cfg.mode", "a", "test")
+
+	_, err = bc.CommitBatch([]ledger.BlockOp{
+		{Key: "cfg.mode", Value: "b"},
+		{Key: "cfg.port", Value: "80"},
+	}, []ledger.Precondition{{Key: "cfg.mode", Value: "a"}, {Key: "cfg.port", Absent: true}}, "test")
+	if err != nil {
+		t.Fatalf("CommitBatch failed: %v", err)
+	}
+	height, _ := bc.Status()
+
+	// A failed precondition must leave everything untouched
+	_, err = bc.CommitBatch([]ledger.BlockOp{
+		{Key: "cfg.mode", Value: "c"},
+		{Key: "cfg.new", Value: "1"},
+	}, []ledger.Precondition{{Key: "cfg.mode", Value: "a"}}, "test")
+	if !errors.Is(err, ledger.ErrPreconditionFailed) {
+		t.Fatalf("Expected precondition failure, got %v", err)
+	}
+	if _, err := bc.CommitBatch([]ledger.BlockOp{{Op: ledger.OpDelete, Key: "missing"}}, nil, "test"); err == nil {
+		t.Fatal("Deleting a missing key in a batch should fail")
+	}
+	if h, _ := bc.Status(); h != height {
+		t.Fatalf("Rejected batches should not add blocks, height %d -> %d", height, h)
+	}
+	if _, ok := bc.Get("cfg.new"); ok {
+		t.Fatal("Rejected batch leaked a write")
+	}
+
+	if _, err := bc.CommitBatch([]ledger.BlockOp{
+		{Op: ledger.OpDelete, Key: "cfg.port"},
+		{Key: "cfg.mode", Value: "d"},
+	}, nil, "test"); err != nil {
+		t.Fatalf("Batch with delete failed: %v", err)
+	}
+	bc.Close()
+
+	bc, err = ledger.NewBlockchain(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+	if v, _ := bc.Get("cfg.mode"); v != "d" {
+		t.Fatalf("Expected cfg.mode=d after reload, got %q", v)
+	}
+	if _, ok := bc.Get("cfg.port"); ok {
+		t.Fatal("cfg.port should be deleted by the batch")
+	}
+	history := bc.History("cfg.port")
+	if len(history) != 2 || history[0].Value != "80" || !history[1].Deleted {
+		t.Fatalf("Unexpected batch history %+v", history)
+	}
+	if v, ok := bc.GetVersion("cfg.mode", 2); !ok || v != "b" {
+		t.Fatalf("Expected version 2 of cfg.mode from the batch, got %q", v)
+	}
+	if !bc.IsChainValid() {
+		t.Fatal("Chain mixing single-key and batch blocks should be valid")
+	}
+}
+
+// serveValidator exposes bc's AcceptBlocks on a loopback TCP port, one JSON
+// request and response per connection
+func serveValidator(t *testing.T, bc *ledger.Blockchain) ledger.ValidatorPeer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			var blocks []ledger.Block
+			json.NewDecoder(conn).Decode(&blocks)
+			height, err := bc.AcceptBlocks(blocks)
+			reply := appendReply{Height: height, OutOfSync: errors.Is(err, ledger.ErrOutOfSync)}
+			if err != nil {
+				reply.Error = err.Error()
+			}
+			json.NewEncoder(conn).Encode(reply)
+			conn.Close()
+		}
+	}()
+	return loopbackValidator{addr: ln.Addr().String()}
+}
+
+type appendReply struct {
+	Height    int
+	OutOfSync bool
+	Error     string
+}
+
+type loopbackValidator struct {
+	addr string
+}
+
+func (v loopbackValidator) ID() string { return v.addr }
+
+func (v loopbackValidator) AppendBlocks(blocks []ledger.Block) (int, error) {
+	conn, err := net.Dial("tcp", v.addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	json.NewEncoder(conn).Encode(blocks)
+	var reply appendReply
+	if err := json.NewDecoder(conn).Decode(&reply); err != nil {
+		return 0, err
+	}
+	switch {
+	case reply.OutOfSync:
+		return reply.Height, ledger.ErrOutOfSync
+	case reply.Error != "":
+		return reply.Height, errors.New(reply.Error)
+	}
+	return reply.Height, nil
+}
+
+type downValidator struct{}
+
+func (downValidator) ID() string { return "down" }
+
+func (downValidator) AppendBlocks([]ledger.Block) (int, error) {
+	return 0, errors.New("unreachable")
+}
+
+func TestQuorumConsensus(t *testing.T) {
+	open := func() *ledger.Blockchain {
+		bc, err := ledger.NewBlockchain(filepath.Join(t.TempDir(), "ledger.json"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { bc.Close() })
+		return bc
+	}
+	leader, f1, f2 := open(), open(), open()
+	for _, f := range []*ledger.Blockchain{f1, f2} {
+		f.SetConsensus(ledger.NewFollowerConsensus(leader.Identity().PublicKeyHex()))
+	}
+	v1, v2 := serveValidator(t, f1), serveValidator(t, f2)
+
+	var validators []ledger.ValidatorPeer
+	c := ledger.NewLeaderConsensus(func() []ledger.ValidatorPeer { return validators })
+	c.Timeout = 2 * time.Second
+	leader.SetConsensus(c)
+
+	// Followers start with their own genesis and get the leader's chain
+	validators = []ledger.ValidatorPeer{v1, v2}
+	if _, err := leader.AddClientBlock("a", "1", "leader", nil); err != nil {
+		t.Fatalf("Commit with all validators up failed: %v", err)
+	}
+	// A majority is enough to commit, so the last follower may still be catching up
+	converged := func(f *ledger.Blockchain) bool {
+		_, head := leader.Status()
+		for start := time.Now(); time.Since(start) < 2*time.Second; time.Sleep(10 * time.Millisecond) {
+			if _, h := f.Status(); h == head {
+				return true
+			}
+		}
+		return false
+	}
+	for i, f := range []*ledger.Blockchain{f1, f2} {
+		if !converged(f) {
+			t.Fatalf("Follower %d did not converge on the leader head", i+1)
+		}
+		if v, _ := f.Get("a"); v != "1" {
+			t.Fatalf("Follower %d missing replicated value", i+1)
+		}
+	}
+
+	if _, err := f1.AddClientBlock("x", "1", "f1", nil); !errors.Is(err, ledger.ErrNotLeader) {
+		t.Fatalf("Follower writes should fail with ErrNotLeader, got %v", err)
+	}
+
+	// One validator down still leaves a majority of three
+	validators = []ledger.ValidatorPeer{v1, downValidator{}}
+	if _, err := leader.AddClientBlock("b", "1", "leader", nil); err != nil {
+		t.Fatalf("Commit with 2 of 3 should succeed: %v", err)
+	}
+
+	// No majority: the block is not final and the leader does not keep it,
+	// even though f1 stored it
+	validators = []ledger.ValidatorPeer{v1, downValidator{}, downValidator{}, downValidator{}}
+	before, _ := leader.Status()
+	if _, err := leader.AddClientBlock("c", "1", "leader", nil); !errors.Is(err, ledger.ErrNoQuorum) {
+		t.Fatalf("Expected ErrNoQuorum, got %v", err)
+	}
+	if h, _ := leader.Status(); h != before {
+		t.Fatalf("Leader kept a block without quorum")
+	}
+
+	// f2 catches up on what it missed and f1 drops its uncommitted block
+	validators = []ledger.ValidatorPeer{v1, v2}
+	if _, err := leader.AddClientBlock("d", "1", "leader", nil); err != nil {
+		t.Fatalf("Commit after recovery failed: %v", err)
+	}
+	for i, f := range []*ledger.Blockchain{f1, f2} {
+		if !converged(f) {
+			t.Fatalf("Follower %d did not converge after recovery", i+1)
+		}
+		if _, ok := f.Get("c"); ok {
+			t.Fatalf("Follower %d kept the uncommitted block", i+1)
+		}
+		if !f.IsChainValid() {
+			t.Fatalf("Follower %d chain is invalid", i+1)
+		}
+	}
+
+	// Blocks not signed by the leader are refused
+	rogue := open()
+	rogue.AddBlock("evil", "1", "rogue")
+	if _, err := f1.AcceptBlocks(rogue.Blocks(0, 10)); err == nil {
+		t.Fatal("Follower accepted blocks from a non-leader")
+	}
+
+	// Reads go on while a block waits for its validators
+	release := make(chan struct{})
+	validators = []ledger.ValidatorPeer{slowValidator(release), slowValidator(release)}
+	done := make(chan error, 1)
+	go func() {
+		_, err := leader.AddClientBlock("e", "1", "leader", nil)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	read := make(chan bool, 1)
+	go func() {
+		_, ok := leader.Get("a")
+		read <- ok
+	}()
+	select {
+	case <-read:
+	case <-time.After(time.Second):
+		t.Fatal("Get blocked while a block was being replicated")
+	}
+	close(release)
+	if err := <-done; !errors.Is(err, ledger.ErrNoQuorum) {
+		t.Fatalf("Expected ErrNoQuorum from unreachable validators, got %v", err)
+	}
+
+	// A follower that cannot write its log keeps its uncommitted block
+	// rather than a chain its log does not hold
+	validators = []ledger.ValidatorPeer{v2, downValidator{}, downValidator{}, downValidator{}}
+	if _, err := leader.AddClientBlock("f", "1", "leader", nil); !errors.Is(err, ledger.ErrNoQuorum) {
+		t.Fatalf("Expected ErrNoQuorum, got %v", err)
+	}
+	validators = []ledger.ValidatorPeer{v1}
+	if _, err := leader.AddClientBlock("g", "1", "leader", nil); err != nil {
+		t.Fatalf("Commit failed: %v", err)
+	}
+	height, head := f2.Status()
+	f2.Close()
+	if _, err := f2.AcceptBlocks(leader.Blocks(height-1, 10)); err == nil {
+		t.Fatal("Expected an error when the block log cannot be written")
+	}
+	if h, hh := f2.Status(); h != height || hh != head {
+		t.Fatalf("Follower moved to %d/%s without its log", h, hh)
+	}
+}
+
+// slowValidator fails every append once release is closed
+type slowValidator chan struct{}
+
+func (slowValidator) ID() string { return "slow" }
+
+func (v slowValidator) AppendBlocks([]ledger.Block) (int, error) {
+	<-v
+	return 0, errors.New("unreachable")
+}
+
+func TestWatch(t *testing.T) {
+	bc, err := ledger.NewBlockchain(filepath.Join(t.TempDir(), "ledger.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bc.Close()
+
+	old := bc.AddBlock("cfg.a", "1", "test")
+	bc.AddBlock("other", "x", "test")
+
+	next := func(ch <-chan ledger.Change) ledger.Change {
+		select {
+		case c := <-ch:
+			return c
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Timed out waiting for a change")
+		}
+		return ledger.Change{}
+	}
+
+	// Resuming from an old height replays what was missed
+	changes, stop := bc.Watch("cfg.", true, old.Index)
+	if c := next(changes); c.Key != "cfg.a" || c.Value != "1" || c.Index != old.Index || c.Hash != old.Hash {
+		t.Fatalf("Unexpected replayed change %+v", c)
+	}
+
+	live, stopLive := bc.Watch("cfg.b", false, -1)
+	defer stopLive()
+
+	bc.AddBlock("other", "y", "test")
+	bc.CommitBatch([]ledger.BlockOp{{Key: "cfg.b", Value: "2"}, {Op: ledger.OpDelete, Key: "cfg.a"}}, nil, "test")
+
+	if c := next(changes); c.Key != "cfg.b" || c.Value != "2" {
+		t.Fatalf("Expected cfg.b from the batch, got %+v", c)
+	}
+	if c := next(changes); c.Key != "cfg.a" || !c.Deleted {
+		t.Fatalf("Expected cfg.a tombstone, got %+v", c)
+	}
+	if c := next(live); c.Key != "cfg.b" {
+		t.Fatalf("Exact-key watcher got %+v", c)
+	}
+
+	stop()
+	for range changes {
+	}
+}
@@ -0,0 +1,262 @@
+package ledger
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+)
+
+const (
+	// OpCheckpoint marks a block whose Value is the Merkle root of the
+	// key/value state of every block before it
+	OpCheckpoint = "checkpoint"
+	// CheckpointKey is the reserved key used by checkpoint blocks
+	CheckpointKey = "__checkpoint__"
+	// DefaultCheckpointInterval is how many blocks are written between checkpoints
+	DefaultCheckpointInterval = 100
+)
+
+// IsCheckpoint reports whether the block commits a state root
+func (b Block) IsCheckpoint() bool {
+	return b.Op == OpCheckpoint
+}
+
+// ProofStep is one sibling hash on the path from a leaf to the root
+type ProofStep struct {
+	Hash string `json:"hash"`
+	Left bool   `json:"left"` // sibling sits to the left of the running hash
+}
+
+// Proof shows that Key=Value is part of the state committed by Checkpoint
+type Proof struct {
+	Key        string      `json:"key"`
+	Value      string      `json:"value"`
+	Root       string      `json:"root"`
+	Steps      []ProofStep `json:"steps"`
+	Checkpoint Block       `json:"checkpoint"`
+}
+
+// merkleTree is a binary hash tree over the sorted live keys of a state
+type merkleTree struct {
+	keys   []string
+	values map[string]string
+	levels [][][]byte // levels[0] are the leaves
+}
+
+// leafHash hashes a key/value pair. The 0x00 prefix and key length keep
+// leaves distinct from inner nodes and from other key/value splits.
+func leafHash(key, value string) []byte {
+	var klen [4]byte
+	binary.BigEndian.PutUint32(klen[:], uint32(len(key)))
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	h.Write(klen[:])
+	h.Write([]byte(key))
+	h.Write([]byte(value))
+	return h.Sum(nil)
+}
+
+func nodeHash(left, right []byte) []byte {
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(left)
+	h.Write(right)
+	return h.Sum(nil)
+}
+
+func buildMerkleTree(state map[string]string) *merkleTree {
+	t := &merkleTree{values: state}
+	for k := range state {
+		t.keys = append(t.keys, k)
+	}
+	sort.Strings(t.keys)
+
+	level := make([][]byte, len(t.keys))
+	for i, k := range t.keys {
+		level[i] = leafHash(k, state[k])
+	}
+	t.levels = append(t.levels, level)
+
+	for len(level) > 1 {
+		next := make([][]byte, 0, (len(level)+1)/2)
+		for i := 0; i < len(level); i += 2 {
+			if i+1 == len(level) {
+				next = append(next, level[i]) // odd node is promoted as-is
+				continue
+			}
+			next = append(next, nodeHash(level[i], level[i+1]))
+		}
+		t.levels = append(t.levels, next)
+		level = next
+	}
+	return t
+}
+
+// Root returns the hex root hash; an empty state hashes to sha256("")
+func (t *merkleTree) Root() string {
+	top := t.levels[len(t.levels)-1]
+	if len(top) == 0 {
+		sum := sha256.Sum256(nil)
+		return hex.EncodeToString(sum[:])
+	}
+	return hex.EncodeToString(top[0])
+}
+
+// prove returns the sibling path for the leaf of key
+func (t *merkleTree) prove(key string) ([]ProofStep, bool) {
+	i := sort.SearchStrings(t.keys, key)
+	if i == len(t.keys) || t.keys[i] != key {
+		return nil, false
+	}
+
+	var steps []ProofStep
+	for _, level := range t.levels[:len(t.levels)-1] {
+		sibling := i ^ 1
+		if sibling < len(level) {
+			steps = append(steps, ProofStep{Hash: hex.EncodeToString(level[sibling]), Left: sibling < i})
+		}
+		i /= 2
+	}
+	return steps, true
+}
+
+// VerifyProof lets a light client check a key/value against a checkpoint it
+// trusts by hash, without the rest of the chain.
+func VerifyProof(p *Proof, trustedCheckpointHash string) error {
+	cp := p.Checkpoint
+	if cp.Hash != trustedCheckpointHash {
+		return fmt.Errorf("proof is for checkpoint %s, not the trusted one", cp.Hash)
+	}
+	if !cp.IsCheckpoint() {
+		return fmt.Errorf("block %d is not a checkpoint", cp.Index)
+	}
+	if CalculateHash(cp) != cp.Hash {
+		return fmt.Errorf("checkpoint hash mismatch")
+	}
+	if err := VerifyBlock(cp); err != nil {
+		return err
+	}
+	if p.Root != cp.Value {
+		return fmt.Errorf("proof root does not match checkpoint")
+	}
+
+	running := leafHash(p.Key, p.Value)
+	for _, step := range p.Steps {
+		sibling, err := hex.DecodeString(step.Hash)
+		if err != nil {
+			return fmt.Errorf("bad proof step: %v", err)
+		}
+		if step.Left {
+			running = nodeHash(sibling, running)
+		} else {
+			running = nodeHash(running, sibling)
+		}
+	}
+	root, err := hex.DecodeString(cp.Value)
+	if err != nil || !bytes.Equal(running, root) {
+		return fmt.Errorf("key %s is not in the checkpointed state", p.Key)
+	}
+	return nil
+}
+
+// SetCheckpointInterval changes how often checkpoints are written; 0 disables them
+func (bc *Blockchain) SetCheckpointInterval(n int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	bc.checkpointEvery = n
+}
+
+// Checkpoint appends a checkpoint block over the current state
+func (bc *Blockchain) Checkpoint(validator string) (Block, error) {
+	bc.lockWrite()
+	defer bc.unlockWrite()
+	return bc.appendCheckpoint(validator)
+}
+
+// appendCheckpoint commits the root of the current state. Caller holds the
+// locks from lockWrite.
+func (bc *Blockchain) appendCheckpoint(validator string) (Block, error) {
+	tree := buildMerkleTree(bc.stateAt(len(bc.Chain)))
+	b, err := bc.appendOp(CheckpointKey, tree.Root(), OpCheckpoint, validator, nil)
+	if err != nil {
+		return Block{}, err
+	}
+
+	bc.treeMu.Lock()
+	bc.proofTree, bc.proofTreeFor = tree, b.Hash
+	bc.treeMu.Unlock()
+	return b, nil
+}
+
+// maybeCheckpoint writes a checkpoint once enough blocks have accumulated.
+// Caller holds the locks from lockWrite.
+func (bc *Blockchain) maybeCheckpoint(validator string) {
+	if bc.checkpointEvery <= 0 {
+		return
+	}
+	if len(bc.Chain)-1-bc.lastCheckpoint >= bc.checkpointEvery {
+		if _, err := bc.appendCheckpoint(validator); err != nil {
+			log.Printf("WARNING: Checkpoint not committed: %v", err)
+		}
+	}
+}
+
+// stateAt rebuilds the live key/value state from the blocks before chain
+// position pos, on top of the snapshot the chain starts from. Caller holds bc.mu.
+func (bc *Blockchain) stateAt(pos int) map[string]string {
+	state := make(map[string]string)
+	if bc.baseSnap != nil {
+		for k, v := range bc.baseSnap.State {
+			state[k] = v
+		}
+	}
+	for key, positions := range bc.keyIndex {
+		i := sort.SearchInts(positions, pos) - 1
+		if i < 0 {
+			continue
+		}
+		w := bc.Chain[positions[i]].write(key)
+		if w.Op == OpDelete {
+			delete(state, key)
+		} else {
+			state[key] = w.Value
+		}
+	}
+	return state
+}
+
+// Prove returns a Merkle inclusion proof for key against the latest checkpoint.
+// The value is the one the key had when the checkpoint was written.
+func (bc *Blockchain) Prove(key string) (*Proof, error) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	if bc.lastCheckpoint < 0 {
+		return nil, fmt.Errorf("no checkpoint yet")
+	}
+	cp := bc.Chain[bc.lastCheckpoint]
+
+	bc.treeMu.Lock()
+	if bc.proofTree == nil || bc.proofTreeFor != cp.Hash {
+		bc.proofTree = buildMerkleTree(bc.stateAt(bc.lastCheckpoint))
+		bc.proofTreeFor = cp.Hash
+	}
+	tree := bc.proofTree
+	bc.treeMu.Unlock()
+
+	steps, ok := tree.prove(key)
+	if !ok {
+		return nil, fmt.Errorf("key %s not in checkpoint %d", key, cp.Index)
+	}
+	return &Proof{
+		Key:        key,
+		Value:      tree.values[key],
+		Root:       tree.Root(),
+		Steps:      steps,
+		Checkpoint: cp,
+	}, nil
+}
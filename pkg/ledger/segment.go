@@ -0,0 +1,535 @@
+package ledger
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// DefaultSegmentSize is the size at which the active segment is rotated
+	DefaultSegmentSize int64 = 16 << 20
+
+	segmentExt  = ".seg"
+	indexFile   = "blocks.idx"
+	recordHdr   = 8  // 4 bytes length + 4 bytes CRC32
+	indexEntry  = 12 // 4 bytes segment id + 8 bytes offset
+	maxRecordSz = 64 << 20
+)
+
+// SegmentStore is an append-only block log split across rotating segment files.
+// Every record is length-prefixed and checksummed, and a fixed-width index file
+// maps block index -> (segment, offset) so single blocks can be read without a scan.
+type SegmentStore struct {
+	mu          sync.Mutex
+	dir         string
+	maxSize     int64
+	segments    []uint32
+	active      *os.File
+	activeSize  int64
+	index       *os.File
+	count       int
+	readHandles map[uint32]*os.File
+}
+
+// OpenSegmentStore opens (or creates) a block log in dir and recovers from any torn write
+func OpenSegmentStore(dir string, maxSegmentSize int64) (*SegmentStore, error) {
+	if maxSegmentSize <= 0 {
+		maxSegmentSize = DefaultSegmentSize
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create ledger dir: %v", err)
+	}
+
+	s := &SegmentStore{
+		dir:         dir,
+		maxSize:     maxSegmentSize,
+		readHandles: make(map[uint32]*os.File),
+	}
+
+	segs, err := listSegments(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.segments = segs
+	if len(s.segments) == 0 {
+		s.segments = []uint32{1}
+	}
+
+	s.index, err = os.OpenFile(filepath.Join(dir, indexFile), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ledger index: %v", err)
+	}
+
+	if err := s.recover(); err != nil {
+		s.index.Close()
+		return nil, err
+	}
+
+	last := s.segments[len(s.segments)-1]
+	s.active, err = os.OpenFile(s.segmentPath(last), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		s.index.Close()
+		return nil, fmt.Errorf("failed to open segment %d: %v", last, err)
+	}
+	info, err := s.active.Stat()
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	s.activeSize = info.Size()
+
+	return s, nil
+}
+
+// recover reconciles the index with the segment files. Records written after the
+// last index entry are re-indexed, and a torn record at the tail of the last
+// segment is truncated away.
+func (s *SegmentStore) recover() error {
+	info, err := s.index.Stat()
+	if err != nil {
+		return err
+	}
+	s.count = int(info.Size() / indexEntry)
+
+	// Walk back until the last indexed record is readable
+	seg, pos := s.segments[0], int64(0)
+	for s.count > 0 {
+		lastSeg, lastOff, err := s.readIndex(s.count - 1)
+		if err == nil {
+			if n, err := s.recordLen(lastSeg, lastOff); err == nil {
+				seg, pos = lastSeg, lastOff+n
+				break
+			}
+		}
+		s.count--
+	}
+	if err := s.index.Truncate(int64(s.count) * indexEntry); err != nil {
+		return fmt.Errorf("failed to truncate ledger index: %v", err)
+	}
+
+	// Index anything that made it into a segment but not into the index
+	start := sort.Search(len(s.segments), func(i int) bool { return s.segments[i] >= seg })
+	for i := start; i < len(s.segments); i++ {
+		id := s.segments[i]
+		if id != seg {
+			pos = 0
+		}
+		isLast := i == len(s.segments)-1
+
+		for {
+			n, err := s.recordLen(id, pos)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				if !isLast {
+					return fmt.Errorf("segment %d corrupt at offset %d: %v", id, pos, err)
+				}
+				if err := os.Truncate(s.segmentPath(id), pos); err != nil {
+					return fmt.Errorf("failed to truncate torn record: %v", err)
+				}
+				break
+			}
+			if err := s.writeIndex(id, pos); err != nil {
+				return err
+			}
+			pos += n
+		}
+	}
+
+	return s.index.Sync()
+}
+
+// Append writes a block to the active segment and indexes it. Both files are
+// fsync'd before returning so an acknowledged block survives a crash.
+func (s *SegmentStore) Append(b Block) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	payload, err := json.Marshal(b)
+	if err != nil {
+		return err
+	}
+	rec := make([]byte, recordHdr+len(payload))
+	binary.BigEndian.PutUint32(rec[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(rec[4:8], crc32.ChecksumIEEE(payload))
+	copy(rec[recordHdr:], payload)
+
+	if s.activeSize > 0 && s.activeSize+int64(len(rec)) > s.maxSize {
+		if err := s.rotate(); err != nil {
+			return err
+		}
+	}
+
+	offset, count := s.activeSize, s.count
+	if _, err := s.active.Write(rec); err != nil {
+		s.rollback(offset, count)
+		return fmt.Errorf("failed to write block %d: %v", b.Index, err)
+	}
+	if err := s.active.Sync(); err != nil {
+		s.rollback(offset, count)
+		return fmt.Errorf("failed to sync segment: %v", err)
+	}
+	s.activeSize += int64(len(rec))
+
+	if err := s.writeIndex(s.segments[len(s.segments)-1], offset); err != nil {
+		s.rollback(offset, count)
+		return err
+	}
+	if err := s.index.Sync(); err != nil {
+		s.rollback(offset, count)
+		return fmt.Errorf("failed to sync ledger index: %v", err)
+	}
+	return nil
+}
+
+// rollback undoes a failed Append, cutting the active segment back to off
+// and the index back to count entries so the next record is not written
+// after torn data. If the segment cannot be cut its real size is used, so
+// the index at least points where the next record lands. Caller holds s.mu.
+func (s *SegmentStore) rollback(off int64, count int) {
+	if err := s.active.Truncate(off); err == nil {
+		s.activeSize = off
+	} else if info, err := s.active.Stat(); err == nil {
+		s.activeSize = info.Size()
+	}
+	s.index.Truncate(int64(count) * indexEntry)
+	s.count = count
+}
+
+// Get reads a single block by its position in the log
+func (s *SegmentStore) Get(i int) (Block, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i < 0 || i >= s.count {
+		return Block{}, fmt.Errorf("block %d out of range", i)
+	}
+	seg, off, err := s.readIndex(i)
+	if err != nil {
+		return Block{}, err
+	}
+	payload, err := s.readRecord(seg, off)
+	if err != nil {
+		return Block{}, err
+	}
+	var b Block
+	if err := json.Unmarshal(payload, &b); err != nil {
+		return Block{}, fmt.Errorf("failed to decode block %d: %v", i, err)
+	}
+	return b, nil
+}
+
+// ForEach calls fn for every block in log order
+func (s *SegmentStore) ForEach(fn func(Block) error) error {
+	return s.ForEachFrom(0, fn)
+}
+
+// ForEachFrom calls fn for every block from position start onwards
+func (s *SegmentStore) ForEachFrom(start int, fn func(Block) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if start < 0 {
+		start = 0
+	}
+	for i := start; i < s.count; i++ {
+		seg, off, err := s.readIndex(i)
+		if err != nil {
+			return err
+		}
+		payload, err := s.readRecord(seg, off)
+		if err != nil {
+			return err
+		}
+		var b Block
+		if err := json.Unmarshal(payload, &b); err != nil {
+			return fmt.Errorf("failed to decode block %d: %v", i, err)
+		}
+		if err := fn(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Truncate drops every block at position n and beyond. It is used when a
+// fork is resolved in favour of a peer chain.
+func (s *SegmentStore) Truncate(n int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if n < 0 {
+		return fmt.Errorf("invalid truncate position %d", n)
+	}
+	if n >= s.count {
+		return nil
+	}
+	seg, off, err := s.readIndex(n)
+	if err != nil {
+		return err
+	}
+
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+	keep := s.segments[:0]
+	for _, id := range s.segments {
+		if id <= seg {
+			keep = append(keep, id)
+			continue
+		}
+		if f, ok := s.readHandles[id]; ok {
+			f.Close()
+			delete(s.readHandles, id)
+		}
+		if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove segment %d: %v", id, err)
+		}
+	}
+	s.segments = keep
+
+	if err := os.Truncate(s.segmentPath(seg), off); err != nil {
+		return fmt.Errorf("failed to truncate segment %d: %v", seg, err)
+	}
+	if err := s.index.Truncate(int64(n) * indexEntry); err != nil {
+		return fmt.Errorf("failed to truncate ledger index: %v", err)
+	}
+	if err := s.index.Sync(); err != nil {
+		return err
+	}
+	s.count = n
+
+	s.active, err = os.OpenFile(s.segmentPath(seg), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to reopen segment %d: %v", seg, err)
+	}
+	s.activeSize = off
+	return nil
+}
+
+// PruneBefore deletes the segments that only hold blocks before position pos
+// and rewrites the index so position 0 is the first block left. The segment
+// holding pos is kept whole. It returns how many blocks were dropped.
+func (s *SegmentStore) PruneBefore(pos int) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if pos < 0 || pos >= s.count {
+		return 0, fmt.Errorf("prune position %d out of range", pos)
+	}
+	seg, _, err := s.readIndex(pos)
+	if err != nil {
+		return 0, err
+	}
+	first := pos
+	for first > 0 {
+		prev, _, err := s.readIndex(first - 1)
+		if err != nil {
+			return 0, err
+		}
+		if prev != seg {
+			break
+		}
+		first--
+	}
+	if first == 0 {
+		return 0, nil
+	}
+
+	// Swap in the shortened index before deleting segments, so a crash in
+	// between only leaves unreferenced segment files behind
+	entries := make([]byte, (s.count-first)*indexEntry)
+	if _, err := s.index.ReadAt(entries, int64(first)*indexEntry); err != nil {
+		return 0, fmt.Errorf("failed to read ledger index: %v", err)
+	}
+	indexPath := filepath.Join(s.dir, indexFile)
+	tmp, err := os.OpenFile(indexPath+".tmp", os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, fmt.Errorf("failed to write ledger index: %v", err)
+	}
+	if _, err := tmp.Write(entries); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to write ledger index: %v", err)
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return 0, err
+	}
+	s.index.Close()
+	if err := os.Rename(tmp.Name(), indexPath); err != nil {
+		tmp.Close()
+		return 0, fmt.Errorf("failed to replace ledger index: %v", err)
+	}
+	s.index = tmp
+	s.count -= first
+
+	keep := s.segments[:0]
+	for _, id := range s.segments {
+		if id >= seg {
+			keep = append(keep, id)
+			continue
+		}
+		if f, ok := s.readHandles[id]; ok {
+			f.Close()
+			delete(s.readHandles, id)
+		}
+		if err := os.Remove(s.segmentPath(id)); err != nil && !os.IsNotExist(err) {
+			return first, fmt.Errorf("failed to remove segment %d: %v", id, err)
+		}
+	}
+	s.segments = keep
+	return first, nil
+}
+
+// Len returns the number of blocks in the log
+func (s *SegmentStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// Close flushes and closes all open files
+func (s *SegmentStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, f := range s.readHandles {
+		f.Close()
+		delete(s.readHandles, id)
+	}
+	var firstErr error
+	if s.active != nil {
+		if err := s.active.Close(); err != nil {
+			firstErr = err
+		}
+	}
+	if s.index != nil {
+		if err := s.index.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *SegmentStore) rotate() error {
+	if err := s.active.Sync(); err != nil {
+		return err
+	}
+	if err := s.active.Close(); err != nil {
+		return err
+	}
+
+	next := s.segments[len(s.segments)-1] + 1
+	f, err := os.OpenFile(s.segmentPath(next), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create segment %d: %v", next, err)
+	}
+	s.segments = append(s.segments, next)
+	s.active = f
+	s.activeSize = 0
+	return nil
+}
+
+func (s *SegmentStore) readIndex(i int) (uint32, int64, error) {
+	var entry [indexEntry]byte
+	if _, err := s.index.ReadAt(entry[:], int64(i)*indexEntry); err != nil {
+		return 0, 0, fmt.Errorf("failed to read index entry %d: %v", i, err)
+	}
+	return binary.BigEndian.Uint32(entry[0:4]), int64(binary.BigEndian.Uint64(entry[4:12])), nil
+}
+
+func (s *SegmentStore) writeIndex(seg uint32, off int64) error {
+	var entry [indexEntry]byte
+	binary.BigEndian.PutUint32(entry[0:4], seg)
+	binary.BigEndian.PutUint64(entry[4:12], uint64(off))
+	if _, err := s.index.WriteAt(entry[:], int64(s.count)*indexEntry); err != nil {
+		return fmt.Errorf("failed to write ledger index: %v", err)
+	}
+	s.count++
+	return nil
+}
+
+// recordLen validates the record at off and returns its total on-disk size
+func (s *SegmentStore) recordLen(seg uint32, off int64) (int64, error) {
+	payload, err := s.readRecord(seg, off)
+	if err != nil {
+		return 0, err
+	}
+	return int64(recordHdr + len(payload)), nil
+}
+
+func (s *SegmentStore) readRecord(seg uint32, off int64) ([]byte, error) {
+	f, err := s.reader(seg)
+	if err != nil {
+		return nil, err
+	}
+
+	var hdr [recordHdr]byte
+	n, err := f.ReadAt(hdr[:], off)
+	if n == 0 && err == io.EOF {
+		return nil, io.EOF
+	}
+	if n < recordHdr {
+		return nil, fmt.Errorf("short record header")
+	}
+	size := binary.BigEndian.Uint32(hdr[0:4])
+	if size == 0 || size > maxRecordSz {
+		return nil, fmt.Errorf("invalid record length %d", size)
+	}
+	payload := make([]byte, size)
+	if _, err := f.ReadAt(payload, off+recordHdr); err != nil {
+		return nil, fmt.Errorf("short record payload")
+	}
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(hdr[4:8]) {
+		return nil, fmt.Errorf("checksum mismatch")
+	}
+	return payload, nil
+}
+
+// reader returns a cached read-only handle for a segment
+func (s *SegmentStore) reader(seg uint32) (*os.File, error) {
+	if f, ok := s.readHandles[seg]; ok {
+		return f, nil
+	}
+	f, err := os.OpenFile(s.segmentPath(seg), os.O_RDONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	s.readHandles[seg] = f
+	return f, nil
+}
+
+func (s *SegmentStore) segmentPath(id uint32) string {
+	return filepath.Join(s.dir, fmt.Sprintf("%08d%s", id, segmentExt))
+}
+
+func listSegments(dir string) ([]uint32, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read ledger dir: %v", err)
+	}
+	var ids []uint32
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 10, 32)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, uint32(id))
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
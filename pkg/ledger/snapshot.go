@@ -0,0 +1,295 @@
+package ledger
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const snapshotFile = "snapshot.json"
+
+// Snapshot is a signed copy of the key/value state after the first Height
+// blocks. A node can start from it and replay only the blocks after Head.
+type Snapshot struct {
+	Height    int               `json:"height"`
+	Head      Block             `json:"head"`       // block Height-1, the tail links to it
+	StateRoot string            `json:"state_root"` // Merkle root of State
+	State     map[string]string `json:"state"`
+	CreatedAt string            `json:"created_at"`
+	NodeID    string            `json:"node_id"`
+	PublicKey string            `json:"public_key"`
+	Signature string            `json:"signature"`
+}
+
+func (s *Snapshot) digest() []byte {
+	return []byte(fmt.Sprintf("%d%s%s%s", s.Height, s.Head.Hash, s.StateRoot, s.CreatedAt))
+}
+
+// Verify checks the anchor block, the state root and the signature
+func (s *Snapshot) Verify() error {
+	if s.Height < 1 || s.Head.Index != s.Height-1 {
+		return fmt.Errorf("snapshot head %d does not match height %d", s.Head.Index, s.Height)
+	}
+	if CalculateHash(s.Head) != s.Head.Hash {
+		return fmt.Errorf("snapshot head hash mismatch")
+	}
+	if buildMerkleTree(s.State).Root() != s.StateRoot {
+		return fmt.Errorf("snapshot state does not match its root")
+	}
+	if !VerifySignature(s.PublicKey, s.Signature, s.digest()) {
+		return fmt.Errorf("invalid snapshot signature")
+	}
+	return nil
+}
+
+func loadSnapshot(filename string) (*Snapshot, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var s Snapshot
+	if err := json.Unmarshal(content, &s); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot: %v", err)
+	}
+	if s.State == nil {
+		s.State = make(map[string]string)
+	}
+	return &s, nil
+}
+
+// writeSnapshot replaces the snapshot file via a temp file so a crash never
+// leaves a half-written snapshot behind
+func writeSnapshot(filename string, s *Snapshot) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func (bc *Blockchain) snapshotPath() string {
+	return filepath.Join(SegmentDir(bc.Filename), snapshotFile)
+}
+
+// useSnapshot loads s as the latest snapshot and, if asBase is set, makes it
+// the starting point of the in-memory chain. The block log must contain the
+// snapshot head, start right after it, or be empty. Caller has exclusive
+// access during load.
+func (bc *Blockchain) useSnapshot(s *Snapshot, asBase bool) error {
+	if err := s.Verify(); err != nil {
+		return err
+	}
+	pos := s.Height - 1 - bc.storeBase
+	switch {
+	case bc.store.Len() == 0:
+		bc.storeBase = s.Height
+	case pos == -1:
+		// Node was started from the snapshot alone
+		b, err := bc.store.Get(0)
+		if err != nil {
+			return err
+		}
+		if b.PreviousHash != s.Head.Hash {
+			return fmt.Errorf("block %d does not link to the snapshot head", b.Index)
+		}
+	case pos < 0 || pos >= bc.store.Len():
+		return fmt.Errorf("snapshot height %d is outside the block log", s.Height)
+	default:
+		b, err := bc.store.Get(pos)
+		if err != nil {
+			return err
+		}
+		if b.Hash != s.Head.Hash {
+			return fmt.Errorf("snapshot head does not match block %d in the log", b.Index)
+		}
+	}
+	bc.snapshot = s
+	if !asBase {
+		return nil
+	}
+	bc.baseSnap = s
+	for k, v := range s.State {
+		bc.Data[k] = v
+	}
+	return nil
+}
+
+// Snapshot returns the latest snapshot, or nil if none was taken
+func (bc *Blockchain) Snapshot() *Snapshot {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.snapshot
+}
+
+// CreateSnapshot signs and saves the state after the first height blocks.
+// A height of 0 snapshots the current head.
+func (bc *Blockchain) CreateSnapshot(height int) (*Snapshot, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	if height == 0 {
+		height = bc.height()
+	}
+	base := bc.base()
+	if height <= base || height > bc.height() {
+		return nil, fmt.Errorf("snapshot height must be between %d and %d", base+1, bc.height())
+	}
+	if bc.identity == nil {
+		return nil, fmt.Errorf("no node identity to sign the snapshot")
+	}
+
+	pos := height - base
+	s := &Snapshot{
+		Height:    height,
+		Head:      bc.Chain[pos-1],
+		State:     bc.stateAt(pos),
+		CreatedAt: time.Now().Format(time.RFC3339),
+		NodeID:    bc.identity.NodeID,
+		PublicKey: bc.identity.PublicKeyHex(),
+	}
+	s.StateRoot = buildMerkleTree(s.State).Root()
+	s.Signature = bc.identity.Sign(s.digest())
+
+	if err := writeSnapshot(bc.snapshotPath(), s); err != nil {
+		return nil, err
+	}
+	bc.snapshot = s
+	return s, nil
+}
+
+// Prune deletes on-disk blocks older than the latest snapshot and restarts
+// the in-memory chain from it. The segment holding the snapshot head is kept
+// so the remaining blocks still link back to a stored block. History and
+// versions only cover blocks after the snapshot from then on.
+func (bc *Blockchain) Prune() (int, error) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	s := bc.snapshot
+	if s == nil {
+		return 0, fmt.Errorf("no snapshot to prune to")
+	}
+	dropped := 0
+	if pos := s.Height - 1 - bc.storeBase; pos > 0 {
+		n, err := bc.store.PruneBefore(pos)
+		if err != nil {
+			return 0, err
+		}
+		bc.storeBase += n
+		dropped = n
+	}
+
+	if s != bc.baseSnap {
+		chain := bc.Chain[s.Height-bc.base():]
+		bc.baseSnap = s
+		bc.Chain = chain
+		bc.rebuildIndexes()
+	}
+	return dropped, nil
+}
+
+// ExportState writes the live key/value state as "json" (one object) or
+// "csv" (key,value rows with a header)
+func (bc *Blockchain) ExportState(w io.Writer, format string) error {
+	bc.mu.RLock()
+	state := make(map[string]string, len(bc.Data))
+	for k, v := range bc.Data {
+		state[k] = v
+	}
+	bc.mu.RUnlock()
+
+	switch format {
+	case "json":
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(state)
+	case "csv":
+		keys := make([]string, 0, len(state))
+		for k := range state {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"key", "value"})
+		for _, k := range keys {
+			cw.Write([]string{k, state[k]})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+	return fmt.Errorf("unknown export format %q", format)
+}
+
+// ImportState appends one block per key read from r (see ExportState for the
+// formats). It only runs on a fresh ledger that holds nothing but genesis.
+func (bc *Blockchain) ImportState(r io.Reader, format, validator string) (int, error) {
+	state := make(map[string]string)
+	switch format {
+	case "json":
+		if err := json.NewDecoder(r).Decode(&state); err != nil {
+			return 0, fmt.Errorf("failed to decode state: %v", err)
+		}
+	case "csv":
+		rows, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return 0, fmt.Errorf("failed to decode state: %v", err)
+		}
+		for i, row := range rows {
+			if len(row) != 2 {
+				return 0, fmt.Errorf("row %d: expected key,value", i+1)
+			}
+			if i == 0 && row[0] == "key" && row[1] == "value" {
+				continue
+			}
+			state[row[0]] = row[1]
+		}
+	default:
+		return 0, fmt.Errorf("unknown import format %q", format)
+	}
+
+	bc.lockWrite()
+	defer bc.unlockWrite()
+
+	if bc.height() > 1 {
+		return 0, fmt.Errorf("ledger already has %d blocks, import needs a fresh ledger", bc.height())
+	}
+	keys := make([]string, 0, len(state))
+	for k := range state {
+		if k == "" || k == CheckpointKey {
+			continue
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for i, k := range keys {
+		if _, err := bc.appendBlock(k, state[k], validator, nil); err != nil {
+			return i, err
+		}
+		bc.maybeCheckpoint(validator)
+	}
+	return len(keys), nil
+}
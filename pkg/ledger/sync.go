@@ -0,0 +1,304 @@
+package ledger
+
+import (
+	"fmt"
+)
+
+// MaxBlocksPerRequest caps how many blocks a peer returns for one BLOCKS call
+const MaxBlocksPerRequest = 500
+
+// Peer is a remote ledger that blocks can be pulled from
+type Peer interface {
+	// Status returns the peer's chain height and head hash
+	Status() (height int, head string, err error)
+	// Blocks returns up to limit blocks starting at index start
+	Blocks(start, limit int) ([]Block, error)
+}
+
+// SyncResult describes what a sync round changed locally
+type SyncResult struct {
+	Height   int    `json:"height"`
+	Head     string `json:"head"`
+	Pulled   int    `json:"pulled"`   // blocks adopted from the peer
+	Orphaned int    `json:"orphaned"` // local blocks dropped by fork resolution
+	Adopted  bool   `json:"adopted"`  // true if the peer chain won
+}
+
+// PrefersChain reports whether a chain with the given height and head should
+// replace the local one. Longest valid chain wins; on equal height the lower
+// head hash wins so every node picks the same fork.
+func PrefersChain(height int, head string, localHeight int, localHead string) bool {
+	if height != localHeight {
+		return height > localHeight
+	}
+	return head != localHead && head < localHead
+}
+
+// ValidateChain checks a full chain from genesis: indices, hashes, links and
+// signatures. Every block must be signed.
+func ValidateChain(blocks []Block) error {
+	return validateSegment(nil, blocks, VerifyBlock)
+}
+
+// validateSegment checks blocks as a continuation of prev (nil for genesis),
+// checking signatures with verify
+func validateSegment(prev *Block, blocks []Block, verify func(Block) error) error {
+	for i := range blocks {
+		b := blocks[i]
+		expected := 0
+		if prev != nil {
+			expected = prev.Index + 1
+		}
+		if b.Index != expected {
+			return fmt.Errorf("block %d: expected index %d", b.Index, expected)
+		}
+		if b.Hash != CalculateHash(b) {
+			return fmt.Errorf("block %d: hash mismatch", b.Index)
+		}
+		if prev != nil && b.PreviousHash != prev.Hash {
+			return fmt.Errorf("block %d: broken link to previous block", b.Index)
+		}
+		if err := verify(b); err != nil {
+			return err
+		}
+		prev = &blocks[i]
+	}
+	return nil
+}
+
+// Status returns the local chain height and head hash
+func (bc *Blockchain) Status() (int, string) {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+	return bc.height(), bc.headHash()
+}
+
+// Blocks returns up to limit blocks starting at index start. Blocks before
+// the in-memory chain are read from the log; pruned ones are not available.
+func (bc *Blockchain) Blocks(start, limit int) []Block {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	if limit <= 0 || limit > MaxBlocksPerRequest {
+		limit = MaxBlocksPerRequest
+	}
+	if start < bc.storeBase || start >= bc.height() {
+		return []Block{}
+	}
+	out := make([]Block, 0, limit)
+	base := bc.base()
+	for i := start; i < base && len(out) < limit; i++ {
+		b, err := bc.store.Get(i - bc.storeBase)
+		if err != nil {
+			return []Block{}
+		}
+		out = append(out, b)
+	}
+	if len(out) == limit {
+		return out
+	}
+
+	from := start - base
+	if from < 0 {
+		from = 0
+	}
+	end := from + limit - len(out)
+	if end > len(bc.Chain) {
+		end = len(bc.Chain)
+	}
+	return append(out, bc.Chain[from:end]...)
+}
+
+// SyncWith pulls missing blocks from a peer and resolves forks with PrefersChain.
+// Network calls happen without holding the chain lock; the local chain is
+// re-checked before anything is replaced.
+func (bc *Blockchain) SyncWith(p Peer) (SyncResult, error) {
+	localHeight, localHead := bc.Status()
+	result := SyncResult{Height: localHeight, Head: localHead}
+
+	peerHeight, peerHead, err := p.Status()
+	if err != nil {
+		return result, fmt.Errorf("peer status: %v", err)
+	}
+	if !PrefersChain(peerHeight, peerHead, localHeight, localHead) {
+		return result, nil
+	}
+
+	fork, err := bc.findForkPoint(p, localHeight, peerHeight)
+	if err != nil {
+		return result, err
+	}
+
+	// Pull everything the peer has past the common prefix
+	var incoming []Block
+	for next := fork; next < peerHeight; {
+		batch, err := p.Blocks(next, MaxBlocksPerRequest)
+		if err != nil {
+			return result, fmt.Errorf("peer blocks from %d: %v", next, err)
+		}
+		if len(batch) == 0 {
+			break
+		}
+		incoming = append(incoming, batch...)
+		next += len(batch)
+	}
+	if fork+len(incoming) != peerHeight {
+		return result, fmt.Errorf("peer returned %d blocks, expected %d", len(incoming), peerHeight-fork)
+	}
+
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	// Blocks covered by a snapshot are final
+	if bc.snapshot != nil && fork < bc.snapshot.Height {
+		return result, fmt.Errorf("peer chain forks at %d, below the snapshot at %d", fork, bc.snapshot.Height)
+	}
+	base := bc.base()
+	var prev *Block
+	switch {
+	case fork > bc.height():
+		return result, fmt.Errorf("local chain changed during sync")
+	case fork > base:
+		prev = &bc.Chain[fork-base-1]
+	case bc.baseSnap != nil:
+		prev = &bc.baseSnap.Head
+	}
+	if err := validateSegment(prev, incoming, VerifyBlock); err != nil {
+		return result, fmt.Errorf("peer chain rejected: %v", err)
+	}
+	if bc.consensus != nil {
+		for _, b := range incoming {
+			if err := bc.consensus.Accept(b); err != nil {
+				return result, fmt.Errorf("peer chain rejected: %v", err)
+			}
+		}
+	}
+
+	// Re-check the fork rule against the current local head
+	curHead := bc.headHash()
+	newHead := incoming[len(incoming)-1].Hash
+	if !PrefersChain(fork+len(incoming), newHead, bc.height(), curHead) {
+		return SyncResult{Height: bc.height(), Head: curHead}, nil
+	}
+
+	orphaned := bc.height() - fork
+	if err := bc.replaceTail(fork, incoming); err != nil {
+		return SyncResult{Height: bc.height(), Head: bc.headHash()}, err
+	}
+
+	return SyncResult{
+		Height:   bc.height(),
+		Head:     newHead,
+		Pulled:   len(incoming),
+		Orphaned: orphaned,
+		Adopted:  true,
+	}, nil
+}
+
+// findForkPoint returns the length of the prefix shared with the peer
+func (bc *Blockchain) findForkPoint(p Peer, localHeight, peerHeight int) (int, error) {
+	top := localHeight
+	if peerHeight < top {
+		top = peerHeight
+	}
+
+	for top > 0 {
+		start := top - MaxBlocksPerRequest
+		if start < 0 {
+			start = 0
+		}
+		remote, err := p.Blocks(start, top-start)
+		if err != nil {
+			return 0, fmt.Errorf("peer blocks from %d: %v", start, err)
+		}
+		local := bc.Blocks(start, top-start)
+
+		for i := len(remote) - 1; i >= 0; i-- {
+			if i < len(local) && local[i].Hash == remote[i].Hash {
+				return start + i + 1, nil
+			}
+		}
+		top = start
+	}
+	return 0, nil
+}
+
+// rebuildIndexes recomputes the latest-value map and key index from the
+// starting snapshot and the chain. Caller holds bc.mu.
+func (bc *Blockchain) rebuildIndexes() {
+	chain := bc.Chain
+	bc.Chain = make([]Block, 0, len(chain))
+	bc.Data = make(map[string]string)
+	if bc.baseSnap != nil {
+		for k, v := range bc.baseSnap.State {
+			bc.Data[k] = v
+		}
+	}
+	bc.keyIndex = make(map[string][]int)
+	bc.lastCheckpoint = -1
+	for _, b := range chain {
+		bc.applyBlock(b)
+	}
+}
+
+// replaceTail swaps the blocks from index fork on, which must not be below
+// base(), for blocks, on disk and in memory. If they cannot all be stored
+// the old tail is written back, and the chain ends up holding exactly what
+// the log does. Caller holds bc.mu and has validated blocks.
+func (bc *Blockchain) replaceTail(fork int, blocks []Block) error {
+	keep := fork - bc.base()
+	old := bc.Chain[keep:]
+	if len(old) == 0 {
+		// A plain append: each stored block is applied as it goes
+		for _, b := range blocks {
+			if err := bc.store.Append(b); err != nil {
+				return fmt.Errorf("failed to persist block %d: %v", b.Index, err)
+			}
+			bc.applyBlock(b)
+		}
+		return nil
+	}
+
+	persist := func(list []Block) (int, error) {
+		for i, b := range list {
+			if err := bc.store.Append(b); err != nil {
+				return i, fmt.Errorf("failed to persist block %d: %v", b.Index, err)
+			}
+		}
+		return len(list), nil
+	}
+	if err := bc.store.Truncate(fork - bc.storeBase); err != nil {
+		return err
+	}
+	n, err := persist(blocks)
+	tail := blocks
+	if err != nil {
+		tail = blocks[:n]
+		if bc.store.Truncate(fork-bc.storeBase) == nil {
+			restored, _ := persist(old)
+			tail = old[:restored]
+		}
+	}
+	bc.Chain = append(bc.Chain[:keep:keep], tail...)
+	bc.rebuildIndexes()
+	return err
+}
+
+// localPeer adapts an in-process Blockchain to the Peer interface
+type localPeer struct {
+	bc *Blockchain
+}
+
+// AsPeer exposes a local chain as a Peer, e.g. for in-process replication
+func (bc *Blockchain) AsPeer() Peer {
+	return localPeer{bc: bc}
+}
+
+func (lp localPeer) Status() (int, string, error) {
+	h, head := lp.bc.Status()
+	return h, head, nil
+}
+
+func (lp localPeer) Blocks(start, limit int) ([]Block, error) {
+	return lp.bc.Blocks(start, limit), nil
+}
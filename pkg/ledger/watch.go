@@ -0,0 +1,103 @@
+package ledger
+
+import (
+	"strings"
+	"sync"
+)
+
+// Change is one key change delivered to a watcher
+type Change struct {
+	Key       string `json:"key"`
+	Value     string `json:"value"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Index     int    `json:"index"` // block index; resume with Index+1
+	Hash      string `json:"hash"`
+	Timestamp string `json:"timestamp"`
+}
+
+// notifyLocked wakes every watcher waiting for new blocks. Caller holds bc.mu.
+func (bc *Blockchain) notifyLocked() {
+	if bc.changed != nil {
+		close(bc.changed)
+	}
+	bc.changed = make(chan struct{})
+}
+
+// waitChange returns a channel that is closed on the next chain change,
+// plus the current height and the first block index still stored
+func (bc *Blockchain) waitChange() (<-chan struct{}, int, int) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+	if bc.changed == nil {
+		bc.changed = make(chan struct{})
+	}
+	return bc.changed, bc.height(), bc.storeBase
+}
+
+// Watch streams every change to key, or to every key starting with key when
+// prefix is set, from block index from onwards. A negative from starts at the
+// current head. The channel is closed after stop is called.
+func (bc *Blockchain) Watch(key string, prefix bool, from int) (<-chan Change, func()) {
+	out := make(chan Change, 64)
+	done := make(chan struct{})
+
+	match := func(k string) bool {
+		if prefix {
+			return strings.HasPrefix(k, key)
+		}
+		return k == key
+	}
+
+	if from < 0 {
+		from, _ = bc.Status()
+	}
+
+	go func() {
+		defer close(out)
+		next := from
+		for {
+			wait, height, first := bc.waitChange()
+			if next > height {
+				next = height // the chain was cut back by fork resolution
+			}
+			if next < first {
+				next = first // older blocks were pruned
+			}
+
+			blocks := bc.Blocks(next, MaxBlocksPerRequest)
+			for _, b := range blocks {
+				for _, w := range b.Writes() {
+					if !match(w.Key) {
+						continue
+					}
+					c := Change{
+						Key:       w.Key,
+						Value:     w.Value,
+						Deleted:   w.Op == OpDelete,
+						Index:     b.Index,
+						Hash:      b.Hash,
+						Timestamp: b.Timestamp,
+					}
+					select {
+					case out <- c:
+					case <-done:
+						return
+					}
+				}
+			}
+			next += len(blocks)
+			if len(blocks) == MaxBlocksPerRequest {
+				continue
+			}
+
+			select {
+			case <-wait:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return out, func() { once.Do(func() { close(done) }) }
+}
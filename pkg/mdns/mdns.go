@@ -0,0 +1,644 @@
+// Package mdns is a multicast DNS responder (RFC 6762). It claims a host
+// name under .local by probing, announces it, answers for it and its
+// subdomains, and advertises services with DNS-SD (RFC 6763).
+package mdns
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+)
+
+const (
+	Port = 5353
+
+	HostTTL    = 120  // address, SRV and reverse records (RFC 6762 §10)
+	ServiceTTL = 4500 // PTR and TXT records
+	legacyTTL  = 10   // one-shot queries from plain resolvers (§6.7)
+
+	// cacheFlush marks a record set as complete (§10.2). In questions the
+	// same bit asks for a unicast reply (QU, §5.4).
+	cacheFlush = 0x8000
+
+	maxPacket = 1460 // stay below a typical Ethernet MTU
+
+	probeCount    = 3
+	announceCount = 2
+
+	DefaultProbeWait    = 250 * time.Millisecond
+	DefaultAnnounceWait = time.Second
+	lostTieWait         = time.Second     // after losing a simultaneous probe (§8.2)
+	rateLimitWait       = 5 * time.Second // after too many conflicts (§8.1)
+	maxConflicts        = 15
+)
+
+// Group is the IPv4 mDNS multicast group
+var Group = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: Port}
+
+// Service is a DNS-SD service instance on the host
+type Service struct {
+	Instance string   // human readable, e.g. "Nexa Storage"
+	Type     string   // e.g. "_http._tcp"
+	Port     int      // SRV port
+	Text     []string // TXT key=value pairs
+}
+
+// Config describes what the responder claims
+type Config struct {
+	Host     string          // label claimed under .local, e.g. "nexa"
+	Addrs    func() []net.IP // current addresses of the host
+	Services []Service
+
+	Group        *net.UDPAddr // multicast destination, Group by default
+	ProbeWait    time.Duration
+	AnnounceWait time.Duration
+
+	// OnClaimed is called with the host name and instance names once
+	// probing has won them, which may differ from the configured ones
+	OnClaimed func(host string, instances []string)
+}
+
+type state int
+
+const (
+	probing state = iota
+	announcing
+	ready
+)
+
+// Responder answers mDNS queries on one socket
+type Responder struct {
+	cfg  Config
+	conn net.PacketConn
+
+	mu          sync.Mutex
+	hostRenames int
+	instRenames []int
+	conflicts   int // since the names were last claimed
+	state       state
+	sent        int // probes or announcements sent in the current state
+	gen         int // invalidates timers from before a restart
+	timer       *time.Timer
+	closed      bool
+}
+
+// record is a resource record we own. Unique records belong to this host
+// alone and are probed for; shared ones (service PTRs) may come from many.
+type record struct {
+	rr     dnsmsg.RR
+	unique bool
+}
+
+// New creates a responder that sends and receives on conn
+func New(cfg Config, conn net.PacketConn) *Responder {
+	if cfg.Group == nil {
+		cfg.Group = Group
+	}
+	if cfg.ProbeWait <= 0 {
+		cfg.ProbeWait = DefaultProbeWait
+	}
+	if cfg.AnnounceWait <= 0 {
+		cfg.AnnounceWait = DefaultAnnounceWait
+	}
+	if cfg.Addrs == nil {
+		cfg.Addrs = func() []net.IP { return nil }
+	}
+	return &Responder{cfg: cfg, conn: conn, instRenames: make([]int, len(cfg.Services))}
+}
+
+// Serve probes for the configured names, announces them and answers
+// queries until the connection is closed
+func (r *Responder) Serve() error {
+	r.mu.Lock()
+	// A random delay keeps hosts that power up together from probing in lockstep
+	r.restart(time.Duration(rand.Int63n(int64(r.cfg.ProbeWait))))
+	r.mu.Unlock()
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			r.mu.Lock()
+			closed := r.closed
+			r.mu.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		if addr, ok := from.(*net.UDPAddr); ok {
+			r.handle(buf[:n], addr)
+		}
+	}
+}
+
+// Close says goodbye (records with TTL 0) and closes the connection
+func (r *Responder) Close() error {
+	r.mu.Lock()
+	if r.state != probing {
+		m := r.announcement()
+		for i := range m.Answers {
+			m.Answers[i].TTL = 0
+		}
+		r.send(m, r.cfg.Group)
+	}
+	r.closed = true
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.mu.Unlock()
+	return r.conn.Close()
+}
+
+// HostName is the host name currently claimed or being probed for
+func (r *Responder) HostName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.hostName()
+}
+
+// Instances are the service instance names currently claimed or being probed for
+func (r *Responder) Instances() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]string, len(r.cfg.Services))
+	for i := range out {
+		out[i] = r.instanceLabel(i)
+	}
+	return out
+}
+
+func (r *Responder) hostName() string {
+	if r.hostRenames == 0 {
+		return r.cfg.Host + ".local"
+	}
+	return fmt.Sprintf("%s-%d.local", r.cfg.Host, r.hostRenames+1)
+}
+
+func (r *Responder) instanceLabel(i int) string {
+	if r.instRenames[i] == 0 {
+		return r.cfg.Services[i].Instance
+	}
+	return fmt.Sprintf("%s (%d)", r.cfg.Services[i].Instance, r.instRenames[i]+1)
+}
+
+func (r *Responder) instanceName(i int) string {
+	return dnsmsg.EscapeLabel(r.instanceLabel(i)) + "." + r.cfg.Services[i].Type + ".local"
+}
+
+// records lists everything we own. Caller holds r.mu.
+func (r *Responder) records() []record {
+	host := r.hostName()
+	var out []record
+	for _, ip := range r.cfg.Addrs() {
+		out = append(out, record{rr: addressRR(host, ip), unique: true})
+		out = append(out, record{unique: true, rr: dnsmsg.RR{
+			Name: reverseName(ip), Class: dnsmsg.ClassINET, TTL: HostTTL, Data: dnsmsg.PTR{Target: host},
+		}})
+	}
+
+	types := make(map[string]bool)
+	for i, svc := range r.cfg.Services {
+		instance := r.instanceName(i)
+		serviceType := svc.Type + ".local"
+		if !types[serviceType] {
+			types[serviceType] = true
+			out = append(out, record{rr: dnsmsg.RR{
+				Name: "_services._dns-sd._udp.local", Class: dnsmsg.ClassINET, TTL: ServiceTTL,
+				Data: dnsmsg.PTR{Target: serviceType},
+			}})
+		}
+		text := svc.Text
+		if len(text) == 0 {
+			text = []string{""} // a TXT record holds at least one string (RFC 6763 §6.1)
+		}
+		out = append(out,
+			record{rr: dnsmsg.RR{Name: serviceType, Class: dnsmsg.ClassINET, TTL: ServiceTTL, Data: dnsmsg.PTR{Target: instance}}},
+			record{unique: true, rr: dnsmsg.RR{
+				Name: instance, Class: dnsmsg.ClassINET, TTL: HostTTL,
+				Data: dnsmsg.SRV{Port: uint16(svc.Port), Target: host},
+			}},
+			record{unique: true, rr: dnsmsg.RR{Name: instance, Class: dnsmsg.ClassINET, TTL: ServiceTTL, Data: dnsmsg.TXT{Strings: text}}},
+		)
+	}
+	return out
+}
+
+// claimed lists the names we probe for: the host and every instance
+func (r *Responder) claimed() []string {
+	names := []string{r.hostName()}
+	for i := range r.cfg.Services {
+		names = append(names, r.instanceName(i))
+	}
+	return names
+}
+
+func addressRR(name string, ip net.IP) dnsmsg.RR {
+	rr := dnsmsg.RR{Name: name, Class: dnsmsg.ClassINET, TTL: HostTTL}
+	if v4 := ip.To4(); v4 != nil {
+		rr.Data = dnsmsg.A{IP: v4}
+	} else {
+		rr.Data = dnsmsg.AAAA{IP: ip}
+	}
+	return rr
+}
+
+// reverseName is the in-addr.arpa or ip6.arpa name of ip
+func reverseName(ip net.IP) string {
+	if v4 := ip.To4(); v4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", v4[3], v4[2], v4[1], v4[0])
+	}
+	var sb strings.Builder
+	ip = ip.To16()
+	for i := len(ip) - 1; i >= 0; i-- {
+		fmt.Fprintf(&sb, "%x.%x.", ip[i]&0xF, ip[i]>>4)
+	}
+	return sb.String() + "ip6.arpa"
+}
+
+// restart begins probing after delay. Caller holds r.mu.
+func (r *Responder) restart(delay time.Duration) {
+	r.state, r.sent = probing, 0
+	r.schedule(delay)
+}
+
+// schedule runs the next probe or announcement step. Caller holds r.mu.
+func (r *Responder) schedule(delay time.Duration) {
+	r.gen++
+	gen := r.gen
+	if r.timer != nil {
+		r.timer.Stop()
+	}
+	r.timer = time.AfterFunc(delay, func() { r.step(gen) })
+}
+
+func (r *Responder) step(gen int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || gen != r.gen {
+		return
+	}
+
+	if r.state == probing {
+		if r.sent < probeCount {
+			r.send(r.probe(), r.cfg.Group)
+			r.sent++
+			r.schedule(r.cfg.ProbeWait)
+			return
+		}
+		r.state, r.sent, r.conflicts = announcing, 0, 0
+		if r.cfg.OnClaimed != nil {
+			instances := make([]string, len(r.cfg.Services))
+			for i := range instances {
+				instances[i] = r.instanceLabel(i)
+			}
+			go r.cfg.OnClaimed(r.hostName(), instances)
+		}
+	}
+	if r.state == announcing {
+		r.send(r.announcement(), r.cfg.Group)
+		r.sent++
+		if r.sent < announceCount {
+			r.schedule(r.cfg.AnnounceWait)
+		} else {
+			r.state = ready
+		}
+	}
+}
+
+// probe asks whether anyone else uses our names, listing the records we
+// intend to use in the authority section for tie-breaking (§8.1)
+func (r *Responder) probe() *dnsmsg.Message {
+	m := &dnsmsg.Message{}
+	for _, name := range r.claimed() {
+		m.Questions = append(m.Questions, dnsmsg.Question{Name: name, Type: dnsmsg.TypeANY, Class: dnsmsg.ClassINET | cacheFlush})
+	}
+	for _, rec := range r.records() {
+		if rec.unique && r.isClaimed(rec.rr.Name) {
+			m.Authority = append(m.Authority, rec.rr)
+		}
+	}
+	return m
+}
+
+// announcement is an unsolicited response with every record we own (§8.3)
+func (r *Responder) announcement() *dnsmsg.Message {
+	m := &dnsmsg.Message{Header: dnsmsg.Header{Response: true, Authoritative: true}}
+	for _, rec := range r.records() {
+		m.Answers = append(m.Answers, withFlush(rec))
+	}
+	return m
+}
+
+func withFlush(rec record) dnsmsg.RR {
+	rr := rec.rr
+	if rec.unique {
+		rr.Class |= cacheFlush
+	}
+	return rr
+}
+
+func (r *Responder) isClaimed(name string) bool {
+	name = dnsmsg.CanonicalName(name)
+	for _, c := range r.claimed() {
+		if dnsmsg.CanonicalName(c) == name {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Responder) send(m *dnsmsg.Message, dst *net.UDPAddr) {
+	out, err := m.Truncate(maxPacket)
+	if err != nil {
+		return
+	}
+	r.conn.WriteTo(out, dst)
+}
+
+func (r *Responder) handle(pkt []byte, from *net.UDPAddr) {
+	m, err := dnsmsg.Parse(pkt)
+	if err != nil || m.Opcode != dnsmsg.OpcodeQuery {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed {
+		return
+	}
+	if m.Response {
+		r.checkConflict(m)
+		return
+	}
+	if len(m.Authority) > 0 && r.state == probing {
+		r.checkTieBreak(m)
+		return
+	}
+	if r.state != probing {
+		r.answer(m, from)
+	}
+}
+
+// checkConflict looks for another host's records under our unique names
+// (§9). While probing that costs us the name; afterwards we probe again.
+func (r *Responder) checkConflict(m *dnsmsg.Message) {
+	ours := r.records()
+	conflicted := make(map[string]bool)
+	for _, rr := range append(m.Answers, m.Additional...) {
+		name := dnsmsg.CanonicalName(rr.Name)
+		if !r.isClaimed(name) {
+			continue
+		}
+		sameType, same := false, false
+		for _, rec := range ours {
+			if !rec.unique || dnsmsg.CanonicalName(rec.rr.Name) != name || rec.rr.Type() != rr.Type() {
+				continue
+			}
+			sameType = true
+			if bytes.Equal(rdata(rec.rr), rdata(rr)) {
+				same = true
+			}
+		}
+		if !same && (sameType || r.state == probing) {
+			conflicted[name] = true
+		}
+	}
+	if len(conflicted) == 0 {
+		return
+	}
+
+	if r.state != probing {
+		// Make sure the name is still ours before giving it up
+		r.restart(0)
+		return
+	}
+	if conflicted[dnsmsg.CanonicalName(r.hostName())] {
+		r.hostRenames++
+	}
+	for i := range r.cfg.Services {
+		if conflicted[dnsmsg.CanonicalName(r.instanceName(i))] {
+			r.instRenames[i]++
+		}
+	}
+	r.conflicts++
+	if r.conflicts > maxConflicts {
+		r.restart(rateLimitWait)
+		return
+	}
+	r.restart(r.cfg.ProbeWait)
+}
+
+// checkTieBreak handles another host probing for one of our names at the
+// same time (§8.2). The lexicographically later record set wins; the loser
+// waits a second and probes again.
+func (r *Responder) checkTieBreak(m *dnsmsg.Message) {
+	ours := r.records()
+	for _, q := range m.Questions {
+		name := dnsmsg.CanonicalName(q.Name)
+		if !r.isClaimed(name) {
+			continue
+		}
+		var mine, theirs []dnsmsg.RR
+		for _, rec := range ours {
+			if rec.unique && dnsmsg.CanonicalName(rec.rr.Name) == name {
+				mine = append(mine, rec.rr)
+			}
+		}
+		for _, rr := range m.Authority {
+			if dnsmsg.CanonicalName(rr.Name) == name {
+				theirs = append(theirs, rr)
+			}
+		}
+		if len(theirs) > 0 && compareSets(theirs, mine) > 0 {
+			r.restart(lostTieWait)
+			return
+		}
+	}
+}
+
+// compareSets orders two record sets as §8.2 describes: sorted by class,
+// type and rdata, then compared record by record
+func compareSets(a, b []dnsmsg.RR) int {
+	sortRecords(a)
+	sortRecords(b)
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := compareRecords(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
+
+func sortRecords(rrs []dnsmsg.RR) {
+	sort.Slice(rrs, func(i, j int) bool { return compareRecords(rrs[i], rrs[j]) < 0 })
+}
+
+func compareRecords(a, b dnsmsg.RR) int {
+	if ca, cb := a.Class&^cacheFlush, b.Class&^cacheFlush; ca != cb {
+		return int(ca) - int(cb)
+	}
+	if a.Type() != b.Type() {
+		return int(a.Type()) - int(b.Type())
+	}
+	return bytes.Compare(rdata(a), rdata(b))
+}
+
+// rdata is the wire form of a record's data, for comparisons
+func rdata(rr dnsmsg.RR) []byte {
+	m := &dnsmsg.Message{Answers: []dnsmsg.RR{{Name: ".", Class: dnsmsg.ClassINET, Data: rr.Data}}}
+	wire, err := m.Pack()
+	if err != nil {
+		return nil
+	}
+	// header, root name, type, class, TTL and length come first
+	return wire[12+1+10:]
+}
+
+// answer replies to a query for our names (§6)
+func (r *Responder) answer(req *dnsmsg.Message, from *net.UDPAddr) {
+	legacy := from.Port != r.cfg.Group.Port
+	ours := r.records()
+
+	var answers []record
+	unicast := true
+	for _, q := range req.Questions {
+		class := q.Class &^ cacheFlush
+		if class != dnsmsg.ClassINET && class != dnsmsg.ClassANY {
+			continue
+		}
+		recs := r.lookup(ours, q.Name, q.Type)
+		if len(recs) == 0 {
+			continue
+		}
+		if q.Class&cacheFlush == 0 {
+			unicast = false
+		}
+		answers = appendNew(answers, recs...)
+	}
+	if !legacy {
+		answers = suppressKnown(answers, req.Answers)
+	}
+	if len(answers) == 0 {
+		return
+	}
+
+	// Save the querier follow-up queries (RFC 6763 §12)
+	var extra []record
+	host := r.hostName()
+	for _, a := range answers {
+		switch d := a.rr.Data.(type) {
+		case dnsmsg.PTR:
+			// A service PTR leads to the instance's SRV and TXT and on to the host
+			for _, rec := range r.lookup(ours, d.Target, dnsmsg.TypeANY) {
+				switch rec.rr.Type() {
+				case dnsmsg.TypeSRV:
+					extra = appendNew(extra, rec)
+					extra = appendNew(extra, r.lookup(ours, host, dnsmsg.TypeANY)...)
+				case dnsmsg.TypeTXT:
+					extra = appendNew(extra, rec)
+				}
+			}
+		case dnsmsg.SRV:
+			extra = appendNew(extra, r.lookup(ours, d.Target, dnsmsg.TypeANY)...)
+		}
+	}
+
+	resp := &dnsmsg.Message{Header: dnsmsg.Header{Response: true, Authoritative: true}}
+	dst := r.cfg.Group
+	if legacy {
+		// Plain resolvers expect a normal DNS reply: their ID, questions
+		// echoed, short TTLs and no cache-flush bit
+		resp.ID = req.ID
+		resp.Questions = req.Questions
+		for _, a := range answers {
+			rr := a.rr
+			if rr.TTL > legacyTTL {
+				rr.TTL = legacyTTL
+			}
+			resp.Answers = append(resp.Answers, rr)
+		}
+		dst = from
+	} else {
+		for _, a := range answers {
+			resp.Answers = append(resp.Answers, withFlush(a))
+		}
+		for _, e := range extra {
+			if !contains(answers, e) {
+				resp.Additional = append(resp.Additional, withFlush(e))
+			}
+		}
+		if unicast {
+			dst = from
+		}
+	}
+	r.send(resp, dst)
+}
+
+// lookup returns our records for name and type. Any name under the host
+// name gets the host's addresses.
+func (r *Responder) lookup(ours []record, name string, typ dnsmsg.Type) []record {
+	name = dnsmsg.CanonicalName(name)
+	var out []record
+	for _, rec := range ours {
+		if dnsmsg.CanonicalName(rec.rr.Name) == name && (typ == dnsmsg.TypeANY || rec.rr.Type() == typ) {
+			out = append(out, rec)
+		}
+	}
+	host := dnsmsg.CanonicalName(r.hostName())
+	if len(out) == 0 && strings.HasSuffix(name, "."+host) {
+		for _, ip := range r.cfg.Addrs() {
+			rr := addressRR(name, ip)
+			if typ == dnsmsg.TypeANY || rr.Type() == typ {
+				out = append(out, record{rr: rr, unique: true})
+			}
+		}
+	}
+	return out
+}
+
+// suppressKnown drops answers the querier already has with at least half
+// their TTL left (§7.1)
+func suppressKnown(answers []record, known []dnsmsg.RR) []record {
+	out := answers[:0]
+	for _, a := range answers {
+		skip := false
+		for _, k := range known {
+			if dnsmsg.CanonicalName(k.Name) == dnsmsg.CanonicalName(a.rr.Name) && k.Type() == a.rr.Type() &&
+				k.TTL >= a.rr.TTL/2 && bytes.Equal(rdata(k), rdata(a.rr)) {
+				skip = true
+				break
+			}
+		}
+		if !skip {
+			out = append(out, a)
+		}
+	}
+	return out
+}
+
+func contains(recs []record, rec record) bool {
+	for _, r := range recs {
+		if dnsmsg.CanonicalName(r.rr.Name) == dnsmsg.CanonicalName(rec.rr.Name) &&
+			r.rr.Type() == rec.rr.Type() && bytes.Equal(rdata(r.rr), rdata(rec.rr)) {
+			return true
+		}
+	}
+	return false
+}
+
+func appendNew(recs []record, more ...record) []record {
+	for _, rec := range more {
+		if !contains(recs, rec) {
+			recs = append(recs, rec)
+		}
+	}
+	return recs
+}
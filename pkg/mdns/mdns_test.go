@@ -0,0 +1,239 @@
+package mdns_test
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+	"github.com/MultiX0/nexa/pkg/mdns"
+)
+
+// lan stands in for the multicast group: everything the responder
+// multicasts arrives on group, and queries sent from group look like they
+// come from another responder on port 5353
+type lan struct {
+	t         *testing.T
+	group     *net.UDPConn
+	responder *mdns.Responder
+	addr      *net.UDPAddr // the responder's socket
+	claimed   chan string
+}
+
+func newLAN(t *testing.T, services []mdns.Service) *lan {
+	t.Helper()
+	group, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	l := &lan{t: t, group: group, addr: conn.LocalAddr().(*net.UDPAddr), claimed: make(chan string, 4)}
+	l.responder = mdns.New(mdns.Config{
+		Host:         "nexa",
+		Addrs:        func() []net.IP { return []net.IP{net.IPv4(192, 168, 1, 10)} },
+		Services:     services,
+		Group:        group.LocalAddr().(*net.UDPAddr),
+		ProbeWait:    20 * time.Millisecond,
+		AnnounceWait: 20 * time.Millisecond,
+		OnClaimed:    func(host string, _ []string) { l.claimed <- host },
+	}, conn)
+	go l.responder.Serve()
+	t.Cleanup(func() { l.responder.Close(); group.Close() })
+	return l
+}
+
+// next returns the next message multicast by the responder
+func (l *lan) next() *dnsmsg.Message {
+	l.t.Helper()
+	return readMessage(l.t, l.group)
+}
+
+func readMessage(t *testing.T, conn *net.UDPConn) *dnsmsg.Message {
+	t.Helper()
+	buf := make([]byte, 9000)
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("no message: %v", err)
+	}
+	m, err := dnsmsg.Parse(buf[:n])
+	if err != nil {
+		t.Fatalf("bad message: %v", err)
+	}
+	return m
+}
+
+func (l *lan) send(conn *net.UDPConn, m *dnsmsg.Message) {
+	l.t.Helper()
+	wire, err := m.Pack()
+	if err != nil {
+		l.t.Fatalf("Pack failed: %v", err)
+	}
+	conn.WriteTo(wire, l.addr)
+}
+
+// waitReady consumes the probes and announcements
+func (l *lan) waitReady() {
+	l.t.Helper()
+	for i := 0; i < 5; i++ {
+		l.next()
+	}
+}
+
+var storage = mdns.Service{Instance: "Nexa Storage", Type: "_http._tcp", Port: 8081, Text: []string{"path=/"}}
+
+func TestProbeAndAnnounce(t *testing.T) {
+	l := newLAN(t, []mdns.Service{storage})
+
+	for i := 0; i < 3; i++ {
+		probe := l.next()
+		if probe.Response || len(probe.Questions) != 2 || len(probe.Authority) == 0 {
+			t.Fatalf("probe %d: %+v", i, probe)
+		}
+		if q := probe.Questions[0]; q.Name != "nexa.local" || q.Type != dnsmsg.TypeANY || q.Class&0x8000 == 0 {
+			t.Fatalf("probe question: %+v", q)
+		}
+		if probe.Questions[1].Name != `Nexa\032Storage._http._tcp.local` {
+			t.Fatalf("instance probe: %q", probe.Questions[1].Name)
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		ann := l.next()
+		if !ann.Response || !ann.Authoritative {
+			t.Fatalf("announcement %d: %+v", i, ann.Header)
+		}
+		types := map[dnsmsg.Type]int{}
+		for _, rr := range ann.Answers {
+			types[rr.Type()]++
+			unique := rr.Type() != dnsmsg.TypePTR || strings.HasSuffix(rr.Name, ".arpa")
+			if unique != (rr.Class&0x8000 != 0) {
+				t.Fatalf("cache-flush bit wrong on %+v", rr)
+			}
+		}
+		// A, reverse PTR, SRV, TXT, the service PTR and the service type enumeration
+		if types[dnsmsg.TypeA] != 1 || types[dnsmsg.TypePTR] != 3 || types[dnsmsg.TypeSRV] != 1 || types[dnsmsg.TypeTXT] != 1 {
+			t.Fatalf("announced %v", types)
+		}
+	}
+	if host := <-l.claimed; host != "nexa.local" {
+		t.Fatalf("claimed %q", host)
+	}
+}
+
+func TestAnswers(t *testing.T) {
+	chat := mdns.Service{Instance: "Nexa Chat", Type: "_http._tcp", Port: 8082}
+	l := newLAN(t, []mdns.Service{storage, chat})
+	l.waitReady()
+
+	// Browsing: PTR answers with SRV, TXT and address in the additional section
+	l.send(l.group, &dnsmsg.Message{Questions: []dnsmsg.Question{
+		{Name: "_http._tcp.local", Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET},
+	}})
+	resp := l.next()
+	if len(resp.Answers) != 2 || resp.ID != 0 || len(resp.Questions) != 0 {
+		t.Fatalf("browse reply: %+v", resp)
+	}
+	extra := map[dnsmsg.Type]int{}
+	for _, rr := range resp.Additional {
+		extra[rr.Type()]++
+	}
+	if extra[dnsmsg.TypeSRV] != 2 || extra[dnsmsg.TypeTXT] != 2 || extra[dnsmsg.TypeA] != 1 {
+		t.Fatalf("additional records: %v", extra)
+	}
+
+	// Known answers are not repeated
+	known := resp.Answers[:1]
+	l.send(l.group, &dnsmsg.Message{
+		Questions: []dnsmsg.Question{{Name: "_http._tcp.local", Type: dnsmsg.TypePTR, Class: dnsmsg.ClassINET}},
+		Answers:   known,
+	})
+	if resp := l.next(); len(resp.Answers) != 1 || resp.Answers[0].Data == known[0].Data {
+		t.Fatalf("known answer repeated: %+v", resp.Answers)
+	}
+
+	// Subdomains of the host name resolve to the host
+	l.send(l.group, &dnsmsg.Message{Questions: []dnsmsg.Question{
+		{Name: "Storage.Nexa.local", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET},
+	}})
+	if resp := l.next(); len(resp.Answers) != 1 || !resp.Answers[0].Data.(dnsmsg.A).IP.Equal(net.IPv4(192, 168, 1, 10)) {
+		t.Fatalf("subdomain reply: %+v", resp.Answers)
+	}
+
+	// Legacy unicast from a plain resolver: ID and question echoed, short TTL
+	client, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer client.Close()
+	l.send(client, &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: 77},
+		Questions: []dnsmsg.Question{{Name: "nexa.local", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+	})
+	legacy := readMessage(t, client)
+	if legacy.ID != 77 || len(legacy.Questions) != 1 || legacy.Answers[0].TTL != 10 || legacy.Answers[0].Class != dnsmsg.ClassINET {
+		t.Fatalf("legacy reply: %+v", legacy)
+	}
+
+	// Names we do not own get no reply at all
+	l.send(client, &dnsmsg.Message{Questions: []dnsmsg.Question{
+		{Name: "printer.local", Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET},
+	}})
+	client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, _, err := client.ReadFrom(make([]byte, 512)); err == nil {
+		t.Fatal("answered for a name we do not own")
+	}
+}
+
+func TestConflictWhileProbing(t *testing.T) {
+	l := newLAN(t, []mdns.Service{storage})
+
+	// Someone else already answers for nexa.local
+	l.next()
+	l.send(l.group, &dnsmsg.Message{
+		Header: dnsmsg.Header{Response: true, Authoritative: true},
+		Answers: []dnsmsg.RR{{Name: "nexa.local", Class: dnsmsg.ClassINET | 0x8000, TTL: 120,
+			Data: dnsmsg.A{IP: net.IPv4(192, 168, 1, 99)}}},
+	})
+
+	select {
+	case host := <-l.claimed:
+		if host != "nexa-2.local" {
+			t.Fatalf("claimed %q after a conflict", host)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("never claimed a name")
+	}
+	if got := l.responder.Instances(); got[0] != "Nexa Storage" {
+		t.Fatalf("instance renamed without a conflict: %v", got)
+	}
+}
+
+func TestLostTieBreak(t *testing.T) {
+	l := newLAN(t, []mdns.Service{storage})
+	l.next()
+
+	// Another host probes for nexa.local with a later address: it wins and
+	// we wait before probing again
+	l.send(l.group, &dnsmsg.Message{
+		Questions: []dnsmsg.Question{{Name: "nexa.local", Type: dnsmsg.TypeANY, Class: dnsmsg.ClassINET | 0x8000}},
+		Authority: []dnsmsg.RR{{Name: "nexa.local", Class: dnsmsg.ClassINET, TTL: 120, Data: dnsmsg.A{IP: net.IPv4(192, 168, 1, 200)}}},
+	})
+	start := time.Now()
+	for {
+		m := l.next()
+		if !m.Response && time.Since(start) > 500*time.Millisecond {
+			break // probing resumed after the back-off
+		}
+		if m.Response {
+			t.Fatal("announced after losing the tie-break")
+		}
+		if time.Since(start) > 2*time.Second {
+			t.Fatal("probing never resumed")
+		}
+	}
+}
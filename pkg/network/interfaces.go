@@ -18,6 +18,7 @@ type NetworkInterface struct {
 	IsActive  bool     `json:"is_active"`
 	Network   string   `json:"network"`
 	Addresses []string `json:"addresses"`
+	Networks  []string `json:"networks"` // every IPv4 subnet, in CIDR form
 }
 
 // GetLocalIP returns the main local IP address
@@ -55,6 +56,7 @@ func GetAllNetworkInterfaces() []NetworkInterface {
 					ni.IP = ipnet.IP.String()
 					ni.Network = ipnet.String()
 					ni.Addresses = append(ni.Addresses, ipnet.IP.String())
+					ni.Networks = append(ni.Networks, ipnet.String())
 				}
 			}
 		}
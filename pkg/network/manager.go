@@ -16,6 +16,7 @@ type NetworkManager struct {
 	config               ConnectionConfig
 	onDeviceConnected    func(*Device)
 	onDeviceDisconnected func(*Device)
+	disconnectListeners  []func(*Device)
 	stopChan             chan bool
 	monitoringActive     bool
 }
@@ -116,9 +117,17 @@ func (nm *NetworkManager) DisconnectDevice(deviceID string) error {
 	delete(nm.handlers, deviceID)
 	nm.mu.Unlock()
 
-	// Trigger callback
-	if nm.onDeviceDisconnected != nil && device != nil {
-		nm.onDeviceDisconnected(device)
+	// Trigger callbacks
+	nm.mu.RLock()
+	callback, listeners := nm.onDeviceDisconnected, nm.disconnectListeners
+	nm.mu.RUnlock()
+	if device != nil {
+		if callback != nil {
+			callback(device)
+		}
+		for _, listener := range listeners {
+			listener(device)
+		}
 	}
 
 	return err
@@ -279,6 +288,14 @@ func (nm *NetworkManager) SetOnDeviceDisconnected(callback func(*Device)) {
 	nm.onDeviceDisconnected = callback
 }
 
+// AddOnDeviceDisconnected registers another callback for device
+// disconnection, called after the one set by SetOnDeviceDisconnected
+func (nm *NetworkManager) AddOnDeviceDisconnected(callback func(*Device)) {
+	nm.mu.Lock()
+	defer nm.mu.Unlock()
+	nm.disconnectListeners = append(nm.disconnectListeners, callback)
+}
+
 // StartMonitoring starts the network monitoring routine
 func (nm *NetworkManager) StartMonitoring() {
 	nm.mu.Lock()
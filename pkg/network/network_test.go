@@ -1,6 +1,7 @@
 package network_test
 
 import (
+	"net"
 	"testing"
 	"time"
 
@@ -338,3 +339,41 @@ func BenchmarkNetworkManagerCreateConnection(b *testing.B) {
 		nm.CreateConnection("dev1", "dev2", network.ConnectionWiFi)
 	}
 }
+
+// TestDisconnectCallbacks checks that every disconnect callback hears about the device
+func TestDisconnectCallbacks(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			if _, err := ln.Accept(); err != nil {
+				return
+			}
+		}
+	}()
+
+	nm := network.NewNetworkManager(network.ConnectionConfig{
+		ConnectionType:    network.ConnectionWiFi,
+		Timeout:           time.Second,
+		HeartbeatInterval: time.Minute,
+	})
+	port := ln.Addr().(*net.TCPAddr).Port
+	if _, err := nm.RegisterDevice("phone-1", "Phone", "", "127.0.0.1", port, network.RoleNode); err != nil {
+		t.Fatalf("Failed to register device: %v", err)
+	}
+	if err := nm.ConnectDevice("phone-1", network.ConnectionWiFi); err != nil {
+		t.Fatalf("Failed to connect device: %v", err)
+	}
+
+	var got []string
+	nm.SetOnDeviceDisconnected(func(d *network.Device) { got = append(got, "set:"+d.ID) })
+	nm.AddOnDeviceDisconnected(func(d *network.Device) { got = append(got, "added:"+d.ID) })
+
+	nm.DisconnectDevice("phone-1")
+	if len(got) != 2 || got[0] != "set:phone-1" || got[1] != "added:phone-1" {
+		t.Fatalf("callbacks = %v", got)
+	}
+}
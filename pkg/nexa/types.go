@@ -2,17 +2,29 @@ package nexa
 
 import (
 	"fmt"
+	"net"
 	"os"
+	"time"
 )
 
 // General Protocol Constants
 const (
 	// Protocol Commands
-	CMD_PING    = "PING"
-	CMD_FETCH   = "FETCH"
-	CMD_PUBLISH = "PUBLISH"
-	CMD_LIST    = "LIST"
-	CMD_AUTH    = "AUTH"
+	CMD_PING       = "PING"
+	CMD_FETCH      = "FETCH"
+	CMD_PUBLISH    = "PUBLISH"
+	CMD_LIST       = "LIST"
+	CMD_AUTH       = "AUTH"
+	CMD_SYNC       = "SYNC"   // Chain status, or pull from a peer
+	CMD_BLOCKS     = "BLOCKS" // Raw blocks for replication
+	CMD_HISTORY    = "HISTORY"
+	CMD_DELETE     = "DELETE" // Appends a tombstone block
+	CMD_PROOF      = "PROOF"  // Merkle inclusion proof against the latest checkpoint
+	CMD_CHECKPOINT = "CHECKPOINT"
+	CMD_BATCH      = "BATCH"  // Atomic multi-key write with optional preconditions
+	CMD_TXN        = "TXN"    // Alias of BATCH
+	CMD_APPEND     = "APPEND" // Leader -> validator block replication
+	CMD_WATCH      = "WATCH"  // Stream changes to a key or prefix
 
 	// DNS Commands
 	DNS_PING     = "PING"
@@ -21,14 +33,27 @@ const (
 	DNS_UPDATE   = "UPDATE"
 	DNS_DELETE   = "DELETE"
 	DNS_LIST     = "LIST"
+	DNS_RENEW    = "RENEW"
+	DNS_AUTH     = "AUTH" // AUTH <token> binds the connection to a user
+
+	// DNS Record Types
+	DNS_TYPE_A     = "A"
+	DNS_TYPE_AAAA  = "AAAA"
+	DNS_TYPE_CNAME = "CNAME"
+	DNS_TYPE_PTR   = "PTR"
+	DNS_TYPE_SRV   = "SRV"
+	DNS_TYPE_TXT   = "TXT"
 
 	// HTTP Status Codes
 	STATUS_OK           = 200
 	STATUS_CREATED      = 201
 	STATUS_BAD_REQ      = 400
 	STATUS_UNAUTHORIZED = 401
+	STATUS_FORBIDDEN    = 403
 	STATUS_NOT_FOUND    = 404
+	STATUS_CONFLICT     = 409
 	STATUS_SERVER_ERROR = 500
+	STATUS_UNAVAILABLE  = 503
 )
 
 // Standard Ports (initialized at runtime)
@@ -65,13 +90,40 @@ type Response struct {
 // DNSRecord defines the structure of a DNS entry
 // Includes validation for required fields.
 type DNSRecord struct {
-	Name      string `json:"name"`
-	IP        string `json:"ip"`
-	Port      int    `json:"port"`
-	Service   string `json:"service"`
-	Owner     string `json:"owner,omitempty"` // User who owns this record
-	CreatedAt string `json:"created_at"`
-	UpdatedAt string `json:"updated_at"`
+	Name      string   `json:"name"`
+	Type      string   `json:"type,omitempty"` // Empty for address records from older registries
+	IP        string   `json:"ip"`
+	Port      int      `json:"port"`
+	Service   string   `json:"service"`
+	Target    string   `json:"target,omitempty"`     // CNAME, PTR and SRV
+	Priority  int      `json:"priority,omitempty"`   // SRV
+	Weight    int      `json:"weight,omitempty"`     // SRV
+	Text      []string `json:"text,omitempty"`       // TXT
+	Owner     string   `json:"owner,omitempty"`      // User who owns this record
+	System    bool     `json:"system,omitempty"`     // Built-in shortcut, read-only
+	TTL       int      `json:"ttl,omitempty"`        // Lease in seconds, 0 keeps the record until deleted
+	ExpiresAt int64    `json:"expires_at,omitempty"` // Unix time the lease runs out, renewed by RENEW
+	DeviceID  string   `json:"device_id,omitempty"`  // network.Device whose disconnection expires the record
+	View      string   `json:"view,omitempty"`       // Named view the record is answered in, empty for every client
+	CreatedAt string   `json:"created_at"`
+	UpdatedAt string   `json:"updated_at"`
+}
+
+// Expired reports whether the record's lease ran out before now
+func (d *DNSRecord) Expired(now time.Time) bool {
+	return d.ExpiresAt > 0 && now.Unix() >= d.ExpiresAt
+}
+
+// RecordType returns the record type, telling A and AAAA apart by the IP
+// for records stored without one
+func (d *DNSRecord) RecordType() string {
+	if d.Type != "" {
+		return d.Type
+	}
+	if ip := net.ParseIP(d.IP); ip != nil && ip.To4() == nil {
+		return DNS_TYPE_AAAA
+	}
+	return DNS_TYPE_A
 }
 
 // Validate checks if the DNSRecord has valid fields.
@@ -79,11 +131,46 @@ func (d *DNSRecord) Validate() error {
 	if d.Name == "" {
 		return fmt.Errorf("name is required")
 	}
-	if d.IP == "" {
-		return fmt.Errorf("IP is required")
+	if d.Port < 0 || d.Port > 65535 {
+		return fmt.Errorf("port must be between 0 and 65535")
+	}
+	if d.TTL < 0 {
+		return fmt.Errorf("ttl cannot be negative")
 	}
-	if d.Port <= 0 {
-		return fmt.Errorf("port must be greater than 0")
+	switch d.RecordType() {
+	case DNS_TYPE_A:
+		if ip := net.ParseIP(d.IP); ip == nil || ip.To4() == nil {
+			return fmt.Errorf("A records need an IPv4 address")
+		}
+	case DNS_TYPE_AAAA:
+		if ip := net.ParseIP(d.IP); ip == nil || ip.To4() != nil {
+			return fmt.Errorf("AAAA records need an IPv6 address")
+		}
+	case DNS_TYPE_CNAME, DNS_TYPE_PTR:
+		if d.Target == "" {
+			return fmt.Errorf("target is required")
+		}
+	case DNS_TYPE_SRV:
+		if d.Target == "" {
+			return fmt.Errorf("target is required")
+		}
+		if d.Port <= 0 {
+			return fmt.Errorf("port must be greater than 0")
+		}
+		if d.Priority < 0 || d.Priority > 65535 || d.Weight < 0 || d.Weight > 65535 {
+			return fmt.Errorf("priority and weight must be between 0 and 65535")
+		}
+	case DNS_TYPE_TXT:
+		if len(d.Text) == 0 {
+			return fmt.Errorf("text is required")
+		}
+		for _, t := range d.Text {
+			if len(t) > 255 {
+				return fmt.Errorf("TXT strings are limited to 255 bytes")
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported record type %q", d.Type)
 	}
 	return nil
 }
@@ -0,0 +1,281 @@
+// Package querylog records DNS queries as JSON lines in a size-rotated file
+// and keeps counters for top-domain and top-client statistics.
+package querylog
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultMaxSize  int64 = 10 << 20
+	DefaultMaxFiles       = 5
+	DefaultRecent         = 500
+
+	// maxTracked bounds each counter map. Past it the least counted half is
+	// dropped, so long tails of one-off names cannot grow memory forever.
+	maxTracked = 10000
+)
+
+// Where an answer came from
+const (
+	SourceLocal    = "local"    // the registry
+	SourceUpstream = "upstream" // forwarded
+	SourceCache    = "cache"    // the forwarder's reply cache
+	SourceBlocked  = "blocked"  // a blocklist rule
+	SourceOffline  = "offline"  // no upstream was tried
+)
+
+// Entry is one answered query
+type Entry struct {
+	Time      time.Time `json:"time"`
+	Client    string    `json:"client"`
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	RCode     string    `json:"rcode"`
+	Answers   []string  `json:"answers,omitempty"`
+	Source    string    `json:"source"`
+	Upstream  string    `json:"upstream,omitempty"`
+	LatencyMs float64   `json:"latency_ms"`
+	Rule      string    `json:"rule,omitempty"` // blocklist rule that matched
+}
+
+// Count is one row of a top list
+type Count struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// Stats summarises the queries logged since Open
+type Stats struct {
+	Since      time.Time `json:"since"`
+	Total      uint64    `json:"total"`
+	Blocked    uint64    `json:"blocked"`
+	CacheHits  uint64    `json:"cache_hits"`
+	Local      uint64    `json:"local"`
+	Forwarded  uint64    `json:"forwarded"`
+	AvgUpMs    float64   `json:"avg_upstream_ms"`
+	TopDomains []Count   `json:"top_domains"`
+	TopBlocked []Count   `json:"top_blocked"`
+	TopClients []Count   `json:"top_clients"`
+}
+
+// Config sets where the log goes and how much of it is kept
+type Config struct {
+	File     string // empty keeps the statistics without writing a file
+	MaxSize  int64  // bytes before the file is rotated
+	MaxFiles int    // rotated files kept next to the active one, file.1 being the newest
+	Recent   int    // entries kept in memory for Recent
+}
+
+// Log is safe for concurrent use
+type Log struct {
+	mu   sync.Mutex
+	cfg  Config
+	file *os.File
+	size int64
+
+	since                            time.Time
+	total, blocked, cached           uint64
+	local, forwarded, upstream       uint64
+	upstreamMs                       float64
+	domains, blockedDomains, clients map[string]uint64
+	recent                           []Entry // ring buffer
+	next                             int
+}
+
+// Open starts a log, appending to cfg.File if it exists
+func Open(cfg Config) (*Log, error) {
+	if cfg.MaxSize <= 0 {
+		cfg.MaxSize = DefaultMaxSize
+	}
+	if cfg.MaxFiles <= 0 {
+		cfg.MaxFiles = DefaultMaxFiles
+	}
+	if cfg.Recent <= 0 {
+		cfg.Recent = DefaultRecent
+	}
+	l := &Log{
+		cfg:            cfg,
+		since:          time.Now(),
+		domains:        make(map[string]uint64),
+		blockedDomains: make(map[string]uint64),
+		clients:        make(map[string]uint64),
+	}
+	if cfg.File == "" {
+		return l, nil
+	}
+	if dir := filepath.Dir(cfg.File); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create query log dir: %v", err)
+		}
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *Log) open() error {
+	f, err := os.OpenFile(l.cfg.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open query log: %v", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	l.file, l.size = f, info.Size()
+	return nil
+}
+
+// Add records e, rotating the file once it passes MaxSize
+func (l *Log) Add(e Entry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.count(e)
+	if len(l.recent) < l.cfg.Recent {
+		l.recent = append(l.recent, e)
+	} else {
+		l.recent[l.next] = e
+	}
+	l.next = (l.next + 1) % l.cfg.Recent
+
+	if l.file == nil {
+		return nil
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if l.size > 0 && l.size+int64(len(line)) > l.cfg.MaxSize {
+		if err := l.rotate(); err != nil {
+			return err
+		}
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	return err
+}
+
+func (l *Log) count(e Entry) {
+	l.total++
+	switch e.Source {
+	case SourceBlocked:
+		l.blocked++
+		bump(l.blockedDomains, e.Name)
+	case SourceCache:
+		l.cached++
+		l.forwarded++
+	case SourceUpstream:
+		l.forwarded++
+		l.upstream++
+		l.upstreamMs += e.LatencyMs
+	case SourceOffline:
+		l.forwarded++
+	case SourceLocal:
+		l.local++
+	}
+	bump(l.domains, e.Name)
+	bump(l.clients, e.Client)
+}
+
+func bump(m map[string]uint64, key string) {
+	m[key]++
+	if len(m) <= maxTracked {
+		return
+	}
+	counts := top(m, len(m))
+	for _, c := range counts[maxTracked/2:] {
+		delete(m, c.Key)
+	}
+}
+
+// rotate moves file.1 to file.2 and so on, dropping the oldest, then the
+// active file to file.1, and starts a new one. Caller holds l.mu.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	l.file = nil
+	os.Remove(fmt.Sprintf("%s.%d", l.cfg.File, l.cfg.MaxFiles))
+	for i := l.cfg.MaxFiles - 1; i >= 1; i-- {
+		os.Rename(fmt.Sprintf("%s.%d", l.cfg.File, i), fmt.Sprintf("%s.%d", l.cfg.File, i+1))
+	}
+	if err := os.Rename(l.cfg.File, l.cfg.File+".1"); err != nil {
+		return fmt.Errorf("failed to rotate query log: %v", err)
+	}
+	return l.open()
+}
+
+// Recent returns up to n of the latest entries, newest first
+func (l *Log) Recent(n int) []Entry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if n <= 0 || n > len(l.recent) {
+		n = len(l.recent)
+	}
+	out := make([]Entry, 0, n)
+	for i := 1; i <= n; i++ {
+		out = append(out, l.recent[(l.next-i+len(l.recent))%len(l.recent)])
+	}
+	return out
+}
+
+// Stats returns the counters with the n most queried domains, blocked
+// domains and clients
+func (l *Log) Stats(n int) Stats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := Stats{
+		Since: l.since, Total: l.total, Blocked: l.blocked, CacheHits: l.cached,
+		Local: l.local, Forwarded: l.forwarded,
+		TopDomains: top(l.domains, n),
+		TopBlocked: top(l.blockedDomains, n),
+		TopClients: top(l.clients, n),
+	}
+	if l.upstream > 0 {
+		s.AvgUpMs = l.upstreamMs / float64(l.upstream)
+	}
+	return s
+}
+
+func top(m map[string]uint64, n int) []Count {
+	out := make([]Count, 0, len(m))
+	for k, v := range m {
+		out = append(out, Count{Key: k, Count: v})
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].Count != out[j].Count {
+			return out[i].Count > out[j].Count
+		}
+		return out[i].Key < out[j].Key
+	})
+	if n >= 0 && len(out) > n {
+		out = out[:n]
+	}
+	return out
+}
+
+// Close closes the file; statistics keep working
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
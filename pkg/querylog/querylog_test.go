@@ -0,0 +1,88 @@
+package querylog_test
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/querylog"
+)
+
+func TestRotation(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "logs", "dns_queries.log")
+	l, err := querylog.Open(querylog.Config{File: file, MaxSize: 1024, MaxFiles: 2})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := l.Add(querylog.Entry{Client: "10.0.0.2", Name: fmt.Sprintf("host%d.example", i), Type: "A", Source: querylog.SourceUpstream}); err != nil {
+			t.Fatalf("Add failed: %v", err)
+		}
+	}
+	l.Close()
+
+	for _, name := range []string{file, file + ".1", file + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("missing %s: %v", filepath.Base(name), err)
+		}
+		if info.Size() > 1024 {
+			t.Fatalf("%s grew to %d bytes", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(file + ".3"); !os.IsNotExist(err) {
+		t.Fatal("kept more rotated files than MaxFiles")
+	}
+
+	// The active file ends with the latest query, as valid JSON lines
+	f, _ := os.Open(file)
+	defer f.Close()
+	var last querylog.Entry
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		if err := json.Unmarshal(sc.Bytes(), &last); err != nil {
+			t.Fatalf("bad line %q: %v", sc.Text(), err)
+		}
+	}
+	if last.Name != "host99.example" {
+		t.Fatalf("last entry %q", last.Name)
+	}
+}
+
+func TestStats(t *testing.T) {
+	l, _ := querylog.Open(querylog.Config{Recent: 3})
+	add := func(client, name, source string, ms float64) {
+		l.Add(querylog.Entry{Client: client, Name: name, Source: source, LatencyMs: ms})
+	}
+	add("10.0.0.2", "a.example", querylog.SourceUpstream, 30)
+	add("10.0.0.2", "a.example", querylog.SourceCache, 0)
+	add("10.0.0.3", "ads.example", querylog.SourceBlocked, 0)
+	add("10.0.0.3", "ads.example", querylog.SourceBlocked, 0)
+	add("10.0.0.2", "dash.n", querylog.SourceLocal, 0)
+	add("10.0.0.4", "b.example", querylog.SourceUpstream, 10)
+
+	s := l.Stats(2)
+	if s.Total != 6 || s.Blocked != 2 || s.CacheHits != 1 || s.Local != 1 || s.Forwarded != 3 {
+		t.Fatalf("counters: %+v", s)
+	}
+	if s.AvgUpMs != 20 {
+		t.Fatalf("average upstream latency %v", s.AvgUpMs)
+	}
+	if len(s.TopDomains) != 2 || s.TopDomains[0] != (querylog.Count{Key: "a.example", Count: 2}) || s.TopDomains[1].Key != "ads.example" {
+		t.Fatalf("top domains: %+v", s.TopDomains)
+	}
+	if len(s.TopBlocked) != 1 || s.TopBlocked[0].Count != 2 {
+		t.Fatalf("top blocked: %+v", s.TopBlocked)
+	}
+	if s.TopClients[0] != (querylog.Count{Key: "10.0.0.2", Count: 3}) {
+		t.Fatalf("top clients: %+v", s.TopClients)
+	}
+
+	recent := l.Recent(10)
+	if len(recent) != 3 || recent[0].Name != "b.example" || recent[2].Name != "ads.example" {
+		t.Fatalf("recent: %+v", recent)
+	}
+}
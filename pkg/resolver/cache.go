@@ -0,0 +1,157 @@
+package resolver
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+)
+
+// cache is an LRU of upstream replies keyed by question. Entries expire with
+// the smallest TTL they carry and are served with their TTLs counted down.
+type cache struct {
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List // front is most recently used
+}
+
+type cacheEntry struct {
+	key      string
+	msg      *dnsmsg.Message
+	stored   time.Time
+	expires  time.Time
+	negative bool
+}
+
+func newCache(size int) *cache {
+	return &cache{size: size, entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+// cacheKey identifies a single-question query. Other queries are not cached.
+func cacheKey(req *dnsmsg.Message) (string, bool) {
+	if len(req.Questions) != 1 || req.Opcode != dnsmsg.OpcodeQuery {
+		return "", false
+	}
+	q := req.Questions[0]
+	do := req.EDNS != nil && req.EDNS.DNSSECOK
+	return fmt.Sprintf("%s|%d|%d|%t|%t", dnsmsg.CanonicalName(q.Name), q.Type, q.Class, do, req.CheckingDisabled), true
+}
+
+// get returns a copy of the cached reply with TTLs reduced by its age
+func (c *cache) get(key string, now time.Time) (*dnsmsg.Message, bool, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false, false
+	}
+	e := el.Value.(*cacheEntry)
+	if !now.Before(e.expires) {
+		c.lru.Remove(el)
+		delete(c.entries, key)
+		return nil, false, false
+	}
+	c.lru.MoveToFront(el)
+
+	age := uint32(now.Sub(e.stored) / time.Second)
+	m := *e.msg
+	m.Answers = agedRecords(e.msg.Answers, age)
+	m.Authority = agedRecords(e.msg.Authority, age)
+	m.Additional = agedRecords(e.msg.Additional, age)
+	return &m, e.negative, true
+}
+
+func agedRecords(rrs []dnsmsg.RR, age uint32) []dnsmsg.RR {
+	if rrs == nil {
+		return nil
+	}
+	out := make([]dnsmsg.RR, len(rrs))
+	for i, rr := range rrs {
+		out[i] = rr
+		if rr.TTL > age {
+			out[i].TTL = rr.TTL - age
+		} else {
+			out[i].TTL = 0
+		}
+	}
+	return out
+}
+
+// put stores msg for ttl and returns how many entries were evicted
+func (c *cache) put(key string, msg *dnsmsg.Message, ttl time.Duration, negative bool, now time.Time) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e := &cacheEntry{key: key, msg: msg, stored: now, expires: now.Add(ttl), negative: negative}
+	if el, ok := c.entries[key]; ok {
+		el.Value = e
+		c.lru.MoveToFront(el)
+		return 0
+	}
+	c.entries[key] = c.lru.PushFront(e)
+
+	evicted := 0
+	for c.lru.Len() > c.size {
+		last := c.lru.Back()
+		c.lru.Remove(last)
+		delete(c.entries, last.Value.(*cacheEntry).key)
+		evicted++
+	}
+	return evicted
+}
+
+func (c *cache) len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+func (c *cache) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// cacheTTL decides how long a reply may be cached: the smallest answer TTL
+// for positive replies and the SOA minimum (RFC 2308) for NXDOMAIN and
+// empty answers. Other response codes are not cached.
+func cacheTTL(m *dnsmsg.Message, cfg *Config) (time.Duration, bool, bool) {
+	if m.Truncated {
+		return 0, false, false
+	}
+	switch {
+	case m.RCode == dnsmsg.RCodeSuccess && len(m.Answers) > 0:
+		ttl := m.Answers[0].TTL
+		for _, rr := range m.Answers[1:] {
+			if rr.TTL < ttl {
+				ttl = rr.TTL
+			}
+		}
+		return clampTTL(time.Duration(ttl)*time.Second, cfg.MinTTL, cfg.MaxTTL), false, true
+	case m.RCode == dnsmsg.RCodeSuccess || m.RCode == dnsmsg.RCodeNameError:
+		for _, rr := range m.Authority {
+			if soa, ok := rr.Data.(dnsmsg.SOA); ok {
+				ttl := rr.TTL
+				if soa.MinTTL < ttl {
+					ttl = soa.MinTTL
+				}
+				return clampTTL(time.Duration(ttl)*time.Second, cfg.MinTTL, cfg.MaxNegativeTTL), true, true
+			}
+		}
+		return cfg.NegativeTTL, true, true
+	}
+	return 0, false, false
+}
+
+func clampTTL(ttl, min, max time.Duration) time.Duration {
+	if ttl < min {
+		return min
+	}
+	if max > 0 && ttl > max {
+		return max
+	}
+	return ttl
+}
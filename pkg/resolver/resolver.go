@@ -0,0 +1,385 @@
+// Package resolver forwards DNS queries to upstream resolvers over UDP,
+// TCP, DNS-over-TLS or DNS-over-HTTPS, with failover between upstreams,
+// health tracking and a TTL-respecting reply cache.
+package resolver
+
+import (
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+)
+
+// Config controls forwarding. Zero values fall back to the defaults below.
+type Config struct {
+	Upstreams []Upstream
+	Timeout   time.Duration // per upstream attempt
+
+	// Offline never forwards and answers every query with OfflineRCode.
+	// The same answer is given while all upstreams are marked down.
+	Offline      bool
+	OfflineRCode uint16 // dnsmsg.RCodeServerFailure or dnsmsg.RCodeNameError
+
+	FailThreshold int           // consecutive failures before an upstream is marked down
+	RetryAfter    time.Duration // how long a down upstream is skipped before it is probed
+
+	CacheSize      int // entries; negative disables the cache
+	MinTTL         time.Duration
+	MaxTTL         time.Duration
+	NegativeTTL    time.Duration // for negative replies without an SOA
+	MaxNegativeTTL time.Duration
+
+	TLSConfig  *tls.Config  // roots for DoT, e.g. in tests
+	HTTPClient *http.Client // client for DoH
+}
+
+const (
+	DefaultTimeout       = 2 * time.Second
+	DefaultFailThreshold = 3
+	DefaultRetryAfter    = 30 * time.Second
+	DefaultCacheSize     = 10000
+	DefaultMaxTTL        = time.Hour
+	DefaultNegativeTTL   = 30 * time.Second
+
+	upstreamUDPSize = 4096 // advertised to upstreams, clients get replies truncated to their own limit
+)
+
+// Forwarder resolves queries through the configured upstreams
+type Forwarder struct {
+	cfg       Config
+	upstreams []*upstream
+	cache     *cache
+
+	queries   uint64
+	hits      uint64
+	negHits   uint64
+	misses    uint64
+	offline   uint64
+	failed    uint64
+	evictions uint64
+}
+
+// New creates a forwarder, filling in defaults for unset fields
+func New(cfg Config) *Forwarder {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	if cfg.FailThreshold <= 0 {
+		cfg.FailThreshold = DefaultFailThreshold
+	}
+	if cfg.RetryAfter <= 0 {
+		cfg.RetryAfter = DefaultRetryAfter
+	}
+	if cfg.CacheSize == 0 {
+		cfg.CacheSize = DefaultCacheSize
+	}
+	if cfg.MaxTTL <= 0 {
+		cfg.MaxTTL = DefaultMaxTTL
+	}
+	if cfg.NegativeTTL <= 0 {
+		cfg.NegativeTTL = DefaultNegativeTTL
+	}
+	if cfg.MaxNegativeTTL <= 0 {
+		cfg.MaxNegativeTTL = cfg.MaxTTL
+	}
+	if cfg.OfflineRCode == 0 {
+		cfg.OfflineRCode = dnsmsg.RCodeServerFailure
+	}
+	client := cfg.HTTPClient
+	if client == nil {
+		client = &http.Client{Transport: &http.Transport{TLSClientConfig: cfg.TLSConfig, MaxIdleConnsPerHost: poolSize}}
+	}
+
+	f := &Forwarder{cfg: cfg}
+	if cfg.CacheSize > 0 {
+		f.cache = newCache(cfg.CacheSize)
+	}
+	for _, u := range cfg.Upstreams {
+		f.upstreams = append(f.upstreams, newUpstream(u, cfg.TLSConfig, client))
+	}
+	return f
+}
+
+// Result tells how Resolve came by its reply
+type Result struct {
+	Cached   bool          // answered from the reply cache
+	Offline  bool          // answered without trying an upstream
+	Upstream string        // the upstream that answered, empty otherwise
+	RTT      time.Duration // round trip to that upstream
+}
+
+// Exchange answers req from the cache or the first upstream that replies.
+// The reply is ready to send back: it carries req's ID and questions, and
+// EDNS only if req used it. An error is returned only if req itself cannot
+// be forwarded.
+func (f *Forwarder) Exchange(req *dnsmsg.Message) (*dnsmsg.Message, error) {
+	resp, _, err := f.Resolve(req)
+	return resp, err
+}
+
+// Resolve is Exchange that also reports where the reply came from
+func (f *Forwarder) Resolve(req *dnsmsg.Message) (*dnsmsg.Message, Result, error) {
+	var res Result
+	atomic.AddUint64(&f.queries, 1)
+	now := time.Now()
+
+	key, cacheable := cacheKey(req)
+	if cacheable && f.cache != nil {
+		if m, negative, ok := f.cache.get(key, now); ok {
+			atomic.AddUint64(&f.hits, 1)
+			if negative {
+				atomic.AddUint64(&f.negHits, 1)
+			}
+			res.Cached = true
+			return f.reply(req, m), res, nil
+		}
+		atomic.AddUint64(&f.misses, 1)
+	}
+
+	res.Offline = true
+	if f.cfg.Offline {
+		atomic.AddUint64(&f.offline, 1)
+		return f.rcodeReply(req, f.cfg.OfflineRCode), res, nil
+	}
+	candidates := f.candidates(now)
+	if len(candidates) == 0 {
+		// Every upstream is down: answer at once instead of timing out
+		atomic.AddUint64(&f.offline, 1)
+		return f.rcodeReply(req, f.cfg.OfflineRCode), res, nil
+	}
+	res.Offline = false
+
+	q := &dnsmsg.Message{
+		Header: dnsmsg.Header{
+			ID:               randomID(),
+			Opcode:           req.Opcode,
+			RecursionDesired: req.RecursionDesired,
+			CheckingDisabled: req.CheckingDisabled,
+		},
+		Questions: req.Questions,
+		EDNS:      &dnsmsg.EDNS{UDPSize: upstreamUDPSize},
+	}
+	if req.EDNS != nil {
+		q.EDNS.DNSSECOK = req.EDNS.DNSSECOK
+	}
+	wire, err := q.Pack()
+	if err != nil {
+		return nil, res, fmt.Errorf("cannot forward query: %v", err)
+	}
+
+	var last *dnsmsg.Message
+	for _, u := range candidates {
+		start := time.Now()
+		resp, err := f.try(u, wire, q)
+		if err != nil {
+			continue
+		}
+		last = resp
+		res.Upstream, res.RTT = u.String(), time.Since(start)
+		// Another upstream may do better than a server failure
+		if resp.RCode == dnsmsg.RCodeServerFailure || resp.RCode == dnsmsg.RCodeRefused {
+			continue
+		}
+		if cacheable && f.cache != nil {
+			if ttl, negative, ok := cacheTTL(resp, &f.cfg); ok && ttl > 0 {
+				n := f.cache.put(key, resp, ttl, negative, time.Now())
+				atomic.AddUint64(&f.evictions, uint64(n))
+			}
+		}
+		return f.reply(req, resp), res, nil
+	}
+
+	atomic.AddUint64(&f.failed, 1)
+	if last != nil {
+		return f.reply(req, last), res, nil
+	}
+	return f.rcodeReply(req, dnsmsg.RCodeServerFailure), res, nil
+}
+
+// try sends the packed query to one upstream and checks that the reply
+// answers it, updating the upstream's health either way
+func (f *Forwarder) try(u *upstream, wire []byte, q *dnsmsg.Message) (*dnsmsg.Message, error) {
+	start := time.Now()
+	raw, err := u.exchange(wire, q.ID, f.cfg.Timeout)
+	var resp *dnsmsg.Message
+	if err == nil {
+		resp, err = dnsmsg.Parse(raw)
+	}
+	if err == nil && (!resp.Response || resp.ID != q.ID || !sameQuestions(resp.Questions, q.Questions)) {
+		err = fmt.Errorf("%s: reply does not match the query", u)
+	}
+	if err != nil {
+		f.markFailure(u)
+		return nil, err
+	}
+	f.markSuccess(u, time.Since(start))
+	return resp, nil
+}
+
+func sameQuestions(a, b []dnsmsg.Question) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Type != b[i].Type || a[i].Class != b[i].Class || !strings.EqualFold(a[i].Name, b[i].Name) {
+			return false
+		}
+	}
+	return true
+}
+
+// reply adapts an upstream or cached reply to the client's query
+func (f *Forwarder) reply(req, resp *dnsmsg.Message) *dnsmsg.Message {
+	r := *resp
+	r.ID = req.ID
+	r.Questions = req.Questions
+	r.RecursionAvailable = true
+	r.EDNS = nil
+	if req.EDNS != nil {
+		r.EDNS = &dnsmsg.EDNS{UDPSize: dnsmsg.DefaultEDNSSize, DNSSECOK: req.EDNS.DNSSECOK}
+	} else if r.RCode > 0xF {
+		r.RCode = dnsmsg.RCodeServerFailure
+	}
+	return &r
+}
+
+func (f *Forwarder) rcodeReply(req *dnsmsg.Message, rcode uint16) *dnsmsg.Message {
+	r := req.Reply()
+	r.RecursionAvailable = true
+	r.RCode = rcode
+	return r
+}
+
+// candidates returns the healthy upstreams in configured order. Down
+// upstreams whose retry time has come are probed in the background.
+func (f *Forwarder) candidates(now time.Time) []*upstream {
+	var out []*upstream
+	for _, u := range f.upstreams {
+		u.mu.Lock()
+		down := !u.downUntil.IsZero()
+		due := down && !now.Before(u.downUntil) && !u.probing
+		if due {
+			u.probing = true
+		}
+		u.mu.Unlock()
+
+		if !down {
+			out = append(out, u)
+		} else if due {
+			go f.probe(u)
+		}
+	}
+	return out
+}
+
+// probe asks a down upstream for the root NS records and brings it back on a reply
+func (f *Forwarder) probe(u *upstream) {
+	q := &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: randomID(), RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: ".", Type: dnsmsg.TypeNS, Class: dnsmsg.ClassINET}},
+	}
+	wire, _ := q.Pack()
+	f.try(u, wire, q)
+
+	u.mu.Lock()
+	u.probing = false
+	u.mu.Unlock()
+}
+
+func (f *Forwarder) markFailure(u *upstream) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+	u.failures++
+	u.fails++
+	if u.fails >= f.cfg.FailThreshold {
+		u.downUntil = time.Now().Add(f.cfg.RetryAfter)
+	}
+}
+
+func (f *Forwarder) markSuccess(u *upstream, rtt time.Duration) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.queries++
+	u.fails = 0
+	u.downUntil = time.Time{}
+	u.rtt = rtt
+}
+
+// FlushCache drops every cached reply
+func (f *Forwarder) FlushCache() {
+	if f.cache != nil {
+		f.cache.flush()
+	}
+}
+
+// UpstreamStats reports the health of one upstream
+type UpstreamStats struct {
+	Upstream  string  `json:"upstream"`
+	Healthy   bool    `json:"healthy"`
+	Queries   uint64  `json:"queries"`
+	Failures  uint64  `json:"failures"`
+	LastRTTms float64 `json:"last_rtt_ms"`
+}
+
+// Stats is a snapshot of forwarding and cache counters
+type Stats struct {
+	Queries      uint64          `json:"queries"`
+	CacheHits    uint64          `json:"cache_hits"`
+	NegativeHits uint64          `json:"negative_hits"`
+	CacheMisses  uint64          `json:"cache_misses"`
+	CacheEntries int             `json:"cache_entries"`
+	Evictions    uint64          `json:"evictions"`
+	Offline      uint64          `json:"offline_answers"` // answered without trying an upstream
+	Failed       uint64          `json:"failed"`          // no upstream gave a usable answer
+	Upstreams    []UpstreamStats `json:"upstreams"`
+}
+
+// HitRatio is the share of cacheable queries answered from the cache
+func (s Stats) HitRatio() float64 {
+	total := s.CacheHits + s.CacheMisses
+	if total == 0 {
+		return 0
+	}
+	return float64(s.CacheHits) / float64(total)
+}
+
+// Stats returns the current counters
+func (f *Forwarder) Stats() Stats {
+	s := Stats{
+		Queries:      atomic.LoadUint64(&f.queries),
+		CacheHits:    atomic.LoadUint64(&f.hits),
+		NegativeHits: atomic.LoadUint64(&f.negHits),
+		CacheMisses:  atomic.LoadUint64(&f.misses),
+		Evictions:    atomic.LoadUint64(&f.evictions),
+		Offline:      atomic.LoadUint64(&f.offline),
+		Failed:       atomic.LoadUint64(&f.failed),
+	}
+	if f.cache != nil {
+		s.CacheEntries = f.cache.len()
+	}
+	for _, u := range f.upstreams {
+		u.mu.Lock()
+		s.Upstreams = append(s.Upstreams, UpstreamStats{
+			Upstream:  u.String(),
+			Healthy:   u.downUntil.IsZero(),
+			Queries:   u.queries,
+			Failures:  u.failures,
+			LastRTTms: float64(u.rtt.Microseconds()) / 1000,
+		})
+		u.mu.Unlock()
+	}
+	return s
+}
+
+func randomID() uint16 {
+	var b [2]byte
+	rand.Read(b[:])
+	return binary.BigEndian.Uint16(b[:])
+}
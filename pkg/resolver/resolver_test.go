@@ -0,0 +1,388 @@
+package resolver_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+	"github.com/MultiX0/nexa/pkg/resolver"
+)
+
+// stubResolver answers queries over UDP and TCP on the same loopback port
+type stubResolver struct {
+	udp     net.PacketConn
+	tcp     net.Listener
+	queries int64
+	handle  func(q *dnsmsg.Message, tcp bool) *dnsmsg.Message
+}
+
+func newStubResolver(t *testing.T, handle func(q *dnsmsg.Message, tcp bool) *dnsmsg.Message) *stubResolver {
+	t.Helper()
+	udp, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	tcp, err := net.Listen("tcp", udp.LocalAddr().String())
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	s := &stubResolver{udp: udp, tcp: tcp, handle: handle}
+	t.Cleanup(func() { udp.Close(); tcp.Close() })
+
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if out := s.answer(buf[:n], false); out != nil {
+				udp.WriteTo(out, addr)
+			}
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go s.serveStream(conn)
+		}
+	}()
+	return s
+}
+
+func (s *stubResolver) serveStream(conn net.Conn) {
+	defer conn.Close()
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return
+		}
+		msg := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, msg); err != nil {
+			return
+		}
+		out := s.answer(msg, true)
+		if out == nil {
+			return
+		}
+		conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(out))), out...))
+	}
+}
+
+func (s *stubResolver) answer(msg []byte, tcp bool) []byte {
+	atomic.AddInt64(&s.queries, 1)
+	q, err := dnsmsg.Parse(msg)
+	if err != nil {
+		return nil
+	}
+	r := s.handle(q, tcp)
+	if r == nil {
+		return nil
+	}
+	out, _ := r.Pack()
+	return out
+}
+
+func (s *stubResolver) count() int64 {
+	return atomic.LoadInt64(&s.queries)
+}
+
+func (s *stubResolver) upstream(proto string) resolver.Upstream {
+	return resolver.Upstream{Protocol: proto, Addr: s.udp.LocalAddr().String()}
+}
+
+// zone answers www.example with an A record and everything else with NXDOMAIN
+func zone(q *dnsmsg.Message, _ bool) *dnsmsg.Message {
+	r := q.Reply()
+	r.RecursionAvailable = true
+	name := q.Questions[0].Name
+	if strings.EqualFold(name, "www.example") {
+		r.Answers = []dnsmsg.RR{{Name: name, Class: dnsmsg.ClassINET, TTL: 300, Data: dnsmsg.A{IP: net.IPv4(192, 0, 2, 1)}}}
+		return r
+	}
+	r.RCode = dnsmsg.RCodeNameError
+	r.Authority = []dnsmsg.RR{{Name: "example", Class: dnsmsg.ClassINET, TTL: 3600,
+		Data: dnsmsg.SOA{NS: "ns.example", MBox: "admin.example", MinTTL: 60}}}
+	return r
+}
+
+func query(name string, id uint16) *dnsmsg.Message {
+	return &dnsmsg.Message{
+		Header:    dnsmsg.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmsg.Question{{Name: name, Type: dnsmsg.TypeA, Class: dnsmsg.ClassINET}},
+	}
+}
+
+// deadUpstream is a UDP port that swallows queries without answering
+func deadUpstream(t *testing.T) resolver.Upstream {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return resolver.Upstream{Protocol: resolver.ProtoUDP, Addr: conn.LocalAddr().String()}
+}
+
+func TestParseUpstream(t *testing.T) {
+	cases := map[string]resolver.Upstream{
+		"8.8.8.8":                          {Protocol: "udp", Addr: "8.8.8.8:53"},
+		"udp://192.168.1.1:5353":           {Protocol: "udp", Addr: "192.168.1.1:5353"},
+		"tcp://[2001:db8::1]":              {Protocol: "tcp", Addr: "[2001:db8::1]:53"},
+		"tls://1.1.1.1#cloudflare-dns.com": {Protocol: "tls", Addr: "1.1.1.1:853", ServerName: "cloudflare-dns.com"},
+		"tls://dns.quad9.net:853":          {Protocol: "tls", Addr: "dns.quad9.net:853", ServerName: "dns.quad9.net"},
+		"https://dns.google/dns-query":     {Protocol: "https", Addr: "https://dns.google/dns-query"},
+	}
+	for spec, want := range cases {
+		got, err := resolver.ParseUpstream(spec)
+		if err != nil {
+			t.Fatalf("%s: %v", spec, err)
+		}
+		if got != want {
+			t.Fatalf("%s: got %+v, want %+v", spec, got, want)
+		}
+	}
+	if _, err := resolver.ParseUpstream("quic://1.1.1.1"); err == nil {
+		t.Fatal("unknown protocol accepted")
+	}
+}
+
+func TestForwardAndCache(t *testing.T) {
+	stub := newStubResolver(t, zone)
+	f := resolver.New(resolver.Config{Upstreams: []resolver.Upstream{stub.upstream(resolver.ProtoUDP)}})
+
+	resp, err := f.Exchange(query("www.example", 7))
+	if err != nil {
+		t.Fatalf("Exchange failed: %v", err)
+	}
+	if resp.ID != 7 || len(resp.Answers) != 1 || resp.EDNS != nil {
+		t.Fatalf("unexpected reply: %+v", resp)
+	}
+
+	// Same question, different case and ID: served from the cache
+	resp, res, _ := f.Resolve(query("WWW.example", 8))
+	if !res.Cached || res.Upstream != "" {
+		t.Fatalf("cached reply reported as %+v", res)
+	}
+	if stub.count() != 1 {
+		t.Fatalf("stub saw %d queries, want 1", stub.count())
+	}
+	if resp.ID != 8 || resp.Questions[0].Name != "WWW.example" || resp.Answers[0].TTL > 300 {
+		t.Fatalf("cached reply not adapted: %+v", resp)
+	}
+
+	// NXDOMAIN is cached for the SOA minimum
+	for i := 0; i < 3; i++ {
+		resp, _ = f.Exchange(query("missing.example", 9))
+		if resp.RCode != dnsmsg.RCodeNameError {
+			t.Fatalf("rcode = %d", resp.RCode)
+		}
+	}
+	if stub.count() != 2 {
+		t.Fatalf("stub saw %d queries, want 2", stub.count())
+	}
+
+	s := f.Stats()
+	if s.CacheHits != 3 || s.NegativeHits != 2 || s.CacheMisses != 2 || s.CacheEntries != 2 {
+		t.Fatalf("unexpected stats: %+v", s)
+	}
+	if r := s.HitRatio(); r != 0.6 {
+		t.Fatalf("hit ratio = %v", r)
+	}
+
+	f.FlushCache()
+	_, res, _ = f.Resolve(query("www.example", 10))
+	if stub.count() != 3 || res.Cached {
+		t.Fatal("flushed cache still answered")
+	}
+	if res.Upstream == "" || res.RTT <= 0 {
+		t.Fatalf("upstream reply reported as %+v", res)
+	}
+}
+
+func TestFailoverAndOffline(t *testing.T) {
+	stub := newStubResolver(t, zone)
+	f := resolver.New(resolver.Config{
+		Upstreams:     []resolver.Upstream{deadUpstream(t), stub.upstream(resolver.ProtoUDP)},
+		Timeout:       100 * time.Millisecond,
+		FailThreshold: 2,
+		RetryAfter:    time.Hour,
+		CacheSize:     -1,
+	})
+
+	for i := 0; i < 2; i++ {
+		resp, _ := f.Exchange(query("www.example", 1))
+		if len(resp.Answers) != 1 {
+			t.Fatalf("failover did not reach the second upstream: %+v", resp)
+		}
+	}
+	// The dead upstream is now skipped, so answers come back quickly
+	start := time.Now()
+	f.Exchange(query("www.example", 1))
+	if time.Since(start) > 80*time.Millisecond {
+		t.Fatal("down upstream was still tried")
+	}
+	s := f.Stats()
+	if s.Upstreams[0].Healthy || !s.Upstreams[1].Healthy || s.Upstreams[0].Failures != 2 {
+		t.Fatalf("unexpected upstream health: %+v", s.Upstreams)
+	}
+
+	// With every upstream down, queries fail fast
+	offline := resolver.New(resolver.Config{
+		Upstreams:     []resolver.Upstream{deadUpstream(t)},
+		Timeout:       100 * time.Millisecond,
+		FailThreshold: 1,
+		RetryAfter:    time.Hour,
+	})
+	resp, _ := offline.Exchange(query("www.example", 2))
+	if resp.RCode != dnsmsg.RCodeServerFailure {
+		t.Fatalf("rcode = %d", resp.RCode)
+	}
+	start = time.Now()
+	resp, _ = offline.Exchange(query("www.example", 3))
+	if resp.RCode != dnsmsg.RCodeServerFailure || resp.ID != 3 || time.Since(start) > 50*time.Millisecond {
+		t.Fatalf("offline answer was slow or wrong: %+v", resp)
+	}
+	if offline.Stats().Offline != 1 {
+		t.Fatalf("offline answers = %d", offline.Stats().Offline)
+	}
+
+	// Explicit offline mode never forwards
+	off := resolver.New(resolver.Config{
+		Upstreams:    []resolver.Upstream{stub.upstream(resolver.ProtoUDP)},
+		Offline:      true,
+		OfflineRCode: dnsmsg.RCodeNameError,
+	})
+	before := stub.count()
+	if resp, _ := off.Exchange(query("www.example", 4)); resp.RCode != dnsmsg.RCodeNameError {
+		t.Fatalf("rcode = %d", resp.RCode)
+	}
+	if stub.count() != before {
+		t.Fatal("offline mode forwarded a query")
+	}
+}
+
+func TestRecovery(t *testing.T) {
+	var fail int32 = 1
+	stub := newStubResolver(t, func(q *dnsmsg.Message, tcp bool) *dnsmsg.Message {
+		if atomic.LoadInt32(&fail) == 1 {
+			return nil
+		}
+		return zone(q, tcp)
+	})
+	f := resolver.New(resolver.Config{
+		Upstreams:     []resolver.Upstream{stub.upstream(resolver.ProtoUDP)},
+		Timeout:       100 * time.Millisecond,
+		FailThreshold: 1,
+		RetryAfter:    50 * time.Millisecond,
+		CacheSize:     -1,
+	})
+	f.Exchange(query("www.example", 1))
+	if f.Stats().Upstreams[0].Healthy {
+		t.Fatal("upstream still healthy after a timeout")
+	}
+
+	atomic.StoreInt32(&fail, 0)
+	time.Sleep(60 * time.Millisecond)
+	f.Exchange(query("www.example", 2)) // kicks off the background probe
+	deadline := time.Now().Add(2 * time.Second)
+	for !f.Stats().Upstreams[0].Healthy {
+		if time.Now().After(deadline) {
+			t.Fatal("probe did not bring the upstream back")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp, _ := f.Exchange(query("www.example", 3)); len(resp.Answers) != 1 {
+		t.Fatalf("recovered upstream not used: %+v", resp)
+	}
+}
+
+func TestTruncatedFallsBackToTCP(t *testing.T) {
+	stub := newStubResolver(t, func(q *dnsmsg.Message, tcp bool) *dnsmsg.Message {
+		r := zone(q, tcp)
+		if !tcp {
+			r.Answers = nil
+			r.Truncated = true
+		}
+		return r
+	})
+	f := resolver.New(resolver.Config{Upstreams: []resolver.Upstream{stub.upstream(resolver.ProtoUDP)}})
+	resp, _ := f.Exchange(query("www.example", 1))
+	if resp.Truncated || len(resp.Answers) != 1 {
+		t.Fatalf("TCP retry missing: %+v", resp)
+	}
+}
+
+func TestEncryptedUpstreams(t *testing.T) {
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		q, err := dnsmsg.Parse(body)
+		if r.Header.Get("Content-Type") != "application/dns-message" || err != nil {
+			http.Error(w, "bad query", http.StatusBadRequest)
+			return
+		}
+		out, _ := zone(q, true).Pack()
+		w.Header().Set("Content-Type", "application/dns-message")
+		io.Copy(w, bytes.NewReader(out))
+	}))
+	defer doh.Close()
+	roots := doh.Client().Transport.(*http.Transport).TLSClientConfig
+
+	// DoT stub reusing the test server certificate
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", doh.TLS)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer ln.Close()
+	dot := &stubResolver{handle: zone}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go dot.serveStream(conn)
+		}
+	}()
+
+	f := resolver.New(resolver.Config{
+		Upstreams: []resolver.Upstream{
+			{Protocol: resolver.ProtoTLS, Addr: ln.Addr().String(), ServerName: "127.0.0.1"},
+			{Protocol: resolver.ProtoHTTPS, Addr: doh.URL + "/dns-query"},
+		},
+		TLSConfig:  roots,
+		HTTPClient: doh.Client(),
+		CacheSize:  -1,
+	})
+	for i := uint16(0); i < 3; i++ {
+		resp, _ := f.Exchange(query("www.example", i))
+		if len(resp.Answers) != 1 {
+			t.Fatalf("DoT query %d failed: %+v", i, resp)
+		}
+	}
+	if dot.count() != 3 {
+		t.Fatalf("DoT stub saw %d queries", dot.count())
+	}
+
+	// Same queries over DoH once DoT is gone
+	ln.Close()
+	dohOnly := resolver.New(resolver.Config{
+		Upstreams:  []resolver.Upstream{{Protocol: resolver.ProtoHTTPS, Addr: doh.URL + "/dns-query"}},
+		HTTPClient: doh.Client(),
+	})
+	if resp, _ := dohOnly.Exchange(query("www.example", 4)); len(resp.Answers) != 1 {
+		t.Fatalf("DoH query failed: %+v", resp)
+	}
+}
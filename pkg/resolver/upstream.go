@@ -0,0 +1,265 @@
+package resolver
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+)
+
+// Upstream protocols
+const (
+	ProtoUDP   = "udp" // plain DNS, retried over TCP when the answer is truncated
+	ProtoTCP   = "tcp"
+	ProtoTLS   = "tls"   // DNS-over-TLS (RFC 7858)
+	ProtoHTTPS = "https" // DNS-over-HTTPS (RFC 8484)
+)
+
+const (
+	maxMessage = 65535
+	poolSize   = 4
+)
+
+// Upstream is one resolver queries are forwarded to
+type Upstream struct {
+	Protocol   string
+	Addr       string // host:port, or the query URL for DoH
+	ServerName string // TLS server name for DoT, defaults to the host
+}
+
+func (u Upstream) String() string {
+	if u.Protocol == ProtoHTTPS {
+		return u.Addr
+	}
+	return u.Protocol + "://" + u.Addr
+}
+
+// ParseUpstream reads an upstream spec:
+//
+//	8.8.8.8                       plain DNS on port 53
+//	udp://192.168.1.1:5353
+//	tcp://9.9.9.9
+//	tls://1.1.1.1#cloudflare-dns.com   DoT on port 853, TLS name after #
+//	https://dns.google/dns-query       DoH
+func ParseUpstream(spec string) (Upstream, error) {
+	spec = strings.TrimSpace(spec)
+	if !strings.Contains(spec, "://") {
+		spec = ProtoUDP + "://" + spec
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return Upstream{}, fmt.Errorf("invalid upstream %q: %v", spec, err)
+	}
+	if u.Host == "" {
+		return Upstream{}, fmt.Errorf("invalid upstream %q: missing host", spec)
+	}
+
+	up := Upstream{Protocol: strings.ToLower(u.Scheme)}
+	switch up.Protocol {
+	case ProtoUDP, ProtoTCP:
+		up.Addr = withPort(u.Host, "53")
+	case ProtoTLS:
+		up.Addr = withPort(u.Host, "853")
+		up.ServerName = u.Fragment
+		if up.ServerName == "" {
+			up.ServerName = u.Hostname()
+		}
+	case ProtoHTTPS:
+		u.Fragment = ""
+		up.Addr = u.String()
+	default:
+		return Upstream{}, fmt.Errorf("invalid upstream %q: unknown protocol %q", spec, u.Scheme)
+	}
+	return up, nil
+}
+
+func withPort(host, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
+
+// upstream is an Upstream plus its health and idle connections
+type upstream struct {
+	Upstream
+	tlsConfig *tls.Config
+	client    *http.Client
+
+	mu        sync.Mutex
+	fails     int       // consecutive failures
+	downUntil time.Time // zero while healthy
+	probing   bool
+	queries   uint64
+	failures  uint64
+	rtt       time.Duration
+
+	idle chan net.Conn // reusable sockets for UDP, TCP and TLS
+}
+
+func newUpstream(u Upstream, tlsConfig *tls.Config, client *http.Client) *upstream {
+	return &upstream{Upstream: u, tlsConfig: tlsConfig, client: client, idle: make(chan net.Conn, poolSize)}
+}
+
+// exchange sends one packed query and returns the raw reply
+func (u *upstream) exchange(query []byte, id uint16, timeout time.Duration) ([]byte, error) {
+	switch u.Protocol {
+	case ProtoHTTPS:
+		return u.exchangeHTTPS(query, timeout)
+	case ProtoUDP:
+		resp, err := u.exchangeConn(query, id, timeout, false)
+		if err != nil {
+			return nil, err
+		}
+		if h, err := dnsmsg.ParseHeader(resp); err == nil && h.Truncated {
+			// Too big for a datagram, ask again over TCP
+			return u.exchangeConn(query, id, timeout, true)
+		}
+		return resp, nil
+	}
+	return u.exchangeConn(query, id, timeout, true)
+}
+
+// exchangeConn uses an idle socket if there is one. A reused stream may
+// have been closed by the server, so a failure on it is retried once on a
+// fresh connection.
+func (u *upstream) exchangeConn(query []byte, id uint16, timeout time.Duration, stream bool) ([]byte, error) {
+	deadline := time.Now().Add(timeout)
+	for attempt := 0; attempt < 2; attempt++ {
+		conn, reused := u.conn(stream)
+		if conn == nil {
+			var err error
+			if conn, err = u.dial(stream, timeout); err != nil {
+				return nil, err
+			}
+		}
+		conn.SetDeadline(deadline)
+		var resp []byte
+		var err error
+		if stream {
+			resp, err = streamExchange(conn, query, id)
+		} else {
+			resp, err = datagramExchange(conn, query, id)
+		}
+		if err == nil {
+			u.release(conn, stream)
+			return resp, nil
+		}
+		conn.Close()
+		if !reused || time.Now().After(deadline) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("%s: no usable connection", u)
+}
+
+func (u *upstream) conn(stream bool) (net.Conn, bool) {
+	// UDP and stream sockets never share the pool: a UDP upstream only
+	// opens streams for truncated answers, and those are not kept
+	if stream != (u.Protocol != ProtoUDP) {
+		return nil, false
+	}
+	select {
+	case c := <-u.idle:
+		return c, true
+	default:
+		return nil, false
+	}
+}
+
+func (u *upstream) release(c net.Conn, stream bool) {
+	if stream != (u.Protocol != ProtoUDP) {
+		c.Close()
+		return
+	}
+	select {
+	case u.idle <- c:
+	default:
+		c.Close()
+	}
+}
+
+func (u *upstream) dial(stream bool, timeout time.Duration) (net.Conn, error) {
+	d := net.Dialer{Timeout: timeout}
+	switch {
+	case u.Protocol == ProtoTLS:
+		cfg := &tls.Config{ServerName: u.ServerName}
+		if u.tlsConfig != nil {
+			cfg = u.tlsConfig.Clone()
+			cfg.ServerName = u.ServerName
+		}
+		return tls.DialWithDialer(&d, "tcp", u.Addr, cfg)
+	case stream:
+		return d.Dial("tcp", u.Addr)
+	}
+	return d.Dial("udp", u.Addr)
+}
+
+// datagramExchange skips replies with another ID, e.g. late answers to an
+// earlier query that timed out on the same socket
+func datagramExchange(conn net.Conn, query []byte, id uint16) ([]byte, error) {
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if h, err := dnsmsg.ParseHeader(buf[:n]); err == nil && h.Response && h.ID == id {
+			return append([]byte(nil), buf[:n]...), nil
+		}
+	}
+}
+
+// streamExchange frames messages with a two byte length (RFC 1035 §4.2.2)
+func streamExchange(conn net.Conn, query []byte, id uint16) ([]byte, error) {
+	framed := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(query)), uint16(len(query)))
+	if _, err := conn.Write(append(framed, query...)); err != nil {
+		return nil, err
+	}
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(conn, size[:]); err != nil {
+			return nil, err
+		}
+		resp := make([]byte, binary.BigEndian.Uint16(size[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, err
+		}
+		if h, err := dnsmsg.ParseHeader(resp); err == nil && h.Response && h.ID == id {
+			return resp, nil
+		}
+	}
+}
+
+func (u *upstream) exchangeHTTPS(query []byte, timeout time.Duration) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, u.Addr, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+	req.Header.Set("Accept", "application/dns-message")
+
+	client := *u.client
+	client.Timeout = timeout
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: HTTP %d", u, resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxMessage))
+}
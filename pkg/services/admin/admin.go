@@ -16,6 +16,7 @@ import (
 	"github.com/MultiX0/nexa/pkg/config"
 	"github.com/MultiX0/nexa/pkg/governance"
 	"github.com/MultiX0/nexa/pkg/network"
+	"github.com/MultiX0/nexa/pkg/services/dns"
 	"github.com/MultiX0/nexa/pkg/utils"
 	"golang.org/x/crypto/bcrypt"
 )
@@ -75,6 +76,10 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	mux.HandleFunc("/login", loginHandler)
 	mux.HandleFunc("/logout", logoutHandler)
 	mux.HandleFunc("/api/command", authHandler(apiCommandHandler))
+	mux.HandleFunc("/api/leases", authHandler(leasesHandler))
+	mux.HandleFunc("/api/dns/views", authHandler(viewsHandler))
+	mux.HandleFunc("/api/dns/blocklist", adminHandler(blocklistHandler))
+	mux.HandleFunc("/api/dns/blocklist/import", adminHandler(blocklistImportHandler))
 	mux.HandleFunc("/admin/users", adminHandler(usersHandler))
 
 	utils.LogInfo("Admin", "Unified Service Starting...")
@@ -184,6 +189,76 @@ func apiCommandHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// leasesHandler lists DNS records that expire, like a DHCP lease table
+func leasesHandler(w http.ResponseWriter, r *http.Request) {
+	leases := dns.Leases()
+	if leases == nil {
+		leases = []dns.Lease{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(leases)
+}
+
+// viewsHandler lists the split-horizon DNS views from config.yaml
+func viewsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dns.Views())
+}
+
+// blocklistHandler lists (GET), adds (POST pattern=) and removes
+// (DELETE ?pattern=, or ?pattern=list:<name> for an imported list) DNS
+// blocklist rules. Patterns are exact names or *.domain wildcards.
+func blocklistHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	switch r.Method {
+	case http.MethodGet:
+		json.NewEncoder(w).Encode(dns.BlockRules())
+	case http.MethodPost:
+		rule, err := dns.Block(r.FormValue("pattern"), getUsername(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(rule)
+	case http.MethodDelete:
+		n, err := dns.Unblock(r.URL.Query().Get("pattern"), getUsername(r))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if n == 0 {
+			http.Error(w, "no such rule", http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]int{"removed": n})
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// blocklistImportHandler loads a hosts-format block list from the "file"
+// upload, replacing the rules previously imported under the same "list" name
+func blocklistImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, "file is required", http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	n, err := dns.ImportBlocklist(file, r.FormValue("list"), getUsername(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"list": r.FormValue("list"), "imported": n})
+}
+
 func usersHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		action := r.FormValue("action")
@@ -251,10 +326,16 @@ func loadUsers() {
 	json.NewDecoder(f).Decode(&users)
 }
 
+// saveUsers replaces the users file atomically, since the other services
+// re-read it whenever it changes
 func saveUsers() {
-	f, _ := os.Create(usersFilePath)
-	defer f.Close()
-	json.NewEncoder(f).Encode(users)
+	data, err := json.Marshal(users)
+	if err != nil {
+		return
+	}
+	if err := utils.WriteFileAtomic(usersFilePath, data, 0644); err != nil {
+		utils.LogError("Admin", "Failed to save users", err)
+	}
 }
 
 func newSessionID() string {
@@ -7,12 +7,14 @@ import (
 	"html/template"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/MultiX0/nexa/pkg/config"
 	"github.com/MultiX0/nexa/pkg/governance"
 	"github.com/MultiX0/nexa/pkg/network"
+	"github.com/MultiX0/nexa/pkg/services/dns"
 	"github.com/MultiX0/nexa/pkg/utils"
 )
 
@@ -67,6 +69,24 @@ func handleGovernancePolicy(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(policy)
 }
 
+// handleDNSStats returns DNS query counters with the ?top= (default 10)
+// busiest domains, blocked domains and clients
+func handleDNSStats(w http.ResponseWriter, r *http.Request) {
+	n, _ := strconv.Atoi(r.URL.Query().Get("top"))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dns.QueryStats(n))
+}
+
+// handleDNSQueries returns the latest ?limit= (default 100) DNS queries
+func handleDNSQueries(w http.ResponseWriter, r *http.Request) {
+	n, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || n <= 0 {
+		n = 100
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(dns.RecentQueries(n))
+}
+
 func handleDashboard(w http.ResponseWriter, r *http.Request) {
 	utils.LogInfo("Dashboard", "Connection received from: "+r.RemoteAddr)
 	localIP := utils.GetLocalIP()
@@ -203,6 +223,8 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	mux.HandleFunc("/api/network/map", handleNetworkMap)
 	mux.HandleFunc("/api/governance/timeline", handleGovernanceTimeline)
 	mux.HandleFunc("/api/governance/policy", handleGovernancePolicy)
+	mux.HandleFunc("/api/dns/stats", handleDNSStats)
+	mux.HandleFunc("/api/dns/queries", handleDNSQueries)
 
 	localIP := utils.GetLocalIP()
 	utils.LogInfo("Dashboard", fmt.Sprintf("Web Interface:     http://%s:%s", localIP, config.DashboardPort))
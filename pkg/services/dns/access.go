@@ -0,0 +1,58 @@
+package dns
+
+import (
+	"errors"
+
+	"github.com/MultiX0/nexa/pkg/auth"
+	"github.com/MultiX0/nexa/pkg/nexa"
+)
+
+// systemOwner owns the built-in shortcuts
+const systemOwner = "system"
+
+var (
+	ErrUnauthorized = errors.New("authentication required")
+	ErrForbidden    = errors.New("name is owned by another user")
+	ErrReadOnly     = errors.New("system records are read-only")
+	ErrNotFound     = errors.New("record not found")
+	ErrAdminOnly    = errors.New("admin role required")
+)
+
+var authManager *auth.AuthManager
+
+// systemCaller registers records on behalf of Nexa's own services
+var systemCaller = Caller{User: systemOwner, Role: auth.RoleAdmin}
+
+// Caller is the authenticated user behind a registry change
+type Caller struct {
+	User string
+	Role string
+}
+
+func (c Caller) IsAdmin() bool {
+	return c.Role == auth.RoleAdmin
+}
+
+// Authenticate checks a token issued by the core server's AUTH command
+func Authenticate(token string) (Caller, error) {
+	if authManager == nil || token == "" {
+		return Caller{}, ErrUnauthorized
+	}
+	user, role, err := authManager.ValidateToken(token)
+	if err != nil {
+		return Caller{}, ErrUnauthorized
+	}
+	return Caller{User: user, Role: role}, nil
+}
+
+// checkOwner reports whether caller may change rec. Records from before
+// ownership was tracked have no owner and are left to admins.
+func checkOwner(rec *nexa.DNSRecord, caller Caller) error {
+	switch {
+	case rec.System:
+		return ErrReadOnly
+	case caller.IsAdmin() || (rec.Owner != "" && rec.Owner == caller.User):
+		return nil
+	}
+	return ErrForbidden
+}
@@ -0,0 +1,161 @@
+package dns
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/audit"
+	"github.com/MultiX0/nexa/pkg/blocklist"
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+	"github.com/MultiX0/nexa/pkg/governance"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// blockReportInterval limits governance events to one per blocked name in
+// this interval, so a chatty tracker does not flood the timeline
+const blockReportInterval = 10 * time.Minute
+
+var (
+	blocks *blocklist.List
+
+	blockReportsMu sync.Mutex
+	blockReports   = make(map[string]time.Time)
+)
+
+// loadBlocklist reads the admin-managed rules, starting empty on errors
+func loadBlocklist(filename string) *blocklist.List {
+	l, err := blocklist.Load(filename)
+	if err != nil {
+		utils.LogError("DNS", "Failed to load blocklist, starting with an empty one", err)
+	}
+	return l
+}
+
+// blockedQuestion returns the first question a blocklist rule matches
+func blockedQuestion(questions []dnsmsg.Question) (dnsmsg.Question, blocklist.Rule, bool) {
+	if blocks == nil {
+		return dnsmsg.Question{}, blocklist.Rule{}, false
+	}
+	for _, q := range questions {
+		if rule, ok := blocks.Match(q.Name); ok {
+			return q, rule, true
+		}
+	}
+	return dnsmsg.Question{}, blocklist.Rule{}, false
+}
+
+// answerBlocked answers every question with NXDOMAIN, or in sinkhole mode
+// with the sinkhole address for the address types it fits
+func answerBlocked(req, resp *dnsmsg.Message, cfg config.DNSConfig) {
+	resp.Authoritative = true
+	resp.RecursionAvailable = true
+	sinkhole := net.ParseIP(cfg.SinkholeIP)
+	if !strings.EqualFold(cfg.BlockMode, "sinkhole") || sinkhole == nil {
+		resp.RCode = dnsmsg.RCodeNameError
+		resp.Authority = append(resp.Authority, zoneSOA(req.Questions[0].Name))
+		return
+	}
+	for _, q := range req.Questions {
+		var data dnsmsg.RData
+		switch v4 := sinkhole.To4(); {
+		case v4 != nil && (q.Type == dnsmsg.TypeA || q.Type == dnsmsg.TypeANY):
+			data = dnsmsg.A{IP: v4}
+		case v4 == nil && (q.Type == dnsmsg.TypeAAAA || q.Type == dnsmsg.TypeANY):
+			data = dnsmsg.AAAA{IP: sinkhole}
+		default:
+			continue
+		}
+		resp.Answers = append(resp.Answers, dnsmsg.RR{Name: q.Name, Class: dnsmsg.ClassINET, TTL: localTTL, Data: data})
+	}
+	if len(resp.Answers) == 0 {
+		resp.Authority = append(resp.Authority, zoneSOA(req.Questions[0].Name))
+	}
+}
+
+// reportBlocked tells governance about a blocked name, once per
+// blockReportInterval
+func reportBlocked(name string, rule blocklist.Rule, client string) {
+	if govManager == nil {
+		return
+	}
+	name = dnsmsg.CanonicalName(name)
+	now := time.Now()
+	blockReportsMu.Lock()
+	if last, ok := blockReports[name]; ok && now.Sub(last) < blockReportInterval {
+		blockReportsMu.Unlock()
+		return
+	}
+	blockReports[name] = now
+	for n, t := range blockReports {
+		if now.Sub(t) >= blockReportInterval {
+			delete(blockReports, n)
+		}
+	}
+	blockReportsMu.Unlock()
+
+	govManager.ReportEvent("DNS", governance.LevelNotice,
+		fmt.Sprintf("Blocked DNS lookup of %s", name),
+		fmt.Sprintf("Client %s matched blocklist rule %s (%s)", client, rule.Pattern, rule.Source),
+		"Query Blocked")
+}
+
+// BlockRules lists the blocklist rules
+func BlockRules() []blocklist.Rule {
+	if blocks == nil {
+		return []blocklist.Rule{}
+	}
+	return blocks.Rules()
+}
+
+// Block adds a manual blocklist rule on behalf of an admin
+func Block(pattern, user string) (blocklist.Rule, error) {
+	if blocks == nil {
+		return blocklist.Rule{}, fmt.Errorf("blocklist not initialized")
+	}
+	rule, err := blocks.Add(pattern, user)
+	if err == nil {
+		audit.Log(user, "BLOCK", rule.Pattern, "SUCCESS", "local")
+	}
+	return rule, err
+}
+
+// Unblock removes a rule, or every rule imported from a list when pattern
+// names the list with a "list:" prefix, and returns how many were removed
+func Unblock(pattern, user string) (int, error) {
+	if blocks == nil {
+		return 0, fmt.Errorf("blocklist not initialized")
+	}
+	var n int
+	var err error
+	if source, ok := strings.CutPrefix(pattern, "list:"); ok {
+		n, err = blocks.RemoveSource(source)
+	} else {
+		var removed bool
+		removed, err = blocks.Remove(pattern)
+		if removed {
+			n = 1
+		}
+	}
+	if err == nil && n > 0 {
+		audit.Log(user, "UNBLOCK", pattern, "SUCCESS", "local")
+	}
+	return n, err
+}
+
+// ImportBlocklist replaces the rules of list with the names in a
+// hosts-format file
+func ImportBlocklist(r io.Reader, list, user string) (int, error) {
+	if blocks == nil {
+		return 0, fmt.Errorf("blocklist not initialized")
+	}
+	n, err := blocks.Import(r, list, user)
+	if err == nil {
+		audit.Log(user, "BLOCK_IMPORT", fmt.Sprintf("%s (%d)", list, n), "SUCCESS", "local")
+	}
+	return n, err
+}
@@ -0,0 +1,271 @@
+package dns
+
+import (
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/audit"
+	"github.com/MultiX0/nexa/pkg/nexa"
+	"github.com/MultiX0/nexa/pkg/zonefile"
+)
+
+// zones are the domains the registry imports and exports as zone files
+var zones = []string{"n", "nexa"}
+
+// Bulk change operations
+const (
+	OpAdd    = "add"
+	OpUpdate = "update"
+	OpDelete = "delete"
+)
+
+// RecordRef names the records a bulk request deletes: every record of
+// Name, narrowed to one type and one view when they are set
+type RecordRef struct {
+	Name string `json:"name"`
+	Type string `json:"type,omitempty"`
+	View string `json:"view,omitempty"`
+}
+
+// BulkRequest adds or updates Records and removes Delete in one step.
+// Replace also removes every record not in Records, so the batch becomes
+// the whole registry; system records are always kept. DryRun reports the
+// changes without making them.
+type BulkRequest struct {
+	Records []nexa.DNSRecord `json:"records"`
+	Delete  []RecordRef      `json:"delete,omitempty"`
+	Replace bool             `json:"replace,omitempty"`
+	DryRun  bool             `json:"dry_run,omitempty"`
+}
+
+// BulkChange is one record a bulk request adds, updates or deletes
+type BulkChange struct {
+	Op  string          `json:"op"`
+	Key string          `json:"key"`
+	Old *nexa.DNSRecord `json:"old,omitempty"`
+	New *nexa.DNSRecord `json:"new,omitempty"`
+}
+
+// BulkResult lists what a bulk request changed, or would change in a dry run
+type BulkResult struct {
+	Changes   []BulkChange `json:"changes"`
+	Unchanged int          `json:"unchanged"`
+	DryRun    bool         `json:"dry_run"`
+}
+
+// apply makes every change in one swap of the record map, so the batch
+// is applied in full or not at all. With replace set, records scope
+// accepts that are missing from recs are removed.
+func (r *DNSRegistry) apply(recs []*nexa.DNSRecord, deletes []RecordRef, scope func(*nexa.DNSRecord) bool, replace, dryRun bool, caller Caller) (*BulkResult, error) {
+	if replace && !caller.IsAdmin() {
+		return nil, fmt.Errorf("%w to replace records", ErrAdminOnly)
+	}
+	for i, rec := range recs {
+		if err := prepareRecord(rec); err != nil {
+			return nil, fmt.Errorf("record %d (%s): %w", i+1, rec.Name, err)
+		}
+		if !scope(rec) {
+			return nil, fmt.Errorf("record %d: %s is outside the imported zone", i+1, rec.Name)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	next := make(map[string]*nexa.DNSRecord, len(r.Records))
+	for key, rec := range r.Records {
+		next[key] = rec
+	}
+	// live returns name's unexpired records in next
+	live := func(name string) []*nexa.DNSRecord {
+		var out []*nexa.DNSRecord
+		for _, rec := range next {
+			if strings.EqualFold(rec.Name, name) && !rec.Expired(now) {
+				out = append(out, rec)
+			}
+		}
+		return out
+	}
+	res := &BulkResult{Changes: []BulkChange{}, DryRun: dryRun}
+
+	for i, ref := range deletes {
+		name, typ, view := strings.TrimSuffix(ref.Name, "."), strings.ToUpper(ref.Type), strings.ToLower(ref.View)
+		found := false
+		for _, rec := range live(name) {
+			if (typ != "" && rec.RecordType() != typ) || (view != "" && rec.View != view) {
+				continue
+			}
+			if err := checkOwner(rec, caller); err != nil {
+				return nil, fmt.Errorf("delete %d (%s): %w", i+1, name, err)
+			}
+			key := recordKey(rec)
+			res.Changes = append(res.Changes, BulkChange{Op: OpDelete, Key: key, Old: recordCopy(rec)})
+			delete(next, key)
+			found = true
+		}
+		if !found {
+			return nil, fmt.Errorf("delete %d: %w: %s", i+1, ErrNotFound, strings.TrimSpace(name+" "+typ))
+		}
+	}
+
+	kept := make(map[string]bool, len(recs))
+	touched := make(map[string]bool, len(recs))
+	stamp := now.String()
+	for i, rec := range recs {
+		key := recordKey(rec)
+		if kept[key] {
+			return nil, fmt.Errorf("record %d: %s %s appears twice", i+1, rec.Name, rec.Type)
+		}
+		kept[key] = true
+
+		old, exists := next[key]
+		if exists && old.Expired(now) {
+			exists = false
+		}
+		if exists && sameRecord(old, rec) {
+			res.Unchanged++
+			continue
+		}
+		for _, other := range live(rec.Name) {
+			if err := checkOwner(other, caller); err != nil {
+				return nil, fmt.Errorf("record %d (%s): %w", i+1, rec.Name, err)
+			}
+		}
+
+		rec.ExpiresAt = 0
+		if rec.TTL > 0 {
+			rec.ExpiresAt = now.Add(time.Duration(rec.TTL) * time.Second).Unix()
+		}
+		change := BulkChange{Op: OpAdd, Key: key}
+		rec.Owner, rec.CreatedAt, rec.UpdatedAt = caller.User, stamp, ""
+		if exists {
+			rec.Owner, rec.CreatedAt, rec.UpdatedAt = old.Owner, old.CreatedAt, stamp
+			change.Op, change.Old = OpUpdate, recordCopy(old)
+		}
+		change.New = recordCopy(rec)
+		next[key] = rec
+		touched[strings.ToLower(rec.Name)] = true
+		res.Changes = append(res.Changes, change)
+	}
+
+	if replace {
+		for key, rec := range next {
+			if kept[key] || rec.System || !scope(rec) {
+				continue
+			}
+			res.Changes = append(res.Changes, BulkChange{Op: OpDelete, Key: key, Old: recordCopy(rec)})
+			delete(next, key)
+		}
+	}
+
+	for name := range touched {
+		recs := live(name)
+		for i, rec := range recs {
+			for _, other := range recs[i+1:] {
+				if err := cnameConflict(rec, other); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(res.Changes, func(i, j int) bool { return res.Changes[i].Key < res.Changes[j].Key })
+	if dryRun || len(res.Changes) == 0 {
+		return res, nil
+	}
+
+	prev := r.Records
+	r.Records = next
+	if err := r.Save(); err != nil {
+		r.Records = prev
+		return nil, fmt.Errorf("%w: %v", ErrSaveFailed, err)
+	}
+	return res, nil
+}
+
+// sameRecord reports whether a stored record already holds everything a
+// batch would set, so re-importing an export changes nothing
+func sameRecord(old, rec *nexa.DNSRecord) bool {
+	return old.RecordType() == rec.RecordType() &&
+		old.IP == rec.IP && old.Port == rec.Port && old.Service == rec.Service &&
+		old.Target == rec.Target && old.Priority == rec.Priority && old.Weight == rec.Weight &&
+		reflect.DeepEqual(old.Text, rec.Text) &&
+		old.TTL == rec.TTL && old.DeviceID == rec.DeviceID && old.View == rec.View
+}
+
+func recordCopy(rec *nexa.DNSRecord) *nexa.DNSRecord {
+	c := *rec
+	c.Type = rec.RecordType()
+	return &c
+}
+
+// zoneName checks that zone is one the registry serves
+func zoneName(zone string) (string, error) {
+	zone = strings.ToLower(strings.Trim(zone, "."))
+	for _, z := range zones {
+		if z == zone {
+			return zone, nil
+		}
+	}
+	return "", fmt.Errorf("unknown zone %q, expected one of %s", zone, strings.Join(zones, ", "))
+}
+
+// ApplyBulk makes the changes of req on behalf of caller, all or none
+func ApplyBulk(req BulkRequest, caller Caller) (*BulkResult, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("registry not initialized")
+	}
+	recs := make([]*nexa.DNSRecord, len(req.Records))
+	for i := range req.Records {
+		rec := req.Records[i]
+		recs[i] = &rec
+	}
+	all := func(*nexa.DNSRecord) bool { return true }
+	res, err := registry.apply(recs, req.Delete, all, req.Replace, req.DryRun, caller)
+	if err == nil && !req.DryRun {
+		audit.Log(caller.User, "BULK", fmt.Sprintf("%d changes", len(res.Changes)), "SUCCESS", "local")
+	}
+	return res, err
+}
+
+// ExportZone writes the records of zone, in every view, as a zone file
+func ExportZone(w io.Writer, zone string) error {
+	zone, err := zoneName(zone)
+	if err != nil {
+		return err
+	}
+	var recs []nexa.DNSRecord
+	for _, rec := range Records("") {
+		if zonefile.InZone(rec.Name, zone) {
+			recs = append(recs, rec)
+		}
+	}
+	return zonefile.Write(w, zone, recs)
+}
+
+// ImportZone adds or updates the records of a zone file. With replace set
+// the zone's other records are removed, so it ends up matching the file.
+func ImportZone(r io.Reader, zone string, replace, dryRun bool, caller Caller) (*BulkResult, error) {
+	if registry == nil {
+		return nil, fmt.Errorf("registry not initialized")
+	}
+	zone, err := zoneName(zone)
+	if err != nil {
+		return nil, err
+	}
+	recs, err := zonefile.Parse(r, zone)
+	if err != nil {
+		return nil, err
+	}
+	inZone := func(rec *nexa.DNSRecord) bool { return zonefile.InZone(rec.Name, zone) }
+	res, err := registry.apply(recs, nil, inZone, replace, dryRun, caller)
+	if err == nil && !dryRun {
+		audit.Log(caller.User, "ZONE_IMPORT", fmt.Sprintf("%s (%d changes)", zone, len(res.Changes)), "SUCCESS", "local")
+	}
+	return res, err
+}
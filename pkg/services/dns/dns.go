@@ -4,15 +4,18 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/MultiX0/nexa/pkg/audit"
+	"github.com/MultiX0/nexa/pkg/auth"
 	"github.com/MultiX0/nexa/pkg/config"
 	"github.com/MultiX0/nexa/pkg/governance"
 	"github.com/MultiX0/nexa/pkg/network"
@@ -60,10 +63,18 @@ func NewDNSRegistry(filename string) *DNSRegistry {
 
 	changed := false
 	for name, rec := range defaults {
-		if _, exists := r.Records[name]; !exists {
-			r.Records[name] = rec
-			changed = true
+		rec.Owner, rec.System = systemOwner, true
+		existing, exists := r.Records[name]
+		if exists && existing.System {
+			continue
+		}
+		// Registries from before system records were read-only may hold a
+		// shortcut overwritten by a guest
+		if exists {
+			utils.LogWarning("DNS", fmt.Sprintf("Restoring system record %s (was owned by %q)", name, existing.Owner))
 		}
+		r.Records[name] = rec
+		changed = true
 	}
 
 	if changed || len(r.Records) == 0 {
@@ -72,30 +83,70 @@ func NewDNSRegistry(filename string) *DNSRegistry {
 	return r
 }
 
+// Save writes the registry through a temporary file, so a crash mid-save
+// leaves the previous file intact
 func (r *DNSRegistry) Save() error {
 	data, err := json.MarshalIndent(r.Records, "", "  ")
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(r.Filename, data, 0644)
+	return utils.WriteFileAtomic(r.Filename, data, 0644)
+}
+
+// Len returns the number of stored records
+func (r *DNSRegistry) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.Records)
 }
 
 func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	netManager = nm
 	govManager = gm
-	audit.Init("dns_audit.log")
 	registry = NewDNSRegistry("dns_records.json")
 
+	// Record changes need a token from the core server's AUTH command
+	var err error
+	authManager, err = auth.NewAuthManager(utils.FindFile("users.json"))
+	if err != nil {
+		utils.LogError("DNS", "Failed to init auth, record changes are disabled", err)
+	}
+	forwarder = newForwarder(config.Get().Services.DNS)
+	views = loadViews(config.Get().Services.DNS.Views)
+	blocks = loadBlocklist("dns_blocklist.json")
+	queryLog = openQueryLog(config.Get().Services.DNS)
+
+	// Leases run out on their own or when their device drops off the network
+	go startReaper()
+	if netManager != nil {
+		netManager.AddOnDeviceDisconnected(expireDevice)
+	}
+
 	// Metrics reporter
 	go func() {
 		ticker := time.NewTicker(2 * time.Second)
 		for range ticker.C {
 			if netManager != nil {
 				qCount := atomic.SwapInt64(&queryCount, 0)
+				fwd := forwarder.Stats()
+				healthy := 0
+				for _, u := range fwd.Upstreams {
+					if u.Healthy {
+						healthy++
+					}
+				}
 				netManager.UpdateServiceMetrics("dns", map[string]interface{}{
-					"queries_per_sec": float64(qCount) / 2.0,
-					"active_records":  len(registry.Records),
-					"status":          "Ready",
+					"queries_per_sec":   float64(qCount) / 2.0,
+					"active_records":    registry.Len(),
+					"active_leases":     len(Leases()),
+					"status":            "Ready",
+					"forwarded_queries": fwd.Queries,
+					"cache_entries":     fwd.CacheEntries,
+					"cache_hit_ratio":   fwd.HitRatio(),
+					"negative_hits":     fwd.NegativeHits,
+					"upstreams_healthy": healthy,
+					"upstreams":         fwd.Upstreams,
+					"blocklist_rules":   blocks.Len(),
 				})
 			}
 		}
@@ -144,159 +195,6 @@ func handleDNSListener(ln net.Listener) {
 	}
 }
 
-func startZerosmDNS() {
-	// mDNS uses Port 5353 UDP multicast 224.0.0.251
-	addr, err := net.ResolveUDPAddr("udp4", "224.0.0.251:5353")
-	if err != nil {
-		return
-	}
-
-	conn, err := net.ListenMulticastUDP("udp4", nil, addr)
-	if err != nil {
-		utils.LogWarning("DNS-PRO", "mDNS Port 5353 busy. Zero-config might be limited.")
-		return
-	}
-	defer conn.Close()
-
-	utils.LogSuccess("DNS-PRO", "Zero-Config mDNS Active (nexa.local)")
-
-	buffer := make([]byte, 1024)
-	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			continue
-		}
-
-		// respond to anything asking for nexa or .local
-		if n > 12 {
-			resp := buildDNSResponse(buffer[:n], conn.LocalAddr().(*net.UDPAddr).IP.String())
-			if resp != nil {
-				conn.WriteToUDP(resp, remoteAddr)
-			}
-		}
-	}
-}
-
-func startStandardUDPDNS() {
-	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:53")
-	if err != nil {
-		utils.LogWarning("DNS-PRO", fmt.Sprintf("Standard DNS (Port 53) failed: %v", err))
-		return
-	}
-
-	conn, err := net.ListenUDP("udp", addr)
-	if err != nil {
-		utils.LogWarning("DNS-PRO", "Port 53 is busy. Standard DNS will not work automatically.")
-		return
-	}
-	defer conn.Close()
-
-	utils.LogSuccess("DNS-PRO", "NEXA Smart DNS Active on Port 53")
-
-	buffer := make([]byte, 512)
-	for {
-		n, remoteAddr, err := conn.ReadFromUDP(buffer)
-		if err != nil {
-			continue
-		}
-
-		// PROCESS DNS QUERY
-		go func(data []byte, addr *net.UDPAddr, interfaceAddr string) {
-			response := handleSmartDNSQuery(data, interfaceAddr)
-			if response != nil {
-				conn.WriteToUDP(response, addr)
-			}
-		}(buffer[:n], remoteAddr, conn.LocalAddr().(*net.UDPAddr).IP.String())
-	}
-}
-
-func handleSmartDNSQuery(query []byte, interfaceIP string) []byte {
-	if len(query) < 12 {
-		return nil
-	}
-
-	// Extract domain name from DNS query
-	domain := ""
-	offset := 12
-	for {
-		length := int(query[offset])
-		if length == 0 {
-			break
-		}
-		if domain != "" {
-			domain += "."
-		}
-		domain += string(query[offset+1 : offset+1+length])
-		offset += length + 1
-	}
-
-	// IF domain ends with .n or is a nexa system domain
-	if strings.HasSuffix(domain, ".n") || strings.HasSuffix(domain, ".nexa") {
-		return buildDNSResponse(query, interfaceIP) // Point to local IP
-	}
-
-	// ELSE: Forward to Global DNS (8.8.8.8) - Recursive Proxy Mode
-	return forwardDNSQuery(query)
-}
-
-func forwardDNSQuery(query []byte) []byte {
-	dnsServer := "8.8.8.8:53"
-	conn, err := net.Dial("udp", dnsServer)
-	if err != nil {
-		return nil
-	}
-	defer conn.Close()
-
-	_, err = conn.Write(query)
-	if err != nil {
-		return nil
-	}
-
-	resp := make([]byte, 512)
-	n, err := conn.Read(resp)
-	if err != nil {
-		return nil
-	}
-
-	return resp[:n]
-}
-
-func buildDNSResponse(query []byte, interfaceIP string) []byte {
-	tid := query[0:2]
-	flags := []byte{0x81, 0x80} // Standard Answer
-	qdcount := query[4:6]
-
-	resp := append(tid, flags...)
-	resp = append(resp, qdcount...)                        // Questions
-	resp = append(resp, qdcount...)                        // Answers
-	resp = append(resp, []byte{0x00, 0x00, 0x00, 0x00}...) // Authority + Additional
-
-	// Extract Question part
-	offset := 12
-	for {
-		length := int(query[offset])
-		if length == 0 {
-			break
-		}
-		offset += length + 1
-	}
-	resp = append(resp, query[12:offset+5]...)
-
-	// Answer Resource Record
-	resp = append(resp, []byte{0xc0, 0x0c}...)
-	resp = append(resp, []byte{0x00, 0x01, 0x00, 0x01}...)
-	resp = append(resp, []byte{0x00, 0x00, 0x00, 0x3c}...)
-	resp = append(resp, []byte{0x00, 0x04}...)
-
-	// Return the IP of the interface that received the query
-	localIP := net.ParseIP(interfaceIP).To4()
-	if localIP == nil {
-		localIP = net.ParseIP(utils.GetLocalIP()).To4()
-	}
-	resp = append(resp, localIP...)
-	return resp
-}
-
 // Resolve returns the IP and Port for a given name if it exists
 func Resolve(name string) (*nexa.DNSRecord, bool) {
 	if registry == nil {
@@ -304,10 +202,10 @@ func Resolve(name string) (*nexa.DNSRecord, bool) {
 	}
 	registry.mu.RLock()
 	defer registry.mu.RUnlock()
-	rec, exists := registry.Records[name]
+	rec, exists := registry.lookup(name, "")
 
 	// EXPERT ARCH: Wildcard .n resolution
-	if !exists && (strings.HasSuffix(name, ".n") || strings.HasSuffix(name, ".nexa")) {
+	if !exists && isWildcardName(name) {
 		return &nexa.DNSRecord{
 			Name: name, IP: utils.GetLocalIP(), Port: 8000, Service: "gateway",
 		}, true
@@ -316,17 +214,26 @@ func Resolve(name string) (*nexa.DNSRecord, bool) {
 	return rec, exists
 }
 
-// Register adds or updates a record
-func Register(name, ip string, port int, service string) error {
-	if registry == nil {
-		return fmt.Errorf("registry not initialized")
-	}
-	registry.mu.Lock()
-	defer registry.mu.Unlock()
-	registry.Records[name] = &nexa.DNSRecord{
-		Name: name, IP: ip, Port: port, Service: service, CreatedAt: time.Now().String(),
+// isWildcardName reports whether an unregistered name still resolves to the
+// gateway. Strict mode turns the wildcard off.
+func isWildcardName(name string) bool {
+	return isLocalName(name) && !config.Get().Services.DNS.Strict
+}
+
+// lookup finds the address record for name as clients in view see it,
+// ignoring case and a trailing dot. Caller holds r.mu.
+func (r *DNSRegistry) lookup(name, view string) (*nexa.DNSRecord, bool) {
+	for _, rec := range r.visible(name, view) {
+		if t := rec.RecordType(); t == nexa.DNS_TYPE_A || t == nexa.DNS_TYPE_AAAA {
+			return rec, true
+		}
 	}
-	return registry.Save()
+	return nil, false
+}
+
+// Register adds or updates an address record on behalf of a Nexa service
+func Register(name, ip string, port int, service string) error {
+	return RegisterRecord(&nexa.DNSRecord{Name: name, IP: ip, Port: port, Service: service}, systemCaller)
 }
 
 func handleDNS(conn net.Conn) {
@@ -334,6 +241,8 @@ func handleDNS(conn net.Conn) {
 	reader := bufio.NewReader(conn)
 	remoteAddr := conn.RemoteAddr().String()
 
+	sess := &session{}
+
 	for {
 		conn.SetReadDeadline(time.Now().Add(60 * time.Second))
 		line, err := reader.ReadString('\n')
@@ -346,13 +255,18 @@ func handleDNS(conn net.Conn) {
 			continue
 		}
 
-		response := processDNSQuery(line, remoteAddr)
+		response := processDNSQuery(line, remoteAddr, sess)
 		atomic.AddInt64(&queryCount, 1)
 		conn.Write([]byte(response + "\n"))
 	}
 }
 
-func processDNSQuery(query, ip string) string {
+// session is the state of one TCP connection
+type session struct {
+	caller *Caller // set by AUTH and used for every later command
+}
+
+func processDNSQuery(query, ip string, sess *session) string {
 	parts := strings.Fields(query)
 	if len(parts) == 0 {
 		return formatError(nexa.STATUS_BAD_REQ, "Empty query")
@@ -362,43 +276,91 @@ func processDNSQuery(query, ip string) string {
 
 	switch command {
 	case nexa.DNS_PING:
-		return formatSuccess(nexa.STATUS_OK, "PONG", fmt.Sprintf("Records: %d", len(registry.Records)))
+		return formatSuccess(nexa.STATUS_OK, "PONG", fmt.Sprintf("Records: %d", registry.Len()))
+
+	case nexa.DNS_AUTH:
+		if len(parts) != 2 {
+			return formatError(nexa.STATUS_BAD_REQ, "Usage: AUTH <token>")
+		}
+		c, err := Authenticate(parts[1])
+		if err != nil {
+			audit.Log("GUEST", "AUTH", "", "FAILED", ip)
+			return formatError(nexa.STATUS_UNAUTHORIZED, "Invalid or expired token")
+		}
+		sess.caller = &c
+		return formatSuccess(nexa.STATUS_OK, "AUTHENTICATED", c.User+" "+c.Role)
 
 	case nexa.DNS_RESOLVE:
 		if len(parts) < 2 {
 			return formatError(nexa.STATUS_BAD_REQ, "Usage: RESOLVE <name>")
 		}
 		name := parts[1]
+		h := horizonForAddr(ip)
 		registry.mu.RLock()
-		rec, exists := registry.Records[name]
+		rec, exists := registry.lookup(name, h.view)
 		registry.mu.RUnlock()
 
 		if !exists {
 			return formatError(nexa.STATUS_NOT_FOUND, "Name not found")
 		}
-		return formatSuccess(nexa.STATUS_OK, "RESOLVED", fmt.Sprintf("%s:%d|service=%s", rec.IP, rec.Port, rec.Service))
+		return formatSuccess(nexa.STATUS_OK, "RESOLVED", fmt.Sprintf("%s:%d|service=%s", h.address(rec.IP), rec.Port, rec.Service))
 
-	case nexa.DNS_REGISTER:
-		if len(parts) < 5 {
-			return formatError(nexa.STATUS_BAD_REQ, "Usage: REGISTER <name> <ip> <port> <service>")
+	case nexa.DNS_REGISTER, nexa.DNS_UPDATE:
+		if sess.caller == nil {
+			audit.Log("GUEST", command, strings.Join(parts[1:], " "), "DENIED", ip)
+			return formatError(nexa.STATUS_UNAUTHORIZED, "Authentication required: AUTH <token>")
 		}
-		port := 0
-		fmt.Sscanf(parts[3], "%d", &port)
-		name := parts[1]
-
-		registry.mu.Lock()
-		registry.Records[name] = &nexa.DNSRecord{
-			Name: name, IP: parts[2], Port: port, Service: parts[4], CreatedAt: time.Now().String(),
+		parts, opts, err := parseRecordOptions(parts)
+		if err != nil {
+			return formatError(nexa.STATUS_BAD_REQ, err.Error())
 		}
-		err := registry.Save()
-		registry.mu.Unlock()
+		rec, err := parseCommandRecord(command, parts)
+		if err != nil {
+			return formatError(nexa.STATUS_BAD_REQ, err.Error())
+		}
+		rec.TTL, rec.DeviceID, rec.View = opts.ttl, opts.device, opts.view
+		return storeRecord(command, rec, *sess.caller, ip)
 
+	case nexa.DNS_RENEW:
+		if sess.caller == nil {
+			audit.Log("GUEST", command, strings.Join(parts[1:], " "), "DENIED", ip)
+			return formatError(nexa.STATUS_UNAUTHORIZED, "Authentication required: AUTH <token>")
+		}
+		ttl := 0
+		if len(parts) == 3 {
+			ttl, _ = strconv.Atoi(parts[2])
+		}
+		if len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && ttl <= 0) {
+			return formatError(nexa.STATUS_BAD_REQ, "Usage: RENEW <name> [ttl-seconds]")
+		}
+		expires, err := registry.renew(parts[1], ttl, *sess.caller)
 		if err != nil {
-			return formatError(nexa.STATUS_SERVER_ERROR, "Failed to save record")
+			audit.Log(sess.caller.User, command, parts[1], "FAILED", ip)
+			return recordError(err)
 		}
+		audit.Log(sess.caller.User, command, parts[1], "SUCCESS", ip)
+		return formatSuccess(nexa.STATUS_OK, "RENEWED", fmt.Sprintf("%s %s", parts[1], expires.Format(time.RFC3339)))
 
-		audit.Log("GUEST", "REGISTER", name, "SUCCESS", ip)
-		return formatSuccess(nexa.STATUS_CREATED, "REGISTERED", name)
+	case nexa.DNS_DELETE:
+		if sess.caller == nil {
+			audit.Log("GUEST", command, strings.Join(parts[1:], " "), "DENIED", ip)
+			return formatError(nexa.STATUS_UNAUTHORIZED, "Authentication required: AUTH <token>")
+		}
+		parts, opts, err := parseRecordOptions(parts)
+		if err != nil || len(parts) < 2 || len(parts) > 3 || (len(parts) == 3 && !isRecordType(parts[2])) {
+			return formatError(nexa.STATUS_BAD_REQ, "Usage: DELETE <name> [type] [view=<name>]")
+		}
+		typ := ""
+		if len(parts) == 3 {
+			typ = parts[2]
+		}
+		n, err := registry.remove(parts[1], typ, opts.view, *sess.caller)
+		if err != nil {
+			audit.Log(sess.caller.User, command, parts[1], "FAILED", ip)
+			return recordError(err)
+		}
+		audit.Log(sess.caller.User, command, parts[1], "SUCCESS", ip)
+		return formatSuccess(nexa.STATUS_OK, "DELETED", fmt.Sprintf("%s %d", parts[1], n))
 
 	case nexa.DNS_LIST:
 		registry.mu.RLock()
@@ -414,6 +376,47 @@ func processDNSQuery(query, ip string) string {
 	}
 }
 
+// parseCommandRecord reads the record of a REGISTER or UPDATE command, in
+// the typed form or the legacy <name> <ip> <port> <service> form
+func parseCommandRecord(command string, parts []string) (*nexa.DNSRecord, error) {
+	if len(parts) >= 4 && isRecordType(parts[2]) {
+		return parseRecord(parts[1], parts[2], parts[3:])
+	}
+	if len(parts) < 5 {
+		return nil, fmt.Errorf("Usage: %s <name> <ip> <port> <service> | %s <name> <type> <data...>", command, command)
+	}
+	port := 0
+	fmt.Sscanf(parts[3], "%d", &port)
+	return &nexa.DNSRecord{Name: parts[1], IP: parts[2], Port: port, Service: parts[4]}, nil
+}
+
+func storeRecord(command string, rec *nexa.DNSRecord, caller Caller, ip string) string {
+	if err := registry.put(rec, caller, command == nexa.DNS_UPDATE); err != nil {
+		audit.Log(caller.User, command, rec.Name, "FAILED", ip)
+		return recordError(err)
+	}
+	audit.Log(caller.User, command, rec.Name, "SUCCESS", ip)
+	if command == nexa.DNS_UPDATE {
+		return formatSuccess(nexa.STATUS_OK, "UPDATED", rec.Name+" "+rec.Type)
+	}
+	return formatSuccess(nexa.STATUS_CREATED, "REGISTERED", rec.Name+" "+rec.Type)
+}
+
+// recordError maps registry errors to protocol status codes
+func recordError(err error) string {
+	switch {
+	case errors.Is(err, ErrSaveFailed):
+		return formatError(nexa.STATUS_SERVER_ERROR, "Failed to save record")
+	case errors.Is(err, ErrUnauthorized):
+		return formatError(nexa.STATUS_UNAUTHORIZED, err.Error())
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrReadOnly):
+		return formatError(nexa.STATUS_FORBIDDEN, err.Error())
+	case errors.Is(err, ErrNotFound):
+		return formatError(nexa.STATUS_NOT_FOUND, err.Error())
+	}
+	return formatError(nexa.STATUS_BAD_REQ, err.Error())
+}
+
 func formatSuccess(code int, msg, body string) string {
 	return fmt.Sprintf("%d %s %s", code, msg, body)
 }
@@ -0,0 +1,59 @@
+package dns
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+	"github.com/MultiX0/nexa/pkg/resolver"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// forwarder answers names the registry is not authoritative for
+var forwarder *resolver.Forwarder
+
+// newForwarder builds the upstream resolver from the DNS service settings.
+// Invalid upstream specs are logged and skipped.
+func newForwarder(cfg config.DNSConfig) *resolver.Forwarder {
+	rc := resolver.Config{
+		Timeout:   time.Duration(cfg.TimeoutMs) * time.Millisecond,
+		CacheSize: cfg.CacheSize,
+		Offline:   cfg.Offline,
+	}
+	switch strings.ToUpper(cfg.OfflineRCode) {
+	case "NXDOMAIN":
+		rc.OfflineRCode = dnsmsg.RCodeNameError
+	case "", "SERVFAIL":
+		rc.OfflineRCode = dnsmsg.RCodeServerFailure
+	default:
+		utils.LogWarning("DNS-PRO", fmt.Sprintf("Unknown offline_rcode %q, using SERVFAIL", cfg.OfflineRCode))
+		rc.OfflineRCode = dnsmsg.RCodeServerFailure
+	}
+
+	for _, spec := range cfg.Upstreams {
+		u, err := resolver.ParseUpstream(spec)
+		if err != nil {
+			utils.LogWarning("DNS-PRO", err.Error())
+			continue
+		}
+		rc.Upstreams = append(rc.Upstreams, u)
+	}
+	if len(rc.Upstreams) == 0 && !rc.Offline {
+		utils.LogWarning("DNS-PRO", "No usable upstream resolvers, answering non-local names offline")
+		rc.Offline = true
+	}
+	return resolver.New(rc)
+}
+
+// forwardDNSQuery resolves req through the upstreams and the reply cache
+func forwardDNSQuery(req *dnsmsg.Message) (*dnsmsg.Message, resolver.Result) {
+	resp, res, err := forwarder.Resolve(req)
+	if err != nil {
+		utils.LogError("DNS-PRO", "Failed to forward DNS query", err)
+		resp = req.Reply()
+		resp.RCode = dnsmsg.RCodeServerFailure
+	}
+	return resp, res
+}
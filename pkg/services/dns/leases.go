@@ -0,0 +1,216 @@
+package dns
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/audit"
+	"github.com/MultiX0/nexa/pkg/governance"
+	"github.com/MultiX0/nexa/pkg/network"
+	"github.com/MultiX0/nexa/pkg/nexa"
+)
+
+const reapInterval = 15 * time.Second
+
+// Lease is a record with a lifetime, listed DHCP-style in the admin UI
+type Lease struct {
+	Name      string    `json:"name"`
+	Type      string    `json:"type"`
+	Address   string    `json:"address"`
+	Owner     string    `json:"owner"`
+	DeviceID  string    `json:"device_id,omitempty"`
+	View      string    `json:"view,omitempty"`
+	TTL       int       `json:"ttl"`
+	ExpiresAt time.Time `json:"expires_at"` // zero for device-bound records without a lease
+	Remaining int64     `json:"remaining"`  // seconds, -1 for device-bound records without a lease
+}
+
+// recordOptions are the key=value options of record commands
+type recordOptions struct {
+	ttl    int
+	device string
+	view   string
+}
+
+// parseRecordOptions strips ttl=<seconds>, device=<id> and view=<name>
+// from a record command, wherever they appear after the name
+func parseRecordOptions(parts []string) ([]string, recordOptions, error) {
+	var rest []string
+	var opts recordOptions
+	for i, p := range parts {
+		key, value, ok := strings.Cut(p, "=")
+		if i < 2 || !ok {
+			rest = append(rest, p)
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "ttl":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, opts, fmt.Errorf("invalid ttl %q", value)
+			}
+			opts.ttl = n
+		case "device":
+			opts.device = value
+		case "view":
+			opts.view = value
+		default:
+			rest = append(rest, p)
+		}
+	}
+	return rest, opts, nil
+}
+
+// renew restarts the leases of name's records. A ttl above zero replaces
+// their lease length, so permanent records can be turned into leases too.
+func (r *DNSRegistry) renew(name string, ttl int, caller Caller) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	recs := r.match(name)
+	if len(recs) == 0 {
+		return time.Time{}, fmt.Errorf("%w: %s", ErrNotFound, name)
+	}
+	for _, rec := range recs {
+		if err := checkOwner(rec, caller); err != nil {
+			return time.Time{}, err
+		}
+	}
+
+	var expires time.Time
+	renewed := 0
+	for _, rec := range recs {
+		if ttl > 0 {
+			rec.TTL = ttl
+		}
+		if rec.TTL == 0 {
+			continue
+		}
+		rec.ExpiresAt = now.Add(time.Duration(rec.TTL) * time.Second).Unix()
+		rec.UpdatedAt = now.String()
+		if t := time.Unix(rec.ExpiresAt, 0); expires.IsZero() || t.Before(expires) {
+			expires = t
+		}
+		renewed++
+	}
+	if renewed == 0 {
+		return time.Time{}, fmt.Errorf("%s has no lease to renew, pass a ttl", name)
+	}
+	if err := r.Save(); err != nil {
+		return time.Time{}, fmt.Errorf("%w: %v", ErrSaveFailed, err)
+	}
+	return expires, nil
+}
+
+// expire removes every record drop selects and returns them
+func (r *DNSRegistry) expire(drop func(*nexa.DNSRecord) bool) []*nexa.DNSRecord {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var removed []*nexa.DNSRecord
+	for key, rec := range r.Records {
+		if !rec.System && drop(rec) {
+			delete(r.Records, key)
+			removed = append(removed, rec)
+		}
+	}
+	if len(removed) > 0 {
+		r.Save()
+	}
+	sort.Slice(removed, func(i, j int) bool { return recordKey(removed[i]) < recordKey(removed[j]) })
+	return removed
+}
+
+// startReaper drops records whose lease ran out
+func startReaper() {
+	ticker := time.NewTicker(reapInterval)
+	for now := range ticker.C {
+		removed := registry.expire(func(rec *nexa.DNSRecord) bool { return rec.Expired(now) })
+		reportExpired(removed, "Lease not renewed")
+	}
+}
+
+// expireDevice drops the records tied to a device that went offline
+func expireDevice(device *network.Device) {
+	removed := registry.expire(func(rec *nexa.DNSRecord) bool { return rec.DeviceID == device.ID })
+	reportExpired(removed, fmt.Sprintf("Device %s disconnected", device.ID))
+}
+
+func reportExpired(removed []*nexa.DNSRecord, reason string) {
+	for _, rec := range removed {
+		audit.Log(systemOwner, "EXPIRE", rec.Name, "SUCCESS", "local")
+	}
+	if len(removed) == 0 || govManager == nil {
+		return
+	}
+	names := make([]string, len(removed))
+	for i, rec := range removed {
+		names[i] = rec.Name + " " + rec.RecordType()
+	}
+	govManager.ReportEvent("DNS", governance.LevelNotice,
+		fmt.Sprintf("%d DNS record(s) expired", len(removed)),
+		fmt.Sprintf("%s: %s", reason, strings.Join(names, ", ")),
+		"Records Removed")
+}
+
+// answerTTL caps the TTL of answers from a leased record at the time left
+func answerTTL(rec *nexa.DNSRecord, now time.Time) uint32 {
+	if rec.ExpiresAt == 0 {
+		return localTTL
+	}
+	left := rec.ExpiresAt - now.Unix()
+	if left < 0 {
+		return 0
+	}
+	if left < localTTL {
+		return uint32(left)
+	}
+	return localTTL
+}
+
+// Leases lists the records that expire, by lease or with their device,
+// soonest first
+func Leases() []Lease {
+	if registry == nil {
+		return nil
+	}
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	now := time.Now()
+	var out []Lease
+	for _, rec := range registry.Records {
+		if rec.ExpiresAt == 0 && rec.DeviceID == "" {
+			continue
+		}
+		if rec.Expired(now) {
+			continue
+		}
+		l := Lease{
+			Name: rec.Name, Type: rec.RecordType(), Address: rec.IP, Owner: rec.Owner,
+			DeviceID: rec.DeviceID, View: rec.View, TTL: rec.TTL, Remaining: -1,
+		}
+		if l.Address == "" {
+			l.Address = rec.Target + strings.Join(rec.Text, " ")
+		}
+		if rec.ExpiresAt > 0 {
+			l.ExpiresAt = time.Unix(rec.ExpiresAt, 0)
+			l.Remaining = rec.ExpiresAt - now.Unix()
+		}
+		out = append(out, l)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if (out[i].Remaining < 0) != (out[j].Remaining < 0) {
+			return out[j].Remaining < 0
+		}
+		if out[i].Remaining != out[j].Remaining {
+			return out[i].Remaining < out[j].Remaining
+		}
+		return out[i].Name < out[j].Name
+	})
+	return out
+}
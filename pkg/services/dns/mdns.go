@@ -0,0 +1,53 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/mdns"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// mdnsHost is the label claimed under .local, renamed on conflicts
+const mdnsHost = "nexa"
+
+// mdnsServices are the web services advertised over DNS-SD
+func mdnsServices(cfg *config.Config) []mdns.Service {
+	web := func(instance string, port int) mdns.Service {
+		return mdns.Service{Instance: instance, Type: "_http._tcp", Port: port, Text: []string{"path=/"}}
+	}
+	return []mdns.Service{
+		web("Nexa Gateway", cfg.Services.Gateway.Port),
+		web("Nexa Storage", cfg.Services.Storage.Port),
+		web("Nexa Chat", cfg.Services.Chat.Port),
+		web("Nexa Dashboard", cfg.Services.Dashboard.Port),
+	}
+}
+
+func startZerosmDNS() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdns.Group)
+	if err != nil {
+		utils.LogWarning("DNS-PRO", "mDNS Port 5353 busy. Zero-config might be limited.")
+		return
+	}
+
+	responder := mdns.New(mdns.Config{
+		Host: mdnsHost,
+		Addrs: func() []net.IP {
+			if ip := net.ParseIP(utils.GetLocalIP()); ip != nil {
+				return []net.IP{ip}
+			}
+			return nil
+		},
+		Services: mdnsServices(config.Get()),
+		OnClaimed: func(host string, instances []string) {
+			utils.LogSuccess("DNS-PRO", fmt.Sprintf("Zero-Config mDNS Active (%s: %s)", host, strings.Join(instances, ", ")))
+		},
+	}, conn)
+
+	if err := responder.Serve(); err != nil {
+		utils.LogError("DNS-PRO", "mDNS responder stopped", err)
+	}
+}
@@ -0,0 +1,107 @@
+package dns
+
+import (
+	"net"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+	"github.com/MultiX0/nexa/pkg/querylog"
+	"github.com/MultiX0/nexa/pkg/resolver"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// topN is how many rows the statistics' top lists have by default
+const topN = 10
+
+var queryLog *querylog.Log
+
+// openQueryLog starts the query log, keeping only in-memory statistics if
+// the file cannot be opened
+func openQueryLog(cfg config.DNSConfig) *querylog.Log {
+	qc := querylog.Config{
+		File:     cfg.QueryLog,
+		MaxSize:  int64(cfg.QueryLogMaxMB) << 20,
+		MaxFiles: cfg.QueryLogFiles,
+	}
+	l, err := querylog.Open(qc)
+	if err != nil {
+		utils.LogError("DNS", "Failed to open the query log, keeping statistics only", err)
+		qc.File = ""
+		l, _ = querylog.Open(qc)
+	}
+	return l
+}
+
+// forwardSource names where a forwarded reply came from
+func forwardSource(res resolver.Result) string {
+	switch {
+	case res.Cached:
+		return querylog.SourceCache
+	case res.Offline:
+		return querylog.SourceOffline
+	}
+	return querylog.SourceUpstream
+}
+
+// logQuery records an answered query
+func logQuery(req, resp *dnsmsg.Message, client net.IP, e querylog.Entry, start time.Time) {
+	if queryLog == nil || len(req.Questions) == 0 {
+		return
+	}
+	q := req.Questions[0]
+	e.Time = start
+	e.Client = client.String()
+	e.Name = dnsmsg.CanonicalName(q.Name)
+	e.Type = q.Type.String()
+	e.RCode = dnsmsg.RCodeString(resp.RCode)
+	if e.LatencyMs == 0 {
+		e.LatencyMs = float64(time.Since(start).Microseconds()) / 1000
+	}
+	for _, rr := range resp.Answers {
+		e.Answers = append(e.Answers, answerString(rr))
+	}
+	if err := queryLog.Add(e); err != nil {
+		utils.LogError("DNS", "Failed to write the query log", err)
+	}
+}
+
+// answerString is the logged form of an answer record
+func answerString(rr dnsmsg.RR) string {
+	switch d := rr.Data.(type) {
+	case dnsmsg.A:
+		return d.IP.String()
+	case dnsmsg.AAAA:
+		return d.IP.String()
+	case dnsmsg.CNAME:
+		return "CNAME " + d.Target
+	case dnsmsg.PTR:
+		return "PTR " + d.Target
+	case dnsmsg.SRV:
+		return "SRV " + d.Target
+	case dnsmsg.TXT:
+		return "TXT " + strings.Join(d.Strings, " ")
+	}
+	return rr.Type().String()
+}
+
+// QueryStats returns the query counters with the n busiest domains,
+// blocked domains and clients
+func QueryStats(n int) querylog.Stats {
+	if queryLog == nil {
+		return querylog.Stats{}
+	}
+	if n <= 0 {
+		n = topN
+	}
+	return queryLog.Stats(n)
+}
+
+// RecentQueries returns up to n of the latest queries, newest first
+func RecentQueries(n int) []querylog.Entry {
+	if queryLog == nil {
+		return []querylog.Entry{}
+	}
+	return queryLog.Recent(n)
+}
@@ -0,0 +1,350 @@
+package dns
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/nexa"
+)
+
+// ErrSaveFailed wraps errors writing the registry file, as opposed to invalid records
+var ErrSaveFailed = errors.New("failed to save record")
+
+// recordKey is the registry key of a record. A records keep the bare name
+// so registries written before typed records load unchanged; records in a
+// view get an @view suffix.
+func recordKey(rec *nexa.DNSRecord) string {
+	key := rec.Name
+	if t := rec.RecordType(); t != nexa.DNS_TYPE_A {
+		key += "/" + t
+	}
+	if rec.View != "" {
+		key += "@" + rec.View
+	}
+	return key
+}
+
+// parseRecord builds a typed record from the arguments of
+// REGISTER <name> <type> <data...>:
+//
+//	A|AAAA <ip> [port] [service]
+//	CNAME|PTR <target>
+//	SRV <priority> <weight> <port> <target>
+//	TXT <text>...
+func parseRecord(name, typ string, args []string) (*nexa.DNSRecord, error) {
+	rec := &nexa.DNSRecord{Name: name, Type: strings.ToUpper(typ)}
+	need := func(n int, usage string) error {
+		if len(args) < n {
+			return fmt.Errorf("Usage: REGISTER <name> %s %s", rec.Type, usage)
+		}
+		return nil
+	}
+	var err error
+	switch rec.Type {
+	case nexa.DNS_TYPE_A, nexa.DNS_TYPE_AAAA:
+		if err := need(1, "<ip> [port] [service]"); err != nil {
+			return nil, err
+		}
+		rec.IP = args[0]
+		if len(args) > 1 {
+			if rec.Port, err = strconv.Atoi(args[1]); err != nil {
+				return nil, fmt.Errorf("invalid port %q", args[1])
+			}
+		}
+		if len(args) > 2 {
+			rec.Service = args[2]
+		}
+	case nexa.DNS_TYPE_CNAME, nexa.DNS_TYPE_PTR:
+		if err := need(1, "<target>"); err != nil {
+			return nil, err
+		}
+		rec.Target = args[0]
+	case nexa.DNS_TYPE_SRV:
+		if err := need(4, "<priority> <weight> <port> <target>"); err != nil {
+			return nil, err
+		}
+		nums := make([]int, 3)
+		for i := range nums {
+			if nums[i], err = strconv.Atoi(args[i]); err != nil {
+				return nil, fmt.Errorf("invalid number %q", args[i])
+			}
+		}
+		rec.Priority, rec.Weight, rec.Port, rec.Target = nums[0], nums[1], nums[2], args[3]
+	case nexa.DNS_TYPE_TXT:
+		if err := need(1, "<text>..."); err != nil {
+			return nil, err
+		}
+		rec.Text = args
+	default:
+		return nil, fmt.Errorf("unsupported record type %q", typ)
+	}
+	return rec, nil
+}
+
+// isRecordType reports whether s names a record type REGISTER accepts
+func isRecordType(s string) bool {
+	switch strings.ToUpper(s) {
+	case nexa.DNS_TYPE_A, nexa.DNS_TYPE_AAAA, nexa.DNS_TYPE_CNAME, nexa.DNS_TYPE_PTR, nexa.DNS_TYPE_SRV, nexa.DNS_TYPE_TXT:
+		return true
+	}
+	return false
+}
+
+// put validates rec and stores it for caller, replacing the record with
+// the same name and type. Every record of a name belongs to the user who
+// created the first one; only they or an admin may add to it or change it.
+// With update set the record must already exist. A CNAME cannot share its
+// name with any other record of the same view.
+func (r *DNSRegistry) put(rec *nexa.DNSRecord, caller Caller, update bool) error {
+	if err := prepareRecord(rec); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	key := recordKey(rec)
+	old, exists := r.Records[key]
+	if exists && old.Expired(now) {
+		// A lapsed record is gone; whoever claims the name now owns it
+		exists = false
+	}
+	if update && !exists {
+		return fmt.Errorf("%w: %s %s", ErrNotFound, rec.Name, rec.Type)
+	}
+	for _, other := range r.match(rec.Name) {
+		if err := checkOwner(other, caller); err != nil {
+			return err
+		}
+		if recordKey(other) == key {
+			continue
+		}
+		if err := cnameConflict(rec, other); err != nil {
+			return err
+		}
+	}
+
+	rec.ExpiresAt = 0
+	if rec.TTL > 0 {
+		rec.ExpiresAt = now.Add(time.Duration(rec.TTL) * time.Second).Unix()
+	}
+	rec.Owner, rec.CreatedAt, rec.UpdatedAt = caller.User, now.String(), ""
+	if exists {
+		// An admin editing someone else's record does not take it over
+		rec.Owner, rec.CreatedAt, rec.UpdatedAt = old.Owner, old.CreatedAt, now.String()
+	}
+	r.Records[key] = rec
+	if err := r.Save(); err != nil {
+		return fmt.Errorf("%w: %v", ErrSaveFailed, err)
+	}
+	return nil
+}
+
+// prepareRecord validates rec and normalises it for storage
+func prepareRecord(rec *nexa.DNSRecord) error {
+	rec.Name = strings.TrimSuffix(rec.Name, ".")
+	rec.Target = strings.TrimSuffix(rec.Target, ".")
+	rec.Type = strings.ToUpper(rec.Type)
+	if err := rec.Validate(); err != nil {
+		return err
+	}
+	rec.Type = rec.RecordType()
+	rec.System = false
+	rec.View = strings.ToLower(rec.View)
+	if !viewExists(rec.View) {
+		return fmt.Errorf("unknown view %q", rec.View)
+	}
+	return nil
+}
+
+// cnameConflict reports whether rec and other, two records of one name,
+// cannot coexist because either is a CNAME in the same view
+func cnameConflict(rec, other *nexa.DNSRecord) error {
+	if other.View != rec.View {
+		return nil
+	}
+	if rec.RecordType() == nexa.DNS_TYPE_CNAME || other.RecordType() == nexa.DNS_TYPE_CNAME {
+		return fmt.Errorf("%s already has a %s record, CNAME names cannot hold other records", rec.Name, other.RecordType())
+	}
+	return nil
+}
+
+// remove deletes the record of the given type for name, or all of the
+// name's records when typ is empty, and returns how many were removed. A
+// view limits it to that view's records.
+func (r *DNSRegistry) remove(name, typ, view string, caller Caller) (int, error) {
+	typ = strings.ToUpper(typ)
+	view = strings.ToLower(view)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var keys []string
+	for _, rec := range r.match(name) {
+		if (typ != "" && rec.RecordType() != typ) || (view != "" && rec.View != view) {
+			continue
+		}
+		if err := checkOwner(rec, caller); err != nil {
+			return 0, err
+		}
+		keys = append(keys, recordKey(rec))
+	}
+	if len(keys) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, strings.TrimSpace(name+" "+typ))
+	}
+	for _, key := range keys {
+		delete(r.Records, key)
+	}
+	if err := r.Save(); err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrSaveFailed, err)
+	}
+	return len(keys), nil
+}
+
+// match returns every live record for name, ignoring case. Records whose
+// lease ran out are skipped until the reaper removes them. Caller holds r.mu.
+func (r *DNSRegistry) match(name string) []*nexa.DNSRecord {
+	name = strings.TrimSuffix(name, ".")
+	now := time.Now()
+	var out []*nexa.DNSRecord
+	for _, rec := range r.Records {
+		if strings.EqualFold(rec.Name, name) && !rec.Expired(now) {
+			out = append(out, rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return recordKey(out[i]) < recordKey(out[j]) })
+	return out
+}
+
+// byAddress returns the address records pointing at ip as the client
+// behind h sees them, for reverse lookups. Caller holds r.mu.
+func (r *DNSRegistry) byAddress(ip net.IP, h horizon) []*nexa.DNSRecord {
+	now := time.Now()
+	var out []*nexa.DNSRecord
+	for _, rec := range r.Records {
+		t := rec.RecordType()
+		if (t != nexa.DNS_TYPE_A && t != nexa.DNS_TYPE_AAAA) || rec.Expired(now) {
+			continue
+		}
+		if rec.View != "" && rec.View != h.view {
+			continue
+		}
+		if ip.Equal(net.ParseIP(rec.IP)) || ip.Equal(net.ParseIP(h.address(rec.IP))) {
+			out = append(out, rec)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+// serviceHost finds the address record that publishes service, so that
+// _<service>._tcp.<host> can be answered with its port. Caller holds r.mu.
+func (r *DNSRegistry) serviceHost(name, view string) (*nexa.DNSRecord, bool) {
+	labels := strings.SplitN(strings.TrimSuffix(name, "."), ".", 3)
+	if len(labels) < 3 || !strings.HasPrefix(labels[0], "_") || !strings.EqualFold(labels[1], "_tcp") {
+		return nil, false
+	}
+	service := labels[0][1:]
+	for _, rec := range r.visible(labels[2], view) {
+		t := rec.RecordType()
+		if (t == nexa.DNS_TYPE_A || t == nexa.DNS_TYPE_AAAA) && rec.Port > 0 && strings.EqualFold(rec.Service, service) {
+			return rec, true
+		}
+	}
+	return nil, false
+}
+
+// reverseIP decodes an in-addr.arpa or ip6.arpa name, or returns nil
+func reverseIP(name string) net.IP {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	switch {
+	case strings.HasSuffix(name, ".in-addr.arpa"):
+		parts := strings.Split(strings.TrimSuffix(name, ".in-addr.arpa"), ".")
+		if len(parts) != 4 {
+			return nil
+		}
+		for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+			parts[i], parts[j] = parts[j], parts[i]
+		}
+		return net.ParseIP(strings.Join(parts, ".")).To4()
+	case strings.HasSuffix(name, ".ip6.arpa"):
+		nibbles := strings.Split(strings.TrimSuffix(name, ".ip6.arpa"), ".")
+		if len(nibbles) != 32 {
+			return nil
+		}
+		ip := make(net.IP, net.IPv6len)
+		for i, n := range nibbles {
+			v, err := strconv.ParseUint(n, 16, 8)
+			if err != nil || len(n) != 1 {
+				return nil
+			}
+			pos := 31 - i
+			if pos%2 == 0 {
+				ip[pos/2] |= byte(v) << 4
+			} else {
+				ip[pos/2] |= byte(v)
+			}
+		}
+		return ip
+	}
+	return nil
+}
+
+// RegisterRecord validates and stores a typed record owned by caller
+func RegisterRecord(rec *nexa.DNSRecord, caller Caller) error {
+	if registry == nil {
+		return fmt.Errorf("registry not initialized")
+	}
+	return registry.put(rec, caller, false)
+}
+
+// UpdateRecord replaces an existing record caller may change
+func UpdateRecord(rec *nexa.DNSRecord, caller Caller) error {
+	if registry == nil {
+		return fmt.Errorf("registry not initialized")
+	}
+	return registry.put(rec, caller, true)
+}
+
+// DeleteRecord removes name's record of type typ, or all of them when typ
+// is empty, in view or in every view when view is empty
+func DeleteRecord(name, typ, view string, caller Caller) (int, error) {
+	if registry == nil {
+		return 0, fmt.Errorf("registry not initialized")
+	}
+	return registry.remove(name, typ, view, caller)
+}
+
+// Records returns a copy of every record named name, or of all records when name is empty
+func Records(name string) []nexa.DNSRecord {
+	if registry == nil {
+		return nil
+	}
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	var recs []*nexa.DNSRecord
+	if name != "" {
+		recs = registry.match(name)
+	} else {
+		now := time.Now()
+		for _, rec := range registry.Records {
+			if !rec.Expired(now) {
+				recs = append(recs, rec)
+			}
+		}
+		sort.Slice(recs, func(i, j int) bool { return recordKey(recs[i]) < recordKey(recs[j]) })
+	}
+	out := make([]nexa.DNSRecord, len(recs))
+	for i, rec := range recs {
+		out[i] = *rec
+		out[i].Type = rec.RecordType()
+	}
+	return out
+}
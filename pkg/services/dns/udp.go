@@ -0,0 +1,310 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/dnsmsg"
+	"github.com/MultiX0/nexa/pkg/nexa"
+	"github.com/MultiX0/nexa/pkg/querylog"
+	"github.com/MultiX0/nexa/pkg/resolver"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+const (
+	localTTL      = 60 // TTL of answers from the registry
+	udpBufferSize = 4096
+)
+
+func startStandardUDPDNS() {
+	addr, err := net.ResolveUDPAddr("udp", "0.0.0.0:53")
+	if err != nil {
+		utils.LogWarning("DNS-PRO", fmt.Sprintf("Standard DNS (Port 53) failed: %v", err))
+		return
+	}
+
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		utils.LogWarning("DNS-PRO", "Port 53 is busy. Standard DNS will not work automatically.")
+		return
+	}
+	defer conn.Close()
+
+	utils.LogSuccess("DNS-PRO", "NEXA Smart DNS Active on Port 53")
+
+	buffer := make([]byte, udpBufferSize)
+	for {
+		n, remoteAddr, err := conn.ReadFromUDP(buffer)
+		if err != nil {
+			continue
+		}
+
+		// The buffer is reused for the next packet, so each query gets its own copy
+		query := append([]byte(nil), buffer[:n]...)
+		go func(data []byte, addr *net.UDPAddr) {
+			response := handleSmartDNSQuery(data, addr.IP)
+			if response != nil {
+				conn.WriteToUDP(response, addr)
+			}
+		}(query, remoteAddr)
+	}
+}
+
+// handleSmartDNSQuery answers names the registry is authoritative for and
+// forwards everything else upstream. Answers depend on the client's subnet
+// and view. It returns nil when nothing should be sent back.
+func handleSmartDNSQuery(query []byte, client net.IP) []byte {
+	start := time.Now()
+	req, err := dnsmsg.Parse(query)
+	if err != nil {
+		return errorReply(query, dnsmsg.RCodeFormatError)
+	}
+	if req.Response {
+		return nil
+	}
+
+	h := horizonFor(client)
+	resp := req.Reply()
+	entry := querylog.Entry{Source: querylog.SourceLocal}
+	blockedQ, rule, blocked := blockedQuestion(req.Questions)
+	switch {
+	case req.Opcode != dnsmsg.OpcodeQuery:
+		resp.RCode = dnsmsg.RCodeNotImplemented
+	case req.EDNS != nil && req.EDNS.Version > 0:
+		resp.RCode = dnsmsg.RCodeBadVersion
+	case len(req.Questions) == 0:
+		resp.RCode = dnsmsg.RCodeFormatError
+	case blocked:
+		answerBlocked(req, resp, config.Get().Services.DNS)
+		entry.Source, entry.Rule = querylog.SourceBlocked, rule.Pattern
+		reportBlocked(blockedQ.Name, rule, client.String())
+	case !allAuthoritative(req.Questions, h):
+		// Recursive Proxy Mode
+		var res resolver.Result
+		resp, res = forwardDNSQuery(req)
+		entry.Source, entry.Upstream = forwardSource(res), res.Upstream
+		if res.Upstream != "" {
+			entry.LatencyMs = float64(res.RTT.Microseconds()) / 1000
+		}
+	default:
+		answerLocal(req, resp, h)
+	}
+	logQuery(req, resp, client, entry, start)
+
+	out, err := resp.Truncate(req.MaxUDPSize())
+	if err != nil {
+		utils.LogError("DNS-PRO", "Failed to encode DNS reply", err)
+		return nil
+	}
+	return out
+}
+
+func isLocalName(name string) bool {
+	name = dnsmsg.CanonicalName(name)
+	return strings.HasSuffix(name, ".n") || strings.HasSuffix(name, ".nexa")
+}
+
+// isAuthoritative reports whether name is answered here instead of
+// upstream: .n and .nexa names, registered names and the reverse names of
+// registered addresses, as seen from h
+func isAuthoritative(name string, h horizon) bool {
+	if isLocalName(name) {
+		return true
+	}
+	if registry == nil {
+		return false
+	}
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+	if len(registry.visible(name, h.view)) > 0 {
+		return true
+	}
+	ip := reverseIP(name)
+	return ip != nil && len(registry.byAddress(ip, h)) > 0
+}
+
+func allAuthoritative(questions []dnsmsg.Question, h horizon) bool {
+	for _, q := range questions {
+		if !isAuthoritative(q.Name, h) {
+			return false
+		}
+	}
+	return true
+}
+
+// answerLocal answers every question from the registry. Unknown .n and
+// .nexa names point at the gateway's address on the client's subnet,
+// unless strict mode is on and they get NXDOMAIN.
+func answerLocal(req, resp *dnsmsg.Message, h horizon) {
+	resp.Authoritative = true
+	if registry == nil {
+		return
+	}
+	registry.mu.RLock()
+	defer registry.mu.RUnlock()
+
+	for _, q := range req.Questions {
+		if q.Class != dnsmsg.ClassINET && q.Class != dnsmsg.ClassANY {
+			continue
+		}
+		answers, extra, exists := registry.answer(q, h)
+		if !exists {
+			resp.RCode = dnsmsg.RCodeNameError
+			continue
+		}
+		resp.Answers = append(resp.Answers, answers...)
+		resp.Additional = append(resp.Additional, extra...)
+	}
+	if len(resp.Answers) == 0 {
+		resp.Authority = append(resp.Authority, zoneSOA(req.Questions[0].Name))
+	}
+}
+
+// maxCNAMEHops bounds how far answer follows CNAME chains inside the registry
+const maxCNAMEHops = 8
+
+// answer resolves one question, following CNAMEs held in the registry. It
+// returns the answers, the addresses of SRV targets for the additional
+// section, and whether the name exists. Caller holds r.mu.
+func (r *DNSRegistry) answer(q dnsmsg.Question, h horizon) ([]dnsmsg.RR, []dnsmsg.RR, bool) {
+	var answers, extra []dnsmsg.RR
+	name := q.Name
+	for hop := 0; hop < maxCNAMEHops; hop++ {
+		rrs := r.resourceRecords(name, h)
+		if len(rrs) == 0 {
+			if hop == 0 {
+				return nil, nil, false
+			}
+			break // the alias points outside the registry
+		}
+		next := ""
+		for _, rr := range rrs {
+			cname, isAlias := rr.Data.(dnsmsg.CNAME)
+			switch {
+			case q.Type == dnsmsg.TypeANY || rr.Type() == q.Type:
+				answers = append(answers, rr)
+			case isAlias:
+				answers = append(answers, rr)
+				next = cname.Target
+			}
+		}
+		if next == "" {
+			break
+		}
+		name = next
+	}
+
+	for _, rr := range answers {
+		if srv, ok := rr.Data.(dnsmsg.SRV); ok {
+			for _, addr := range r.resourceRecords(srv.Target, h) {
+				if t := addr.Type(); t == dnsmsg.TypeA || t == dnsmsg.TypeAAAA {
+					extra = append(extra, addr)
+				}
+			}
+		}
+	}
+	return answers, extra, true
+}
+
+// resourceRecords returns every record owned by name: registered records,
+// SRV records derived from address records with a service and port, PTR
+// records for registered addresses, and the gateway wildcard, as the
+// client behind h sees them. Caller holds r.mu.
+func (r *DNSRegistry) resourceRecords(name string, h horizon) []dnsmsg.RR {
+	var out []dnsmsg.RR
+	has := make(map[string]bool)
+	now := time.Now()
+	for _, rec := range r.visible(name, h.view) {
+		if data := recordData(rec, h); data != nil {
+			out = append(out, dnsmsg.RR{Name: name, Class: dnsmsg.ClassINET, TTL: answerTTL(rec, now), Data: data})
+			has[rec.RecordType()] = true
+		}
+	}
+	if host, ok := r.serviceHost(name, h.view); ok && !has[nexa.DNS_TYPE_SRV] {
+		out = append(out, dnsmsg.RR{
+			Name: name, Class: dnsmsg.ClassINET, TTL: answerTTL(host, now),
+			Data: dnsmsg.SRV{Port: uint16(host.Port), Target: host.Name},
+		})
+	}
+	if ip := reverseIP(name); ip != nil && !has[nexa.DNS_TYPE_PTR] {
+		for _, rec := range r.byAddress(ip, h) {
+			out = append(out, dnsmsg.RR{Name: name, Class: dnsmsg.ClassINET, TTL: answerTTL(rec, now), Data: dnsmsg.PTR{Target: rec.Name}})
+		}
+	}
+	if len(out) == 0 && isWildcardName(name) {
+		if ip := h.gatewayIP(); ip != nil {
+			out = append(out, dnsmsg.RR{Name: name, Class: dnsmsg.ClassINET, TTL: localTTL, Data: dnsmsg.A{IP: ip}})
+		}
+	}
+	return out
+}
+
+// recordData converts a registry record to its wire form, or nil if it is
+// unusable. Addresses of this host become the one reachable from h.
+func recordData(rec *nexa.DNSRecord, h horizon) dnsmsg.RData {
+	switch rec.RecordType() {
+	case nexa.DNS_TYPE_A:
+		if ip := net.ParseIP(h.address(rec.IP)).To4(); ip != nil {
+			return dnsmsg.A{IP: ip}
+		}
+	case nexa.DNS_TYPE_AAAA:
+		if ip := net.ParseIP(rec.IP); ip != nil {
+			return dnsmsg.AAAA{IP: ip}
+		}
+	case nexa.DNS_TYPE_CNAME:
+		return dnsmsg.CNAME{Target: rec.Target}
+	case nexa.DNS_TYPE_PTR:
+		return dnsmsg.PTR{Target: rec.Target}
+	case nexa.DNS_TYPE_SRV:
+		return dnsmsg.SRV{Priority: uint16(rec.Priority), Weight: uint16(rec.Weight), Port: uint16(rec.Port), Target: rec.Target}
+	case nexa.DNS_TYPE_TXT:
+		return dnsmsg.TXT{Strings: rec.Text}
+	}
+	return nil
+}
+
+// zoneSOA is the authority record sent with NXDOMAIN and empty answers so
+// resolvers cache them for localTTL
+func zoneSOA(name string) dnsmsg.RR {
+	zone := dnsmsg.CanonicalName(name)
+	if i := strings.LastIndexByte(zone, '.'); i >= 0 && isLocalName(zone) {
+		zone = zone[i+1:]
+	}
+	return dnsmsg.RR{
+		Name: zone, Class: dnsmsg.ClassINET, TTL: localTTL,
+		Data: dnsmsg.SOA{
+			NS: "ns." + zone, MBox: "hostmaster." + zone,
+			Serial: 1, Refresh: 3600, Retry: 600, Expire: 86400, MinTTL: localTTL,
+		},
+	}
+}
+
+// answerIP returns the address to hand out for local names. A listener
+// bound to 0.0.0.0 falls back to the primary local IP.
+func answerIP(interfaceIP string) net.IP {
+	ip := net.ParseIP(interfaceIP).To4()
+	if ip == nil || ip.IsUnspecified() {
+		ip = net.ParseIP(utils.GetLocalIP()).To4()
+	}
+	return ip
+}
+
+// errorReply builds a bare reply from the query header alone, so it also
+// works for queries whose body does not parse
+func errorReply(query []byte, rcode uint16) []byte {
+	h, err := dnsmsg.ParseHeader(query)
+	if err != nil || h.Response {
+		return nil
+	}
+	resp := &dnsmsg.Message{Header: dnsmsg.Header{
+		ID: h.ID, Response: true, Opcode: h.Opcode, RecursionDesired: h.RecursionDesired, RCode: rcode,
+	}}
+	out, err := resp.Pack()
+	if err != nil {
+		return nil
+	}
+	return out
+}
@@ -0,0 +1,253 @@
+package dns
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/network"
+	"github.com/MultiX0/nexa/pkg/nexa"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// interfaceRefresh is how long the interface list is trusted. Hotspots and
+// cables come and go while the service runs.
+const interfaceRefresh = 30 * time.Second
+
+// localSubnet is a subnet this host has an address on
+type localSubnet struct {
+	iface string
+	ip    net.IP
+	net   *net.IPNet
+}
+
+// dnsView is a named view from the config with its subnets parsed
+type dnsView struct {
+	name       string
+	subnets    []*net.IPNet
+	interfaces []string
+}
+
+// horizon is what one client sees: the Nexa address on its subnet and the
+// view it belongs to
+type horizon struct {
+	addr net.IP // nil for clients on no local subnet and for this host
+	view string
+}
+
+// View describes a configured view for the admin UI
+type View struct {
+	Name       string   `json:"name"`
+	Subnets    []string `json:"subnets"`
+	Interfaces []string `json:"interfaces"`
+	Records    int      `json:"records"`
+}
+
+var (
+	views []dnsView // set once by Start
+
+	subnetsMu sync.Mutex
+	subnets   []localSubnet
+	subnetsAt time.Time
+)
+
+// loadViews parses the configured views, skipping invalid subnets
+func loadViews(cfg []config.DNSView) []dnsView {
+	var out []dnsView
+	seen := make(map[string]bool)
+	for _, v := range cfg {
+		name := strings.ToLower(strings.TrimSpace(v.Name))
+		if name == "" || seen[name] {
+			utils.LogWarning("DNS", fmt.Sprintf("Ignoring DNS view with missing or duplicate name %q", v.Name))
+			continue
+		}
+		seen[name] = true
+		view := dnsView{name: name, interfaces: v.Interfaces}
+		for _, s := range v.Subnets {
+			_, subnet, err := net.ParseCIDR(strings.TrimSpace(s))
+			if err != nil {
+				utils.LogWarning("DNS", fmt.Sprintf("DNS view %s: invalid subnet %q", name, s))
+				continue
+			}
+			view.subnets = append(view.subnets, subnet)
+		}
+		out = append(out, view)
+	}
+	return out
+}
+
+// viewExists reports whether records may be registered in view
+func viewExists(view string) bool {
+	if view == "" {
+		return true
+	}
+	for _, v := range views {
+		if v.name == view {
+			return true
+		}
+	}
+	return false
+}
+
+// localSubnets lists the subnets of the active interfaces, refreshed every
+// interfaceRefresh
+func localSubnets() []localSubnet {
+	subnetsMu.Lock()
+	defer subnetsMu.Unlock()
+	if subnets != nil && time.Since(subnetsAt) < interfaceRefresh {
+		return subnets
+	}
+
+	list := []localSubnet{}
+	for _, iface := range network.GetAllNetworkInterfaces() {
+		if !iface.IsActive {
+			continue
+		}
+		for _, cidr := range iface.Networks {
+			ip, subnet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				continue
+			}
+			list = append(list, localSubnet{iface: iface.Name, ip: ip.To4(), net: subnet})
+		}
+	}
+	// The narrowest subnet wins when networks overlap
+	sort.SliceStable(list, func(i, j int) bool {
+		a, _ := list[i].net.Mask.Size()
+		b, _ := list[j].net.Mask.Size()
+		return a > b
+	})
+	subnets, subnetsAt = list, time.Now()
+	return subnets
+}
+
+// horizonFor finds the local address and the view for a client. Queries
+// arrive on a socket bound to 0.0.0.0, so the client's subnet tells which
+// interface it reached us through.
+func horizonFor(client net.IP) horizon {
+	var h horizon
+	if client == nil {
+		return h
+	}
+	var clientIfaces []string
+	for _, s := range localSubnets() {
+		if s.net.Contains(client) {
+			// Local clients can reach every address, loopback stays private
+			if h.addr == nil && !s.ip.IsLoopback() {
+				h.addr = s.ip
+			}
+			clientIfaces = append(clientIfaces, s.iface)
+		}
+	}
+
+	for _, v := range views {
+		if v.matches(client, clientIfaces) {
+			h.view = v.name
+			break
+		}
+	}
+	return h
+}
+
+// horizonForAddr is horizonFor for a host:port address
+func horizonForAddr(addr string) horizon {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	return horizonFor(net.ParseIP(host))
+}
+
+func (v dnsView) matches(client net.IP, clientIfaces []string) bool {
+	for _, subnet := range v.subnets {
+		if subnet.Contains(client) {
+			return true
+		}
+	}
+	for _, name := range v.interfaces {
+		for _, iface := range clientIfaces {
+			if strings.EqualFold(name, iface) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// address rewrites an address of this host to the one the client can
+// reach. Services register whichever address they saw first, which is
+// useless to a client on another interface.
+func (h horizon) address(ip string) string {
+	if h.addr == nil || !isSelfAddress(net.ParseIP(ip)) {
+		return ip
+	}
+	return h.addr.String()
+}
+
+// gatewayIP is where unknown .n and .nexa names point for this client
+func (h horizon) gatewayIP() net.IP {
+	if h.addr != nil {
+		return h.addr
+	}
+	return answerIP("")
+}
+
+// isSelfAddress reports whether ip is on one of this host's interfaces
+func isSelfAddress(ip net.IP) bool {
+	if ip == nil || ip.To4() == nil {
+		return false
+	}
+	for _, s := range localSubnets() {
+		if s.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// visible returns name's records as a client in view sees them. A view
+// holding any record for the name replaces the shared records of that
+// name. Caller holds r.mu.
+func (r *DNSRegistry) visible(name, view string) []*nexa.DNSRecord {
+	var shared, own []*nexa.DNSRecord
+	for _, rec := range r.match(name) {
+		switch rec.View {
+		case "":
+			shared = append(shared, rec)
+		case view:
+			own = append(own, rec)
+		}
+	}
+	if len(own) > 0 {
+		return own
+	}
+	return shared
+}
+
+// Views lists the configured views with how many records each holds
+func Views() []View {
+	out := []View{}
+	counts := make(map[string]int)
+	if registry != nil {
+		registry.mu.RLock()
+		now := time.Now()
+		for _, rec := range registry.Records {
+			if rec.View != "" && !rec.Expired(now) {
+				counts[rec.View]++
+			}
+		}
+		registry.mu.RUnlock()
+	}
+	for _, v := range views {
+		subnets := make([]string, len(v.subnets))
+		for i, s := range v.subnets {
+			subnets[i] = s.String()
+		}
+		out = append(out, View{Name: v.name, Subnets: subnets, Interfaces: append([]string{}, v.interfaces...), Records: counts[v.name]})
+	}
+	return out
+}
@@ -1,7 +1,9 @@
 package gateway
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net"
@@ -10,6 +12,7 @@ import (
 	"net/url"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync/atomic"
 	"time"
@@ -18,6 +21,7 @@ import (
 	"github.com/MultiX0/nexa/pkg/config"
 	"github.com/MultiX0/nexa/pkg/governance"
 	"github.com/MultiX0/nexa/pkg/network"
+	"github.com/MultiX0/nexa/pkg/nexa"
 	"github.com/MultiX0/nexa/pkg/services/dns"
 	"github.com/MultiX0/nexa/pkg/utils"
 	"github.com/go-chi/chi/v5"
@@ -219,6 +223,12 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	r.Route("/api", func(r chi.Router) {
 		r.Get("/status", handleStatus)
 		r.Post("/register-site", handleRegisterSite)
+		r.Get("/dns/records", handleDNSRecords)
+		r.Delete("/dns/records", handleDeleteDNSRecord)
+		r.Post("/dns/bulk", handleDNSBulk)
+		r.Get("/dns/zone", handleExportZone)
+		r.Post("/dns/zone", handleImportZone)
+		r.Get("/ledger/watch", handleLedgerWatch)
 
 		// Network Expansion Routes
 		r.Route("/network", func(r chi.Router) {
@@ -436,25 +446,137 @@ func handleStatus(w http.ResponseWriter, r *http.Request) {
 }
 
 func handleRegisterSite(w http.ResponseWriter, r *http.Request) {
-	var req struct {
-		Name    string `json:"name"`
-		IP      string `json:"ip"`
-		Port    int    `json:"port"`
-		Service string `json:"service"`
+	// name, ip, port and service register a site; type plus target, text,
+	// priority and weight add the other record types
+	caller, err := dnsCaller(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
 	}
+	var req nexa.DNSRecord
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		http.Error(w, "Invalid request body", http.StatusBadRequest)
 		return
 	}
-	if !strings.HasSuffix(req.Name, ".n") && !strings.HasSuffix(req.Name, ".nexa") {
+	if !strings.HasSuffix(req.Name, ".n") && !strings.HasSuffix(req.Name, ".nexa") && !strings.HasSuffix(req.Name, ".arpa") {
 		req.Name += ".n"
 	}
-	if err := dns.Register(req.Name, req.IP, req.Port, req.Service); err != nil {
-		http.Error(w, "Failed to register site: "+err.Error(), http.StatusInternalServerError)
+	if err := dns.RegisterRecord(&req, caller); err != nil {
+		http.Error(w, "Failed to register site: "+err.Error(), dnsErrorStatus(err))
 		return
 	}
 	w.WriteHeader(http.StatusCreated)
-	json.NewEncoder(w).Encode(map[string]string{"status": "registered", "domain": req.Name})
+	json.NewEncoder(w).Encode(map[string]string{"status": "registered", "domain": req.Name, "type": req.Type, "owner": req.Owner})
+}
+
+// handleDeleteDNSRecord removes ?name= records, only those of ?type= and
+// ?view= if given
+func handleDeleteDNSRecord(w http.ResponseWriter, r *http.Request) {
+	caller, err := dnsCaller(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	n, err := dns.DeleteRecord(name, r.URL.Query().Get("type"), r.URL.Query().Get("view"), caller)
+	if err != nil {
+		http.Error(w, "Failed to delete record: "+err.Error(), dnsErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"status": "deleted", "domain": name, "removed": n})
+}
+
+// handleDNSBulk applies a dns.BulkRequest of record changes, all or none
+func handleDNSBulk(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, err := dnsCaller(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	var req dns.BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid request body", http.StatusBadRequest)
+		return
+	}
+	res, err := dns.ApplyBulk(req, caller)
+	if err != nil {
+		http.Error(w, "Bulk change failed: "+err.Error(), dnsErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleExportZone returns the ?zone= records as a BIND zone file
+func handleExportZone(w http.ResponseWriter, r *http.Request) {
+	zone := r.URL.Query().Get("zone")
+	var buf bytes.Buffer
+	if err := dns.ExportZone(&buf, zone); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	w.Header().Set("Content-Type", "text/dns; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", strings.Trim(zone, ".")+".zone"))
+	w.Write(buf.Bytes())
+}
+
+// maxZoneSize bounds an imported zone file
+const maxZoneSize = 4 << 20
+
+// handleImportZone loads the zone file in the body into ?zone=. With
+// ?replace=true the zone's records not in the file are removed, and
+// ?dry_run=true only reports the changes.
+func handleImportZone(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	caller, err := dnsCaller(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	q := r.URL.Query()
+	replace, _ := strconv.ParseBool(q.Get("replace"))
+	dryRun, _ := strconv.ParseBool(q.Get("dry_run"))
+	res, err := dns.ImportZone(http.MaxBytesReader(w, r.Body, maxZoneSize), q.Get("zone"), replace, dryRun, caller)
+	if err != nil {
+		http.Error(w, "Zone import failed: "+err.Error(), dnsErrorStatus(err))
+		return
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// dnsCaller authenticates the bearer token issued by the core server's AUTH command
+func dnsCaller(r *http.Request) (dns.Caller, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return dns.Caller{}, dns.ErrUnauthorized
+	}
+	return dns.Authenticate(strings.TrimSpace(token))
+}
+
+func dnsErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, dns.ErrSaveFailed):
+		return http.StatusInternalServerError
+	case errors.Is(err, dns.ErrForbidden), errors.Is(err, dns.ErrReadOnly), errors.Is(err, dns.ErrAdminOnly):
+		return http.StatusForbidden
+	case errors.Is(err, dns.ErrNotFound):
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
+// handleDNSRecords lists registry records, optionally only those for ?name=
+func handleDNSRecords(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	records := dns.Records(r.URL.Query().Get("name"))
+	if records == nil {
+		records = []nexa.DNSRecord{}
+	}
+	json.NewEncoder(w).Encode(records)
 }
 
 func handleGatewayHome(w http.ResponseWriter, r *http.Request) {
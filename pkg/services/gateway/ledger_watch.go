@@ -0,0 +1,110 @@
+package gateway
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/utils"
+	"github.com/gorilla/websocket"
+)
+
+var watchUpgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true // Allow all origins for local network
+	},
+}
+
+// handleLedgerWatch bridges a WebSocket to a WATCH stream on the core server.
+// Query: key=<key> or prefix=<prefix>, optional from=<height> to resume.
+// Every message is one JSON change.
+func handleLedgerWatch(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	pattern := q.Get("key")
+	if p := q.Get("prefix"); p != "" {
+		pattern = p + "*"
+	}
+	if pattern == "" || strings.ContainsAny(pattern, " \r\n") {
+		http.Error(w, "key or prefix required", http.StatusBadRequest)
+		return
+	}
+	line := "WATCH " + pattern
+	if from := q.Get("from"); from != "" {
+		if _, err := strconv.Atoi(from); err != nil {
+			http.Error(w, "invalid from height", http.StatusBadRequest)
+			return
+		}
+		line += " " + from
+	}
+
+	coreAddr := fmt.Sprintf("127.0.0.1:%d", config.Get().Server.Port)
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	core, err := tls.DialWithDialer(dialer, "tcp", coreAddr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		http.Error(w, "Core server unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	defer core.Close()
+
+	fmt.Fprintf(core, "%s\n", line)
+	reader := bufio.NewReader(core)
+	status, _, err := readCoreFrame(reader)
+	if err != nil || !strings.HasPrefix(status, "200") {
+		http.Error(w, "Watch rejected: "+status, http.StatusBadRequest)
+		return
+	}
+
+	ws, err := watchUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		utils.LogError("Gateway", "WebSocket upgrade failed", err)
+		return
+	}
+	defer ws.Close()
+
+	// Closing the core connection stops the relay below when the client leaves
+	go func() {
+		for {
+			if _, _, err := ws.ReadMessage(); err != nil {
+				core.Close()
+				return
+			}
+		}
+	}()
+
+	for {
+		_, body, err := readCoreFrame(reader)
+		if err != nil {
+			return
+		}
+		if err := ws.WriteMessage(websocket.TextMessage, []byte(body)); err != nil {
+			return
+		}
+	}
+}
+
+// readCoreFrame reads one "<status> <message>\n<body>\n---END---" response
+func readCoreFrame(reader *bufio.Reader) (string, string, error) {
+	status, err := reader.ReadString('\n')
+	if err != nil {
+		return "", "", err
+	}
+	var body []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return "", "", err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "---END---" {
+			break
+		}
+		body = append(body, line)
+	}
+	return strings.TrimSpace(status), strings.Join(body, "\n"), nil
+}
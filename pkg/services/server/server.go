@@ -4,9 +4,11 @@ import (
 	"bufio"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
 	"strings"
 	"time"
 
@@ -49,16 +51,26 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 		ticker := time.NewTicker(2 * time.Second)
 		for range ticker.C {
 			if networkManager != nil {
+				height, _ := chain.Status()
 				networkManager.UpdateServiceMetrics("core", map[string]interface{}{
-					"blocks":         len(chain.Chain),
-					"ledger_size":    len(chain.Data),
+					"blocks":         height,
+					"ledger_size":    len(chain.Keys()),
 					"last_heartbeat": time.Now().Format("15:04:05"),
 				})
 			}
 		}
 	}()
 
+	// Ledger replication
+	cfg := config.Get()
+	for _, addr := range cfg.Server.Peers {
+		addPeer(addr)
+	}
+	go startPeerSync()
+	setupConsensus()
+
 	localIP := utils.GetLocalIP()
+	portStr := fmt.Sprintf("%d", cfg.Server.Port)
 
 	// TLS Configuration
 	certFile, keyFile := utils.FindCertFiles()
@@ -76,14 +88,16 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	}
 
 	// Start Listener
-	ln, err := tls.Listen("tcp", "0.0.0.0:"+config.ServerPort, serverTLSConfig)
+	ln, err := tls.Listen("tcp", "0.0.0.0:"+portStr, serverTLSConfig)
 	if err != nil {
 		utils.LogFatal("Server", "Listener failed: "+err.Error())
 	}
 
-	utils.LogInfo("Server", fmt.Sprintf("Blockchain Height: %d blocks", len(chain.Chain)))
-	utils.LogInfo("Server", fmt.Sprintf("Listening Port:    %s", config.ServerPort))
-	utils.SaveEndpoint("core", fmt.Sprintf("tcp://%s:%s", localIP, config.ServerPort))
+	height, _ := chain.Status()
+	utils.LogInfo("Server", fmt.Sprintf("Blockchain Height: %d blocks", height))
+	utils.LogInfo("Server", fmt.Sprintf("Listening Port:    %s", portStr))
+	utils.LogInfo("Server", fmt.Sprintf("Node Identity:     %s", chain.Identity().NodeID))
+	utils.SaveEndpoint("core", fmt.Sprintf("tcp://%s:%s", localIP, portStr))
 
 	for {
 		conn, err := ln.Accept()
@@ -114,6 +128,10 @@ func handleConnection(conn net.Conn) {
 		utils.LogInfo("Server", fmt.Sprintf("[%s] REQ: %s", conn.RemoteAddr(), line))
 
 		req := parseRequest(line)
+		if req.Command == nexa.CMD_WATCH {
+			handleWatch(conn, reader, req)
+			return
+		}
 		resp := processRequest(req)
 
 		sendResponse(conn, resp)
@@ -137,36 +155,118 @@ func parseRequest(line string) nexa.Request {
 func processRequest(req nexa.Request) nexa.Response {
 	switch req.Command {
 	case nexa.CMD_PING:
-		return nexa.Response{Status: nexa.STATUS_OK, Message: "PONG", Body: fmt.Sprintf("Height=%d", len(chain.Chain))}
+		height, _ := chain.Status()
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "PONG", Body: fmt.Sprintf("Height=%d", height)}
 
 	case nexa.CMD_FETCH:
 		if req.Target == "" {
 			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Target Required"}
 		}
-		val, exists := chain.Get(req.Target)
+		val, exists, err := fetchValue(req.Target)
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Bad Target: " + err.Error()}
+		}
 		if !exists {
 			return nexa.Response{Status: nexa.STATUS_NOT_FOUND, Message: "Not Found"}
 		}
 		return nexa.Response{Status: nexa.STATUS_OK, Message: "Success", Body: val}
 
+	case nexa.CMD_HISTORY:
+		if req.Target == "" {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Target Required"}
+		}
+		history := chain.History(req.Target)
+		if len(history) == 0 {
+			return nexa.Response{Status: nexa.STATUS_NOT_FOUND, Message: "Not Found"}
+		}
+		data, _ := json.MarshalIndent(history, "", "  ")
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "History", Body: string(data)}
+
 	case nexa.CMD_PUBLISH:
 		if req.Target == "" {
 			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Target Required"}
 		}
-		// In a real network, we'd verify signature. For now, we assume simple publishing.
-		block := chain.AddBlock(req.Target, req.Body, "Node-Local")
+		if req.Target == ledger.CheckpointKey {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Reserved Key"}
+		}
+		value, clientSig := splitClientSignature(req.Body)
+		block, err := chain.AddClientBlock(req.Target, value, chain.Identity().NodeID, clientSig)
+		if isConsensusError(err) {
+			return consensusError(err)
+		}
+		if errors.Is(err, ledger.ErrBadSignature) {
+			return nexa.Response{Status: nexa.STATUS_UNAUTHORIZED, Message: "Invalid Client Signature"}
+		}
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_SERVER_ERROR, Message: "Publish failed: " + err.Error()}
+		}
 		return nexa.Response{Status: nexa.STATUS_CREATED, Message: "Mined", Body: block.Hash}
 
-	case nexa.CMD_LIST:
-		// Return list of keys in data map
-		keys := make([]string, 0, len(chain.Data))
-		for k := range chain.Data {
-			keys = append(keys, k)
+	case nexa.CMD_BATCH, nexa.CMD_TXN:
+		// The whole batch is one JSON document, so rejoin what parseRequest split
+		var batch struct {
+			Ops []ledger.BlockOp      `json:"ops"`
+			If  []ledger.Precondition `json:"if"`
+		}
+		payload := strings.TrimSpace(req.Target + " " + req.Body)
+		if err := json.Unmarshal([]byte(payload), &batch); err != nil {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: `Usage: BATCH {"ops":[{"key":"k","value":"v"}],"if":[{"key":"k","value":"old"}]}`}
+		}
+		block, err := chain.CommitBatch(batch.Ops, batch.If, chain.Identity().NodeID)
+		if isConsensusError(err) {
+			return consensusError(err)
+		}
+		if errors.Is(err, ledger.ErrPreconditionFailed) {
+			return nexa.Response{Status: nexa.STATUS_CONFLICT, Message: "Precondition Failed", Body: err.Error()}
+		}
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Bad Batch: " + err.Error()}
+		}
+		return nexa.Response{Status: nexa.STATUS_CREATED, Message: "Committed", Body: block.Hash}
+
+	case nexa.CMD_DELETE:
+		if req.Target == "" {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Target Required"}
+		}
+		block, err := chain.Delete(req.Target, chain.Identity().NodeID)
+		if isConsensusError(err) {
+			return consensusError(err)
+		}
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_NOT_FOUND, Message: "Not Found"}
+		}
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Deleted", Body: block.Hash}
+
+	case nexa.CMD_PROOF:
+		if req.Target == "" {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Target Required"}
+		}
+		proof, err := chain.Prove(req.Target)
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_NOT_FOUND, Message: fmt.Sprintf("No Proof: %v", err)}
 		}
-		return nexa.Response{Status: nexa.STATUS_OK, Message: "Keys", Body: strings.Join(keys, ",")}
+		data, _ := json.Marshal(proof)
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Proof", Body: string(data)}
+
+	case nexa.CMD_CHECKPOINT:
+		// Commit the current state now; the returned hash is what light clients trust
+		block, err := chain.Checkpoint(chain.Identity().NodeID)
+		if err != nil {
+			return consensusError(err)
+		}
+		data, _ := json.Marshal(block)
+		return nexa.Response{Status: nexa.STATUS_CREATED, Message: "Checkpoint", Body: string(data)}
+
+	case nexa.CMD_LIST:
+		// Return list of live keys (tombstoned keys are hidden)
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Keys", Body: strings.Join(chain.Keys(), ",")}
 
 	case "LEDGER": // New command to see chain info
-		return nexa.Response{Status: nexa.STATUS_OK, Message: "Chain Info", Body: fmt.Sprintf("Height: %d, Valid: %v", len(chain.Chain), chain.IsChainValid())}
+		height, _ := chain.Status()
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Chain Info", Body: fmt.Sprintf("Height: %d, Valid: %v, Node: %s, Key: %s", height, chain.IsChainValid(), chain.Identity().NodeID, chain.Identity().PublicKeyHex())}
+
+	case nexa.CMD_SYNC, nexa.CMD_BLOCKS, nexa.CMD_APPEND:
+		return processSyncRequest(req)
 
 	case nexa.CMD_AUTH:
 		parts := strings.Fields(req.Body)
@@ -183,7 +283,12 @@ func processRequest(req nexa.Request) nexa.Response {
 			}
 			return nexa.Response{Status: nexa.STATUS_UNAUTHORIZED, Message: "Invalid Credentials"}
 		}
-		return nexa.Response{Status: nexa.STATUS_OK, Message: "Authenticated", Body: role}
+		// The token authorizes DNS record changes and other per-user actions
+		token, err := authManager.IssueToken(parts[0])
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_SERVER_ERROR, Message: "Failed to issue token"}
+		}
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Authenticated", Body: role + " " + token}
 
 	// Network Expansion Commands (v3.1)
 	case "NETWORK":
@@ -233,6 +338,55 @@ func processRequest(req nexa.Request) nexa.Response {
 	}
 }
 
+// fetchValue resolves a FETCH target: "key", "key@<version>" or
+// "key@<RFC3339 timestamp>"
+func fetchValue(target string) (string, bool, error) {
+	if val, ok := chain.Get(target); ok {
+		return val, true, nil
+	}
+	at := strings.LastIndex(target, "@")
+	if at <= 0 {
+		return "", false, nil
+	}
+	key, selector := target[:at], target[at+1:]
+	if version, err := strconv.Atoi(selector); err == nil {
+		val, ok := chain.GetVersion(key, version)
+		return val, ok, nil
+	}
+	if ts, err := time.Parse(time.RFC3339, selector); err == nil {
+		val, ok := chain.GetAt(key, ts)
+		return val, ok, nil
+	}
+	return "", false, fmt.Errorf("invalid version or timestamp %q", selector)
+}
+
+// isConsensusError reports whether a write failed for lack of agreement
+// rather than because of the request itself
+func isConsensusError(err error) bool {
+	return errors.Is(err, ledger.ErrNotLeader) || errors.Is(err, ledger.ErrNoQuorum)
+}
+
+func consensusError(err error) nexa.Response {
+	if errors.Is(err, ledger.ErrNotLeader) {
+		return nexa.Response{Status: nexa.STATUS_UNAVAILABLE, Message: "Not Leader", Body: "Send writes to the consensus leader"}
+	}
+	return nexa.Response{Status: nexa.STATUS_UNAVAILABLE, Message: "No Quorum", Body: err.Error()}
+}
+
+// splitClientSignature strips an optional trailing "SIG=<pubkey>:<signature>"
+// field (both hex) from a PUBLISH body
+func splitClientSignature(body string) (string, *ledger.ClientSignature) {
+	idx := strings.LastIndex(body, " SIG=")
+	if idx < 0 {
+		return body, nil
+	}
+	parts := strings.SplitN(body[idx+len(" SIG="):], ":", 2)
+	if len(parts) != 2 || strings.ContainsAny(parts[1], " ") {
+		return body, nil
+	}
+	return body[:idx], &ledger.ClientSignature{PublicKey: parts[0], Signature: parts[1]}
+}
+
 func sendResponse(conn net.Conn, resp nexa.Response) {
 	fmt.Fprintf(conn, "%d %s\n%s\n---END---\n", resp.Status, resp.Message, resp.Body)
 }
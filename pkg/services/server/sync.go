@@ -0,0 +1,277 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/auth"
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/ledger"
+	"github.com/MultiX0/nexa/pkg/nexa"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+const syncInterval = 15 * time.Second
+
+var (
+	peersMu sync.RWMutex
+	peers   = make(map[string]bool) // host:port of the configured core nodes
+)
+
+// chainStatus is the body of a SYNC status response
+type chainStatus struct {
+	NodeID string `json:"node_id"`
+	Height int    `json:"height"`
+	Head   string `json:"head"`
+}
+
+// tcpPeer talks to another core node over the line protocol
+type tcpPeer struct {
+	addr string
+}
+
+func (p *tcpPeer) call(line string) (nexa.Response, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	conn, err := tls.DialWithDialer(dialer, "tcp", p.addr, &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		return nexa.Response{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	fmt.Fprintf(conn, "%s\n", line)
+	reader := bufio.NewReader(conn)
+
+	statusLine, err := reader.ReadString('\n')
+	if err != nil {
+		return nexa.Response{}, err
+	}
+	parts := strings.SplitN(strings.TrimSpace(statusLine), " ", 2)
+	status, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nexa.Response{}, fmt.Errorf("bad status line: %q", statusLine)
+	}
+	resp := nexa.Response{Status: status}
+	if len(parts) > 1 {
+		resp.Message = parts[1]
+	}
+
+	var body []string
+	for {
+		l, err := reader.ReadString('\n')
+		if err != nil {
+			return nexa.Response{}, err
+		}
+		l = strings.TrimRight(l, "\r\n")
+		if l == "---END---" {
+			break
+		}
+		body = append(body, l)
+	}
+	resp.Body = strings.Join(body, "\n")
+	if resp.Status != nexa.STATUS_OK {
+		return resp, fmt.Errorf("peer %s: %d %s", p.addr, resp.Status, resp.Message)
+	}
+	return resp, nil
+}
+
+func (p *tcpPeer) Status() (int, string, error) {
+	resp, err := p.call(nexa.CMD_SYNC)
+	if err != nil {
+		return 0, "", err
+	}
+	var st chainStatus
+	if err := json.Unmarshal([]byte(resp.Body), &st); err != nil {
+		return 0, "", fmt.Errorf("bad SYNC body: %v", err)
+	}
+	return st.Height, st.Head, nil
+}
+
+func (p *tcpPeer) Blocks(start, limit int) ([]ledger.Block, error) {
+	resp, err := p.call(fmt.Sprintf("%s %d %d", nexa.CMD_BLOCKS, start, limit))
+	if err != nil {
+		return nil, err
+	}
+	var blocks []ledger.Block
+	if err := json.Unmarshal([]byte(resp.Body), &blocks); err != nil {
+		return nil, fmt.Errorf("bad BLOCKS body: %v", err)
+	}
+	return blocks, nil
+}
+
+// ID identifies the peer by address
+func (p *tcpPeer) ID() string {
+	return p.addr
+}
+
+// AppendBlocks replicates blocks to a follower validator
+func (p *tcpPeer) AppendBlocks(blocks []ledger.Block) (int, error) {
+	data, err := json.Marshal(blocks)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := p.call(fmt.Sprintf("%s %s", nexa.CMD_APPEND, data))
+	height, _ := strconv.Atoi(strings.TrimSpace(resp.Body))
+	if resp.Status == nexa.STATUS_CONFLICT {
+		return height, ledger.ErrOutOfSync
+	}
+	return height, err
+}
+
+// setupConsensus installs quorum consensus when enabled in config. The
+// validators are fixed by config (the configured peers unless listed
+// separately), so nothing learned at runtime can change the quorum.
+func setupConsensus() {
+	cfg := config.Get().Server
+	cc := cfg.Consensus
+	if !cc.Enabled {
+		return
+	}
+	if cc.Leader {
+		addrs := cc.Validators
+		if len(addrs) == 0 {
+			addrs = cfg.Peers
+		}
+		var validators []ledger.ValidatorPeer
+		for _, addr := range addrs {
+			if addr = strings.TrimSpace(addr); addr != "" {
+				validators = append(validators, &tcpPeer{addr: addr})
+			}
+		}
+		chain.SetConsensus(ledger.NewLeaderConsensus(func() []ledger.ValidatorPeer {
+			return validators
+		}))
+		utils.LogInfo("Consensus", fmt.Sprintf("Quorum consensus enabled, this node is the leader of %d validators", len(validators)))
+		return
+	}
+	if cc.LeaderKey == "" {
+		utils.LogWarning("Consensus", "No leader_key configured, consensus stays disabled")
+		return
+	}
+	chain.SetConsensus(ledger.NewFollowerConsensus(cc.LeaderKey))
+	utils.LogInfo("Consensus", "Quorum consensus enabled, following leader "+cc.LeaderKey)
+}
+
+// addPeer remembers a configured core node to replicate with
+func addPeer(addr string) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return
+	}
+	peersMu.Lock()
+	peers[addr] = true
+	peersMu.Unlock()
+}
+
+// knownPeers returns the configured peers. Devices that merely register as
+// ledger nodes are not synced with, since adopting a longer chain from one
+// would let any client on the network replace the ledger.
+func knownPeers() []string {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	list := make([]string, 0, len(peers))
+	for addr := range peers {
+		list = append(list, addr)
+	}
+	return list
+}
+
+// isPeer reports whether addr is a configured peer
+func isPeer(addr string) bool {
+	peersMu.RLock()
+	defer peersMu.RUnlock()
+	return peers[strings.TrimSpace(addr)]
+}
+
+// syncWithPeer runs one replication round against addr
+func syncWithPeer(addr string) (ledger.SyncResult, error) {
+	result, err := chain.SyncWith(&tcpPeer{addr: addr})
+	if err != nil {
+		return result, err
+	}
+	if result.Adopted {
+		utils.LogInfo("Sync", fmt.Sprintf("Adopted chain from %s: +%d blocks, %d orphaned, height %d",
+			addr, result.Pulled, result.Orphaned, result.Height))
+	}
+	return result, nil
+}
+
+// startPeerSync periodically pulls from every known peer
+func startPeerSync() {
+	ticker := time.NewTicker(syncInterval)
+	for range ticker.C {
+		for _, addr := range knownPeers() {
+			if _, err := syncWithPeer(addr); err != nil {
+				utils.LogWarning("Sync", fmt.Sprintf("Peer %s: %v", addr, err))
+			}
+		}
+	}
+}
+
+// processSyncRequest handles SYNC [peer token], BLOCKS <start> [limit] and
+// APPEND <blocks>. Pulling from a peer on demand takes an admin token from
+// AUTH and only works for configured peers.
+func processSyncRequest(req nexa.Request) nexa.Response {
+	switch req.Command {
+	case nexa.CMD_SYNC:
+		if req.Target == "" {
+			height, head := chain.Status()
+			data, _ := json.Marshal(chainStatus{NodeID: chain.Identity().NodeID, Height: height, Head: head})
+			return nexa.Response{Status: nexa.STATUS_OK, Message: "Chain Status", Body: string(data)}
+		}
+		user, role, err := authManager.ValidateToken(strings.TrimSpace(req.Body))
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_UNAUTHORIZED, Message: "Usage: SYNC <host:port> <admin token>"}
+		}
+		if role != auth.RoleAdmin {
+			return nexa.Response{Status: nexa.STATUS_FORBIDDEN, Message: "Admin Only"}
+		}
+		if !isPeer(req.Target) {
+			return nexa.Response{Status: nexa.STATUS_FORBIDDEN, Message: "Not A Configured Peer"}
+		}
+		utils.LogInfo("Sync", fmt.Sprintf("%s requested a sync with %s", user, req.Target))
+		result, err := syncWithPeer(req.Target)
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_SERVER_ERROR, Message: fmt.Sprintf("Sync failed: %v", err)}
+		}
+		data, _ := json.Marshal(result)
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Synced", Body: string(data)}
+
+	case nexa.CMD_BLOCKS:
+		start, err := strconv.Atoi(req.Target)
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Usage: BLOCKS <start> [limit]"}
+		}
+		limit := ledger.MaxBlocksPerRequest
+		if req.Body != "" {
+			if limit, err = strconv.Atoi(strings.TrimSpace(req.Body)); err != nil {
+				return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Usage: BLOCKS <start> [limit]"}
+			}
+		}
+		data, _ := json.Marshal(chain.Blocks(start, limit))
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Blocks", Body: string(data)}
+
+	case nexa.CMD_APPEND:
+		var blocks []ledger.Block
+		if err := json.Unmarshal([]byte(strings.TrimSpace(req.Target+" "+req.Body)), &blocks); err != nil {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Usage: APPEND <json blocks>"}
+		}
+		height, err := chain.AcceptBlocks(blocks)
+		if errors.Is(err, ledger.ErrOutOfSync) {
+			return nexa.Response{Status: nexa.STATUS_CONFLICT, Message: "Out Of Sync", Body: strconv.Itoa(height)}
+		}
+		if err != nil {
+			return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: fmt.Sprintf("Rejected: %v", err), Body: strconv.Itoa(height)}
+		}
+		return nexa.Response{Status: nexa.STATUS_OK, Message: "Appended", Body: strconv.Itoa(height)}
+	}
+	return nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Unknown Command"}
+}
@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/nexa"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// handleWatch turns the connection into a stream for WATCH <key|prefix*> [from].
+// After the "200 Watching" response every change is sent as its own
+// "200 Change" response with the JSON change as body, until the client hangs up.
+func handleWatch(conn net.Conn, reader *bufio.Reader, req nexa.Request) {
+	if req.Target == "" {
+		sendResponse(conn, nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Usage: WATCH <key|prefix*> [from_height]"})
+		return
+	}
+	from := -1
+	if req.Body != "" {
+		n, err := strconv.Atoi(strings.TrimSpace(req.Body))
+		if err != nil || n < 0 {
+			sendResponse(conn, nexa.Response{Status: nexa.STATUS_BAD_REQ, Message: "Bad Height"})
+			return
+		}
+		from = n
+	}
+	key := req.Target
+	prefix := strings.HasSuffix(key, "*")
+	key = strings.TrimSuffix(key, "*")
+
+	changes, stop := chain.Watch(key, prefix, from)
+	defer stop()
+
+	height, _ := chain.Status()
+	sendResponse(conn, nexa.Response{Status: nexa.STATUS_OK, Message: "Watching", Body: fmt.Sprintf("Height=%d", height)})
+	utils.LogInfo("Server", fmt.Sprintf("[%s] WATCH %s from %d", conn.RemoteAddr(), req.Target, from))
+
+	// Any input or a read error ends the stream
+	conn.SetReadDeadline(time.Time{})
+	closed := make(chan struct{})
+	go func() {
+		reader.ReadString('\n')
+		close(closed)
+	}()
+
+	for {
+		select {
+		case c, ok := <-changes:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(c)
+			conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+			if _, err := fmt.Fprintf(conn, "%d %s\n%s\n---END---\n", nexa.STATUS_OK, "Change", data); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
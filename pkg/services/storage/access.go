@@ -0,0 +1,446 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/MultiX0/nexa/pkg/acl"
+	"github.com/MultiX0/nexa/pkg/auth"
+	"github.com/MultiX0/nexa/pkg/blobstore"
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// Every endpoint but the page itself, login and share links needs a token
+// from the auth manager, sent as a bearer token or in the cookie set by
+// POST /api/login. Users own home/<user>; elsewhere the folder ACLs admins
+// manage at /api/acl decide, and admins may do anything.
+const (
+	homeRoot    = "home"
+	tokenCookie = "storage_token"
+	aclFile     = "storage_acl.json"
+	quotaFile   = "storage_quotas.json"
+)
+
+var (
+	ErrUnauthorized = errors.New("authentication required")
+	ErrForbidden    = errors.New("permission denied")
+	ErrAdminOnly    = errors.New("admin role required")
+	ErrQuota        = errors.New("storage quota exceeded")
+)
+
+var (
+	authManager *auth.AuthManager
+	acls        *acl.List
+	quotas      = &quotaTable{mb: make(map[string]int)}
+)
+
+// defaultACL opens the shared folders to every user. locked, vault and
+// backup have no rule, which leaves them to admins.
+var defaultACL = []acl.Rule{
+	{Path: "public", Subject: acl.Everyone, Perms: acl.Read},
+	{Path: "incoming", Subject: acl.Everyone, Perms: acl.Read | acl.Write},
+	{Path: "shared", Subject: acl.Everyone, Perms: acl.Read | acl.Write | acl.Share},
+}
+
+// Caller is the authenticated user behind a request
+type Caller struct {
+	User string
+	Role string
+}
+
+func (c Caller) IsAdmin() bool {
+	return c.Role == auth.RoleAdmin
+}
+
+// openAccess loads the users, folder ACLs and quotas. Without users every
+// request is refused.
+func openAccess() {
+	var err error
+	authManager, err = auth.NewAuthManager(utils.FindFile("users.json"))
+	if err != nil {
+		authManager = nil
+		utils.LogError("Storage", "Failed to init auth, storage is closed to everyone", err)
+	}
+	acls, err = acl.Load(aclFile, defaultACL)
+	if err != nil {
+		utils.LogError("Storage", "Failed to load folder ACLs, only admins and home folders are open", err)
+	}
+	if err := quotas.load(quotaFile); err != nil {
+		utils.LogError("Storage", "Failed to load quotas", err)
+	}
+}
+
+// authenticate finds the caller's token in the Authorization header or
+// the login cookie
+func authenticate(r *http.Request) (Caller, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		if cookie, err := r.Cookie(tokenCookie); err == nil {
+			token = cookie.Value
+		}
+	}
+	token = strings.TrimSpace(token)
+	if authManager == nil || token == "" {
+		return Caller{}, ErrUnauthorized
+	}
+	user, role, err := authManager.ValidateToken(token)
+	if err != nil {
+		return Caller{}, ErrUnauthorized
+	}
+	return Caller{User: user, Role: role}, nil
+}
+
+// withAuth passes the caller to h, creating their home folder on first use
+func withAuth(h func(http.ResponseWriter, *http.Request, Caller)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		c, err := authenticate(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if home := homeDir(c.User); home != "" && !store.IsDir(home) {
+			if err := store.Mkdir(home); err != nil {
+				utils.LogError("Storage", "Failed to create home folder for "+c.User, err)
+			}
+		}
+		h(w, r, c)
+	}
+}
+
+// homeDir is the folder user owns, or "" for names that cannot be one
+func homeDir(user string) string {
+	if user == "" || user == "." || user == ".." || strings.ContainsAny(user, "/\\") {
+		return ""
+	}
+	return homeRoot + "/" + user
+}
+
+func within(p, dir string) bool {
+	return dir == "" || p == dir || strings.HasPrefix(p, dir+"/")
+}
+
+// can reports whether c has every permission in want at p
+func can(c Caller, p string, want acl.Perm) bool {
+	p = blobstore.Clean(p)
+	if c.IsAdmin() {
+		return true
+	}
+	if home := homeDir(c.User); home != "" && within(p, home) {
+		return true
+	}
+	return acls != nil && acls.Allowed(c.User, p, want)
+}
+
+// visible reports whether c may see p while browsing: p is readable, or
+// leads to their home or to a folder they were granted
+func visible(c Caller, p string) bool {
+	p = blobstore.Clean(p)
+	if can(c, p, acl.Read) {
+		return true
+	}
+	if home := homeDir(c.User); home != "" && within(home, p) {
+		return true
+	}
+	return acls != nil && acls.Reachable(c.User, p)
+}
+
+// canChange reports whether c may delete or replace p, which takes write
+// access to p and to the folder holding it
+func canChange(c Caller, p string) bool {
+	p = blobstore.Clean(p)
+	return p != "" && can(c, p, acl.Write) && can(c, parentDir(p), acl.Write)
+}
+
+func parentDir(p string) string {
+	if dir := path.Dir(blobstore.Clean(p)); dir != "." {
+		return dir
+	}
+	return ""
+}
+
+// quotaTable holds the quotas admins set, in MB by user. A negative quota
+// is unlimited; users without one get the configured default.
+type quotaTable struct {
+	mu       sync.RWMutex
+	mb       map[string]int
+	filename string
+}
+
+func (q *quotaTable) load(filename string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.filename = filename
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, &q.mb)
+}
+
+// set stores user's quota; 0 returns them to the default
+func (q *quotaTable) set(user string, mb int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	old, had := q.mb[user]
+	if mb == 0 {
+		delete(q.mb, user)
+	} else {
+		q.mb[user] = mb
+	}
+	data, _ := json.MarshalIndent(q.mb, "", "  ")
+	if err := utils.WriteFileAtomic(q.filename, data, 0644); err != nil {
+		if had {
+			q.mb[user] = old
+		} else {
+			delete(q.mb, user)
+		}
+		return err
+	}
+	return nil
+}
+
+func (q *quotaTable) all() map[string]int {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+	out := make(map[string]int, len(q.mb))
+	for u, mb := range q.mb {
+		out[u] = mb
+	}
+	return out
+}
+
+// limit returns user's quota in bytes, 0 for unlimited
+func (q *quotaTable) limit(user string) int64 {
+	q.mu.RLock()
+	mb, ok := q.mb[user]
+	q.mu.RUnlock()
+	if !ok {
+		mb = config.Get().Services.Storage.DefaultQuotaMB
+	}
+	if mb <= 0 {
+		return 0
+	}
+	return int64(mb) << 20
+}
+
+// checkQuota reports whether c may store size more bytes at target. Their
+// kept versions and trash count too, until pruned or purged. A file of
+// theirs being replaced only stops counting when it is not kept as a version.
+func checkQuota(c Caller, target string, size int64) error {
+	limit := quotas.limit(c.User)
+	if limit == 0 {
+		return nil
+	}
+	used := totalUsed(store.Owners()[c.User])
+	if e, err := store.Stat(target); err == nil && e.Owner == c.User && !versioning() {
+		used -= e.Size
+	}
+	if used+size > limit {
+		return fmt.Errorf("%w: %s of %s used", ErrQuota, utils.FormatSize(used), utils.FormatSize(limit))
+	}
+	return nil
+}
+
+// totalUsed is what counts against a quota: files, versions and trash
+func totalUsed(u blobstore.Usage) int64 {
+	return u.Bytes + u.VersionBytes + u.TrashBytes
+}
+
+type quotaUsage struct {
+	User      string `json:"user"`
+	Files     int    `json:"files"`
+	Used      int64  `json:"used"` // including the two below
+	Versions  int64  `json:"versionBytes"`
+	Trash     int64  `json:"trashBytes"`
+	Limit     int64  `json:"limit"` // 0 is unlimited
+	UsedText  string `json:"usedFormatted"`
+	LimitText string `json:"limitFormatted,omitempty"`
+}
+
+func usageOf(user string, owners map[string]blobstore.Usage) quotaUsage {
+	o := owners[user]
+	u := quotaUsage{User: user, Files: o.Files, Used: totalUsed(o), Versions: o.VersionBytes, Trash: o.TrashBytes, Limit: quotas.limit(user)}
+	u.UsedText = utils.FormatSize(u.Used)
+	if u.Limit > 0 {
+		u.LimitText = utils.FormatSize(u.Limit)
+	}
+	return u
+}
+
+// loginHandler exchanges {"username","password"} for a token, also set as
+// a cookie for the file manager
+func loginHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if authManager == nil {
+		http.Error(w, "Authentication unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		Username string `json:"username"`
+		Password string `json:"password"`
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "application/json") {
+		json.NewDecoder(r.Body).Decode(&req)
+	} else {
+		req.Username, req.Password = r.FormValue("username"), r.FormValue("password")
+	}
+	ok, role := authManager.Verify(req.Username, req.Password)
+	if !ok {
+		utils.LogWarning("Storage", fmt.Sprintf("Failed login for %q from %s", req.Username, r.RemoteAddr))
+		http.Error(w, "Invalid username or password", http.StatusUnauthorized)
+		return
+	}
+	token, err := authManager.IssueToken(req.Username)
+	if err != nil {
+		http.Error(w, "Failed to issue token", http.StatusInternalServerError)
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     tokenCookie,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   int(auth.TokenTTL.Seconds()),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	utils.LogInfo("Storage", "Logged in: "+req.Username)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"user":  req.Username,
+		"role":  role,
+		"home":  homeDir(req.Username),
+		"token": token,
+	})
+}
+
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: tokenCookie, Value: "", Path: "/", MaxAge: -1})
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// meHandler reports who the caller is, their home and their quota
+func meHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"user":  c.User,
+		"role":  c.Role,
+		"home":  homeDir(c.User),
+		"quota": usageOf(c.User, store.Owners()),
+	})
+}
+
+// aclHandler lists folder rules and quotas on GET and changes a rule from
+// {"path","user","perms"} on POST, perms being letters from "rws" and ""
+// removing the rule. Admins only.
+func aclHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if !c.IsAdmin() {
+		http.Error(w, ErrAdminOnly.Error(), http.StatusForbidden)
+		return
+	}
+	if acls == nil {
+		http.Error(w, "Folder ACLs unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"rules":  acls.Rules(),
+			"quotas": quotas.all(),
+		})
+	case http.MethodPost:
+		var req struct {
+			Path  string `json:"path"`
+			User  string `json:"user"`
+			Perms string `json:"perms"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		perms, err := acl.ParsePerm(req.Perms)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		rule, err := acls.Set(req.Path, req.User, perms, c.User)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, acl.ErrInvalidSubject) || errors.Is(err, acl.ErrInvalidPerm) {
+				status = http.StatusBadRequest
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		utils.LogInfo("Storage", fmt.Sprintf("%s set %s on /%s for %s", c.User, rule.Perms, rule.Path, rule.Subject))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(rule)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// quotaHandler sets a user's quota from {"user","mb"}: a negative quota is
+// unlimited and 0 returns the user to the default. Admins only.
+func quotaHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if !c.IsAdmin() {
+		http.Error(w, ErrAdminOnly.Error(), http.StatusForbidden)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var req struct {
+		User string `json:"user"`
+		MB   int    `json:"mb"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || homeDir(req.User) == "" {
+		http.Error(w, "user and mb are required", http.StatusBadRequest)
+		return
+	}
+	if err := quotas.set(req.User, req.MB); err != nil {
+		utils.LogError("Storage", "Failed to save quotas", err)
+		http.Error(w, "Failed to save quota", http.StatusInternalServerError)
+		return
+	}
+	utils.LogInfo("Storage", fmt.Sprintf("%s set the quota of %s to %d MB", c.User, req.User, req.MB))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(usageOf(req.User, store.Owners()))
+}
+
+// quotaReport lists every user with files or a quota, for admins
+func quotaReport() []quotaUsage {
+	owners := store.Owners()
+	users := make(map[string]bool)
+	for u := range owners {
+		users[u] = true
+	}
+	for u := range quotas.all() {
+		users[u] = true
+	}
+	out := make([]quotaUsage, 0, len(users))
+	for u := range users {
+		out = append(out, usageOf(u, owners))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].User < out[j].User })
+	return out
+}
@@ -0,0 +1,176 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/blobstore"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// storeDir holds the blobs and the index behind every file the service
+// serves; temp stays a plain folder for upload sessions
+const storeDir = ".store"
+
+var store *blobstore.Store
+
+// openStore opens the blob store, moving in any plain files left in
+// StorageRoot by versions that wrote them directly
+func openStore() error {
+	s, err := blobstore.Open(filepath.Join(StorageRoot, storeDir))
+	if err != nil {
+		return err
+	}
+	store = s
+	store.SetRetention(retention())
+	n, err := importPlainFiles()
+	if err != nil {
+		utils.LogError("Storage", "Failed to move existing files into the blob store", err)
+	}
+	if n > 0 {
+		u := store.Usage()
+		utils.LogSuccess("Storage", fmt.Sprintf("Moved %d files into the blob store (%s stored for %s)",
+			n, utils.FormatSize(u.StoredBytes), utils.FormatSize(u.Bytes)))
+	}
+	return nil
+}
+
+// importPlainFiles stores every regular file under StorageRoot and
+// removes the original, then the emptied folders. Files are copied rather
+// than moved so a failure leaves the original where it was.
+func importPlainFiles() (int, error) {
+	var dirs []string
+	n := 0
+	err := filepath.WalkDir(StorageRoot, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(StorageRoot, p)
+		if rel == "." {
+			return nil
+		}
+		if d.IsDir() {
+			if rel == storeDir || rel == "temp" {
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, p)
+			return store.Mkdir(rel)
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		_, err = store.Put(rel, f)
+		f.Close()
+		if err != nil {
+			return err
+		}
+		n++
+		return os.Remove(p)
+	})
+	// Deepest first, so parents are empty by the time they are reached
+	sort.Sort(sort.Reverse(sort.StringSlice(dirs)))
+	for _, d := range dirs {
+		os.Remove(d) // fails harmlessly on anything left behind
+	}
+	return n, err
+}
+
+// saveUpload links an uploaded blob into dir. Content identical to the
+// file already at the name is not stored twice. Other content replaces
+// it, keeping it as a version, or gets a timestamped name beside it when
+// versioning is off. Replacing a file takes the same rights as changing
+// it, and only its owner or an admin becomes the owner of the new content;
+// anyone else's upload keeps the existing owner. New files belong to c.
+func saveUpload(dir, filename string, blob blobstore.Blob, c Caller) (string, blobstore.Entry, error) {
+	if err := validName(filename); err != nil {
+		store.Release(blob)
+		return "", blobstore.Entry{}, err
+	}
+	owner := c.User
+	target := path.Join(dir, filename)
+	if e, err := store.Stat(target); err == nil {
+		if versioning() && !canChange(c, target) {
+			store.Release(blob)
+			return "", blobstore.Entry{}, ErrForbidden
+		}
+		if e.Blob == blob.Hash {
+			store.Release(blob)
+			return filename, e, nil
+		}
+		if e.Owner != c.User && !c.IsAdmin() {
+			owner = ""
+		}
+	}
+	var err error
+	if !versioning() {
+		if filename, target, err = uniquePath(dir, filename); err != nil {
+			store.Release(blob)
+			return "", blobstore.Entry{}, err
+		}
+	}
+	e, err := store.LinkAs(target, blob, owner)
+	if err != nil {
+		store.Release(blob)
+	}
+	return filename, e, err
+}
+
+// validName reports whether name may be stored: a single path element
+// without markup characters, since names are shown in the file manager
+func validName(name string) error {
+	if err := blobstore.ValidName(name); err != nil {
+		return err
+	}
+	if strings.ContainsAny(name, "<>\"") {
+		return fmt.Errorf("%q: %w", name, blobstore.ErrBadName)
+	}
+	return nil
+}
+
+// storeErrorStatus maps store and access errors to HTTP statuses
+func storeErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrAdminOnly):
+		return http.StatusForbidden
+	case errors.Is(err, ErrQuota):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, blobstore.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, blobstore.ErrIsDir), errors.Is(err, blobstore.ErrNotDir):
+		return http.StatusConflict
+	case errors.Is(err, blobstore.ErrRoot), errors.Is(err, blobstore.ErrBadName):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// uniquePath returns the name and store path filename is saved under in
+// dir, adding a timestamp when the name is taken. filename must be a single
+// path element.
+func uniquePath(dir, filename string) (string, string, error) {
+	if err := validName(filename); err != nil {
+		return "", "", err
+	}
+	target := path.Join(dir, filename)
+	if _, err := store.Stat(target); !errors.Is(err, blobstore.ErrNotFound) {
+		ext := path.Ext(filename)
+		name := strings.TrimSuffix(filename, ext)
+		filename = fmt.Sprintf("%s_%d%s", name, time.Now().Unix(), ext)
+		target = path.Join(dir, filename)
+	}
+	return filename, target, nil
+}
@@ -0,0 +1,212 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/acl"
+	"github.com/MultiX0/nexa/pkg/analytics"
+	"github.com/MultiX0/nexa/pkg/blobstore"
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// Overwritten files keep their earlier versions and deleted files go to
+// the trash: GET /api/versions?file= and POST /api/versions/restore?file=&id=
+// for versions, GET /api/trash, POST /api/trash/restore?id= and POST
+// /api/trash/purge?id= for the trash. Both are trimmed hourly to the
+// limits in the storage config.
+const retentionInterval = time.Hour
+
+// retention turns the storage config into the store's version limits
+func retention() blobstore.Retention {
+	cfg := config.Get().Services.Storage
+	r := blobstore.Retention{Keep: cfg.VersionsKept}
+	if r.Keep < 0 {
+		r.Keep = 0
+	}
+	if cfg.VersionMaxDays > 0 {
+		r.MaxAge = time.Duration(cfg.VersionMaxDays) * 24 * time.Hour
+	}
+	return r
+}
+
+// versioning reports whether overwritten files are kept as versions
+func versioning() bool {
+	return config.Get().Services.Storage.VersionsKept > 0
+}
+
+// startRetention drops expired versions and purges old trash on a timer
+func startRetention() {
+	trashAge := time.Duration(config.Get().Services.Storage.TrashDays) * 24 * time.Hour
+	ticker := time.NewTicker(retentionInterval)
+	for range ticker.C {
+		if n, err := store.PruneVersions(); err != nil {
+			utils.LogError("Storage", "Failed to drop expired versions", err)
+		} else if n > 0 {
+			utils.LogInfo("Storage", fmt.Sprintf("Dropped %d expired versions", n))
+		}
+		if trashAge <= 0 {
+			continue
+		}
+		purged, err := store.PurgeTrashOlder(trashAge)
+		if err != nil {
+			utils.LogError("Storage", "Failed to empty the trash", err)
+		}
+		for _, t := range purged {
+			utils.LogInfo("Storage", fmt.Sprintf("Purged from trash: %s (%d files, %s)",
+				t.Path, t.Files, utils.FormatSize(t.Size)))
+		}
+	}
+}
+
+// trackRestore records a restore in the caller's analytics session
+func trackRestore(r *http.Request, p string, size int64) {
+	sessionID := "unknown"
+	if cookie, err := r.Cookie("session_id"); err == nil {
+		sessionID = cookie.Value
+	}
+	analytics.GetManager().TrackFile(sessionID, analytics.FileActivity{
+		Action:   "restore",
+		FileName: path.Base(p),
+		Path:     p,
+		FileSize: size,
+		Status:   "success",
+	})
+}
+
+type versionInfo struct {
+	ID       int64  `json:"id"`
+	Size     int64  `json:"size"`
+	SizeText string `json:"sizeFormatted"`
+	Modified string `json:"modified"`
+	Replaced string `json:"replaced"`
+}
+
+// versionsHandler lists the earlier versions of a file, newest first
+func versionsHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	file := r.URL.Query().Get("file")
+	if !can(c, file, acl.Read) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	versions, err := store.Versions(file)
+	if err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+	list := make([]versionInfo, 0, len(versions))
+	for _, v := range versions {
+		list = append(list, versionInfo{
+			ID:       v.ID,
+			Size:     v.Size,
+			SizeText: utils.FormatSize(v.Size),
+			Modified: v.ModTime.Format("02/01 15:04"),
+			Replaced: v.Replaced.Format("02/01 15:04"),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// restoreVersionHandler makes an earlier version current again; the
+// content it replaces becomes a version itself
+func restoreVersionHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	file := r.URL.Query().Get("file")
+	if !canChange(c, file) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid version id", http.StatusBadRequest)
+		return
+	}
+	e, err := store.RestoreVersion(file, id)
+	if err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+	utils.LogSuccess("Storage", fmt.Sprintf("Restored %s to version %d", e.Path, id))
+	trackRestore(r, e.Path, e.Size)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"path": e.Path, "size": e.Size})
+}
+
+type trashInfo struct {
+	blobstore.TrashItem
+	SizeText string `json:"sizeFormatted"`
+	Deleted  string `json:"deleted"`
+}
+
+// trashHandler lists the items in the trash the caller could restore,
+// most recently deleted first
+func trashHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	list := []trashInfo{}
+	for _, t := range store.TrashList() {
+		if !canChange(c, t.Path) {
+			continue
+		}
+		list = append(list, trashInfo{
+			TrashItem: t,
+			SizeText:  utils.FormatSize(t.Size),
+			Deleted:   t.DeletedAt.Format("02/01 15:04"),
+		})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// trashActionHandler serves /api/trash/restore and /api/trash/purge, for
+// items deleted from where the caller may still write
+func trashActionHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid trash id", http.StatusBadRequest)
+		return
+	}
+	var item blobstore.TrashItem
+	for _, t := range store.TrashList() {
+		if t.ID == id {
+			item = t
+		}
+	}
+	if item.ID != 0 && !canChange(c, item.Path) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	switch r.URL.Path {
+	case "/api/trash/restore":
+		p, err := store.RestoreTrash(id)
+		if err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		utils.LogSuccess("Storage", "Restored from trash: "+p)
+		trackRestore(r, p, item.Size)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{"path": p})
+	case "/api/trash/purge":
+		if err := store.PurgeTrash(id); err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		utils.LogInfo("Storage", "Purged from trash: "+item.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.NotFound(w, r)
+	}
+}
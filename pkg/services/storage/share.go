@@ -0,0 +1,589 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/acl"
+	"github.com/MultiX0/nexa/pkg/audit"
+	"github.com/MultiX0/nexa/pkg/blobstore"
+	"github.com/MultiX0/nexa/pkg/config"
+	"github.com/MultiX0/nexa/pkg/sharelink"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// Share links: POST /api/share creates one, GET /api/shares lists the
+// caller's and DELETE /api/shares?token= revokes one. /s/{token} serves
+// the file, or an upload form for drop box links, asking for the
+// password first when the link has one. Every use of a link, allowed or
+// not, goes to the audit log.
+const (
+	shareFile     = "storage_shares.json"
+	shareGrace    = 7 * 24 * time.Hour // expired links stay listed this long
+	resumeWindow  = time.Hour          // later ranges of a paid download stay free this long
+	tokenLogChars = 8                  // of a token written to logs
+)
+
+var shares *sharelink.Store
+
+// openShares loads the share links and starts dropping long-expired ones
+func openShares() {
+	s, err := sharelink.Load(shareFile)
+	if err != nil {
+		utils.LogError("Storage", "Failed to load share links, sharing disabled", err)
+		return
+	}
+	shares = s
+	go func() {
+		ticker := time.NewTicker(retentionInterval)
+		for range ticker.C {
+			dropped, err := shares.Prune(shareGrace)
+			if err != nil {
+				utils.LogError("Storage", "Failed to drop expired share links", err)
+			}
+			if len(dropped) > 0 {
+				utils.LogInfo("Storage", fmt.Sprintf("Dropped %d expired share links", len(dropped)))
+			}
+		}
+	}()
+}
+
+func remoteIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+func shortToken(token string) string {
+	if len(token) > tokenLogChars {
+		return token[:tokenLogChars]
+	}
+	return token
+}
+
+func shareURL(token string) string {
+	return fmt.Sprintf("http://%s:%d/s/%s", utils.GetLocalIP(), config.Get().Services.Storage.Port, token)
+}
+
+// shareInfo is a link as its owner sees it, without the password hash
+type shareInfo struct {
+	Token     string     `json:"token"`
+	Link      string     `json:"link"`
+	Path      string     `json:"path"`
+	Owner     string     `json:"owner"`
+	DropBox   bool       `json:"dropbox"`
+	Password  bool       `json:"password"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	MaxUses   int        `json:"max_uses"`
+	Uses      int        `json:"uses"`
+	Status    string     `json:"status"` // active, expired or used up
+}
+
+func infoOf(l sharelink.Link) shareInfo {
+	info := shareInfo{
+		Token:     l.Token,
+		Link:      shareURL(l.Token),
+		Path:      l.Path,
+		Owner:     l.Owner,
+		DropBox:   l.DropBox,
+		Password:  l.HasPassword(),
+		CreatedAt: l.CreatedAt,
+		MaxUses:   l.MaxUses,
+		Uses:      l.Uses,
+		Status:    "active",
+	}
+	if !l.ExpiresAt.IsZero() {
+		info.ExpiresAt = &l.ExpiresAt
+	}
+	switch {
+	case l.Expired(time.Now()):
+		info.Status = "expired"
+	case l.Exhausted():
+		info.Status = "used up"
+	}
+	return info
+}
+
+// shareAPIHandler creates a link from {"path","expires_hours","max_uses",
+// "password","dropbox"}, or from ?file= alone. Links expire after the
+// configured share_days unless expires_hours says otherwise; -1 never
+// expires. A drop box link takes a folder and write access to it.
+func shareAPIHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if shares == nil {
+		http.Error(w, "Sharing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	var req struct {
+		Path         string `json:"path"`
+		ExpiresHours int    `json:"expires_hours"`
+		MaxUses      int    `json:"max_uses"`
+		Password     string `json:"password"`
+		DropBox      bool   `json:"dropbox"`
+	}
+	if r.ContentLength > 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	if req.Path == "" {
+		req.Path = r.URL.Query().Get("file")
+	}
+	file := strings.TrimPrefix(path.Clean("/"+req.Path), "/")
+	if file == "" || req.MaxUses < 0 {
+		http.Error(w, "path is required and max_uses cannot be negative", http.StatusBadRequest)
+		return
+	}
+
+	want := acl.Share | acl.Read
+	if req.DropBox {
+		want = acl.Share | acl.Write
+		if !store.IsDir(file) {
+			http.Error(w, "A drop box link needs a folder", http.StatusBadRequest)
+			return
+		}
+	} else if _, err := store.Stat(file); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+	if !can(c, file, want) {
+		audit.Log(c.User, "SHARE_CREATE", file, "DENIED", remoteIP(r))
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+
+	ttl := time.Duration(config.Get().Services.Storage.ShareDays) * 24 * time.Hour
+	switch {
+	case req.ExpiresHours > 0:
+		ttl = time.Duration(req.ExpiresHours) * time.Hour
+	case req.ExpiresHours < 0:
+		ttl = 0
+	}
+	l, err := shares.Create(sharelink.Options{
+		Path:     file,
+		Owner:    c.User,
+		DropBox:  req.DropBox,
+		TTL:      ttl,
+		MaxUses:  req.MaxUses,
+		Password: req.Password,
+	})
+	if err != nil {
+		utils.LogError("Storage", "Failed to create share link", err)
+		http.Error(w, "Failed to create share link", http.StatusInternalServerError)
+		return
+	}
+	audit.Log(c.User, "SHARE_CREATE", fmt.Sprintf("%s (link %s)", file, shortToken(l.Token)), "SUCCESS", remoteIP(r))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infoOf(l))
+}
+
+// sharesHandler lists the caller's links on GET, every link for admins,
+// and revokes ?token= on DELETE
+func sharesHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if shares == nil {
+		http.Error(w, "Sharing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		owner := c.User
+		if c.IsAdmin() {
+			owner = ""
+		}
+		list := []shareInfo{}
+		for _, l := range shares.List(owner) {
+			list = append(list, infoOf(l))
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodDelete:
+		token := r.URL.Query().Get("token")
+		l, err := shares.Get(token)
+		if err == nil && l.Owner != c.User && !c.IsAdmin() {
+			err = sharelink.ErrNotFound
+		}
+		if err == nil {
+			l, err = shares.Revoke(token)
+		}
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, sharelink.ErrNotFound) {
+				status = http.StatusNotFound
+			}
+			http.Error(w, err.Error(), status)
+			return
+		}
+		audit.Log(c.User, "SHARE_REVOKE", fmt.Sprintf("%s (link %s)", l.Path, shortToken(token)), "SUCCESS", remoteIP(r))
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// shareErrorStatus maps a refused link to a status; an expired or used up
+// link is gone for good
+func shareErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, sharelink.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, sharelink.ErrExpired), errors.Is(err, sharelink.ErrExhausted):
+		return http.StatusGone
+	case errors.Is(err, sharelink.ErrPassword):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrForbidden), errors.Is(err, ErrQuota), errors.Is(err, blobstore.ErrBadName):
+		return storeErrorStatus(err)
+	}
+	return http.StatusInternalServerError
+}
+
+// handleSharedLink serves /s/{token} to anyone holding the token
+func handleSharedLink(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.URL.Path, "/s/")
+	ip := remoteIP(r)
+	if shares == nil {
+		http.Error(w, "Sharing unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	l, err := shares.Check(token, "")
+	if errors.Is(err, sharelink.ErrExhausted) {
+		// The download this client spent the last use on may still continue
+		if rl, rerr := shares.Resume(token, "", ip, resumeWindow); rerr == nil || errors.Is(rerr, sharelink.ErrPassword) {
+			l, err = rl, rerr
+		}
+	}
+	if err != nil && !errors.Is(err, sharelink.ErrPassword) {
+		audit.Log("GUEST", "SHARE_ACCESS", fmt.Sprintf("link %s: %v", shortToken(token), err), "DENIED", ip)
+		renderSharePage(w, shareErrorStatus(err), sharePage{Error: shareErrorText(err)})
+		return
+	}
+	if err != nil {
+		// Only the password is missing; the page asks for it
+		l, _ = shares.Get(token)
+	}
+	resource := fmt.Sprintf("%s (link %s)", l.Path, shortToken(token))
+	page := sharePage{Name: path.Base(l.Path), DropBox: l.DropBox, Password: l.HasPassword()}
+
+	switch {
+	case r.Method == http.MethodPost && l.DropBox:
+		sharedUpload(w, r, token, resource, page)
+	case r.Method == http.MethodPost || (!l.DropBox && !l.HasPassword()):
+		sharedDownload(w, r, token, resource, page)
+	default:
+		// The password or upload form
+		audit.Log("GUEST", "SHARE_OPEN", resource, "SUCCESS", ip)
+		renderSharePage(w, http.StatusOK, page)
+	}
+}
+
+// sharedDownload serves the link's file while its owner can still read it.
+// Every response holding the file's first byte spends a use; only the later
+// ranges of a download this client spent one on within resumeWindow are free.
+func sharedDownload(w http.ResponseWriter, r *http.Request, token, resource string, page sharePage) {
+	ip := remoteIP(r)
+	password := r.FormValue("password")
+	deny := func(err error) {
+		audit.Log("GUEST", "SHARE_DOWNLOAD", fmt.Sprintf("%s: %v", resource, err), "DENIED", ip)
+		page.Error = shareErrorText(err)
+		renderSharePage(w, shareErrorStatus(err), page)
+	}
+	l, err := shares.Resume(token, password, ip, resumeWindow)
+	resumed := err == nil
+	if !resumed {
+		l, err = shares.Check(token, password)
+	}
+	if err != nil {
+		deny(err)
+		return
+	}
+	if owner, ok := linkOwner(l); !ok || !can(owner, l.Path, acl.Read) {
+		// The owner lost access since creating the link
+		deny(fmt.Errorf("owner has no read access: %w", ErrForbidden))
+		return
+	}
+	f, e, err := store.Open(l.Path)
+	if err != nil {
+		audit.Log("GUEST", "SHARE_DOWNLOAD", resource, "FAILED", ip)
+		page.Error = "الملف لم يعد موجوداً"
+		renderSharePage(w, http.StatusNotFound, page)
+		return
+	}
+	defer f.Close()
+	if r.Method != http.MethodHead && (!resumed || servesFirstByte(r, e.Size)) {
+		if l, err = shares.UseBy(token, password, ip); err != nil {
+			deny(err)
+			return
+		}
+	}
+	audit.Log("GUEST", "SHARE_DOWNLOAD", resource, "SUCCESS", ip)
+	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(l.Path))
+	cw := &countingWriter{ResponseWriter: w}
+	http.ServeContent(cw, r, filepath.Base(l.Path), e.ModTime, f)
+
+	metricsMutex.Lock()
+	downloadBytes += cw.n
+	metricsMutex.Unlock()
+}
+
+// servesFirstByte reports whether http.ServeContent answers r with content
+// holding the first byte of a file of size bytes. It parses Range the way
+// net/http does, so "bytes=00-", a suffix range covering the file and
+// ranges ServeContent ignores all count.
+func servesFirstByte(r *http.Request, size int64) bool {
+	header := r.Header.Get("Range")
+	if header == "" || r.Header.Get("If-Range") != "" || size == 0 {
+		return true
+	}
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok {
+		return false // answered with 416
+	}
+	var total int64
+	n, first, pastEnd := 0, false, false
+	for _, ra := range strings.Split(spec, ",") {
+		ra = textproto.TrimString(ra)
+		if ra == "" {
+			continue
+		}
+		startText, endText, ok := strings.Cut(ra, "-")
+		if !ok {
+			return false
+		}
+		startText, endText = textproto.TrimString(startText), textproto.TrimString(endText)
+		var start, length int64
+		if startText == "" {
+			// The last endText bytes
+			last, err := strconv.ParseInt(endText, 10, 64)
+			if endText == "" || endText[0] == '-' || err != nil || last < 0 {
+				return false
+			}
+			if last > size {
+				last = size
+			}
+			start, length = size-last, last
+		} else {
+			var err error
+			start, err = strconv.ParseInt(startText, 10, 64)
+			if err != nil || start < 0 {
+				return false
+			}
+			if start >= size {
+				pastEnd = true
+				continue
+			}
+			length = size - start
+			if endText != "" {
+				end, err := strconv.ParseInt(endText, 10, 64)
+				if err != nil || start > end {
+					return false
+				}
+				if end < size {
+					length = end - start + 1
+				}
+			}
+		}
+		n++
+		total += length
+		first = first || start == 0
+	}
+	if n == 0 {
+		// Only ranges past the end is a 416, no ranges at all the whole file
+		return !pastEnd
+	}
+	// Ranges adding up to more than the file get the whole file
+	return first || total > size
+}
+
+// linkOwner returns the owner of l as a caller, or false if they no longer exist
+func linkOwner(l sharelink.Link) (Caller, bool) {
+	if authManager == nil {
+		return Caller{}, false
+	}
+	role, ok := authManager.Role(l.Owner)
+	return Caller{User: l.Owner, Role: role}, ok
+}
+
+// sharedUpload stores files posted to a drop box link in its folder, as
+// its owner and never over an existing file. Each file spends a use.
+func sharedUpload(w http.ResponseWriter, r *http.Request, token, resource string, page sharePage) {
+	ip := remoteIP(r)
+	if err := r.ParseMultipartForm(500 << 20); err != nil {
+		page.Error = "طلب رفع غير صالح"
+		renderSharePage(w, http.StatusBadRequest, page)
+		return
+	}
+	password := r.FormValue("password")
+	if _, err := shares.Check(token, password); err != nil {
+		audit.Log("GUEST", "SHARE_UPLOAD", fmt.Sprintf("%s: %v", resource, err), "DENIED", ip)
+		page.Error = shareErrorText(err)
+		renderSharePage(w, shareErrorStatus(err), page)
+		return
+	}
+	l, _ := shares.Get(token)
+	owner, ok := linkOwner(l)
+	if !ok || !can(owner, l.Path, acl.Write) {
+		// The owner lost access since creating the link
+		audit.Log("GUEST", "SHARE_UPLOAD", resource+": owner has no write access", "DENIED", ip)
+		page.Error = shareErrorText(ErrForbidden)
+		renderSharePage(w, http.StatusForbidden, page)
+		return
+	}
+
+	n := 0
+	for _, header := range r.MultipartForm.File["file"] {
+		name := filepath.Base(header.Filename)
+		stored, err := storeDropped(header, l, owner, name, password)
+		if err != nil {
+			audit.Log("GUEST", "SHARE_UPLOAD", fmt.Sprintf("%s/%s (link %s): %v", l.Path, name, shortToken(token), err), "DENIED", ip)
+			page.Error = shareErrorText(err)
+			renderSharePage(w, shareErrorStatus(err), page)
+			return
+		}
+		audit.Log("GUEST", "SHARE_UPLOAD", fmt.Sprintf("%s/%s (link %s)", l.Path, stored, shortToken(token)), "SUCCESS", ip)
+		n++
+	}
+	page.Uploaded = n
+	renderSharePage(w, http.StatusOK, page)
+}
+
+// storeDropped checks one drop box file against policy and the owner's
+// quota, spends a use of the link and stores the file, returning the name
+// it was stored under
+func storeDropped(header *multipart.FileHeader, l sharelink.Link, owner Caller, name, password string) (string, error) {
+	size := header.Size
+	if err := validName(name); err != nil {
+		return "", err
+	}
+	if !allowUploadSize(name, size) {
+		return "", ErrForbidden
+	}
+	filename, target, err := uniquePath(l.Path, name)
+	if err != nil {
+		return "", err
+	}
+	// Guests only ever add files directly inside the link's folder
+	target = blobstore.Clean(target)
+	if dir := blobstore.Clean(l.Path); target == dir || !within(target, dir) {
+		return "", ErrForbidden
+	}
+	if err := checkQuota(owner, target, size); err != nil {
+		return "", err
+	}
+	if _, err := shares.Use(l.Token, password); err != nil {
+		return "", err
+	}
+	f, err := header.Open()
+	if err != nil {
+		return "", err
+	}
+	blob, err := store.Write(f)
+	f.Close()
+	if err != nil {
+		return "", err
+	}
+	if _, err := store.LinkAs(target, blob, owner.User); err != nil {
+		store.Release(blob)
+		return "", err
+	}
+	utils.LogSuccess("Storage", fmt.Sprintf("Received via drop box: %s (%s)", path.Join(l.Path, filename), utils.FormatSize(size)))
+	metricsMutex.Lock()
+	uploadBytes += size
+	metricsMutex.Unlock()
+	return filename, nil
+}
+
+// countingWriter counts the bytes of a response
+type countingWriter struct {
+	http.ResponseWriter
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func shareErrorText(err error) string {
+	switch {
+	case errors.Is(err, sharelink.ErrNotFound):
+		return "الرابط غير موجود"
+	case errors.Is(err, sharelink.ErrExpired):
+		return "انتهت صلاحية الرابط"
+	case errors.Is(err, sharelink.ErrExhausted):
+		return "استُنفد عدد مرات استخدام الرابط"
+	case errors.Is(err, sharelink.ErrPassword):
+		return "كلمة المرور غير صحيحة"
+	case errors.Is(err, ErrQuota):
+		return "لا توجد مساحة كافية"
+	case errors.Is(err, ErrForbidden):
+		return "غير مسموح"
+	case errors.Is(err, blobstore.ErrBadName):
+		return "اسم الملف غير صالح"
+	}
+	return "حدث خطأ"
+}
+
+// sharePage is what /s/{token} shows instead of the file: a password
+// prompt, a drop box form, or why the link cannot be used
+type sharePage struct {
+	Name     string
+	DropBox  bool
+	Password bool
+	Uploaded int
+	Error    string
+}
+
+var shareTmpl = template.Must(template.New("share").Parse(ShareHTML))
+
+func renderSharePage(w http.ResponseWriter, status int, page sharePage) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	shareTmpl.Execute(w, page)
+}
+
+// ShareHTML is the page behind share links that cannot be served directly
+const ShareHTML = `
+<!DOCTYPE html>
+<html lang="ar" dir="rtl">
+<head>
+    <meta charset="UTF-8">
+    <meta name="viewport" content="width=device-width, initial-scale=1.0">
+    <title>NEXA | Shared</title>
+    <style>
+        body { font-family: sans-serif; background: #020617; color: #f8fafc; display: flex; justify-content: center; align-items: center; min-height: 100vh; margin: 0; }
+        .card { background: #0f172a; border: 1px solid rgba(255,255,255,0.1); border-radius: 24px; padding: 40px; width: 380px; text-align: center; }
+        input { width: 100%; box-sizing: border-box; padding: 10px; margin: 8px 0; border-radius: 8px; border: 1px solid rgba(255,255,255,0.1); background: rgba(255,255,255,0.05); color: white; }
+        button { padding: 10px 24px; border: none; border-radius: 12px; font-weight: 700; color: white; background: linear-gradient(135deg, #6366f1, #ec4899); cursor: pointer; margin-top: 10px; }
+        .error { color: #ef4444; }
+        .ok { color: #10b981; }
+    </style>
+</head>
+<body>
+    <div class="card">
+        {{if .Name}}<h2>{{if .DropBox}}📥{{else}}📄{{end}} {{.Name}}</h2>{{end}}
+        {{if .Error}}<p class="error">{{.Error}}</p>{{end}}
+        {{if .Uploaded}}<p class="ok">تم رفع {{.Uploaded}} ملف</p>{{end}}
+        {{if .Name}}
+        <form method="POST" {{if .DropBox}}enctype="multipart/form-data"{{end}}>
+            {{if .DropBox}}<input type="file" name="file" multiple required>{{end}}
+            {{if .Password}}<input type="password" name="password" placeholder="كلمة المرور" required>{{end}}
+            <button type="submit">{{if .DropBox}}رفع{{else}}تحميل{{end}}</button>
+        </form>
+        {{end}}
+    </div>
+</body>
+</html>
+`
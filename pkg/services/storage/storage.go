@@ -1,21 +1,22 @@
 package storage
 
 import (
-	"crypto/md5"
-	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/MultiX0/nexa/pkg/acl"
 	"github.com/MultiX0/nexa/pkg/analytics"
+	"github.com/MultiX0/nexa/pkg/blobstore"
 	"github.com/MultiX0/nexa/pkg/config"
 	"github.com/MultiX0/nexa/pkg/governance"
 	"github.com/MultiX0/nexa/pkg/network"
@@ -26,11 +27,7 @@ const (
 	StorageRoot = "./storage"
 )
 
-// ShareLinkStore
 var (
-	shareLinks = make(map[string]string)
-	shareMutex sync.RWMutex
-
 	// Telemetry
 	uploadBytes   int64
 	downloadBytes int64
@@ -361,10 +358,14 @@ const FileMangerHTML = `
     <div class="sidebar">
         <div class="logo"><i class="fas fa-cube"></i> NEXA CLOUD</div>
         <div class="nav-item active" onclick="loadFiles('')"><i class="fas fa-home"></i> الرئيسيه</div>
+        <div class="nav-item" onclick="loadFiles(myHome)"><i class="fas fa-user"></i> ملفاتي (Home)</div>
         <div class="nav-item" onclick="loadFiles('incoming')"><i class="fas fa-inbox"></i> الوارد (Incoming)</div>
         <div class="nav-item" onclick="loadFiles('shared')"><i class="fas fa-share-alt"></i> مشترك (Shared)</div>
         <div class="nav-item" onclick="loadFiles('vault')"><i class="fas fa-lock"></i> الخزنة (Vault)</div>
         <div class="nav-item" onclick="loadFiles('backup')"><i class="fas fa-sync"></i> النسخ الاحتياطي</div>
+        <div class="nav-item" onclick="loadShares()"><i class="fas fa-link"></i> روابط المشاركة</div>
+        <div class="nav-item" onclick="loadTrash()"><i class="fas fa-trash-restore"></i> سلة المحذوفات (Trash)</div>
+        <div class="nav-item" onclick="logout()"><i class="fas fa-sign-out-alt"></i> <span id="whoami">خروج</span></div>
         <div style="margin-top: 30px; padding-top: 20px; border-top: 1px solid var(--border); display: none;" id="cat-filters">
             <div style="color: var(--text-muted); font-size: 0.8rem; margin-bottom: 10px; font-weight:700;">التصنيفات</div>
             <div class="nav-item" onclick="filterType('image')"><i class="fas fa-image"></i> صور</div>
@@ -384,6 +385,8 @@ const FileMangerHTML = `
                 <i class="fas fa-search"></i>
             </div>
             <div class="actions">
+                 <span id="quotaInfo" style="color: var(--text-muted); align-self: center; font-size: 0.85rem;"></span>
+                 <span id="uploadProgress" style="color: var(--text-muted); align-self: center; font-size: 0.85rem;"></span>
                  <button class="btn btn-glass" onclick="createFolder()"><i class="fas fa-folder-plus"></i></button>
                  <button class="btn btn-primary" onclick="document.getElementById('fileInput').click()">
                     <i class="fas fa-cloud-upload"></i> رفع ملف
@@ -399,36 +402,136 @@ const FileMangerHTML = `
 
     <div id="shareModal" class="modal">
         <div class="modal-content">
-            <h2 style="margin-bottom: 20px;">مشاركة الملف</h2>
-            <div id="qr-code"></div>
-            <p style="color: var(--text-muted); margin: 15px 0;">انسخ الرابط أو امسح الكود</p>
-            <input type="text" id="shareLink" readonly style="width: 100%; padding: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white; text-align: center;">
+            <h2 id="shareTitle" style="margin-bottom: 10px;">مشاركة الملف</h2>
+            <p id="shareFile" style="color: var(--text-muted); margin-bottom: 15px;"></p>
+            <div id="shareOptions" style="display: flex; flex-direction: column; gap: 10px;">
+                <select id="shareExpiry" style="padding: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white;">
+                    <option value="0">الصلاحية الافتراضية</option>
+                    <option value="1">ساعة واحدة</option>
+                    <option value="24">يوم واحد</option>
+                    <option value="168">أسبوع</option>
+                    <option value="720">30 يوماً</option>
+                    <option value="-1">بدون انتهاء</option>
+                </select>
+                <input type="number" id="shareUses" min="0" placeholder="عدد مرات الاستخدام (0 = غير محدود)" style="padding: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white;">
+                <input type="password" id="sharePassword" placeholder="كلمة مرور (اختياري)" style="padding: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white;">
+                <button class="btn btn-primary" onclick="createShare()">إنشاء الرابط</button>
+            </div>
+            <div id="shareResult" style="display: none;">
+                <div id="qr-code"></div>
+                <p style="color: var(--text-muted); margin: 15px 0;">انسخ الرابط أو امسح الكود</p>
+                <input type="text" id="shareLink" readonly style="width: 100%; padding: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white; text-align: center;">
+            </div>
             <div style="margin-top: 20px; display: flex; gap: 10px; justify-content: center;">
-                <button class="btn btn-primary" onclick="copyLink()">نسخ الرابط</button>
+                <button id="copyBtn" class="btn btn-primary" onclick="copyLink()" style="display: none;">نسخ الرابط</button>
                 <button class="btn btn-glass" onclick="closeModal()">إغلاق</button>
             </div>
         </div>
     </div>
 
+    <div id="loginModal" class="modal">
+        <div class="modal-content">
+            <h2 style="margin-bottom: 20px;">تسجيل الدخول</h2>
+            <input type="text" id="loginUser" placeholder="اسم المستخدم" style="width: 100%; padding: 10px; margin-bottom: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white;">
+            <input type="password" id="loginPass" placeholder="كلمة المرور" onkeyup="if (event.key === 'Enter') login()" style="width: 100%; padding: 10px; border-radius: 8px; border: 1px solid var(--border); background: var(--glass); color: white;">
+            <p id="loginError" style="color: #ef4444; margin-top: 10px;"></p>
+            <div style="margin-top: 20px; display: flex; gap: 10px; justify-content: center;">
+                <button class="btn btn-primary" onclick="login()">دخول</button>
+            </div>
+        </div>
+    </div>
+
+    <div id="versionsModal" class="modal">
+        <div class="modal-content">
+            <h2 style="margin-bottom: 20px;">الإصدارات السابقة</h2>
+            <p id="versionsFile" style="color: var(--text-muted); margin-bottom: 15px;"></p>
+            <div id="versionsList" style="max-height: 300px; overflow-y: auto; text-align: right;"></div>
+            <div style="margin-top: 20px; display: flex; gap: 10px; justify-content: center;">
+                <button class="btn btn-glass" onclick="closeVersions()">إغلاق</button>
+            </div>
+        </div>
+    </div>
+
     <script>
-        let currentPath = ''; let allFiles = [];
+        let currentPath = ''; let allFiles = []; let myHome = '';
+
+        // Any request refused for a missing or expired login asks for one
+        const rawFetch = window.fetch.bind(window);
+        window.fetch = (url, opts) => rawFetch(url, opts).then(res => {
+            if (res.status === 401 && !String(url).startsWith('api/login')) showLogin();
+            return res;
+        });
 
         document.addEventListener('DOMContentLoaded', () => {
-            loadFiles(''); setupDragDrop();
+            loadMe(); loadFiles(''); setupDragDrop();
             if(window.innerWidth > 768) document.getElementById('cat-filters').style.display = 'block';
         });
 
         function loadFiles(path) {
             currentPath = path; updateBreadcrumbs(path);
-            if (path.includes('vault')) {
-                const pin = prompt("🔐 الخزنة مشفرة. رمز الحماية:");
-                if (pin !== '1234') { alert("رمز خاطئ!"); loadFiles(''); return; }
-            }
             // FIXED: Relative paths to support proxying
             fetch('api/list?dir=' + encodeURIComponent(path))
-                .then(res => res.json())
+                .then(res => {
+                    if (res.status === 403) throw new Error('forbidden');
+                    return res.ok ? res.json() : [];
+                })
                 .then(data => { allFiles = data || []; renderFiles(allFiles); })
-                .catch(err => { console.error(err); document.getElementById('fileList').innerHTML = '<div style="color:#ef4444; padding:40px; text-align:center;">خطأ في الاتصال بالسيرفر</div>'; });
+                .catch(err => {
+                    console.error(err);
+                    const msg = err.message === 'forbidden' ? 'ليس لديك صلاحية لهذا المجلد' : 'خطأ في الاتصال بالسيرفر';
+                    document.getElementById('fileList').innerHTML = '<div style="color:#ef4444; padding:40px; text-align:center;">' + msg + '</div>';
+                });
+        }
+
+        function loadMe() {
+            fetch('api/me').then(res => res.ok ? res.json() : null).then(me => {
+                if (!me) return;
+                myHome = me.home;
+                document.getElementById('whoami').textContent = 'خروج (' + me.user + ')';
+                const q = me.quota;
+                document.getElementById('quotaInfo').textContent = q.limitFormatted ? q.usedFormatted + ' / ' + q.limitFormatted : q.usedFormatted;
+            });
+        }
+        function showLogin() { document.getElementById('loginModal').style.display = 'flex'; }
+        function login() {
+            const body = JSON.stringify({ username: document.getElementById('loginUser').value, password: document.getElementById('loginPass').value });
+            fetch('api/login', { method: 'POST', headers: { 'Content-Type': 'application/json' }, body: body }).then(res => {
+                if (!res.ok) { document.getElementById('loginError').textContent = 'بيانات الدخول غير صحيحة'; return; }
+                document.getElementById('loginModal').style.display = 'none';
+                document.getElementById('loginPass').value = ''; document.getElementById('loginError').textContent = '';
+                loadMe(); loadFiles(currentPath);
+            });
+        }
+        function logout() { fetch('api/logout', { method: 'POST' }).then(() => { myHome = ''; showLogin(); }); }
+
+        // Names come from users and drop box guests, so they only ever go
+        // into the page as text
+        function el(tag, className, text) {
+            const node = document.createElement(tag);
+            if (className) node.className = className;
+            if (text !== undefined) node.textContent = text;
+            return node;
+        }
+        function actionButton(icon, onClick, opts) {
+            const btn = el('button', 'btn btn-sm btn-glass');
+            btn.style.padding = '5px 10px';
+            if (opts && opts.danger) btn.style.color = '#ef4444';
+            if (opts && opts.title) btn.title = opts.title;
+            btn.appendChild(el('i', 'fas ' + icon));
+            btn.addEventListener('click', onClick);
+            return btn;
+        }
+        function fileCard(icon, name, title, meta, actions) {
+            const div = el('div', 'file-card');
+            div.appendChild(el('div', 'file-icon', icon));
+            const label = el('div', 'file-name', name); label.title = title;
+            div.appendChild(label);
+            div.appendChild(meta);
+            const menu = el('div', 'context-menu');
+            menu.addEventListener('click', e => e.stopPropagation());
+            actions.forEach(a => menu.appendChild(a));
+            div.appendChild(menu);
+            return div;
         }
 
         function renderFiles(files) {
@@ -438,20 +541,22 @@ const FileMangerHTML = `
                 return;
             }
             files.forEach(file => {
-                const div = document.createElement('div'); div.className = 'file-card';
-                div.onclick = () => { if (file.IsDir) loadFiles(currentPath ? currentPath + '/' + file.Name : file.Name); };
-                const icon = file.IsDir ? '📁' : getIcon(file.Name);
-                let actions = '';
-                if (!file.IsDir) {
-                    actions = '<button class="btn btn-sm btn-glass" onclick="openShare(\'' + file.Name + '\')" style="padding: 5px 10px;"><i class="fas fa-share-alt"></i></button>';
-                    actions += '<a href="download?file=' + encodeURIComponent(currentPath ? currentPath + '/' + file.Name : file.Name) + '" class="btn btn-sm btn-glass" style="padding: 5px 10px; text-decoration:none;"><i class="fas fa-download"></i></a>';
+                const filePath = currentPath ? currentPath + '/' + file.Name : file.Name;
+                const actions = [];
+                if (file.IsDir) {
+                    actions.push(actionButton('fa-inbox', () => openShare(file.Name, true), { title: 'صندوق استلام' }));
+                } else {
+                    actions.push(actionButton('fa-share-alt', () => openShare(file.Name, false)));
+                    actions.push(actionButton('fa-history', () => openVersions(file.Name)));
+                    const dl = el('a', 'btn btn-sm btn-glass');
+                    dl.href = 'download?file=' + encodeURIComponent(filePath);
+                    dl.style.cssText = 'padding: 5px 10px; text-decoration:none;';
+                    dl.appendChild(el('i', 'fas fa-download'));
+                    actions.push(dl);
                 }
-                actions += '<button class="btn btn-sm btn-glass" onclick="deleteFile(\'' + file.Name + '\')" style="padding: 5px 10px; color: #ef4444;"><i class="fas fa-trash"></i></button>';
-
-                div.innerHTML = '<div class="file-icon">' + icon + '</div>' +
-                                '<div class="file-name" title="' + file.Name + '">' + file.Name + '</div>' +
-                                '<div class="file-meta">' + file.Size + '</div>' +
-                                '<div class="context-menu" onclick="event.stopPropagation()">' + actions + '</div>';
+                actions.push(actionButton('fa-trash', () => deleteFile(file.Name), { danger: true }));
+                const div = fileCard(file.IsDir ? '📁' : getIcon(file.Name), file.Name, file.Name, el('div', 'file-meta', file.Size), actions);
+                div.onclick = () => { if (file.IsDir) loadFiles(filePath); };
                 container.appendChild(div);
             });
         }
@@ -476,37 +581,154 @@ const FileMangerHTML = `
         }
 
         function updateBreadcrumbs(path) {
-            const bc = document.getElementById('breadcrumbs');
-            if (!path) { bc.innerHTML = '<span onclick="loadFiles(\'\')">الرئيسية</span>'; return; }
-            const parts = path.split('/');
-            let html = '<span onclick="loadFiles(\'\')">الرئيسية</span>', acc = '';
-            parts.forEach(p => { acc += (acc ? '/' : '') + p; html += ' / <span onclick="loadFiles(\'' + acc + '\')">' + p + '</span>'; });
-            bc.innerHTML = html;
+            const bc = document.getElementById('breadcrumbs'); bc.textContent = '';
+            const crumb = (text, target) => {
+                const span = el('span', '', text);
+                span.addEventListener('click', () => loadFiles(target));
+                bc.appendChild(span);
+            };
+            crumb('الرئيسية', '');
+            let acc = '';
+            (path ? path.split('/') : []).forEach(p => {
+                acc += (acc ? '/' : '') + p;
+                bc.appendChild(document.createTextNode(' / '));
+                crumb(p, acc);
+            });
         }
 
-        function openShare(filename) {
-            const filePath = currentPath ? currentPath + '/' + filename : filename;
-            fetch('api/share?file=' + encodeURIComponent(filePath))
-                .then(res => res.json())
+        // A folder gets a drop box link: others can upload into it but not see it
+        let shareTarget = { path: '', dropbox: false };
+        function openShare(filename, dropbox) {
+            shareTarget = { path: currentPath ? currentPath + '/' + filename : filename, dropbox: dropbox };
+            document.getElementById('shareTitle').textContent = dropbox ? 'صندوق استلام' : 'مشاركة الملف';
+            document.getElementById('shareFile').textContent = shareTarget.path;
+            document.getElementById('shareExpiry').value = '0';
+            document.getElementById('shareUses').value = '';
+            document.getElementById('sharePassword').value = '';
+            document.getElementById('shareOptions').style.display = 'flex';
+            document.getElementById('shareResult').style.display = 'none';
+            document.getElementById('copyBtn').style.display = 'none';
+            document.getElementById('shareModal').style.display = 'flex';
+        }
+        function createShare() {
+            fetch('api/share', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    path: shareTarget.path,
+                    dropbox: shareTarget.dropbox,
+                    expires_hours: parseInt(document.getElementById('shareExpiry').value, 10),
+                    max_uses: parseInt(document.getElementById('shareUses').value || '0', 10),
+                    password: document.getElementById('sharePassword').value
+                })
+            })
+                .then(res => { if (!res.ok) throw new Error(res.status); return res.json(); })
                 .then(data => {
                     document.getElementById('shareLink').value = data.link;
                     document.getElementById('qr-code').innerHTML = '';
                     new QRCode(document.getElementById('qr-code'), { text: data.link, width: 128, height: 128 });
-                    document.getElementById('shareModal').style.display = 'flex';
-                });
+                    document.getElementById('shareOptions').style.display = 'none';
+                    document.getElementById('shareResult').style.display = 'block';
+                    document.getElementById('copyBtn').style.display = 'inline-block';
+                })
+                .catch(() => alert('تعذر إنشاء الرابط'));
         }
         function closeModal() { document.getElementById('shareModal').style.display = 'none'; }
+        // Share links replace the file grid like the trash does
+        function loadShares() {
+            currentPath = '';
+            document.getElementById('breadcrumbs').innerHTML = '<span onclick="loadFiles(\'\')">الرئيسية</span> / روابط المشاركة';
+            fetch('api/shares')
+                .then(res => res.json())
+                .then(links => {
+                    const container = document.getElementById('fileList'); container.innerHTML = '';
+                    if (!links || links.length === 0) {
+                        container.innerHTML = '<div style="grid-column: 1/-1; text-align: center; padding: 50px; color: var(--text-muted);">لا توجد روابط</div>';
+                        return;
+                    }
+                    links.forEach(l => {
+                        const name = l.path.split('/').pop();
+                        const uses = l.max_uses ? l.uses + '/' + l.max_uses : l.uses;
+                        const expires = l.expires_at ? new Date(l.expires_at).toLocaleString() : '∞';
+                        const meta = el('div', 'file-meta', uses + ' · ' + expires);
+                        if (l.status !== 'active') {
+                            meta.appendChild(document.createTextNode(' · '));
+                            const status = el('span', '', l.status === 'expired' ? 'منتهي' : 'مستنفد');
+                            status.style.color = '#ef4444';
+                            meta.appendChild(status);
+                        }
+                        const actions = [
+                            actionButton('fa-copy', () => navigator.clipboard.writeText(l.link)),
+                            actionButton('fa-ban', () => revokeShare(l.token), { danger: true })
+                        ];
+                        container.appendChild(fileCard((l.dropbox ? '📥' : getIcon(name)) + (l.password ? '🔒' : ''), name, l.path, meta, actions));
+                    });
+                });
+        }
+        function revokeShare(token) {
+            if (!confirm('إلغاء الرابط؟')) return;
+            fetch('api/shares?token=' + encodeURIComponent(token), { method: 'DELETE' }).then(() => loadShares());
+        }
         function copyLink() { document.getElementById("shareLink").select(); document.execCommand("copy"); alert("تم النسخ"); }
         function deleteFile(filename) {
-            if(!confirm('حذف النهائي؟')) return;
+            if(!confirm('نقل إلى سلة المحذوفات؟')) return;
             const filePath = currentPath ? currentPath + '/' + filename : filename;
             fetch('delete?file=' + encodeURIComponent(filePath), { method: 'POST' }).then(() => loadFiles(currentPath));
         }
+        function openVersions(filename) {
+            const filePath = currentPath ? currentPath + '/' + filename : filename;
+            document.getElementById('versionsFile').textContent = filePath;
+            fetch('api/versions?file=' + encodeURIComponent(filePath))
+                .then(res => res.json())
+                .then(list => {
+                    const box = document.getElementById('versionsList'); box.innerHTML = '';
+                    if (!list || list.length === 0) box.innerHTML = '<div style="color: var(--text-muted); text-align: center;">لا توجد إصدارات سابقة</div>';
+                    (list || []).forEach(v => {
+                        const row = document.createElement('div');
+                        row.style.cssText = 'display:flex; justify-content:space-between; align-items:center; padding:10px; border-bottom:1px solid var(--border);';
+                        row.appendChild(el('span', '', v.modified + ' · ' + v.sizeFormatted));
+                        const btn = document.createElement('button'); btn.className = 'btn btn-glass'; btn.style.padding = '5px 10px';
+                        btn.innerHTML = '<i class="fas fa-undo"></i> استعادة';
+                        btn.onclick = () => fetch('api/versions/restore?file=' + encodeURIComponent(filePath) + '&id=' + v.id, { method: 'POST' })
+                            .then(() => { closeVersions(); loadFiles(currentPath); });
+                        row.appendChild(btn); box.appendChild(row);
+                    });
+                    document.getElementById('versionsModal').style.display = 'flex';
+                });
+        }
+        function closeVersions() { document.getElementById('versionsModal').style.display = 'none'; }
+        // The trash replaces the file grid until a folder is opened again
+        function loadTrash() {
+            currentPath = '';
+            document.getElementById('breadcrumbs').innerHTML = '<span onclick="loadFiles(\'\')">الرئيسية</span> / سلة المحذوفات';
+            fetch('api/trash')
+                .then(res => res.json())
+                .then(items => {
+                    const container = document.getElementById('fileList'); container.innerHTML = '';
+                    if (!items || items.length === 0) {
+                        container.innerHTML = '<div style="grid-column: 1/-1; text-align: center; padding: 50px; color: var(--text-muted);">سلة المحذوفات فارغة</div>';
+                        return;
+                    }
+                    items.forEach(item => {
+                        const name = item.path.split('/').pop();
+                        const actions = [
+                            actionButton('fa-undo', () => trashAction('restore', item.id)),
+                            actionButton('fa-times', () => trashAction('purge', item.id), { danger: true })
+                        ];
+                        const meta = el('div', 'file-meta', item.sizeFormatted + ' · ' + item.deleted);
+                        container.appendChild(fileCard(item.is_dir ? '📁' : getIcon(name), name, item.path, meta, actions));
+                    });
+                });
+        }
+        function trashAction(action, id) {
+            if (action === 'purge' && !confirm('حذف نهائي؟')) return;
+            fetch('api/trash/' + action + '?id=' + id, { method: 'POST' }).then(() => loadTrash());
+        }
         function createFolder() {
             const name = prompt("اسم المجلد:");
             if (name) {
                 const path = currentPath ? currentPath + '/' + name : name;
-                fetch('api/mkdir?dir=' + encodeURIComponent(path)).then(() => loadFiles(currentPath));
+                fetch('api/mkdir?dir=' + encodeURIComponent(path), { method: 'POST' }).then(() => loadFiles(currentPath));
             }
         }
         function setupDragDrop() {
@@ -515,11 +737,44 @@ const FileMangerHTML = `
             document.addEventListener('dragleave', e => { if (!e.relatedTarget || !e.relatedTarget.closest('.drag-overlay')) dz.classList.remove('drag-active'); });
             document.addEventListener('drop', e => { e.preventDefault(); dz.classList.remove('drag-active'); if(e.dataTransfer.files.length) handleFileSelect(e.dataTransfer.files); });
         }
-        function handleFileSelect(files) {
-            const fd = new FormData();
-            for (let i=0; i<files.length; i++) fd.append('file', files[i]);
-            if (currentPath) fd.append('dir', currentPath);
-            fetch('upload', { method: 'POST', body: fd }).then(res => { if(res.ok) loadFiles(currentPath); else alert('خطأ في الرفع'); });
+        const CHUNK_SIZE = 8 * 1024 * 1024, MAX_FAILURES = 30;
+        async function handleFileSelect(files) {
+            for (let i=0; i<files.length; i++) {
+                try { await uploadResumable(files[i]); }
+                catch (err) { console.error(err); alert('خطأ في الرفع: ' + files[i].name); }
+            }
+            document.getElementById('uploadProgress').textContent = '';
+            loadMe(); loadFiles(currentPath);
+        }
+        // Sends a file in chunks; after a failure it asks the server for the
+        // offset, so a dropped connection resumes instead of starting over
+        async function uploadResumable(file) {
+            const created = await fetch('api/uploads', { method: 'POST', headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ filename: file.name, dir: currentPath, size: file.size }) });
+            if (!created.ok) throw new Error(await created.text());
+            const base = 'api/uploads/' + (await created.json()).id;
+            let offset = 0, failures = 0;
+            while (offset < file.size) {
+                showProgress(file.name, offset, file.size);
+                try {
+                    const res = await fetch(base, { method: 'PATCH', headers: { 'Upload-Offset': String(offset) }, body: file.slice(offset, offset + CHUNK_SIZE) });
+                    if (res.ok) { offset = (await res.json()).offset; failures = 0; continue; }
+                    if (res.status !== 409) failures = MAX_FAILURES;
+                } catch (err) { console.warn(err); }
+                if (++failures > MAX_FAILURES) throw new Error('upload failed');
+                await new Promise(r => setTimeout(r, 2000));
+                try {
+                    const res = await fetch(base);
+                    if (res.ok) offset = (await res.json()).offset;
+                } catch (err) { console.warn(err); }
+            }
+            showProgress(file.name, file.size, file.size);
+            const done = await fetch(base + '/finish', { method: 'POST' });
+            if (!done.ok) throw new Error(await done.text());
+        }
+        function showProgress(name, done, total) {
+            const pct = total ? Math.floor(done * 100 / total) : 100;
+            document.getElementById('uploadProgress').textContent = name + ' ' + pct + '%';
         }
     </script>
 </body>
@@ -540,29 +795,44 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	go reportMetrics()
 
 	// Ensure professional storage structure
-	os.MkdirAll(StorageRoot, 0755)
-	os.MkdirAll(filepath.Join(StorageRoot, "public"), 0755)
-	os.MkdirAll(filepath.Join(StorageRoot, "locked"), 0755)
-	subDirs := []string{"incoming", "shared", "vault", "backup", "temp"}
+	os.MkdirAll(filepath.Join(StorageRoot, "temp"), 0755)
+	if err := openStore(); err != nil {
+		utils.LogError("Storage", "Failed to open the blob store", err)
+		return
+	}
+	openAccess()
+	openShares()
+	subDirs := []string{"public", "locked", "incoming", "shared", "vault", "backup", homeRoot}
 	for _, sub := range subDirs {
-		path := filepath.Join(StorageRoot, sub)
-		if _, err := os.Stat(path); os.IsNotExist(err) {
-			os.MkdirAll(path, 0755)
-		}
+		store.Mkdir(sub)
 	}
 
 	// Start Auto-Backup Routine (Every 5 minutes)
 	go startAutoBackup()
+	go startRetention()
+	openUploads()
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", enableCORS(webHandler))
-	mux.HandleFunc("/upload", enableCORS(uploadHandler))
-	mux.HandleFunc("/delete", enableCORS(deleteHandler))
-	mux.HandleFunc("/download", enableCORS(downloadHandler))
-	mux.HandleFunc("/api/list", enableCORS(listAPIHandler))
-	mux.HandleFunc("/api/stats", enableCORS(statsHandler))
-	mux.HandleFunc("/api/share", enableCORS(shareAPIHandler))
-	mux.HandleFunc("/api/mkdir", enableCORS(mkdirAPIHandler))
+	mux.HandleFunc("/api/login", enableCORS(loginHandler))
+	mux.HandleFunc("/api/logout", enableCORS(logoutHandler))
+	mux.HandleFunc("/api/me", enableCORS(withAuth(meHandler)))
+	mux.HandleFunc("/api/acl", enableCORS(withAuth(aclHandler)))
+	mux.HandleFunc("/api/quota", enableCORS(withAuth(quotaHandler)))
+	mux.HandleFunc("/upload", enableCORS(withAuth(uploadHandler)))
+	mux.HandleFunc("/api/uploads", enableCORS(withAuth(uploadsHandler)))
+	mux.HandleFunc("/api/uploads/", enableCORS(withAuth(uploadHandlerByID)))
+	mux.HandleFunc("/delete", enableCORS(withAuth(deleteHandler)))
+	mux.HandleFunc("/download", enableCORS(withAuth(downloadHandler)))
+	mux.HandleFunc("/api/list", enableCORS(withAuth(listAPIHandler)))
+	mux.HandleFunc("/api/stats", enableCORS(withAuth(statsHandler)))
+	mux.HandleFunc("/api/share", enableCORS(withAuth(shareAPIHandler)))
+	mux.HandleFunc("/api/shares", enableCORS(withAuth(sharesHandler)))
+	mux.HandleFunc("/api/mkdir", enableCORS(withAuth(mkdirAPIHandler)))
+	mux.HandleFunc("/api/versions", enableCORS(withAuth(versionsHandler)))
+	mux.HandleFunc("/api/versions/restore", enableCORS(withAuth(restoreVersionHandler)))
+	mux.HandleFunc("/api/trash", enableCORS(withAuth(trashHandler)))
+	mux.HandleFunc("/api/trash/", enableCORS(withAuth(trashActionHandler)))
 	mux.HandleFunc("/s/", enableCORS(handleSharedLink))
 
 	cfg := config.Get()
@@ -582,26 +852,17 @@ func Start(nm *network.NetworkManager, gm *governance.GovernanceManager) {
 	}
 }
 
+// startAutoBackup copies incoming into backup. Copies share the blob of
+// their source, so a backup costs no space until the original changes.
 func startAutoBackup() {
 	ticker := time.NewTicker(5 * time.Minute)
 	for range ticker.C {
-		source := filepath.Join(StorageRoot, "incoming")
-		dest := filepath.Join(StorageRoot, "backup")
-		files, _ := os.ReadDir(source)
+		files, _ := store.List("incoming")
 		for _, f := range files {
-			if !f.IsDir() {
-				srcFile, err := os.Open(filepath.Join(source, f.Name()))
-				if err != nil {
-					continue
-				}
-				dstFile, err := os.Create(filepath.Join(dest, f.Name()))
-				if err != nil {
-					srcFile.Close()
-					continue
+			if !f.IsDir {
+				if _, err := store.Copy(path.Join("incoming", f.Name), path.Join("backup", f.Name)); err != nil {
+					utils.LogError("Storage", "Backup of "+f.Name+" failed", err)
 				}
-				io.Copy(dstFile, srcFile)
-				srcFile.Close()
-				dstFile.Close()
 			}
 		}
 	}
@@ -610,7 +871,9 @@ func startAutoBackup() {
 func enableCORS(next http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS, PUT, PATCH, DELETE, HEAD")
+		w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Upload-Offset")
+		w.Header().Set("Access-Control-Expose-Headers", "Upload-Offset, Upload-Length, Location")
 		next(w, r)
 	}
 }
@@ -621,30 +884,31 @@ func webHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, nil)
 }
 
-func listAPIHandler(w http.ResponseWriter, r *http.Request) {
+// listAPIHandler lists what the caller may see of a folder
+func listAPIHandler(w http.ResponseWriter, r *http.Request, c Caller) {
 	subDir := r.URL.Query().Get("dir")
 	if strings.Contains(subDir, "..") {
 		subDir = ""
 	}
-	readPath := filepath.Join(StorageRoot, subDir)
-	files, err := os.ReadDir(readPath)
+	if !visible(c, subDir) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	files, err := store.List(subDir)
 	if err != nil {
-		if subDir == "" {
-			os.MkdirAll(StorageRoot, 0755)
-			files, _ = os.ReadDir(readPath)
-		} else {
-			http.Error(w, "Directory not found", 404)
-			return
-		}
+		http.Error(w, "Directory not found", 404)
+		return
 	}
 	var fileList []FileInfo
 	for _, f := range files {
-		info, _ := f.Info()
+		if !visible(c, path.Join(subDir, f.Name)) {
+			continue
+		}
 		fileList = append(fileList, FileInfo{
-			Name:  f.Name(),
-			Size:  utils.FormatSize(info.Size()),
-			Time:  info.ModTime().Format("02/01 15:04"),
-			IsDir: f.IsDir(),
+			Name:  f.Name,
+			Size:  utils.FormatSize(f.Size),
+			Time:  f.ModTime.Format("02/01 15:04"),
+			IsDir: f.IsDir,
 		})
 	}
 	sort.Slice(fileList, func(i, j int) bool {
@@ -657,59 +921,84 @@ func listAPIHandler(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(fileList)
 }
 
-func statsHandler(w http.ResponseWriter, r *http.Request) {
-	files, _ := os.ReadDir(StorageRoot)
-	totalSize := int64(0)
-	fileCount := 0
-	for _, f := range files {
-		if !f.IsDir() {
-			info, _ := f.Info()
-			totalSize += info.Size()
-			fileCount++
-		}
+// statsHandler reports the size of every file, of the versions and trash
+// kept beside them and, since identical files share a blob, how much of
+// it is actually stored, with the caller's quota. Admins also get every
+// user's quota.
+func statsHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	u := store.Usage()
+	stats := map[string]interface{}{
+		"files":               u.Files,
+		"totalSize":           u.Bytes,
+		"totalSizeFormatted":  utils.FormatSize(u.Bytes),
+		"versions":            u.Versions,
+		"versionSize":         u.VersionBytes,
+		"trashed":             u.Trashed,
+		"trashSize":           u.TrashBytes,
+		"storedSize":          u.StoredBytes,
+		"storedSizeFormatted": utils.FormatSize(u.StoredBytes),
+		"blobs":               u.Blobs,
+		"quota":               usageOf(c.User, store.Owners()),
+	}
+	if c.IsAdmin() {
+		stats["quotas"] = quotaReport()
 	}
 	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"files":%d,"totalSize":%d,"totalSizeFormatted":"%s"}`, fileCount, totalSize, utils.FormatSize(totalSize))
+	json.NewEncoder(w).Encode(stats)
 }
 
-func uploadHandler(w http.ResponseWriter, r *http.Request) {
-	r.ParseMultipartForm(500 << 20) // 500MB
+func uploadHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if err := r.ParseMultipartForm(500 << 20); err != nil { // 500MB
+		http.Error(w, "Invalid upload", http.StatusBadRequest)
+		return
+	}
 	files := r.MultipartForm.File["file"]
 	targetDir := r.FormValue("dir")
 	if strings.Contains(targetDir, "..") {
 		targetDir = ""
 	}
-	saveDir := filepath.Join(StorageRoot, targetDir)
-	os.MkdirAll(saveDir, 0755)
+	if !can(c, targetDir, acl.Write) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
 
 	for _, header := range files {
+		name := filepath.Base(header.Filename)
+		if err := validName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
 		// Governance Check: File Size
-		if govManager != nil {
-			policy := govManager.PolicyEngine.GetPolicy()
-			if header.Size > int64(policy.MaxUploadSizeMB)*1024*1024 {
-				govManager.ReportEvent("Security", governance.LevelAction,
-					fmt.Sprintf("Blocked large upload: %s", header.Filename),
-					fmt.Sprintf("Size %d bytes exceeds policy %d MB", header.Size, policy.MaxUploadSizeMB),
-					"Upload Rejected")
-				http.Error(w, "File exceeds system policy", http.StatusForbidden)
-				return
-			}
+		if !allowUploadSize(name, header.Size) {
+			http.Error(w, "File exceeds system policy", http.StatusForbidden)
+			return
+		}
+		if err := checkQuota(c, path.Join(targetDir, name), header.Size); err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
 		}
 
-		file, _ := header.Open()
+		file, err := header.Open()
+		if err != nil {
+			http.Error(w, "Failed to read upload", http.StatusBadRequest)
+			return
+		}
+		blob, err := store.Write(file)
+		file.Close()
+		if err != nil {
+			utils.LogError("Storage", "Failed to store upload", err)
+			http.Error(w, "Failed to store upload", http.StatusInternalServerError)
+			return
+		}
 
 		// Safe filename with check
-		filename := filepath.Base(header.Filename)
-		targetPath := filepath.Join(saveDir, filename)
-		if _, err := os.Stat(targetPath); err == nil {
-			ext := filepath.Ext(filename)
-			name := strings.TrimSuffix(filename, ext)
-			filename = fmt.Sprintf("%s_%d%s", name, time.Now().Unix(), ext)
-			targetPath = filepath.Join(saveDir, filename)
+		filename, entry, err := saveUpload(targetDir, name, blob, c)
+		if err != nil {
+			utils.LogError("Storage", "Failed to store upload", err)
+			http.Error(w, "Failed to store upload: "+err.Error(), storeErrorStatus(err))
+			return
 		}
-
-		dst, _ := os.Create(targetPath)
-		written, _ := io.Copy(dst, file)
+		written := blob.Size
 
 		utils.LogSuccess("Storage", fmt.Sprintf("Uploaded: %s (%s)", filename, utils.FormatSize(written)))
 
@@ -721,7 +1010,7 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		analytics.GetManager().TrackFile(sessionID, analytics.FileActivity{
 			Action:   "upload",
 			FileName: filename,
-			Path:     targetPath,
+			Path:     entry.Path,
 			FileSize: written,
 			Status:   "success",
 		})
@@ -729,28 +1018,55 @@ func uploadHandler(w http.ResponseWriter, r *http.Request) {
 		metricsMutex.Lock()
 		uploadBytes += written
 		metricsMutex.Unlock()
-		dst.Close()
-		file.Close()
 	}
 	w.WriteHeader(200)
 }
 
-func mkdirAPIHandler(w http.ResponseWriter, r *http.Request) {
+func mkdirAPIHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	dir := r.URL.Query().Get("dir")
 	if strings.Contains(dir, "..") || dir == "" {
 		return
 	}
-	os.MkdirAll(filepath.Join(StorageRoot, dir), 0755)
+	for _, name := range strings.Split(blobstore.Clean(dir), "/") {
+		if err := validName(name); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if !can(c, dir, acl.Write) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	if err := store.Mkdir(dir); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
 	w.WriteHeader(200)
 }
 
-func deleteHandler(w http.ResponseWriter, r *http.Request) {
+func deleteHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
 	file := r.URL.Query().Get("file")
 	if strings.Contains(file, "..") {
 		return
 	}
-	os.RemoveAll(filepath.Join(StorageRoot, file))
-	utils.LogInfo("Storage", "Deleted: "+file)
+	if !canChange(c, file) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	// Deleted files wait in the trash until restored or purged
+	if _, err := store.Trash(file); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+	utils.LogInfo("Storage", "Moved to trash: "+file)
 
 	// Track in analytics
 	sessionID := "unknown"
@@ -767,20 +1083,22 @@ func deleteHandler(w http.ResponseWriter, r *http.Request) {
 	w.WriteHeader(200)
 }
 
-func downloadHandler(w http.ResponseWriter, r *http.Request) {
+func downloadHandler(w http.ResponseWriter, r *http.Request, c Caller) {
 	file := r.URL.Query().Get("file")
 	if strings.Contains(file, "..") {
 		return
 	}
-	path := filepath.Join(StorageRoot, file)
-	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(file))
-
-	f, err := os.Open(path)
+	if !can(c, file, acl.Read) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	f, _, err := store.Open(file)
 	if err != nil {
 		http.Error(w, "File not found", 404)
 		return
 	}
 	defer f.Close()
+	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(file))
 
 	// Track download size
 	n, _ := io.Copy(w, f)
@@ -802,35 +1120,3 @@ func downloadHandler(w http.ResponseWriter, r *http.Request) {
 	downloadBytes += n
 	metricsMutex.Unlock()
 }
-
-func shareAPIHandler(w http.ResponseWriter, r *http.Request) {
-	file := r.URL.Query().Get("file")
-	if file == "" {
-		return
-	}
-	hasher := md5.New()
-	hasher.Write([]byte(file + time.Now().String()))
-	token := hex.EncodeToString(hasher.Sum(nil))[:8]
-	shareMutex.Lock()
-	shareLinks[token] = file
-	shareMutex.Unlock()
-	localIP := utils.GetLocalIP()
-	cfg := config.Get()
-	link := fmt.Sprintf("http://%s:%d/s/%s", localIP, cfg.Services.Storage.Port, token)
-	w.Header().Set("Content-Type", "application/json")
-	fmt.Fprintf(w, `{"link":"%s"}`, link)
-}
-
-func handleSharedLink(w http.ResponseWriter, r *http.Request) {
-	token := strings.TrimPrefix(r.URL.Path, "/s/")
-	shareMutex.RLock()
-	file, exists := shareLinks[token]
-	shareMutex.RUnlock()
-	if !exists {
-		http.Error(w, "Link expired", 404)
-		return
-	}
-	path := filepath.Join(StorageRoot, file)
-	w.Header().Set("Content-Disposition", "attachment; filename="+filepath.Base(file))
-	http.ServeFile(w, r, path)
-}
@@ -0,0 +1,256 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/acl"
+	"github.com/MultiX0/nexa/pkg/audit"
+	"github.com/MultiX0/nexa/pkg/auth"
+	"github.com/MultiX0/nexa/pkg/sharelink"
+	"github.com/MultiX0/nexa/pkg/upload"
+)
+
+// TestMain runs the handlers against a store, users, ACLs and share links
+// in a scratch directory, since StorageRoot and the other files are
+// relative to the working directory
+func TestMain(m *testing.M) {
+	dir, err := os.MkdirTemp("", "storage-test")
+	if err != nil {
+		panic(err)
+	}
+	cwd, _ := os.Getwd()
+	os.Chdir(dir)
+	code := func() int {
+		users := `{"admin": {"password": "x", "role": "admin"}, "bob": {"password": "x", "role": "user"}}`
+		if err := os.WriteFile("users.json", []byte(users), 0600); err != nil {
+			panic(err)
+		}
+		audit.Init("audit.log")
+		if err := openStore(); err != nil {
+			panic(err)
+		}
+		if authManager, err = auth.NewAuthManager("users.json"); err != nil {
+			panic(err)
+		}
+		if acls, err = acl.Load(aclFile, defaultACL); err != nil {
+			panic(err)
+		}
+		if shares, err = sharelink.Load(shareFile); err != nil {
+			panic(err)
+		}
+		if uploads, err = upload.Open(filepath.Join(StorageRoot, "temp")); err != nil {
+			panic(err)
+		}
+		for _, sub := range []string{"public", "locked", "incoming", "shared"} {
+			store.Mkdir(sub)
+		}
+		return m.Run()
+	}()
+	os.Chdir(cwd)
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// put stores content at p as owner's file
+func put(t *testing.T, p, content, owner string) {
+	t.Helper()
+	blob, err := store.Write(strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.LinkAs(p, blob, owner); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// postUpload posts one file to the upload handler as user
+func postUpload(t *testing.T, user, dir, filename, content string) *httptest.ResponseRecorder {
+	t.Helper()
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	mw.WriteField("dir", dir)
+	fw, _ := mw.CreateFormFile("file", filename)
+	fw.Write([]byte(content))
+	mw.Close()
+
+	token, err := authManager.IssueToken(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest(http.MethodPost, "/upload", &body)
+	r.Header.Set("Content-Type", mw.FormDataContentType())
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	withAuth(uploadHandler)(w, r)
+	return w
+}
+
+func TestUploadAccess(t *testing.T) {
+	if w := postUpload(t, "bob", "locked", "a.txt", "x"); w.Code != http.StatusForbidden {
+		t.Errorf("upload to a folder without write access = %d", w.Code)
+	}
+	if w := postUpload(t, "bob", "incoming", `..\evil.txt`, "x"); w.Code != http.StatusBadRequest {
+		t.Errorf("upload with a backslash name = %d", w.Code)
+	}
+	if _, err := store.Stat("incoming/..\\evil.txt"); err == nil {
+		t.Error("backslash name was stored")
+	}
+	if w := postUpload(t, "bob", "incoming", "a.txt", "x"); w.Code != http.StatusOK {
+		t.Fatalf("upload = %d %s", w.Code, w.Body)
+	}
+
+	// Overwriting takes change rights on the file and keeps its owner
+	put(t, "shared/fixed.txt", "v1", "admin")
+	if _, err := acls.Set("shared/fixed.txt", acl.Everyone, acl.Read, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	if w := postUpload(t, "bob", "shared", "fixed.txt", "v2"); w.Code != http.StatusForbidden {
+		t.Errorf("overwrite of a read-only file = %d", w.Code)
+	}
+	put(t, "shared/notes.txt", "v1", "admin")
+	if w := postUpload(t, "bob", "shared", "notes.txt", "v2"); w.Code != http.StatusOK {
+		t.Fatalf("overwrite = %d %s", w.Code, w.Body)
+	}
+	if e, _ := store.Stat("shared/notes.txt"); e.Owner != "admin" || e.Size != 2 {
+		t.Errorf("overwritten file = %+v, want admin's", e)
+	}
+}
+
+func TestFinishUpload(t *testing.T) {
+	put(t, "shared/locked.txt", "v1", "admin")
+	if _, err := acls.Set("shared/locked.txt", acl.Everyone, acl.Read, "admin"); err != nil {
+		t.Fatal(err)
+	}
+	s, err := uploads.Create(upload.Session{Filename: "locked.txt", Dir: "shared", Size: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := uploads.Write(s.ID, 0, strings.NewReader("v2")); err != nil {
+		t.Fatal(err)
+	}
+	finish := func(c Caller) int {
+		w := httptest.NewRecorder()
+		finishUpload(w, httptest.NewRequest(http.MethodPost, "/api/uploads/"+s.ID+"/finish", nil), s, c)
+		return w.Code
+	}
+
+	// The file never reached the store, so the session is still there
+	if code := finish(Caller{User: "bob"}); code != http.StatusForbidden {
+		t.Errorf("finish over a read-only file = %d", code)
+	}
+	if _, err := uploads.Get(s.ID); err != nil {
+		t.Fatalf("session lost after a refused finish: %v", err)
+	}
+	if code := finish(Caller{User: "admin", Role: auth.RoleAdmin}); code != http.StatusOK {
+		t.Fatalf("finish = %d", code)
+	}
+	if _, err := uploads.Get(s.ID); !errors.Is(err, upload.ErrNotFound) {
+		t.Errorf("session left after finishing: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(StorageRoot, "temp", "*")); len(left) != 0 {
+		t.Errorf("leftover upload files %v", left)
+	}
+}
+
+func TestUploadQuota(t *testing.T) {
+	quotas.mu.Lock()
+	quotas.mb["bob"] = 1
+	quotas.mu.Unlock()
+	defer func() {
+		quotas.mu.Lock()
+		delete(quotas.mb, "bob")
+		quotas.mu.Unlock()
+	}()
+
+	big := strings.Repeat("x", 2<<20)
+	if w := postUpload(t, "bob", "incoming", "big.bin", big); w.Code != http.StatusInsufficientStorage {
+		t.Errorf("upload over quota = %d", w.Code)
+	}
+	if _, err := store.Stat("incoming/big.bin"); err == nil {
+		t.Error("file over quota was stored")
+	}
+}
+
+func TestShareRanges(t *testing.T) {
+	put(t, "public/report.txt", "0123456789", "admin")
+	l, err := shares.Create(sharelink.Options{Path: "public/report.txt", Owner: "admin", MaxUses: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	get := func(client, rng string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/s/"+l.Token, nil)
+		r.RemoteAddr = client + ":4000"
+		if rng != "" {
+			r.Header.Set("Range", rng)
+		}
+		w := httptest.NewRecorder()
+		handleSharedLink(w, r)
+		return w
+	}
+
+	// The first range spends the only use; the same client may fetch the rest
+	if w := get("10.0.0.1", "bytes=0-4"); w.Code != http.StatusPartialContent || w.Body.String() != "01234" {
+		t.Fatalf("first range = %d %q", w.Code, w.Body)
+	}
+	if w := get("10.0.0.1", "bytes=5-"); w.Code != http.StatusPartialContent || w.Body.String() != "56789" {
+		t.Fatalf("resumed range = %d %q", w.Code, w.Body)
+	}
+	// Starting over, in any spelling, or another client is a new download
+	for _, rng := range []string{"", "bytes=0-", "bytes=00-3", "bytes=-10", "bytes=5-,0-1"} {
+		if w := get("10.0.0.1", rng); w.Code != http.StatusGone {
+			t.Errorf("download again with Range %q = %d", rng, w.Code)
+		}
+	}
+	if w := get("10.0.0.2", "bytes=5-"); w.Code != http.StatusGone {
+		t.Errorf("range from another client = %d", w.Code)
+	}
+	if got, _ := shares.Get(l.Token); got.Uses != 1 {
+		t.Errorf("uses = %d, want 1", got.Uses)
+	}
+}
+
+func TestDropBoxNames(t *testing.T) {
+	l, err := shares.Create(sharelink.Options{Path: "incoming", Owner: "admin", DropBox: true, MaxUses: 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	drop := func(filename string) int {
+		var body bytes.Buffer
+		mw := multipart.NewWriter(&body)
+		fw, _ := mw.CreateFormFile("file", filename)
+		fw.Write([]byte("dropped"))
+		mw.Close()
+		r := httptest.NewRequest(http.MethodPost, "/s/"+l.Token, &body)
+		r.Header.Set("Content-Type", mw.FormDataContentType())
+		w := httptest.NewRecorder()
+		handleSharedLink(w, r)
+		return w.Code
+	}
+
+	for _, name := range []string{`..\..\locked\evil.txt`, `a\b.txt`, "<b>.txt"} {
+		if code := drop(name); code != http.StatusBadRequest {
+			t.Errorf("drop of %q = %d", name, code)
+		}
+	}
+	if code := drop("../locked/evil.txt"); code != http.StatusOK {
+		t.Errorf("drop of a path = %d", code)
+	}
+	if _, err := store.Stat("locked/evil.txt"); err == nil {
+		t.Error("drop box wrote outside its folder")
+	}
+	e, err := store.Stat("incoming/evil.txt")
+	if err != nil || e.Owner != "admin" {
+		t.Errorf("dropped file = %+v %v", e, err)
+	}
+	if got, _ := shares.Get(l.Token); got.Uses != 1 {
+		t.Errorf("uses = %d, want 1 for the one stored file", got.Uses)
+	}
+}
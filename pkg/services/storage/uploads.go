@@ -0,0 +1,310 @@
+package storage
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/acl"
+	"github.com/MultiX0/nexa/pkg/analytics"
+	"github.com/MultiX0/nexa/pkg/blobstore"
+	"github.com/MultiX0/nexa/pkg/governance"
+	"github.com/MultiX0/nexa/pkg/upload"
+	"github.com/MultiX0/nexa/pkg/utils"
+)
+
+// Resumable uploads: POST /api/uploads declares a file, PATCH
+// /api/uploads/{id} sends chunks at the Upload-Offset header's offset,
+// GET or HEAD reports progress, and POST /api/uploads/{id}/finish checks
+// the SHA-256 and moves the file into place.
+const (
+	uploadGCInterval = time.Hour
+	uploadMaxAge     = 24 * time.Hour // sessions untouched this long are abandoned
+)
+
+var uploads *upload.Manager
+
+// uploadStatus is a session with its progress
+type uploadStatus struct {
+	upload.Session
+	Percent float64 `json:"percent"`
+}
+
+func statusOf(s upload.Session) uploadStatus {
+	st := uploadStatus{Session: s, Percent: 100}
+	if s.Size > 0 {
+		st.Percent = float64(s.Offset) * 100 / float64(s.Size)
+	}
+	return st
+}
+
+// openUploads loads the sessions kept in storage/temp and starts sweeping
+// abandoned ones
+func openUploads() {
+	m, err := upload.Open(filepath.Join(StorageRoot, "temp"))
+	if err != nil {
+		utils.LogError("Storage", "Failed to open upload sessions, resumable uploads disabled", err)
+		return
+	}
+	uploads = m
+	go func() {
+		ticker := time.NewTicker(uploadGCInterval)
+		for range ticker.C {
+			for _, s := range uploads.GC(uploadMaxAge) {
+				utils.LogInfo("Storage", fmt.Sprintf("Removed abandoned upload of %s (%s of %s)",
+					s.Filename, utils.FormatSize(s.Offset), utils.FormatSize(s.Size)))
+			}
+		}
+	}()
+}
+
+// allowUploadSize applies the governance size policy to a file before any
+// of it is stored, reporting rejections
+func allowUploadSize(filename string, size int64) bool {
+	if govManager == nil {
+		return true
+	}
+	policy := govManager.PolicyEngine.GetPolicy()
+	if size <= int64(policy.MaxUploadSizeMB)*1024*1024 {
+		return true
+	}
+	govManager.ReportEvent("Security", governance.LevelAction,
+		fmt.Sprintf("Blocked large upload: %s", filename),
+		fmt.Sprintf("Size %d bytes exceeds policy %d MB", size, policy.MaxUploadSizeMB),
+		"Upload Rejected")
+	return false
+}
+
+func uploadErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, upload.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, upload.ErrOffset), errors.Is(err, upload.ErrBusy), errors.Is(err, upload.ErrIncomplete):
+		return http.StatusConflict
+	case errors.Is(err, upload.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, upload.ErrChecksum):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, upload.ErrFilename):
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+func writeUploadStatus(w http.ResponseWriter, code int, s upload.Session) {
+	w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(s.Size, 10))
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(statusOf(s))
+}
+
+// uploadsHandler creates a session from {"filename","dir","size"} on POST
+// and lists the caller's sessions on GET
+func uploadsHandler(w http.ResponseWriter, r *http.Request, c Caller) {
+	if uploads == nil {
+		http.Error(w, "Resumable uploads unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		list := []uploadStatus{}
+		for _, s := range uploads.List() {
+			if s.Owner == c.User || c.IsAdmin() {
+				list = append(list, statusOf(s))
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPost:
+		var req struct {
+			Filename string `json:"filename"`
+			Dir      string `json:"dir"`
+			Size     int64  `json:"size"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		req.Filename = filepath.Base(req.Filename)
+		if req.Filename == "." || req.Filename == string(filepath.Separator) || req.Size < 0 {
+			http.Error(w, "filename and a size are required", http.StatusBadRequest)
+			return
+		}
+		if err := validName(req.Filename); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(req.Dir, "..") {
+			req.Dir = ""
+		}
+		if !can(c, req.Dir, acl.Write) {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		// The declared size is checked before a byte is sent
+		if !allowUploadSize(req.Filename, req.Size) {
+			http.Error(w, "File exceeds system policy", http.StatusForbidden)
+			return
+		}
+		if err := checkQuota(c, path.Join(req.Dir, req.Filename), req.Size); err != nil {
+			http.Error(w, err.Error(), storeErrorStatus(err))
+			return
+		}
+		s, err := uploads.Create(upload.Session{Filename: req.Filename, Dir: req.Dir, Owner: c.User, Size: req.Size})
+		if err != nil {
+			utils.LogError("Storage", "Failed to create upload session", err)
+			http.Error(w, "Failed to create upload", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Location", "api/uploads/"+s.ID)
+		writeUploadStatus(w, http.StatusCreated, s)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// uploadHandlerByID serves /api/uploads/{id} and /api/uploads/{id}/finish
+// to the session's owner
+func uploadHandlerByID(w http.ResponseWriter, r *http.Request, c Caller) {
+	if uploads == nil {
+		http.Error(w, "Resumable uploads unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/uploads/"), "/")
+	// Other users' sessions look like no session at all
+	s, err := uploads.Get(id)
+	if err == nil && s.Owner != c.User && !c.IsAdmin() {
+		err = upload.ErrNotFound
+	}
+	if err != nil {
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+	switch {
+	case action == "finish" && r.Method == http.MethodPost:
+		finishUpload(w, r, s, c)
+	case action != "":
+		http.NotFound(w, r)
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		writeUploadStatus(w, http.StatusOK, s)
+	case r.Method == http.MethodPatch:
+		patchUpload(w, r, id)
+	case r.Method == http.MethodDelete:
+		if err := uploads.Cancel(id); err != nil {
+			http.Error(w, err.Error(), uploadErrorStatus(err))
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// patchUpload stores the request body at the Upload-Offset header's
+// offset. On a conflict the response carries the offset to resume from.
+func patchUpload(w http.ResponseWriter, r *http.Request, id string) {
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil {
+		http.Error(w, "Upload-Offset header is required", http.StatusBadRequest)
+		return
+	}
+	before, _ := uploads.Get(id)
+	s, err := uploads.Write(id, offset, r.Body)
+
+	if written := s.Offset - before.Offset; written > 0 {
+		metricsMutex.Lock()
+		uploadBytes += written
+		metricsMutex.Unlock()
+	}
+	if err != nil {
+		if s.ID != "" {
+			w.Header().Set("Upload-Offset", strconv.FormatInt(s.Offset, 10))
+		}
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+	writeUploadStatus(w, http.StatusOK, s)
+}
+
+// finishUpload verifies {"checksum": "sha256:<hex>"} when given and moves
+// the file to its folder, if the caller still has room for it there. The
+// session only ends once the file is in the store, so a failed move can
+// be finished again.
+func finishUpload(w http.ResponseWriter, r *http.Request, s upload.Session, c Caller) {
+	var req struct {
+		Checksum string `json:"checksum"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+	}
+	target := path.Join(s.Dir, s.Filename)
+	if !can(c, s.Dir, acl.Write) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	// saveUpload checks this too, but only once the file has left the session
+	if _, err := store.Stat(target); err == nil && versioning() && !canChange(c, target) {
+		http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+		return
+	}
+	if err := checkQuota(c, target, s.Size); err != nil {
+		http.Error(w, err.Error(), storeErrorStatus(err))
+		return
+	}
+	var (
+		filename string
+		entry    blobstore.Entry
+		storeErr error
+	)
+	sum, err := uploads.Finish(s.ID, req.Checksum, func(part string) error {
+		blob, err := store.WriteFile(part)
+		if err == nil {
+			filename, entry, err = saveUpload(s.Dir, s.Filename, blob, c)
+		}
+		storeErr = err
+		return err
+	})
+	if storeErr != nil {
+		utils.LogError("Storage", "Failed to store upload", storeErr)
+		http.Error(w, "Failed to store upload: "+storeErr.Error(), storeErrorStatus(storeErr))
+		return
+	}
+	if err != nil {
+		if errors.Is(err, upload.ErrChecksum) {
+			utils.LogWarning("Storage", fmt.Sprintf("Discarded upload of %s: %v", s.Filename, err))
+		}
+		http.Error(w, err.Error(), uploadErrorStatus(err))
+		return
+	}
+
+	utils.LogSuccess("Storage", fmt.Sprintf("Uploaded: %s (%s, resumable)", filename, utils.FormatSize(s.Size)))
+	sessionID := "unknown"
+	if cookie, err := r.Cookie("session_id"); err == nil {
+		sessionID = cookie.Value
+	}
+	analytics.GetManager().TrackFile(sessionID, analytics.FileActivity{
+		Action:   "upload",
+		FileName: filename,
+		Path:     entry.Path,
+		FileSize: s.Size,
+		Status:   "success",
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":   filename,
+		"path":   entry.Path,
+		"size":   s.Size,
+		"sha256": sum,
+	})
+}
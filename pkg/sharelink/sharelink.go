@@ -0,0 +1,320 @@
+// Package sharelink keeps share links: crypto-random tokens that let
+// anyone holding them download a file, or upload into a folder for a
+// "drop box" link, until the link expires, runs out of uses or is revoked.
+// Links may also require a password, kept as a bcrypt hash. They are
+// stored in a JSON file so they survive restarts.
+package sharelink
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/utils"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrNotFound  = errors.New("share link not found")
+	ErrExpired   = errors.New("share link expired")
+	ErrExhausted = errors.New("share link has no uses left")
+	ErrPassword  = errors.New("wrong or missing password")
+	ErrNoResume  = errors.New("no recent download to resume")
+)
+
+// Link is a share link. Downloads links name a file, drop box links a folder.
+type Link struct {
+	Token        string    `json:"token"`
+	Path         string    `json:"path"`
+	Owner        string    `json:"owner"`
+	DropBox      bool      `json:"dropbox,omitempty"` // upload-only link to a folder
+	CreatedAt    time.Time `json:"created_at"`
+	ExpiresAt    time.Time `json:"expires_at,omitempty"` // zero never expires
+	MaxUses      int       `json:"max_uses,omitempty"`   // downloads, or uploads for a drop box; 0 is unlimited
+	Uses         int       `json:"uses"`
+	PasswordHash string    `json:"password_hash,omitempty"`
+	LastUsedAt   time.Time `json:"last_used_at,omitempty"`
+}
+
+// HasPassword reports whether the link needs a password
+func (l Link) HasPassword() bool {
+	return l.PasswordHash != ""
+}
+
+// Expired reports whether the link had expired at t
+func (l Link) Expired(t time.Time) bool {
+	return !l.ExpiresAt.IsZero() && !t.Before(l.ExpiresAt)
+}
+
+// Exhausted reports whether every use has been spent
+func (l Link) Exhausted() bool {
+	return l.MaxUses > 0 && l.Uses >= l.MaxUses
+}
+
+// Options describe a new link
+type Options struct {
+	Path     string
+	Owner    string
+	DropBox  bool
+	TTL      time.Duration // 0 never expires
+	MaxUses  int
+	Password string // "" needs none
+}
+
+// Store is safe for concurrent use
+type Store struct {
+	mu       sync.Mutex
+	links    map[string]*Link
+	filename string
+	started  map[string]time.Time // last use spent by UseBy, by token and client
+}
+
+// Load reads the links kept in filename. A missing file is an empty store.
+func Load(filename string) (*Store, error) {
+	s := &Store{links: make(map[string]*Link), filename: filename, started: make(map[string]time.Time)}
+	data, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return s, err
+	}
+	var links []*Link
+	if err := json.Unmarshal(data, &links); err != nil {
+		return s, fmt.Errorf("failed to parse %s: %v", filename, err)
+	}
+	for _, l := range links {
+		s.links[l.Token] = l
+	}
+	return s, nil
+}
+
+// Create makes a link with a fresh token
+func (s *Store) Create(o Options) (Link, error) {
+	if o.MaxUses < 0 || o.TTL < 0 {
+		return Link{}, fmt.Errorf("expiry and uses cannot be negative")
+	}
+	token, err := newToken()
+	if err != nil {
+		return Link{}, err
+	}
+	l := &Link{
+		Token:     token,
+		Path:      o.Path,
+		Owner:     o.Owner,
+		DropBox:   o.DropBox,
+		CreatedAt: time.Now(),
+		MaxUses:   o.MaxUses,
+	}
+	if o.TTL > 0 {
+		l.ExpiresAt = l.CreatedAt.Add(o.TTL)
+	}
+	if o.Password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(o.Password), bcrypt.DefaultCost)
+		if err != nil {
+			return Link{}, err
+		}
+		l.PasswordHash = string(hash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.links[token] = l
+	if err := s.save(); err != nil {
+		delete(s.links, token)
+		return Link{}, err
+	}
+	return *l, nil
+}
+
+// Get returns the link for token, usable or not
+func (s *Store) Get(token string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[token]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	return *l, nil
+}
+
+// Check returns the link for token if it can be used with password now
+func (s *Store) Check(token, password string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, err := s.check(token, password)
+	if err != nil {
+		return Link{}, err
+	}
+	return *l, nil
+}
+
+// Use is Check spending one use of the link. The use is spent before the
+// caller serves it, so a link with one use left serves one request even
+// when two arrive together.
+func (s *Store) Use(token, password string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.use(token, password, "")
+}
+
+// UseBy is Use on behalf of client, e.g. an IP address, which lets the
+// client Resume the download the use was spent on
+func (s *Store) UseBy(token, password, client string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.use(token, password, client)
+}
+
+// Resume is Check for the later requests of a download, such as its
+// remaining ranges. It only succeeds for a client that UseBy spent a use
+// for at most window ago, and then even if no uses are left since.
+func (s *Store) Resume(token, password, client string, window time.Duration) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[token]
+	at, started := s.started[startKey(token, client)]
+	switch {
+	case !ok:
+		return Link{}, ErrNotFound
+	case l.Expired(time.Now()):
+		return Link{}, ErrExpired
+	case !started || time.Since(at) > window:
+		return Link{}, ErrNoResume
+	case !l.passwordOK(password):
+		return Link{}, ErrPassword
+	}
+	return *l, nil
+}
+
+// use spends a use of the link, recording client if not empty. Caller holds s.mu.
+func (s *Store) use(token, password, client string) (Link, error) {
+	l, err := s.check(token, password)
+	if err != nil {
+		return Link{}, err
+	}
+	prev, prevAt := l.Uses, l.LastUsedAt
+	l.Uses++
+	l.LastUsedAt = time.Now()
+	if err := s.save(); err != nil {
+		l.Uses, l.LastUsedAt = prev, prevAt
+		return Link{}, err
+	}
+	if client != "" {
+		s.started[startKey(token, client)] = l.LastUsedAt
+	}
+	return *l, nil
+}
+
+func startKey(token, client string) string {
+	return token + " " + client
+}
+
+// check finds a usable link. Caller holds s.mu.
+func (s *Store) check(token, password string) (*Link, error) {
+	l, ok := s.links[token]
+	switch {
+	case !ok:
+		return nil, ErrNotFound
+	case l.Expired(time.Now()):
+		return nil, ErrExpired
+	case l.Exhausted():
+		return nil, ErrExhausted
+	case !l.passwordOK(password):
+		return nil, ErrPassword
+	}
+	return l, nil
+}
+
+func (l *Link) passwordOK(password string) bool {
+	return !l.HasPassword() || bcrypt.CompareHashAndPassword([]byte(l.PasswordHash), []byte(password)) == nil
+}
+
+// List returns owner's links, or every link for an empty owner, newest first
+func (s *Store) List(owner string) []Link {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := []Link{}
+	for _, l := range s.links {
+		if owner == "" || l.Owner == owner {
+			out = append(out, *l)
+		}
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.After(out[j].CreatedAt) })
+	return out
+}
+
+// Revoke deletes the link for token and returns it
+func (s *Store) Revoke(token string) (Link, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	l, ok := s.links[token]
+	if !ok {
+		return Link{}, ErrNotFound
+	}
+	delete(s.links, token)
+	if err := s.save(); err != nil {
+		s.links[token] = l
+		return Link{}, err
+	}
+	return *l, nil
+}
+
+// Prune deletes links that expired more than grace ago, keeping recently
+// expired ones visible to their owners, and returns them
+func (s *Store) Prune(grace time.Duration) ([]Link, error) {
+	cutoff := time.Now().Add(-grace)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dropped []Link
+	for token, l := range s.links {
+		if l.Expired(cutoff) {
+			dropped = append(dropped, *l)
+			delete(s.links, token)
+		}
+	}
+	for key, at := range s.started {
+		if at.Before(cutoff) {
+			delete(s.started, key)
+		}
+	}
+	if len(dropped) == 0 {
+		return nil, nil
+	}
+	if err := s.save(); err != nil {
+		for i := range dropped {
+			l := dropped[i]
+			s.links[l.Token] = &l
+		}
+		return nil, err
+	}
+	return dropped, nil
+}
+
+// save writes the links. Caller holds s.mu.
+func (s *Store) save() error {
+	links := make([]*Link, 0, len(s.links))
+	for _, l := range s.links {
+		links = append(links, l)
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].CreatedAt.Before(links[j].CreatedAt) })
+	data, err := json.MarshalIndent(links, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(s.filename, data, 0600)
+}
+
+func newToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,104 @@
+package sharelink_test
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/sharelink"
+)
+
+func TestUse(t *testing.T) {
+	s, err := sharelink.Load(filepath.Join(t.TempDir(), "shares.json"))
+	if err != nil {
+		t.Fatalf("Load failed: %v", err)
+	}
+	l, err := s.Create(sharelink.Options{Path: "shared/a.txt", Owner: "bob", MaxUses: 2, Password: "secret"})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+	if len(l.Token) != 32 || !l.ExpiresAt.IsZero() || !l.HasPassword() {
+		t.Fatalf("Create = %+v", l)
+	}
+	other, _ := s.Create(sharelink.Options{Path: "shared/a.txt", Owner: "bob"})
+	if other.Token == l.Token {
+		t.Fatal("two links got the same token")
+	}
+
+	if _, err := s.Use(l.Token, "wrong"); !errors.Is(err, sharelink.ErrPassword) {
+		t.Errorf("Use with a wrong password = %v", err)
+	}
+	if _, err := s.Use(l.Token, "secret"); err != nil {
+		t.Fatalf("first use failed: %v", err)
+	}
+	if _, err := s.Resume(l.Token, "secret", "10.0.0.1", time.Hour); !errors.Is(err, sharelink.ErrNoResume) {
+		t.Errorf("Resume without a download = %v", err)
+	}
+	if _, err := s.UseBy(l.Token, "secret", "10.0.0.1"); err != nil {
+		t.Fatalf("second use failed: %v", err)
+	}
+	if _, err := s.Use(l.Token, "secret"); !errors.Is(err, sharelink.ErrExhausted) {
+		t.Errorf("third use = %v", err)
+	}
+	// The client of the last download may still fetch its remaining
+	// ranges for a while, nobody else
+	if _, err := s.Resume(l.Token, "secret", "10.0.0.1", time.Hour); err != nil {
+		t.Errorf("Resume right after the last use = %v", err)
+	}
+	if _, err := s.Resume(l.Token, "wrong", "10.0.0.1", time.Hour); !errors.Is(err, sharelink.ErrPassword) {
+		t.Errorf("Resume with a wrong password = %v", err)
+	}
+	if _, err := s.Resume(l.Token, "secret", "10.0.0.2", time.Hour); !errors.Is(err, sharelink.ErrNoResume) {
+		t.Errorf("Resume by another client = %v", err)
+	}
+	time.Sleep(5 * time.Millisecond)
+	if _, err := s.Resume(l.Token, "secret", "10.0.0.1", time.Millisecond); !errors.Is(err, sharelink.ErrNoResume) {
+		t.Errorf("Resume after the window = %v", err)
+	}
+	if _, err := s.Use("0123456789abcdef0123456789abcdef", ""); !errors.Is(err, sharelink.ErrNotFound) {
+		t.Errorf("Use of an unknown token = %v", err)
+	}
+
+	if _, err := s.Revoke(other.Token); err != nil {
+		t.Fatalf("Revoke failed: %v", err)
+	}
+	if _, err := s.Check(other.Token, ""); !errors.Is(err, sharelink.ErrNotFound) {
+		t.Errorf("Check after revoke = %v", err)
+	}
+}
+
+func TestExpiry(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "shares.json")
+	s, _ := sharelink.Load(file)
+	short, _ := s.Create(sharelink.Options{Path: "incoming", Owner: "alice", DropBox: true, TTL: time.Millisecond})
+	long, _ := s.Create(sharelink.Options{Path: "public/b.txt", Owner: "carol", TTL: time.Hour})
+	time.Sleep(5 * time.Millisecond)
+
+	if _, err := s.Use(short.Token, ""); !errors.Is(err, sharelink.ErrExpired) {
+		t.Errorf("Use of an expired link = %v", err)
+	}
+
+	// Links and their use counts survive a restart
+	s.Use(long.Token, "")
+	s, err := sharelink.Load(file)
+	if err != nil {
+		t.Fatalf("reload failed: %v", err)
+	}
+	if l, _ := s.Get(long.Token); l.Uses != 1 {
+		t.Fatalf("Uses after reload = %d, want 1", l.Uses)
+	}
+	if l, _ := s.Get(short.Token); !l.DropBox {
+		t.Fatal("drop box flag lost across reload")
+	}
+	if got := s.List("alice"); len(got) != 1 || got[0].Token != short.Token {
+		t.Fatalf("List(alice) = %+v", got)
+	}
+
+	if dropped, _ := s.Prune(time.Hour); len(dropped) != 0 {
+		t.Fatal("Prune dropped a link inside the grace period")
+	}
+	if dropped, _ := s.Prune(0); len(dropped) != 1 || len(s.List("")) != 1 {
+		t.Fatalf("Prune(0) = %+v", dropped)
+	}
+}
@@ -0,0 +1,354 @@
+// Package upload keeps resumable upload sessions: a file declared up front
+// with its total size and written in chunks at explicit offsets, so a
+// client that loses its connection asks for the offset and carries on.
+//
+// Each session is a <id>.part file with a <id>.json sidecar in one
+// directory. The offset is the size of the part file, so sessions survive
+// restarts without rewriting metadata on every chunk.
+package upload
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound   = errors.New("upload not found")
+	ErrOffset     = errors.New("offset does not match the upload")
+	ErrTooLarge   = errors.New("data runs past the declared size")
+	ErrBusy       = errors.New("upload is being written by another request")
+	ErrIncomplete = errors.New("upload is incomplete")
+	ErrChecksum   = errors.New("checksum mismatch")
+	ErrFilename   = errors.New("filename must be a single path element")
+)
+
+const (
+	partExt = ".part"
+	metaExt = ".json"
+)
+
+// Session is an upload in progress
+type Session struct {
+	ID        string    `json:"id"`
+	Filename  string    `json:"filename"`
+	Dir       string    `json:"dir,omitempty"`   // destination folder, for the caller
+	Owner     string    `json:"owner,omitempty"` // for the caller
+	Size      int64     `json:"size"`
+	Offset    int64     `json:"offset"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// Done reports whether every byte has arrived
+func (s Session) Done() bool {
+	return s.Offset == s.Size
+}
+
+type entry struct {
+	Session
+	busy bool
+}
+
+// Manager is safe for concurrent use
+type Manager struct {
+	mu       sync.Mutex
+	dir      string
+	sessions map[string]*entry
+}
+
+// Open loads the sessions kept in dir, creating it if needed
+func Open(dir string) (*Manager, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload dir: %v", err)
+	}
+	m := &Manager{dir: dir, sessions: make(map[string]*entry)}
+	metas, err := filepath.Glob(filepath.Join(dir, "*"+metaExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, meta := range metas {
+		data, err := os.ReadFile(meta)
+		if err != nil {
+			continue
+		}
+		var s Session
+		if json.Unmarshal(data, &s) != nil || !validID(s.ID) {
+			continue
+		}
+		info, err := os.Stat(m.part(s.ID))
+		if err != nil {
+			continue // swept by GC
+		}
+		s.Offset, s.UpdatedAt = info.Size(), info.ModTime()
+		if s.Offset > s.Size {
+			continue
+		}
+		m.sessions[s.ID] = &entry{Session: s}
+	}
+	return m, nil
+}
+
+func (m *Manager) part(id string) string { return filepath.Join(m.dir, id+partExt) }
+func (m *Manager) meta(id string) string { return filepath.Join(m.dir, id+metaExt) }
+
+// Create starts a session for size bytes
+func (m *Manager) Create(s Session) (Session, error) {
+	if s.Size < 0 {
+		return Session{}, fmt.Errorf("size cannot be negative")
+	}
+	if s.Filename == "" || strings.Contains(s.Filename, "..") || strings.ContainsAny(s.Filename, "/\\\x00") {
+		return Session{}, fmt.Errorf("%q: %w", s.Filename, ErrFilename)
+	}
+	id, err := newID()
+	if err != nil {
+		return Session{}, err
+	}
+	now := time.Now()
+	s.ID, s.Offset, s.CreatedAt, s.UpdatedAt = id, 0, now, now
+
+	f, err := os.OpenFile(m.part(id), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return Session{}, err
+	}
+	f.Close()
+	data, _ := json.MarshalIndent(s, "", "  ")
+	if err := os.WriteFile(m.meta(id), data, 0644); err != nil {
+		os.Remove(m.part(id))
+		return Session{}, err
+	}
+
+	m.mu.Lock()
+	m.sessions[id] = &entry{Session: s}
+	m.mu.Unlock()
+	return s, nil
+}
+
+// Get returns a session's progress
+func (m *Manager) Get(id string) (Session, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.sessions[id]
+	if !ok {
+		return Session{}, ErrNotFound
+	}
+	return e.Session, nil
+}
+
+// List returns the sessions, oldest first
+func (m *Manager) List() []Session {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	out := make([]Session, 0, len(m.sessions))
+	for _, e := range m.sessions {
+		out = append(out, e.Session)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].CreatedAt.Before(out[j].CreatedAt) })
+	return out
+}
+
+// acquire marks a session busy so only one request writes it at a time
+func (m *Manager) acquire(id string) (*entry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.sessions[id]
+	switch {
+	case !ok:
+		return nil, ErrNotFound
+	case e.busy:
+		return nil, ErrBusy
+	}
+	e.busy = true
+	return e, nil
+}
+
+func (m *Manager) release(e *entry) {
+	m.mu.Lock()
+	e.busy = false
+	m.mu.Unlock()
+}
+
+// Write appends the chunk in r at offset, which must be the session's
+// current offset. Bytes received before a read error are kept, so the
+// client resumes from the returned offset.
+func (m *Manager) Write(id string, offset int64, r io.Reader) (Session, error) {
+	e, err := m.acquire(id)
+	if err != nil {
+		return Session{}, err
+	}
+	defer m.release(e)
+	if offset != e.Offset {
+		return e.Session, fmt.Errorf("%w: at %d, not %d", ErrOffset, e.Offset, offset)
+	}
+
+	f, err := os.OpenFile(m.part(id), os.O_WRONLY, 0644)
+	if err != nil {
+		return e.Session, err
+	}
+	// A crash may have left bytes past the offset we handed out
+	if err := f.Truncate(offset); err != nil {
+		f.Close()
+		return e.Session, err
+	}
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		f.Close()
+		return e.Session, err
+	}
+	remaining := e.Size - offset
+	n, copyErr := io.Copy(f, io.LimitReader(r, remaining))
+	if err := f.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+
+	m.mu.Lock()
+	e.Offset += n
+	e.UpdatedAt = time.Now()
+	s := e.Session
+	m.mu.Unlock()
+
+	if copyErr != nil {
+		return s, copyErr
+	}
+	if n == remaining {
+		// Anything left in r does not fit the declared size
+		var probe [1]byte
+		if k, _ := r.Read(probe[:]); k > 0 {
+			return s, ErrTooLarge
+		}
+	}
+	return s, nil
+}
+
+// Finish checks a complete upload against checksum, the hex SHA-256 of the
+// file with an optional "sha256:" prefix, and hands the path of its data
+// to keep, which moves or copies it where it belongs. An empty checksum
+// skips the comparison. A mismatch discards the upload, since no amount of
+// resuming can repair it. The session ends once keep succeeds; if keep
+// fails and leaves the data in place, the session stays to be finished
+// again. Finish returns the file's SHA-256.
+func (m *Manager) Finish(id, checksum string, keep func(path string) error) (string, error) {
+	e, err := m.acquire(id)
+	if err != nil {
+		return "", err
+	}
+	defer m.release(e)
+	if !e.Done() {
+		return "", fmt.Errorf("%w: %d of %d bytes", ErrIncomplete, e.Offset, e.Size)
+	}
+
+	sum, err := fileSHA256(m.part(id))
+	if err != nil {
+		return "", err
+	}
+	want := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(checksum), "sha256:"))
+	if want != "" && want != sum {
+		m.remove(id)
+		return sum, fmt.Errorf("%w: got sha256:%s", ErrChecksum, sum)
+	}
+	if err := keep(m.part(id)); err != nil {
+		if _, serr := os.Stat(m.part(id)); os.IsNotExist(serr) {
+			m.remove(id)
+		}
+		return sum, err
+	}
+	m.remove(id)
+	return sum, nil
+}
+
+// Cancel discards a session and its data
+func (m *Manager) Cancel(id string) error {
+	e, err := m.acquire(id)
+	if err != nil {
+		return err
+	}
+	defer m.release(e)
+	m.remove(id)
+	return nil
+}
+
+func (m *Manager) remove(id string) {
+	os.Remove(m.part(id))
+	os.Remove(m.meta(id))
+	m.mu.Lock()
+	delete(m.sessions, id)
+	m.mu.Unlock()
+}
+
+// GC removes sessions untouched for maxAge, and part or sidecar files no
+// session owns, and returns the sessions it removed
+func (m *Manager) GC(maxAge time.Duration) []Session {
+	cutoff := time.Now().Add(-maxAge)
+	var stale []Session
+	m.mu.Lock()
+	for id, e := range m.sessions {
+		if !e.busy && e.UpdatedAt.Before(cutoff) {
+			stale = append(stale, e.Session)
+			delete(m.sessions, id)
+		}
+	}
+	known := make(map[string]bool, len(m.sessions))
+	for id := range m.sessions {
+		known[id] = true
+	}
+	m.mu.Unlock()
+
+	for _, s := range stale {
+		os.Remove(m.part(s.ID))
+		os.Remove(m.meta(s.ID))
+	}
+	// Leftovers of sessions that failed half way, once they are old enough
+	// not to be a Create in progress
+	files, _ := os.ReadDir(m.dir)
+	for _, f := range files {
+		ext := filepath.Ext(f.Name())
+		id := strings.TrimSuffix(f.Name(), ext)
+		if (ext != partExt && ext != metaExt) || !validID(id) || known[id] {
+			continue
+		}
+		if info, err := f.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(m.dir, f.Name()))
+		}
+	}
+	return stale
+}
+
+func fileSHA256(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func newID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validID reports whether id could have come from newID, which keeps
+// client-supplied IDs from naming other files
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
@@ -0,0 +1,166 @@
+package upload_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MultiX0/nexa/pkg/upload"
+)
+
+// dropAfter fails like a connection lost after n bytes
+type dropAfter struct {
+	r io.Reader
+	n int
+}
+
+func (d *dropAfter) Read(p []byte) (int, error) {
+	if d.n <= 0 {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if len(p) > d.n {
+		p = p[:d.n]
+	}
+	k, err := d.r.Read(p)
+	d.n -= k
+	return k, err
+}
+
+// moveTo keeps a finished upload by moving it to target
+func moveTo(target string) func(string) error {
+	return func(p string) error {
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Rename(p, target)
+	}
+}
+
+func TestResume(t *testing.T) {
+	dir := t.TempDir()
+	data := bytes.Repeat([]byte("0123456789"), 1000)
+	sum := sha256.Sum256(data)
+
+	m, err := upload.Open(dir)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	s, err := m.Create(upload.Session{Filename: "video.mp4", Size: int64(len(data))})
+	if err != nil {
+		t.Fatalf("Create failed: %v", err)
+	}
+
+	s, err = m.Write(s.ID, 0, &dropAfter{r: bytes.NewReader(data), n: 4321})
+	if err == nil || s.Offset != 4321 {
+		t.Fatalf("interrupted Write = offset %d, %v", s.Offset, err)
+	}
+	if _, err := m.Write(s.ID, 0, bytes.NewReader(data)); !errors.Is(err, upload.ErrOffset) {
+		t.Fatalf("Write at a stale offset = %v", err)
+	}
+	if _, err := m.Finish(s.ID, "", moveTo(filepath.Join(dir, "out"))); !errors.Is(err, upload.ErrIncomplete) {
+		t.Fatalf("Finish of a partial upload = %v", err)
+	}
+
+	// A restart picks the session up at the same offset
+	m, err = upload.Open(dir)
+	if err != nil {
+		t.Fatalf("reopen failed: %v", err)
+	}
+	if got, err := m.Get(s.ID); err != nil || got.Offset != 4321 || got.Filename != "video.mp4" {
+		t.Fatalf("Get after reopen = %+v, %v", got, err)
+	}
+	s, err = m.Write(s.ID, 4321, bytes.NewReader(data[4321:]))
+	if err != nil || !s.Done() {
+		t.Fatalf("resumed Write = %+v, %v", s, err)
+	}
+
+	// A failure to keep the file leaves the session to be finished again
+	failed := errors.New("disk full")
+	if _, err := m.Finish(s.ID, "", func(string) error { return failed }); !errors.Is(err, failed) {
+		t.Fatalf("Finish with a failing keep = %v", err)
+	}
+	if got, err := m.Get(s.ID); err != nil || !got.Done() {
+		t.Fatalf("Get after a failed Finish = %+v, %v", got, err)
+	}
+
+	target := filepath.Join(dir, "files", "video.mp4")
+	got, err := m.Finish(s.ID, "sha256:"+strings.ToUpper(hex.EncodeToString(sum[:])), moveTo(target))
+	if err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Fatalf("Finish = %q, %v", got, err)
+	}
+	if written, _ := os.ReadFile(target); !bytes.Equal(written, data) {
+		t.Fatal("finished file differs from the upload")
+	}
+	if _, err := m.Get(s.ID); !errors.Is(err, upload.ErrNotFound) {
+		t.Fatalf("session still present after Finish: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, "*.*")); len(left) != 0 {
+		t.Fatalf("leftover files %v", left)
+	}
+}
+
+func TestRejects(t *testing.T) {
+	dir := t.TempDir()
+	m, _ := upload.Open(dir)
+	s, _ := m.Create(upload.Session{Filename: "a.txt", Size: 5})
+
+	if s, err := m.Write(s.ID, 0, strings.NewReader("hello world")); !errors.Is(err, upload.ErrTooLarge) || s.Offset != 5 {
+		t.Fatalf("oversized Write = %+v, %v", s, err)
+	}
+	if _, err := m.Finish(s.ID, "00ff", moveTo(filepath.Join(dir, "a.txt"))); !errors.Is(err, upload.ErrChecksum) {
+		t.Fatalf("Finish with a wrong checksum = %v", err)
+	}
+	if _, err := m.Get(s.ID); !errors.Is(err, upload.ErrNotFound) {
+		t.Fatal("a failed checksum should discard the upload")
+	}
+	if _, err := m.Write("../../etc/passwd", 0, strings.NewReader("x")); !errors.Is(err, upload.ErrNotFound) {
+		t.Fatalf("Write to an unknown session = %v", err)
+	}
+	for _, name := range []string{"", "..", "a/b.txt", `..\..\home\admin\x.html`, "a\x00.txt"} {
+		if _, err := m.Create(upload.Session{Filename: name, Size: 1}); !errors.Is(err, upload.ErrFilename) {
+			t.Errorf("Create(%q) = %v", name, err)
+		}
+	}
+}
+
+func TestGC(t *testing.T) {
+	dir := t.TempDir()
+	m, _ := upload.Open(dir)
+	old, _ := m.Create(upload.Session{Filename: "old", Size: 10})
+	fresh, _ := m.Create(upload.Session{Filename: "fresh", Size: 10})
+	m.Write(fresh.ID, 0, strings.NewReader("abc"))
+
+	past := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(filepath.Join(dir, old.ID+".part"), past, past)
+	orphan := filepath.Join(dir, strings.Repeat("ab", 16)+".part")
+	os.WriteFile(orphan, []byte("x"), 0644)
+	os.Chtimes(orphan, past, past)
+	other := filepath.Join(dir, "notes.txt")
+	os.WriteFile(other, []byte("x"), 0644)
+	os.Chtimes(other, past, past)
+
+	// Reopening takes the age from the part file
+	m, _ = upload.Open(dir)
+	removed := m.GC(time.Hour)
+	if len(removed) != 1 || removed[0].ID != old.ID {
+		t.Fatalf("GC removed %+v", removed)
+	}
+	if _, err := m.Get(fresh.ID); err != nil {
+		t.Fatalf("GC removed the fresh session: %v", err)
+	}
+	for _, f := range []string{old.ID + ".part", old.ID + ".json", filepath.Base(orphan)} {
+		if _, err := os.Stat(filepath.Join(dir, f)); !os.IsNotExist(err) {
+			t.Errorf("%s survived GC", f)
+		}
+	}
+	if _, err := os.Stat(other); err != nil {
+		t.Error("GC removed a file it does not own")
+	}
+}
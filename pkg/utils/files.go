@@ -51,3 +51,31 @@ func FindCertFiles() (string, string) {
 	}
 	return "certs/cert.pem", "certs/key.pem"
 }
+
+// WriteFileAtomic writes data to a temporary file next to filename and
+// renames it into place, so readers and crashes see either the old or the
+// new contents, never a partial write
+func WriteFileAtomic(filename string, data []byte, perm os.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".tmp*")
+	if err != nil {
+		return err
+	}
+	name := tmp.Name()
+	defer os.Remove(name) // no-op once renamed
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(name, perm); err != nil {
+		return err
+	}
+	return os.Rename(name, filename)
+}
@@ -0,0 +1,380 @@
+// Package zonefile reads and writes BIND-style master files (RFC 1035 §5)
+// for the record types the DNS registry holds.
+//
+// Registry details with no place in the format travel in a trailing
+// comment of key=value pairs, e.g. "; port=8081 service=storage view=lan".
+// Record TTLs are written for other tools but ignored on import, since the
+// registry picks its own answer TTL; leases use the lease= key instead.
+package zonefile
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/MultiX0/nexa/pkg/nexa"
+)
+
+// DefaultTTL is the TTL written for every record, the registry's answer TTL
+const DefaultTTL = 60
+
+// Error is a syntax error on one line of a zone file
+type Error struct {
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+}
+
+// line is one logical entry: its tokens, the comment text, and whether the
+// owner was left out
+type line struct {
+	num        int
+	tokens     []string
+	comment    string
+	continuing bool // started with blank space, the owner is the previous one
+}
+
+// Parse reads the records of a zone. Relative names are completed with
+// origin until a $ORIGIN directive changes it. SOA and NS records are
+// skipped: the registry answers for its zones itself.
+func Parse(r io.Reader, origin string) ([]*nexa.DNSRecord, error) {
+	origin = canonical(origin)
+	lines, err := readLines(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*nexa.DNSRecord
+	owner := ""
+	for _, l := range lines {
+		fail := func(format string, args ...interface{}) error {
+			return &Error{Line: l.num, Msg: fmt.Sprintf(format, args...)}
+		}
+		toks := l.tokens
+
+		if !l.continuing && strings.HasPrefix(toks[0], "$") {
+			switch strings.ToUpper(toks[0]) {
+			case "$ORIGIN":
+				if len(toks) != 2 {
+					return nil, fail("$ORIGIN needs one name")
+				}
+				origin = absolute(toks[1], origin)
+			case "$TTL":
+				if len(toks) != 2 || !isTTL(toks[1]) {
+					return nil, fail("$TTL needs one TTL")
+				}
+			default:
+				return nil, fail("unsupported directive %s", toks[0])
+			}
+			continue
+		}
+
+		if !l.continuing {
+			owner = absolute(toks[0], origin)
+			toks = toks[1:]
+		} else if owner == "" {
+			return nil, fail("record without an owner name")
+		}
+
+		// [ttl] [class] or [class] [ttl] before the type
+		for i := 0; i < 2 && len(toks) > 0; i++ {
+			if isTTL(toks[0]) || strings.EqualFold(toks[0], "IN") {
+				toks = toks[1:]
+			}
+		}
+		if len(toks) == 0 {
+			return nil, fail("missing record type")
+		}
+		typ, args := strings.ToUpper(toks[0]), toks[1:]
+
+		rec := &nexa.DNSRecord{Name: owner, Type: typ}
+		need := func(n int) error {
+			if len(args) != n {
+				return fail("%s needs %d field(s), got %d", typ, n, len(args))
+			}
+			return nil
+		}
+		switch typ {
+		case "SOA", "NS":
+			continue
+		case nexa.DNS_TYPE_A, nexa.DNS_TYPE_AAAA:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			rec.IP = args[0]
+		case nexa.DNS_TYPE_CNAME, nexa.DNS_TYPE_PTR:
+			if err := need(1); err != nil {
+				return nil, err
+			}
+			rec.Target = absolute(args[0], origin)
+		case nexa.DNS_TYPE_SRV:
+			if err := need(4); err != nil {
+				return nil, err
+			}
+			nums := make([]int, 3)
+			for i := range nums {
+				n, err := strconv.Atoi(args[i])
+				if err != nil || n < 0 || n > 65535 {
+					return nil, fail("invalid SRV number %q", args[i])
+				}
+				nums[i] = n
+			}
+			rec.Priority, rec.Weight, rec.Port = nums[0], nums[1], nums[2]
+			rec.Target = absolute(args[3], origin)
+		case nexa.DNS_TYPE_TXT:
+			if len(args) == 0 {
+				return nil, fail("TXT needs at least one string")
+			}
+			rec.Text = args
+		default:
+			return nil, fail("unsupported record type %s", toks[0])
+		}
+		if err := applyMeta(rec, l.comment); err != nil {
+			return nil, fail("%v", err)
+		}
+		out = append(out, rec)
+	}
+	return out, nil
+}
+
+// readLines splits the input into logical lines, joining parenthesised
+// continuations and keeping quoted strings whole
+func readLines(r io.Reader) ([]line, error) {
+	var out []line
+	var cur *line
+	depth := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	num := 0
+	for sc.Scan() {
+		num++
+		text := sc.Text()
+		if cur == nil {
+			cur = &line{num: num, continuing: len(text) > 0 && (text[0] == ' ' || text[0] == '\t')}
+		}
+
+		var tok strings.Builder
+		inTok, inQuote := false, false
+		flush := func(quoted bool) {
+			if inTok || quoted {
+				cur.tokens = append(cur.tokens, tok.String())
+			}
+			tok.Reset()
+			inTok = false
+		}
+		for i := 0; i < len(text); i++ {
+			c := text[i]
+			switch {
+			case inQuote && c == '\\' && i+1 < len(text):
+				i++
+				tok.WriteByte(text[i])
+			case inQuote && c == '"':
+				inQuote = false
+				flush(true)
+			case inQuote:
+				tok.WriteByte(c)
+			case c == '"':
+				flush(false)
+				inQuote = true
+			case c == ';':
+				flush(false)
+				cur.comment += " " + text[i+1:]
+				i = len(text)
+			case c == '(':
+				flush(false)
+				depth++
+			case c == ')':
+				flush(false)
+				if depth == 0 {
+					return nil, &Error{Line: num, Msg: "unbalanced )"}
+				}
+				depth--
+			case c == ' ' || c == '\t':
+				flush(false)
+			default:
+				tok.WriteByte(c)
+				inTok = true
+			}
+		}
+		if inQuote {
+			return nil, &Error{Line: num, Msg: "unterminated string"}
+		}
+		flush(false)
+
+		if depth > 0 {
+			continue
+		}
+		if len(cur.tokens) > 0 {
+			out = append(out, *cur)
+		}
+		cur = nil
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if depth > 0 {
+		return nil, &Error{Line: cur.num, Msg: "unbalanced ("}
+	}
+	return out, nil
+}
+
+// applyMeta reads the key=value pairs of a record's comment. Other words
+// are left alone, so ordinary comments do no harm.
+func applyMeta(rec *nexa.DNSRecord, comment string) error {
+	for _, f := range strings.Fields(comment) {
+		key, value, ok := strings.Cut(f, "=")
+		if !ok {
+			continue
+		}
+		var err error
+		switch strings.ToLower(key) {
+		case "port":
+			if rec.Type == nexa.DNS_TYPE_A || rec.Type == nexa.DNS_TYPE_AAAA {
+				rec.Port, err = strconv.Atoi(value)
+			}
+		case "service":
+			rec.Service = value
+		case "view":
+			rec.View = value
+		case "device":
+			rec.DeviceID = value
+		case "lease":
+			rec.TTL, err = strconv.Atoi(value)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid %s %q", key, value)
+		}
+	}
+	return nil
+}
+
+// Write writes recs as a zone for origin, with the registry metadata in
+// trailing comments. Records outside origin are written with absolute names.
+func Write(w io.Writer, origin string, recs []nexa.DNSRecord) error {
+	origin = canonical(origin)
+	sorted := append([]nexa.DNSRecord(nil), recs...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		return sorted[i].RecordType() < sorted[j].RecordType()
+	})
+
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s.\n$TTL %d\n", origin, DefaultTTL)
+	fmt.Fprintf(bw, "@\tIN\tSOA\tns.%s. hostmaster.%s. 1 3600 600 86400 %d\n", origin, origin, DefaultTTL)
+	for _, rec := range sorted {
+		var data string
+		typ := rec.RecordType()
+		switch typ {
+		case nexa.DNS_TYPE_A, nexa.DNS_TYPE_AAAA:
+			data = rec.IP
+		case nexa.DNS_TYPE_CNAME, nexa.DNS_TYPE_PTR:
+			data = fqdn(rec.Target)
+		case nexa.DNS_TYPE_SRV:
+			data = fmt.Sprintf("%d %d %d %s", rec.Priority, rec.Weight, rec.Port, fqdn(rec.Target))
+		case nexa.DNS_TYPE_TXT:
+			quoted := make([]string, len(rec.Text))
+			for i, t := range rec.Text {
+				quoted[i] = strconv.Quote(t)
+			}
+			data = strings.Join(quoted, " ")
+		default:
+			continue
+		}
+		fmt.Fprintf(bw, "%s\t%d\tIN\t%s\t%s%s\n", relative(rec.Name, origin), DefaultTTL, typ, data, meta(rec))
+	}
+	return bw.Flush()
+}
+
+// meta is the trailing comment for a record's registry details
+func meta(rec nexa.DNSRecord) string {
+	var kv []string
+	t := rec.RecordType()
+	if rec.Port > 0 && (t == nexa.DNS_TYPE_A || t == nexa.DNS_TYPE_AAAA) {
+		kv = append(kv, "port="+strconv.Itoa(rec.Port))
+	}
+	if rec.Service != "" {
+		kv = append(kv, "service="+rec.Service)
+	}
+	if rec.View != "" {
+		kv = append(kv, "view="+rec.View)
+	}
+	if rec.DeviceID != "" {
+		kv = append(kv, "device="+rec.DeviceID)
+	}
+	if rec.TTL > 0 {
+		kv = append(kv, "lease="+strconv.Itoa(rec.TTL))
+	}
+	if rec.Owner != "" {
+		kv = append(kv, "owner="+rec.Owner)
+	}
+	if len(kv) == 0 {
+		return ""
+	}
+	return "\t; " + strings.Join(kv, " ")
+}
+
+// InZone reports whether name is origin or below it
+func InZone(name, origin string) bool {
+	name, origin = canonical(name), canonical(origin)
+	return origin == "" || name == origin || strings.HasSuffix(name, "."+origin)
+}
+
+func canonical(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// absolute completes a zone file name: "@" is the origin, names without a
+// trailing dot are relative to it
+func absolute(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return strings.TrimSuffix(name, ".")
+	case origin == "":
+		return name
+	}
+	return name + "." + origin
+}
+
+func relative(name, origin string) string {
+	lower := strings.ToLower(name)
+	switch {
+	case lower == origin:
+		return "@"
+	case origin != "" && strings.HasSuffix(lower, "."+origin):
+		return name[:len(name)-len(origin)-1]
+	}
+	return fqdn(name)
+}
+
+func fqdn(name string) string {
+	return strings.TrimSuffix(name, ".") + "."
+}
+
+// isTTL reports whether s is a TTL: seconds, or BIND units like 1h30m
+func isTTL(s string) bool {
+	if s == "" {
+		return false
+	}
+	digits := false
+	for _, c := range strings.ToLower(s) {
+		switch {
+		case c >= '0' && c <= '9':
+			digits = true
+		case digits && strings.ContainsRune("smhdw", c):
+			digits = false
+		default:
+			return false
+		}
+	}
+	return s[0] >= '0' && s[0] <= '9'
+}
@@ -0,0 +1,126 @@
+package zonefile_test
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/MultiX0/nexa/pkg/nexa"
+	"github.com/MultiX0/nexa/pkg/zonefile"
+)
+
+func TestParse(t *testing.T) {
+	zone := `$ORIGIN n.
+$TTL 1h
+@        IN SOA ns.n. hostmaster.n. ( 1 3600
+                                      600 86400 60 ) ; serial etc.
+         IN NS  ns.n.
+storage  300 IN A 10.0.0.2   ; port=8081 service=storage lease=600 owner=alice
+         IN 300 AAAA fd00::2
+www      CNAME storage
+_http._tcp.storage SRV 0 5 8081 storage.n.
+notes    TXT "hello world" "semi;colon" "quote\"d"
+lan      A 192.168.1.5 ; view=lan device=dev-1
+$ORIGIN example.
+ext      A 10.9.9.9
+`
+	recs, err := zonefile.Parse(strings.NewReader(zone), "ignored")
+	if err != nil {
+		t.Fatalf("Parse failed: %v", err)
+	}
+	want := []nexa.DNSRecord{
+		{Name: "storage.n", Type: "A", IP: "10.0.0.2", Port: 8081, Service: "storage", TTL: 600},
+		{Name: "storage.n", Type: "AAAA", IP: "fd00::2"},
+		{Name: "www.n", Type: "CNAME", Target: "storage.n"},
+		{Name: "_http._tcp.storage.n", Type: "SRV", Priority: 0, Weight: 5, Port: 8081, Target: "storage.n"},
+		{Name: "notes.n", Type: "TXT", Text: []string{"hello world", "semi;colon", `quote"d`}},
+		{Name: "lan.n", Type: "A", IP: "192.168.1.5", View: "lan", DeviceID: "dev-1"},
+		{Name: "ext.example", Type: "A", IP: "10.9.9.9"},
+	}
+	if len(recs) != len(want) {
+		t.Fatalf("got %d records, want %d: %+v", len(recs), len(want), recs)
+	}
+	for i := range want {
+		if !reflect.DeepEqual(*recs[i], want[i]) {
+			t.Errorf("record %d = %+v, want %+v", i, *recs[i], want[i])
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	cases := map[string]int{
+		"a A 10.0.0.1\nb MX 10 mail\n": 2,
+		"$INCLUDE other.zone\n":        1,
+		"  A 10.0.0.1\n":               1,
+		"a TXT \"open\n":               1,
+		"a SRV 0 0 port target\n":      1,
+		"a A 10.0.0.1 ; lease=soon\n":  1,
+		"a A (\n10.0.0.1\n":            1, // where the entry starts
+		"a A 10.0.0.1 10.0.0.2\n":      1,
+	}
+	for zone, line := range cases {
+		_, err := zonefile.Parse(strings.NewReader(zone), "n")
+		var zerr *zonefile.Error
+		if !errors.As(err, &zerr) || zerr.Line != line {
+			t.Errorf("Parse(%q) = %v, want an error on line %d", zone, err, line)
+		}
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	recs := []nexa.DNSRecord{
+		{Name: "storage.n", Type: "A", IP: "10.0.0.2", Port: 8081, Service: "storage", Owner: "alice"},
+		{Name: "n", IP: "10.0.0.1"},
+		{Name: "notes.n", Type: "TXT", Text: []string{"a b", `c"d`}},
+		{Name: "_http._tcp.n", Type: "SRV", Priority: 1, Weight: 2, Port: 80, Target: "storage.n"},
+		{Name: "lan.n", Type: "A", IP: "192.168.1.5", View: "lan", TTL: 300, DeviceID: "dev-1"},
+		{Name: "other.nexa", Type: "CNAME", Target: "storage.n"},
+	}
+	var buf bytes.Buffer
+	if err := zonefile.Write(&buf, "n.", recs); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	out := buf.String()
+	for _, s := range []string{"$ORIGIN n.\n", "@\t60\tIN\tA\t10.0.0.1\n", "other.nexa.\t60\tIN\tCNAME\tstorage.n.\n"} {
+		if !strings.Contains(out, s) {
+			t.Errorf("output lacks %q:\n%s", s, out)
+		}
+	}
+
+	back, err := zonefile.Parse(&buf, "")
+	if err != nil {
+		t.Fatalf("Parse of written zone failed: %v\n%s", err, out)
+	}
+	got := make(map[string]nexa.DNSRecord)
+	for _, r := range back {
+		got[r.Name+"/"+r.Type] = *r
+	}
+	for _, r := range recs {
+		r.Type = r.RecordType()
+		r.Owner = "" // owners are written for reference, not read back
+		if g := got[r.Name+"/"+r.Type]; !reflect.DeepEqual(g, r) {
+			t.Errorf("round trip of %s/%s = %+v, want %+v", r.Name, r.Type, g, r)
+		}
+	}
+}
+
+func TestInZone(t *testing.T) {
+	cases := []struct {
+		name, origin string
+		want         bool
+	}{
+		{"n", "n", true},
+		{"storage.n", "n.", true},
+		{"Storage.N.", "n", true},
+		{"nexa", "n", false},
+		{"storage.nexa", "n", false},
+		{"anything", "", true},
+	}
+	for _, c := range cases {
+		if got := zonefile.InZone(c.name, c.origin); got != c.want {
+			t.Errorf("InZone(%q, %q) = %v", c.name, c.origin, got)
+		}
+	}
+}